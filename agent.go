@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// defaultAgentSteps is how many requests the agent may make for one task,
+// unless agent.max_steps or --steps says otherwise.
+const defaultAgentSteps = 20
+
+// defaultAgentTools are the tools the agent gets when agent.tools names
+// none. With --workspace it also gets the workspace tools.
+var defaultAgentTools = []string{"current_time", "fetch_url", "run_shell"}
+
+// agentPrompt is the prompt of the agent task.
+const agentPrompt = `You are an agent carrying out a task for the user with the tools you have. Work in steps: before each tool call, say in a sentence what you are about to do and why. Look at what each call returns before deciding on the next. Do not ask the user questions; make reasonable assumptions and state them. When the task is done, or cannot be done, stop calling tools and end with a short summary of what you did, what you found and anything left to do.
+
+Task: ` + inputPlaceholder
+
+// agentLimitPrompt is sent when the agent runs out of steps.
+const agentLimitPrompt = "You have used all the steps you were given. Stop here, without calling any more tools, and summarize what you did, what you found and what is left to do."
+
+// AgentConfig is the agent: section of config.yaml: how many steps
+// askgpt agent may take, and the tools it gets.
+//
+//	agent:
+//	  max_steps: 30
+//	  tools: [current_time, run_shell]
+type AgentConfig struct {
+	MaxSteps int      `yaml:"max_steps,omitempty"`
+	Tools    []string `yaml:"tools,omitempty"`
+}
+
+// loadAgent sets s up for the agent task: its tools, on top of those
+// enabled otherwise, and its step limit.
+func (s *chatSession) loadAgent() error {
+	tools := s.cfgFile.Agent.Tools
+	if len(tools) == 0 {
+		tools = defaultAgentTools
+	}
+	if err := s.loadTools(tools); err != nil {
+		return err
+	}
+	s.steps = s.opts.steps
+	if s.steps <= 0 {
+		s.steps = s.cfgFile.Agent.MaxSteps
+	}
+	if s.steps <= 0 {
+		s.steps = defaultAgentSteps
+	}
+	fmt.Fprintf(os.Stderr, "[agent] Up to %d steps, with %d tools.\n", s.steps, len(s.opts.tools))
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const keyCommandTimeout = 30 * time.Second
+
+// commandKeys caches the output of key_command for the lifetime of the
+// process; it is refreshed when the API rejects the key.
+var commandKeys struct {
+	sync.Mutex
+	byCommand map[string]string
+}
+
+// apiKey returns the key to send. With key_command configured the command
+// is run on first use (or when refresh is set) and its trimmed stdout is
+// used, so short-lived gateway keys never have to be stored on disk.
+func apiKey(cfg AskGPTConfig, refresh bool) (string, error) {
+	if strings.TrimSpace(cfg.KeyCommand) == "" {
+		return cfg.Key, nil
+	}
+	commandKeys.Lock()
+	defer commandKeys.Unlock()
+	if key, ok := commandKeys.byCommand[cfg.KeyCommand]; ok && !refresh {
+		return key, nil
+	}
+
+	key, err := runKeyCommand(cfg.KeyCommand)
+	if err != nil {
+		return "", err
+	}
+	if commandKeys.byCommand == nil {
+		commandKeys.byCommand = map[string]string{}
+	}
+	commandKeys.byCommand[cfg.KeyCommand] = key
+	return key, nil
+}
+
+func runKeyCommand(command string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), keyCommandTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("key_command failed: %w", err)
+	}
+	key := strings.TrimSpace(stdout.String())
+	if key == "" {
+		return "", errors.New("key_command printed no key")
+	}
+	return key, nil
+}
+
+// doAPIRequest sends an authenticated POST and returns the response if it
+// is a 200; any other status becomes an *apiError. When the key comes from
+// key_command and the API answers 401, the command is run again and the
+// request retried once with the fresh key.
+func doAPIRequest(ctx context.Context, client *http.Client, cfg AskGPTConfig, url, contentType string, body []byte) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		key, err := apiKey(cfg, attempt > 0)
+		if err != nil {
+			return nil, err
+		}
+		httpReq, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		httpReq.Header.Set("Content-Type", contentType)
+		httpReq.Header.Set("Authorization", "Bearer "+key)
+
+		resp, err := client.Do(httpReq)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+		apiErr := readAPIError(resp)
+		if resp.StatusCode == http.StatusUnauthorized && cfg.KeyCommand != "" && attempt == 0 {
+			fmt.Fprintln(os.Stderr, "API key rejected, running key_command again.")
+			tracef(traceVerbose, "retrying with a fresh key after %s", resp.Status)
+			logger.Info("retry", "url", url, "status", resp.StatusCode, "reason", "key_command")
+			continue
+		}
+		tracef(traceVerbose, "not retrying after %s", resp.Status)
+		return nil, apiErr
+	}
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -27,34 +32,159 @@ const (
 	configDirPerm   = 0o700
 	httpTimeout     = 5 * time.Minute
 	defaultMaxToken = 1024
+
+	continuePrompt = "Continue exactly where you stopped, without repeating anything you already wrote."
 )
 
 type ChatCompletionRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Temperature float32   `json:"temperature,omitempty"`
-	MaxTokens   int       `json:"max_tokens,omitempty"`
-	Stream      bool      `json:"stream"`
+	Model          string          `json:"model"`
+	Messages       []Message       `json:"messages"`
+	Temperature    *float32        `json:"temperature,omitempty"`
+	TopP           *float32        `json:"top_p,omitempty"`
+	MaxTokens      int             `json:"max_tokens,omitempty"`
+	Stream         bool            `json:"stream"`
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Tools          []Tool          `json:"tools,omitempty"`
+	ToolChoice     any             `json:"tool_choice,omitempty"`
+	StreamOptions  *StreamOptions  `json:"stream_options,omitempty"`
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type Usage struct {
+	PromptTokens     int `json:"prompt_tokens"`
+	CompletionTokens int `json:"completion_tokens"`
+	TotalTokens      int `json:"total_tokens"`
+}
+
+type ResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *JSONSchemaFormat `json:"json_schema,omitempty"`
+}
+
+type JSONSchemaFormat struct {
+	Name   string          `json:"name"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+type Tool struct {
+	Type     string       `json:"type"`
+	Function ToolFunction `json:"function"`
+}
+
+type ToolFunction struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Parameters  json.RawMessage `json:"parameters,omitempty"`
+}
+
+// ToolCall is a call of a tool the model asks for, see tools.go.
+type ToolCall struct {
+	ID       string           `json:"id"`
+	Type     string           `json:"type"`
+	Function ToolCallFunction `json:"function"`
+}
+
+type ToolCallFunction struct {
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
 }
 
 type Message struct {
 	Role    string `json:"role"`
 	Content string `json:"content"`
+	// Images go with a user message in the multimodal content format, see
+	// ChatCompletionRequest.MarshalJSON. They are not saved with the
+	// conversation; its text names them.
+	Images []Image `json:"-" yaml:"-"`
+	// ToolCalls are the calls of an assistant message, and ToolCallID the
+	// call a tool message answers. They only live for the rounds of a
+	// turn, see chatSession.chat.
+	ToolCalls  []ToolCall `json:"tool_calls,omitempty" yaml:"-"`
+	ToolCallID string     `json:"tool_call_id,omitempty" yaml:"-"`
+}
+
+// contentPart is a part of a message in the multimodal content format.
+type contentPart struct {
+	Type     string    `json:"type"`
+	Text     string    `json:"text,omitempty"`
+	ImageURL *imageURL `json:"image_url,omitempty"`
+}
+
+type imageURL struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// MarshalJSON sends the messages with images as a list of text and image
+// parts; the others keep their plain string content.
+func (r ChatCompletionRequest) MarshalJSON() ([]byte, error) {
+	type request ChatCompletionRequest
+	messages := make([]any, len(r.Messages))
+	for i, m := range r.Messages {
+		messages[i] = m
+		if len(m.Images) == 0 {
+			continue
+		}
+		parts := []contentPart{{Type: "text", Text: m.Content}}
+		for _, img := range m.Images {
+			parts = append(parts, contentPart{Type: "image_url", ImageURL: &imageURL{URL: img.URL, Detail: img.Detail}})
+		}
+		messages[i] = struct {
+			Role    string        `json:"role"`
+			Content []contentPart `json:"content"`
+		}{m.Role, parts}
+	}
+	return json.Marshal(struct {
+		request
+		Messages []any `json:"messages"`
+	}{request(r), messages})
+}
+
+// For non-streaming responses
+type ChatCompletionResponse struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
+	Choices []struct {
+		Message struct {
+			Content   string     `json:"content"`
+			ToolCalls []ToolCall `json:"tool_calls"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *Usage `json:"usage"`
 }
 
 // For streaming response chunk
 type ChatCompletionChunk struct {
+	ID      string `json:"id"`
+	Model   string `json:"model"`
 	Choices []struct {
 		Delta struct {
 			Content string `json:"content"`
+			// Calls arrive in pieces: the id and name first, then the
+			// arguments bit by bit, all under the index of the call.
+			ToolCalls []struct {
+				Index int `json:"index"`
+				ToolCall
+			} `json:"tool_calls"`
 		} `json:"delta"`
+		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	// Only set on the final chunk when stream_options.include_usage is on.
+	Usage *Usage `json:"usage"`
 }
 
 type AskGPTConfig struct {
 	URL   string
 	Model string
 	Key   string
+	// KeyCommand, when set, is run to obtain the key instead of using Key.
+	KeyCommand string
+	// Provider "mock" answers without a key or network, see mockprovider.go.
+	Provider string
 }
 
 // Unmarshal YAML supporting both shapes:
@@ -74,14 +204,16 @@ func (c *AskGPTConfig) UnmarshalYAML(value *yaml.Node) error {
 	switch value.Kind {
 	case yaml.MappingNode:
 		var tmp struct {
-			URL   string `yaml:"url"`
-			Model string `yaml:"model"`
-			Key   string `yaml:"key"`
+			URL        string `yaml:"url"`
+			Model      string `yaml:"model"`
+			Key        string `yaml:"key"`
+			KeyCommand string `yaml:"key_command"`
+			Provider   string `yaml:"provider"`
 		}
 		if err := value.Decode(&tmp); err != nil {
 			return err
 		}
-		c.URL, c.Model, c.Key = tmp.URL, tmp.Model, tmp.Key
+		c.URL, c.Model, c.Key, c.KeyCommand, c.Provider = tmp.URL, tmp.Model, tmp.Key, tmp.KeyCommand, tmp.Provider
 		return nil
 	case yaml.SequenceNode:
 		for _, item := range value.Content {
@@ -102,6 +234,10 @@ func (c *AskGPTConfig) UnmarshalYAML(value *yaml.Node) error {
 					c.Model = strings.TrimSpace(v.Value)
 				case "key":
 					c.Key = strings.TrimSpace(v.Value)
+				case "key_command":
+					c.KeyCommand = strings.TrimSpace(v.Value)
+				case "provider":
+					c.Provider = strings.TrimSpace(v.Value)
 				}
 			}
 		}
@@ -114,32 +250,368 @@ func (c *AskGPTConfig) UnmarshalYAML(value *yaml.Node) error {
 // Marshal YAML in the exact format the user requested (sequence of maps).
 func (c AskGPTConfig) MarshalYAML() (any, error) {
 	type kv map[string]string
-	return []kv{
+	out := []kv{
 		{"url": c.URL},
 		{"model": c.Model},
 		{"key": c.Key},
-	}, nil
+	}
+	if c.KeyCommand != "" {
+		out = append(out, kv{"key_command": c.KeyCommand})
+	}
+	if c.Provider != "" {
+		out = append(out, kv{"provider": c.Provider})
+	}
+	return out, nil
 }
 
 type ConfigFile struct {
-	AskGPT AskGPTConfig `yaml:"askgpt"`
-}
-
-func getPrompt(task, input string) string {
-	switch task {
-	case "chat":
-		return input
-	case "translate-en":
-		return "Translate the following text into English:\n\n" + input
-	case "translate-zh":
-		return "将下列内容翻译为中文：\n\n" + input
-	case "summarize":
-		return "总结下面的内容：\n\n" + input
-	case "explain":
-		return "解释下面的内容：\n\n" + input
+	AskGPT      AskGPTConfig          `yaml:"askgpt"`
+	Presets     map[string]Preset     `yaml:"presets,omitempty"`
+	TaskPresets map[string]string     `yaml:"task_presets,omitempty"`
+	Personas    map[string]string     `yaml:"personas,omitempty"`
+	Tasks       map[string]TaskConfig `yaml:"tasks,omitempty"`
+	History     HistoryConfig         `yaml:"history,omitempty"`
+	Sessions    SessionsConfig        `yaml:"sessions,omitempty"`
+	// TranscriptDir, when set, gets a Markdown journal of every exchange,
+	// one file per day.
+	TranscriptDir string `yaml:"transcript_dir,omitempty"`
+	// ContextWindows sets the context window, in tokens, of models by name
+	// or name prefix.
+	ContextWindows map[string]int   `yaml:"context_windows,omitempty"`
+	Context        ContextConfig    `yaml:"context,omitempty"`
+	Prices         map[string]Price `yaml:"prices,omitempty"`
+	Budget         BudgetConfig     `yaml:"budget,omitempty"`
+	LargeInput     LargeInputConfig `yaml:"large_input,omitempty"`
+	Images         ImagesConfig     `yaml:"images,omitempty"`
+	Audio          AudioConfig      `yaml:"audio,omitempty"`
+	Chunking       ChunkingConfig   `yaml:"chunking,omitempty"`
+	Embeddings     EmbeddingsConfig `yaml:"embeddings,omitempty"`
+	Tools          ToolsConfig      `yaml:"tools,omitempty"`
+	Agent          AgentConfig      `yaml:"agent,omitempty"`
+	Moderation     ModerationConfig `yaml:"moderation,omitempty"`
+	Redact         RedactConfig     `yaml:"redact,omitempty"`
+	Log            LogConfig        `yaml:"log,omitempty"`
+	Telemetry      TelemetryConfig  `yaml:"telemetry,omitempty"`
+	Mock           MockConfig       `yaml:"mock,omitempty"`
+	// Pager, "on" or a command such as "less -R", shows answers taller
+	// than the screen in a pager once they are complete.
+	Pager string `yaml:"pager,omitempty"`
+	// Theme colors the role labels, errors and usage lines: dark (the
+	// default), light or none.
+	Theme string `yaml:"theme,omitempty"`
+	// MCPServers are the Model Context Protocol servers tools.mcp and --mcp
+	// can name.
+	MCPServers map[string]MCPServer `yaml:"mcp_servers,omitempty"`
+}
+
+// taskOptions holds the flags accepted in task mode.
+type taskOptions struct {
+	jsonMode    bool
+	noStream    bool
+	noUsage     bool
+	noMemory    bool // leave out the memory notes
+	noCost      bool // do not print the estimated cost
+	force       bool // send even when the monthly budget is spent
+	preset      string
+	persona     string
+	sampling    samplingParams // resolved from preset once config is loaded
+	schemaPath  string
+	schema      *outputSchema
+	inputFile   string
+	clipboard   bool
+	editor      bool
+	copy        bool     // copy each answer to the clipboard
+	notify      bool     // show a desktop notification when an answer is done, see notify.go
+	apply       bool     // apply the diff in each answer, see patch.go
+	speak       bool     // read each answer out, see speech.go
+	prompt      string   // set by -p/--prompt
+	args        []string // positional arguments, sent as the message
+	forceBase64 bool
+	yes         bool // skip the confirmation for large messages
+	dir         string
+	include     stringList
+	exclude     stringList
+	images      stringList // set by --image
+	toolNames   stringList // set by --tools, on top of tools.enabled
+	tools       []Tool     // sent with every request, see tools.go
+	workspace   string     // the model may read and edit it, see workspace.go
+	mcp         stringList // MCP servers to connect to, on top of tools.mcp
+	steps       int        // the agent's step limit, see agent.go
+	noRedact    bool       // send secrets as they are, see redact.go
+	restore     *redactor  // puts redacted values back in the answers shown
+	dryRun      bool       // print the request instead of sending it
+	verbose     bool       // trace requests to stderr, see trace.go
+	debug       bool       // trace headers and stream events too
+	record      string     // write requests and responses to a cassette, see cassette.go
+	replay      string     // answer requests from a cassette
+	plain       bool       // print answers as they are, see markdown.go
+	noPager     bool
+	noWrap      bool     // let the terminal break long lines, see wrap.go
+	raw         bool     // only the model's text: no banner, labels or usage lines
+	output      string   // text, or json for an envelope with metadata, see envelope.go
+	codeOnly    codeOnly // print only the code blocks of answers, see code.go
+	pager       string   // shows answers taller than the screen, see pager.go
+	index       string   // searched for every message, see retrieval.go
+	fetchURLs   bool     // add the web pages messages name, see webpages.go
+	topK        int
+	budget      int
+	rawArgs     []string          // set by --raw-args; never nil when the flag was given
+	params      map[string]string // values of the task's own flags
+	oneShot     bool              // one answer without the REPL: print it bare and exit
+	interactive bool              // chat even without terminals
+	batch       bool              // answer once, raw, even on a terminal
+	chaos       bool
+	chaosRate   float64
+}
+
+// parseTaskFlags parses task flags, which may appear anywhere after the task
+// name. Non-flag arguments are returned in order; everything after "--" is
+// treated as a positional argument, and everything after "--raw-args" is kept
+// verbatim as the message. params are the task's own flags with their
+// defaults, see TaskConfig.Params.
+func parseTaskFlags(args []string, params map[string]string) (taskOptions, []string, error) {
+	var opts taskOptions
+	for i, a := range args {
+		if a == "--" {
+			break // a --raw-args after it is a positional argument
+		}
+		if a == "--raw-args" || a == "-raw-args" {
+			opts.rawArgs = append([]string{}, args[i+1:]...)
+			args = args[:i]
+			break
+		}
+	}
+
+	fs := flag.NewFlagSet("askgpt", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.BoolVar(&opts.jsonMode, "json", false, "")
+	fs.StringVar(&opts.schemaPath, "schema", "", "")
+	fs.BoolVar(&opts.noStream, "no-stream", false, "")
+	fs.BoolVar(&opts.noUsage, "no-usage", false, "")
+	fs.BoolVar(&opts.noMemory, "no-memory", false, "")
+	fs.BoolVar(&opts.noCost, "no-cost", false, "")
+	fs.BoolVar(&opts.force, "force", false, "")
+	fs.StringVar(&opts.preset, "preset", "", "")
+	fs.StringVar(&opts.persona, "persona", "", "")
+	fs.StringVar(&opts.inputFile, "file", "", "")
+	fs.BoolVar(&opts.clipboard, "clipboard", false, "")
+	fs.BoolVar(&opts.editor, "editor", false, "")
+	fs.BoolVar(&opts.copy, "copy", false, "")
+	fs.BoolVar(&opts.notify, "notify", false, "")
+	fs.BoolVar(&opts.apply, "apply", false, "")
+	fs.BoolVar(&opts.speak, "speak", false, "")
+	fs.StringVar(&opts.prompt, "p", "", "")
+	fs.StringVar(&opts.prompt, "prompt", "", "")
+	fs.BoolVar(&opts.forceBase64, "force-binary-as-base64", false, "")
+	fs.BoolVar(&opts.yes, "y", false, "")
+	fs.BoolVar(&opts.yes, "yes", false, "")
+	fs.StringVar(&opts.dir, "dir", "", "")
+	fs.Var(&opts.include, "include", "")
+	fs.Var(&opts.exclude, "exclude", "")
+	fs.Var(&opts.images, "image", "")
+	fs.Var(&opts.toolNames, "tools", "")
+	fs.StringVar(&opts.workspace, "workspace", "", "")
+	fs.Var(&opts.mcp, "mcp", "")
+	fs.IntVar(&opts.steps, "steps", 0, "")
+	fs.BoolVar(&opts.noRedact, "no-redact", false, "")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "")
+	fs.BoolVar(&opts.verbose, "v", false, "")
+	fs.BoolVar(&opts.verbose, "verbose", false, "")
+	fs.BoolVar(&opts.debug, "debug", false, "")
+	fs.StringVar(&opts.record, "record", "", "")
+	fs.StringVar(&opts.replay, "replay", "", "")
+	fs.BoolVar(&opts.plain, "plain", false, "")
+	fs.BoolVar(&opts.noPager, "no-pager", false, "")
+	fs.BoolVar(&opts.noWrap, "no-wrap", false, "")
+	fs.BoolVar(&opts.raw, "q", false, "")
+	fs.BoolVar(&opts.raw, "raw", false, "")
+	fs.StringVar(&opts.output, "output", "text", "")
+	fs.Var(&opts.codeOnly, "code-only", "")
+	fs.BoolVar(&opts.interactive, "interactive", false, "")
+	fs.BoolVar(&opts.batch, "batch", false, "")
+	fs.StringVar(&opts.index, "index", "", "")
+	fs.BoolVar(&opts.fetchURLs, "fetch-urls", false, "")
+	fs.IntVar(&opts.topK, "top", defaultTopK, "")
+	fs.IntVar(&opts.budget, "budget", defaultContextBudget, "")
+	// Hidden: fault injection to inspect how failures are reported, see chaos.go.
+	fs.BoolVar(&opts.chaos, "chaos", false, "")
+	fs.Float64Var(&opts.chaosRate, "chaos-rate", defaultChaosRate, "")
+
+	values := map[string]*string{}
+	for name, def := range params {
+		if fs.Lookup(name) != nil {
+			return opts, nil, fmt.Errorf("task parameter %q clashes with the --%s option", name, name)
+		}
+		values[name] = fs.String(name, def, "")
+	}
+
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return opts, nil, err
+		}
+		consumed := len(args) - fs.NArg()
+		if consumed > 0 && args[consumed-1] == "--" {
+			rest = append(rest, fs.Args()...)
+			break
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(values) > 0 {
+		opts.params = make(map[string]string, len(values))
+		for name, v := range values {
+			opts.params[name] = *v
+		}
+	}
+	if opts.interactive && opts.batch {
+		return opts, nil, errors.New("--interactive and --batch cannot be used together")
+	}
+	if opts.codeOnly != "" {
+		if opts.output == "json" {
+			return opts, nil, errors.New("--code-only cannot be used with --output json")
+		}
+		// The code goes to stdout alone.
+		opts.raw = true
+	}
+	switch opts.output {
+	case "text":
+	case "json":
+		if opts.schemaPath != "" {
+			return opts, nil, errors.New("--output json cannot be used with --schema")
+		}
+		// Only the envelopes go to stdout, and nothing else is shown.
+		opts.raw = true
 	default:
-		return input
+		return opts, nil, fmt.Errorf("unknown --output %q (use text or json)", opts.output)
+	}
+	if opts.schemaPath != "" {
+		schema, err := loadOutputSchema(opts.schemaPath)
+		if err != nil {
+			return opts, nil, err
+		}
+		opts.schema = schema
+	}
+	opts.args = rest
+	return opts, rest, nil
+}
+
+// argumentInput returns the first message when it was given on the command
+// line via --file, --clipboard, --editor, --raw-args, -p or as positional
+// arguments rather than typed at the prompt.
+func argumentInput(opts taskOptions) (string, bool, error) {
+	sources := 0
+	for _, given := range []bool{opts.rawArgs != nil, opts.inputFile != "", opts.clipboard, opts.editor, opts.prompt != "", len(opts.args) > 0} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", false, errors.New("give the message only one way: --file, --clipboard, --editor, --raw-args, -p or as arguments")
+	}
+
+	if opts.editor {
+		text, err := composeInEditor("")
+		return text, true, err
+	}
+	if opts.clipboard {
+		text, err := clipboardMessage("")
+		return text, true, err
+	}
+	if opts.prompt != "" {
+		return opts.prompt, true, nil
+	}
+	if len(opts.args) > 0 {
+		text, files, err := messageFromArgs(opts.args, opts.forceBase64)
+		reportAttachments(files, text)
+		return text, true, err
+	}
+	if opts.rawArgs != nil {
+		text, err := decodeTextInput("argument list", []byte(strings.Join(opts.rawArgs, " ")), opts.forceBase64)
+		return text, true, err
+	}
+	if opts.inputFile == "" {
+		return "", false, nil
+	}
+	var b []byte
+	var err error
+	name := opts.inputFile
+	if opts.inputFile == "-" {
+		name = "stdin"
+		b, err = io.ReadAll(os.Stdin)
+	} else {
+		b, err = os.ReadFile(opts.inputFile)
+	}
+	if err != nil {
+		return "", true, fmt.Errorf("cannot read input %s: %w", opts.inputFile, err)
+	}
+	text, err := decodeTextInput(name, b, opts.forceBase64)
+	return text, true, err
+}
+
+// withSystemPrompts returns a copy of the conversation with this run's
+// system prompts in front of it. Empty prompts are skipped.
+func withSystemPrompts(opts taskOptions, prompts []string, conversation []Message) []Message {
+	var out []Message
+	for _, p := range prompts {
+		if p != "" {
+			out = append(out, Message{Role: "system", Content: p})
+		}
+	}
+	if opts.jsonMode {
+		// OpenAI rejects json_object requests unless the conversation mentions JSON.
+		out = append(out, Message{Role: "system", Content: "You are a helpful assistant. Always answer with a single valid JSON object."})
+	}
+	return append(out, conversation...)
+}
+
+// undoExchange removes the last user message and everything after it (the
+// assistant's answer). System messages are never removed.
+func undoExchange(messages []chatMessage) ([]chatMessage, bool) {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" {
+			return messages[:i], true
+		}
+	}
+	return messages, false
+}
+
+// retryOverrides parses the arguments of ":retry [model] [temperature]": a
+// number is taken as the temperature, anything else as the model name.
+func retryOverrides(cfgFile ConfigFile, task string, opts taskOptions, args []string) (AskGPTConfig, taskOptions, error) {
+	cfg := cfgFile.AskGPT
+	var temp *float32
+	for _, a := range args {
+		if t, err := strconv.ParseFloat(a, 32); err == nil {
+			temp = float32Ptr(float32(t))
+		} else {
+			cfg.Model = a
+		}
+	}
+	if cfg.Model != cfgFile.AskGPT.Model {
+		sampling, err := resolveSampling(cfgFile, task, opts.preset, cfg.Model)
+		if err != nil {
+			return cfg, opts, err
+		}
+		opts.sampling = sampling
+	}
+	if temp != nil {
+		opts.sampling.Temperature = temp
 	}
+	return cfg, opts, nil
+}
+
+// getPrompt applies the task's prompt template to the input. Unknown tasks
+// send the input as a direct prompt.
+func getPrompt(cfg ConfigFile, task, input string, params map[string]string) (string, error) {
+	t, ok := lookupTask(cfg, task)
+	if !ok {
+		return input, nil
+	}
+	return renderTaskPrompt(t.Prompt, input, params)
 }
 
 func configPath() (string, error) {
@@ -209,18 +681,81 @@ func writeConfigFile(path string, cfg ConfigFile) error {
 }
 
 func validateRuntimeConfig(cfg ConfigFile) error {
+	if _, ok := themes[cfg.Theme]; cfg.Theme != "" && !ok {
+		return fmt.Errorf("unknown theme %q in config.yaml (use dark, light or none)", cfg.Theme)
+	}
+	switch cfg.AskGPT.Provider {
+	case "":
+	case "mock":
+		_, err := newMockProvider(cfg.Mock)
+		return err
+	default:
+		return fmt.Errorf("unknown askgpt.provider %q in config.yaml (only mock is known)", cfg.AskGPT.Provider)
+	}
 	if strings.TrimSpace(cfg.AskGPT.URL) == "" {
 		return errors.New("missing askgpt.url in config.yaml")
 	}
 	if strings.TrimSpace(cfg.AskGPT.Model) == "" {
 		return errors.New("missing askgpt.model in config.yaml")
 	}
-	if strings.TrimSpace(cfg.AskGPT.Key) == "" {
-		return errors.New("missing askgpt.key in config.yaml")
+	if strings.TrimSpace(cfg.AskGPT.Key) == "" && strings.TrimSpace(cfg.AskGPT.KeyCommand) == "" {
+		return errors.New("missing askgpt.key (or askgpt.key_command) in config.yaml")
 	}
 	return nil
 }
 
+// loadRuntimeConfig loads and validates the config for commands that call
+// the API, creating the template on first use. Problems are reported on
+// stderr; ok is false when the caller should exit with status 1.
+func loadRuntimeConfig() (cfg ConfigFile, ok bool) {
+	path, created, err := ensureConfigFileExists()
+	if err != nil {
+		errorf("%v\n", err)
+		return cfg, false
+	}
+	if created {
+		fmt.Fprintf(os.Stderr, "Created config template at %s\n", path)
+		fmt.Fprintln(os.Stderr, "Please fill url/model/key (edit the file or run set-url/set-model/set-key), then rerun.")
+		return cfg, false
+	}
+
+	cfg, err = loadConfigFile(path)
+	if err != nil {
+		errorf("%v\n", err)
+		return cfg, false
+	}
+	if err := validateRuntimeConfig(cfg); err != nil {
+		errorf("%v\n", err)
+		fmt.Fprintf(os.Stderr, "Hint: edit %s or run set-url/set-model/set-key\n", path)
+		return cfg, false
+	}
+	if cfg, err = withTaskFiles(cfg); err != nil {
+		errorf("%v\n", err)
+		return cfg, false
+	}
+	if cfg.AskGPT.Provider == "mock" {
+		cfg.AskGPT.URL, cfg.AskGPT.Key = mockURL, "mock"
+		if cfg.AskGPT.Model == "" {
+			cfg.AskGPT.Model = mockModel
+		}
+	}
+	// Every command that sends anything loads the config this way, so this
+	// is where the log, telemetry and redaction are set up for all of them.
+	if err := openLog(cfg.Log); err != nil {
+		errorf("%v\n", err)
+		return cfg, false
+	}
+	if err := openTelemetry(cfg.Telemetry); err != nil {
+		errorf("%v\n", err)
+		return cfg, false
+	}
+	if _, err := useRedaction(cfg, false); err != nil {
+		errorf("%v\n", err)
+		return cfg, false
+	}
+	return cfg, true
+}
+
 func readSingleLine(prompt string) (string, error) {
 	fmt.Fprint(os.Stderr, prompt)
 	r := bufio.NewReader(os.Stdin)
@@ -231,123 +766,156 @@ func readSingleLine(prompt string) (string, error) {
 	return strings.TrimSpace(s), nil
 }
 
-// readInput reads user input in a more "Enter feels done" way:
-// - Single-line input: just press Enter.
-// - Multi-line input: end a line with a backslash "\" to continue, or use ":paste" mode.
-// - Commands:
-//   - ":paste" -> enter paste mode, finish with a single line ":end"
-//   - "quit"   -> caller can treat as exit signal
-func readInput(prompt string) (string, error) {
-	fmt.Fprint(os.Stderr, prompt)
-
-	reader := bufio.NewReader(os.Stdin)
-	var lines []string
-
-	for {
-		line, err := reader.ReadString('\n')
-		if err != nil && !errors.Is(err, io.EOF) {
-			return "", err
-		}
-
-		trimmedRight := strings.TrimRight(line, "\r\n")
-		trimmed := strings.TrimSpace(trimmedRight)
-
-		if errors.Is(err, io.EOF) {
-			if trimmedRight == "" && len(lines) == 0 {
-				return "", err // Return io.EOF when Ctrl+D is pressed on an empty line
-			}
-			if trimmedRight != "" {
-				lines = append(lines, trimmedRight)
-			}
-			break
-		}
-
-		if len(lines) == 0 && trimmed == ":paste" {
-			fmt.Fprint(os.Stderr, "Paste mode: end with a single line \":end\"\n")
-			for {
-				pl, perr := reader.ReadString('\n')
-				if perr != nil && !errors.Is(perr, io.EOF) {
-					return "", perr
-				}
-				pr := strings.TrimRight(pl, "\r\n")
-				pt := strings.TrimSpace(pr)
+// formatJSONResponse validates a JSON-mode answer and pretty-prints it.
+// Models occasionally wrap the object in a markdown fence, so that is
+// stripped first.
+func formatJSONResponse(text string) (string, error) {
+	text = strings.TrimSpace(text)
+	if strings.HasPrefix(text, "```") {
+		text = strings.TrimPrefix(text, "```json")
+		text = strings.TrimPrefix(text, "```")
+		text = strings.TrimSuffix(strings.TrimSpace(text), "```")
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, []byte(text), "", "  "); err != nil {
+		return "", fmt.Errorf("model returned invalid JSON: %w", err)
+	}
+	return out.String(), nil
+}
 
-				if pt == ":end" {
-					return strings.Join(lines, "\n"), nil
-				}
+// apiError is a non-200 reply from the API.
+type apiError struct {
+	StatusCode int
+	Body       string
+}
 
-				if errors.Is(perr, io.EOF) {
-					if pr != "" {
-						lines = append(lines, pr)
-					}
-					return strings.Join(lines, "\n"), nil
-				}
+func (e *apiError) Error() string {
+	return fmt.Sprintf("api error (%d): %s", e.StatusCode, e.Body)
+}
 
-				lines = append(lines, pr)
-			}
-		}
+func readAPIError(resp *http.Response) *apiError {
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return &apiError{StatusCode: resp.StatusCode, Body: string(body)}
+}
 
-		if strings.HasSuffix(trimmedRight, `\`) {
-			lines = append(lines, strings.TrimSuffix(trimmedRight, `\`))
-			continue
-		}
+// chatResult is what a single completion request produced.
+type chatResult struct {
+	Content string
+	// ToolArgs holds the concatenated arguments of a forced tool call, used
+	// when structured output is emulated through function calling.
+	ToolArgs     string
+	ToolCalls    []ToolCall
+	FinishReason string
+	Usage        *Usage
+	// ID and Model are the completion's id and the model that answered, as
+	// the response gives them; RequestID is the provider's X-Request-Id.
+	ID        string
+	Model     string
+	RequestID string
+}
 
-		lines = append(lines, trimmedRight)
-		break
+func chatEndpoint(cfg AskGPTConfig) string {
+	url := strings.TrimSpace(cfg.URL)
+	if strings.HasSuffix(url, "/v1") {
+		url += "/chat/completions"
+	} else if strings.HasSuffix(url, "/v1/") {
+		url += "chat/completions"
 	}
+	return url
+}
 
-	return strings.Join(lines, "\n"), nil
+// apiEndpoint returns the URL of another endpoint of the API, such as
+// "images/generations", next to the chat endpoint.
+func apiEndpoint(cfg AskGPTConfig, path string) string {
+	url := strings.TrimSuffix(strings.TrimSpace(cfg.URL), "/")
+	return strings.TrimSuffix(url, "/chat/completions") + "/" + path
 }
 
-func doStreamingChat(client *http.Client, cfg AskGPTConfig, messages []Message) (string, error) {
-	reqBody := ChatCompletionRequest{
+func newChatRequest(cfg AskGPTConfig, messages []Message, opts taskOptions) ChatCompletionRequest {
+	req := ChatCompletionRequest{
 		Model:       cfg.Model,
 		Messages:    messages,
-		Temperature: 0.3,
+		Temperature: opts.sampling.Temperature,
+		TopP:        opts.sampling.TopP,
 		MaxTokens:   defaultMaxToken,
-		Stream:      true,
+		Stream:      !opts.noStream,
 	}
-	jsonData, err := json.Marshal(reqBody)
-	if err != nil {
-		return "", err
+	if req.Stream && !opts.noUsage {
+		req.StreamOptions = &StreamOptions{IncludeUsage: true}
 	}
-
-	url := strings.TrimSpace(cfg.URL)
-	if strings.HasSuffix(url, "/v1") {
-		url += "/chat/completions"
-	} else if strings.HasSuffix(url, "/v1/") {
-		url += "chat/completions"
+	if opts.jsonMode {
+		req.ResponseFormat = &ResponseFormat{Type: "json_object"}
+	}
+	// Structured output has no room for tool calls.
+	if !opts.jsonMode && opts.schema == nil {
+		req.Tools = opts.tools
 	}
+	return req
+}
 
-	httpReq, err := http.NewRequest("POST", url, bytes.NewBuffer(jsonData))
+// sendChat sends req and returns the answer. Streaming requests read the SSE
+// stream and call onContent for every content delta as it arrives; regular
+// requests call it once with the whole answer.
+func sendChat(ctx context.Context, client *http.Client, cfg AskGPTConfig, req ChatCompletionRequest, onContent func(string)) (chatResult, error) {
+	var res chatResult
+	if err := checkBudget(); err != nil {
+		return res, err
+	}
+	// The messages are copied, so the caller's keep what they had.
+	req.Messages = slices.Clone(req.Messages)
+	for i := range req.Messages {
+		req.Messages[i].Content = redactOutgoing(req.Messages[i].Content)
+	}
+	jsonData, err := json.Marshal(req)
 	if err != nil {
-		return "", err
+		return res, err
 	}
-	httpReq.Header.Set("Content-Type", "application/json")
-	httpReq.Header.Set("Authorization", "Bearer "+cfg.Key)
 
-	resp, err := client.Do(httpReq)
+	resp, err := doAPIRequest(ctx, client, cfg, chatEndpoint(cfg), "application/json", jsonData)
 	if err != nil {
-		return "", err
+		return res, err
 	}
 	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("api error (%d): %s", resp.StatusCode, string(body))
+	// Once accepted the request costs money, even if the answer breaks off.
+	defer func() { recordUsage(cfg.Model, res.Usage, req.Messages, res.Content) }()
+	res.RequestID = resp.Header.Get("X-Request-Id")
+
+	if !req.Stream {
+		var out ChatCompletionResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return res, fmt.Errorf("cannot decode response: %w", err)
+		}
+		if len(out.Choices) == 0 {
+			return res, errors.New("response contains no choices")
+		}
+		msg := out.Choices[0].Message
+		res.ID, res.Model = out.ID, out.Model
+		res.Content = msg.Content
+		res.FinishReason = out.Choices[0].FinishReason
+		res.Usage = out.Usage
+		res.ToolCalls = msg.ToolCalls
+		for _, tc := range msg.ToolCalls {
+			res.ToolArgs += tc.Function.Arguments
+		}
+		if onContent != nil && res.Content != "" {
+			onContent(res.Content)
+		}
+		return res, nil
 	}
 
 	reader := bufio.NewReader(resp.Body)
-	var fullResponse strings.Builder
-
-	fmt.Print("Assistant: ")
+	var content, toolArgs strings.Builder
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			if errors.Is(err, io.EOF) {
 				break
 			}
-			return fullResponse.String(), fmt.Errorf("stream read error: %w", err)
+			res.Content, res.ToolArgs = content.String(), toolArgs.String()
+			// Calls cut off are not run.
+			res.ToolCalls = nil
+			return res, fmt.Errorf("stream read error: %w", err)
 		}
 		if strings.HasPrefix(line, "data:") {
 			data := strings.TrimSpace(strings.TrimPrefix(line, "data:"))
@@ -358,15 +926,168 @@ func doStreamingChat(client *http.Client, cfg AskGPTConfig, messages []Message)
 			if err := json.Unmarshal([]byte(data), &chunk); err != nil {
 				continue
 			}
-			if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
-				content := chunk.Choices[0].Delta.Content
-				fmt.Print(content)
-				fullResponse.WriteString(content)
+			if chunk.Usage != nil {
+				res.Usage = chunk.Usage
+			}
+			if res.ID == "" {
+				res.ID, res.Model = chunk.ID, chunk.Model
+			}
+			if len(chunk.Choices) == 0 {
+				continue
+			}
+			if fr := chunk.Choices[0].FinishReason; fr != "" {
+				res.FinishReason = fr
+			}
+			delta := chunk.Choices[0].Delta
+			if delta.Content != "" {
+				if onContent != nil {
+					onContent(delta.Content)
+				}
+				content.WriteString(delta.Content)
+			}
+			for _, tc := range delta.ToolCalls {
+				toolArgs.WriteString(tc.Function.Arguments)
+				if tc.Index < 0 {
+					continue
+				}
+				for len(res.ToolCalls) <= tc.Index {
+					res.ToolCalls = append(res.ToolCalls, ToolCall{Type: "function"})
+				}
+				call := &res.ToolCalls[tc.Index]
+				if tc.ID != "" {
+					call.ID = tc.ID
+				}
+				call.Function.Name += tc.Function.Name
+				call.Function.Arguments += tc.Function.Arguments
 			}
 		}
 	}
-	fmt.Println()
-	return fullResponse.String(), nil
+	res.Content, res.ToolArgs = content.String(), toolArgs.String()
+	return res, nil
+}
+
+// messageCommand runs the chat commands that produce a message, /clip and
+// /edit, each optionally followed by text.
+func messageCommand(c chatCommand) (string, error) {
+	if c.Name == "clip" {
+		return clipboardMessage(c.Arg)
+	}
+	return composeInEditor(c.Arg)
+}
+
+// printInputDiff shows what an editing task changed in the input.
+func printInputDiff(input, answer string) {
+	diff, ok := wordDiff(strings.TrimSpace(input), strings.TrimSpace(answer))
+	switch {
+	case !ok:
+		fmt.Fprintln(os.Stderr, "(The text is too long to show the changes.)")
+	case !strings.Contains(diff, "[-") && !strings.Contains(diff, "{+"):
+		fmt.Fprintln(os.Stderr, "\nNo changes.")
+	default:
+		fmt.Fprintf(os.Stderr, "\nChanges:\n%s\n", diff)
+	}
+}
+
+func printUsage(u *Usage) {
+	if u == nil {
+		return
+	}
+	line := fmt.Sprintf("[tokens] prompt: %d, completion: %d, total: %d",
+		u.PromptTokens, u.CompletionTokens, u.TotalTokens)
+	fmt.Fprintln(os.Stderr, paint(os.Stderr, colors.usage, line))
+}
+
+func doStreamingChat(ctx context.Context, client *http.Client, cfg AskGPTConfig, messages []Message, opts taskOptions) (chatResult, error) {
+	// With --output json nothing is shown: the answer goes into the
+	// envelope printed once it is complete, see envelope.go. With
+	// --code-only its code blocks are printed then.
+	if opts.output == "json" || opts.codeOnly != "" {
+		return sendChat(ctx, client, cfg, newChatRequest(cfg, messages, opts), nil)
+	}
+	if opts.schema != nil {
+		return doSchemaChat(ctx, client, cfg, messages, opts)
+	}
+
+	// In JSON mode the answer is buffered so it can be validated before
+	// anything reaches stdout.
+	if opts.jsonMode {
+		stopSpinner := startSpinner(opts)
+		res, err := sendChat(ctx, client, cfg, newChatRequest(cfg, messages, opts), nil)
+		stopSpinner()
+		if err != nil {
+			return res, err
+		}
+		pretty, err := formatJSONResponse(res.Content)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Raw response:\n%s\n", res.Content)
+			return res, err
+		}
+		if opts.restore != nil {
+			pretty = opts.restore.restore(pretty)
+		}
+		fmt.Println(pretty)
+		if !opts.noUsage && !opts.raw {
+			printUsage(res.Usage)
+		}
+		return res, nil
+	}
+
+	// The prefix waits for the answer: a round that only calls tools has
+	// none.
+	started := false
+	start := func() {
+		if !started && !opts.oneShot && !opts.raw {
+			fmt.Print(paint(os.Stdout, colors.assistant, "Assistant:") + " ")
+		}
+		started = true
+	}
+	col := 0
+	if !opts.oneShot && !opts.raw {
+		col = len("Assistant: ")
+	}
+	var out io.Writer = os.Stdout
+	show, flush := func(s string) { io.WriteString(out, s) }, func() {}
+	if renderMarkdown(opts) {
+		md := newMDRenderer(os.Stdout, col, !opts.oneShot)
+		md.wrap = wrapOutput(opts)
+		out, show, flush = md, md.write, md.flush
+	} else if wrapOutput(opts) {
+		ww := &wrapWriter{w: os.Stdout, col: col}
+		out, show, flush = ww, ww.write, ww.flush
+	}
+	if opts.restore != nil {
+		rw := &restoreWriter{r: opts.restore, w: out}
+		mdFlush := flush
+		show, flush = rw.write, func() { rw.flush(); mdFlush() }
+	}
+	stopSpinner := startSpinner(opts)
+	res, err := sendChat(ctx, client, cfg, newChatRequest(cfg, messages, opts), func(s string) {
+		stopSpinner()
+		start()
+		show(s)
+	})
+	stopSpinner()
+	flush()
+	if err != nil {
+		return res, err
+	}
+	if len(res.ToolCalls) == 0 {
+		start()
+	}
+	if started {
+		fmt.Println()
+	}
+	if opts.pager != "" && len(res.ToolCalls) == 0 && res.Content != "" {
+		answer := res.Content
+		if opts.restore != nil {
+			answer = opts.restore.restore(answer)
+		}
+		pageAnswer(opts.pager, answer, opts)
+	}
+	if !opts.noUsage && !opts.raw {
+		printUsage(res.Usage)
+	}
+	return res, nil
 }
 
 func usage() {
@@ -380,26 +1101,103 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "  %-20s Set OpenAI Model (e.g., gpt-4o)\n", "set-model <value>")
 	fmt.Fprintf(os.Stderr, "  %-20s Set OpenAI API Key\n", "set-key <value>")
 	fmt.Fprintf(os.Stderr, "  %-20s Generate completion script\n", "completion <shell>")
+	fmt.Fprintf(os.Stderr, "  %-20s List personas (named system prompts)\n", "personas list")
+	fmt.Fprintf(os.Stderr, "  %-20s Continue a saved chat session (--at <bookmark> branches from one)\n", "resume [id|last]")
+	fmt.Fprintf(os.Stderr, "  %-20s List, show, rename, tag, count or delete chat sessions\n", "sessions <cmd>")
+	fmt.Fprintf(os.Stderr, "  %-20s List the turns marked with /bookmark\n", "bookmarks [id]")
+	fmt.Fprintf(os.Stderr, "  %-20s Turn a session into a reusable task prompt (--name <task>)\n", "distill <id|last>")
+	fmt.Fprintf(os.Stderr, "  %-20s Export a session as Markdown, JSON or HTML\n", "export [id] --format f")
+	fmt.Fprintf(os.Stderr, "  %-20s Import a ChatGPT or Claude export as sessions\n", "import <file>")
+	fmt.Fprintf(os.Stderr, "  %-20s Search saved sessions (--role user|assistant)\n", "search <text>")
+	fmt.Fprintf(os.Stderr, "  %-20s Show, edit, add to or clear the notes sent with every chat\n", "memory <cmd>")
+	fmt.Fprintf(os.Stderr, "  %-20s Count the tokens of files or stdin (--model <name>)\n", "tokens <file|->")
+	fmt.Fprintf(os.Stderr, "  %-20s Generate images (--size, -n, -o <file>, --model, --quality)\n", "image <prompt>")
+	fmt.Fprintf(os.Stderr, "  %-20s Transcribe audio (--language, --format, --then <task>)\n", "transcribe <file>")
+	fmt.Fprintf(os.Stderr, "  %-20s Read text or stdin out loud, or save it with -o <file>\n", "tts <text|->")
+	fmt.Fprintf(os.Stderr, "  %-20s Print embeddings as JSON Lines (--lines, --format json, --model)\n", "embed <file|->")
+	fmt.Fprintf(os.Stderr, "  %-20s Index a directory for ask --index; again to update it (--list)\n", "index <dir> --name n")
+	fmt.Fprintf(os.Stderr, "  %-20s Tokens and cost of the last days (--by day|model|task,\n", "usage [--days n]")
+	fmt.Fprintf(os.Stderr, "  %-20s   --format table|json|csv)\n", "")
+	fmt.Fprintf(os.Stderr, "  %-20s Add file-manager context menu entries\n", "integrate --target <t>")
+	fmt.Fprintf(os.Stderr, "  %-20s   (nautilus, finder or explorer; --dir to choose the output dir)\n", "")
 	fmt.Fprintln(os.Stderr)
 
 	fmt.Fprintln(os.Stderr, "Tasks:")
 	fmt.Fprintf(os.Stderr, "  %-20s Run a specific task\n", "<task>")
+	fmt.Fprintf(os.Stderr, "  %-20s Translate files into several languages at once\n", "translate --to <l,..>")
+	fmt.Fprintf(os.Stderr, "  %-20s   (<files> --out-dir <dir> [--glossary <file>])\n", "")
+	fmt.Fprintf(os.Stderr, "  %-20s Edit a file as instructed, showing the changes first\n", "edit <file> \"...\"")
+	fmt.Fprintf(os.Stderr, "  %-20s   (--diff to have the model answer with a diff, -y to skip asking)\n", "")
+	fmt.Fprintf(os.Stderr, "  %-20s Write a commit message for the staged changes\n", "commit-msg")
+	fmt.Fprintf(os.Stderr, "  %-20s   (-e to edit it, --commit to commit with it after asking)\n", "")
+	fmt.Fprintf(os.Stderr, "  %-20s Write a pull request title and description for the branch\n", "pr-desc [base]")
+	fmt.Fprintf(os.Stderr, "  %-20s   (-e to edit it, --create to create the PR with gh after asking)\n", "")
 	fmt.Fprintln(os.Stderr)
 	fmt.Fprintln(os.Stderr, "  Available tasks:")
-	fmt.Fprintf(os.Stderr, "    %-18s Start a chat session without prompt template\n", "chat")
-	fmt.Fprintf(os.Stderr, "    %-18s Translate text to English\n", "translate-en")
-	fmt.Fprintf(os.Stderr, "    %-18s Translate text to Chinese\n", "translate-zh")
-	fmt.Fprintf(os.Stderr, "    %-18s Summarize content\n", "summarize")
-	fmt.Fprintf(os.Stderr, "    %-18s Explain content\n", "explain")
+	for _, t := range taskList(loadConfigIfExists()) {
+		fmt.Fprintf(os.Stderr, "    %-18s %s\n", t.Name, t.Task.Description)
+	}
 	fmt.Fprintf(os.Stderr, "    %-18s Any other string is sent as a direct prompt\n", "(direct prompt)")
 	fmt.Fprintln(os.Stderr)
 
+	fmt.Fprintln(os.Stderr, "Task options:")
+	fmt.Fprintf(os.Stderr, "  %-20s Request a JSON object and pretty-print it to stdout\n", "--json")
+	fmt.Fprintf(os.Stderr, "  %-20s Request JSON matching a JSON Schema and validate it\n", "--schema <file>")
+	fmt.Fprintf(os.Stderr, "  %-20s Wait for the whole answer instead of streaming it\n", "--no-stream")
+	fmt.Fprintf(os.Stderr, "  %-20s Do not print token usage after each answer\n", "--no-usage")
+	fmt.Fprintf(os.Stderr, "  %-20s Do not print the estimated cost of each answer\n", "--no-cost")
+	fmt.Fprintf(os.Stderr, "  %-20s Send even when the monthly budget is spent\n", "--force")
+	fmt.Fprintf(os.Stderr, "  %-20s Sampling preset: creative, balanced, precise or one from config\n", "--preset <name>")
+	fmt.Fprintf(os.Stderr, "  %-20s Use a persona as the system prompt (switch with /persona)\n", "--persona <name>")
+	fmt.Fprintf(os.Stderr, "  %-20s Do not send the memory notes (askgpt memory)\n", "--no-memory")
+	fmt.Fprintf(os.Stderr, "  %-20s Send one message, print the answer and exit\n", "-p, --prompt <text>")
+	fmt.Fprintf(os.Stderr, "  %-20s   (arguments after the task do the same; files and globs such as\n", "")
+	fmt.Fprintf(os.Stderr, "  %-20s   'src/**/*.go' are attached)\n", "")
+	fmt.Fprintf(os.Stderr, "  %-20s Send large messages without asking\n", "-y, --yes")
+	fmt.Fprintf(os.Stderr, "  %-20s Add a directory tree as context (honors .gitignore)\n", "--dir <path>")
+	fmt.Fprintf(os.Stderr, "  %-20s   --include/--exclude <pattern> filter it, --budget <tokens>\n", "")
+	fmt.Fprintf(os.Stderr, "  %-20s   caps its size (default %d)\n", "", defaultContextBudget)
+	fmt.Fprintf(os.Stderr, "  %-20s Add the readable text of the web pages a message links to\n", "--fetch-urls")
+	fmt.Fprintf(os.Stderr, "  %-20s Let the model call tools, e.g. current_time,fetch_url\n", "--tools <names>")
+	fmt.Fprintf(os.Stderr, "  %-20s Let the model read a directory and, after asking, edit its files\n", "--workspace <dir>")
+	fmt.Fprintf(os.Stderr, "  %-20s Give the model the tools of MCP servers from mcp_servers in config\n", "--mcp <names>")
+	fmt.Fprintf(os.Stderr, "  %-20s Most steps askgpt agent may take (default %d)\n", "--steps <n>", defaultAgentSteps)
+	fmt.Fprintf(os.Stderr, "  %-20s Send API keys and other secrets without replacing them\n", "--no-redact")
+	fmt.Fprintf(os.Stderr, "  %-20s Print the request that would be sent, key masked, and exit\n", "--dry-run")
+	fmt.Fprintf(os.Stderr, "  %-20s Trace requests, status, rate limits and retries to stderr\n", "-v, --verbose")
+	fmt.Fprintf(os.Stderr, "  %-20s Trace all headers and stream events too\n", "--debug")
+	fmt.Fprintf(os.Stderr, "  %-20s Save the requests and responses of this run to a cassette\n", "--record <file>")
+	fmt.Fprintf(os.Stderr, "  %-20s Answer from a cassette made with --record, without the network\n", "--replay <file>")
+	fmt.Fprintf(os.Stderr, "  %-20s Print answers as raw Markdown instead of rendering them\n", "--plain")
+	fmt.Fprintf(os.Stderr, "  %-20s Do not show long answers in the pager set with pager: in config\n", "--no-pager")
+	fmt.Fprintf(os.Stderr, "  %-20s Do not wrap answers at word boundaries to the terminal width\n", "--no-wrap")
+	fmt.Fprintf(os.Stderr, "  %-20s Print only the answer: no banner, tips, labels, separators or usage\n", "-q, --raw")
+	fmt.Fprintf(os.Stderr, "  %-20s Print each answer as a JSON object with its model, usage and latency\n", "--output json")
+	fmt.Fprintf(os.Stderr, "  %-20s Print only the code blocks of the answer, or the nth with =n\n", "--code-only[=n]")
+	fmt.Fprintf(os.Stderr, "  %-20s Chat even when stdin or stdout is not a terminal\n", "--interactive")
+	fmt.Fprintf(os.Stderr, "  %-20s Answer once and print only the answer, even on a terminal\n", "--batch")
+	fmt.Fprintf(os.Stderr, "  %-20s Answer from an index (askgpt index), citing its files; --top <n>\n", "--index <name>")
+	fmt.Fprintf(os.Stderr, "  %-20s   sets how many parts of it go with each message (default %d)\n", "", defaultTopK)
+	fmt.Fprintf(os.Stderr, "  %-20s Read the first message from a file (- for stdin)\n", "--file <path>")
+	fmt.Fprintf(os.Stderr, "  %-20s Attach an image to the first message (repeatable; @image:path\n", "--image <path>")
+	fmt.Fprintf(os.Stderr, "  %-20s   in the chat), for models that take images\n", "")
+	fmt.Fprintf(os.Stderr, "  %-20s Use the clipboard as the first message (/clip in the chat)\n", "--clipboard")
+	fmt.Fprintf(os.Stderr, "  %-20s Copy each answer to the clipboard (/copy [code] in the chat)\n", "--copy")
+	fmt.Fprintf(os.Stderr, "  %-20s Read each answer out loud\n", "--speak")
+	fmt.Fprintf(os.Stderr, "  %-20s Show a desktop notification when an answer is done or fails\n", "--notify")
+	fmt.Fprintf(os.Stderr, "  %-20s Apply the diff in the answer to the files here, after asking (-y: without)\n", "--apply")
+	fmt.Fprintf(os.Stderr, "  %-20s Write the first message in $EDITOR (/edit in the chat)\n", "--editor")
+	fmt.Fprintf(os.Stderr, "  %-20s Use all remaining arguments verbatim as the message\n", "--raw-args ...")
+	fmt.Fprintf(os.Stderr, "  %-20s Send binary input base64 encoded instead of refusing it\n", "--force-binary-as-base64")
+	fmt.Fprintf(os.Stderr, "  %-20s Set a task parameter, e.g. rewrite --tone formal\n", "--<param> <value>")
+	fmt.Fprintln(os.Stderr)
+
 }
 
 func runShowConfig() int {
 	path, created, err := ensureConfigFileExists()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		errorf("%v\n", err)
 		return 1
 	}
 	if created {
@@ -410,13 +1208,13 @@ func runShowConfig() int {
 
 	cfg, err := loadConfigFile(path)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		errorf("%v\n", err)
 		return 1
 	}
 
 	out, err := yaml.Marshal(&cfg)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: cannot marshal config: %v\n", err)
+		errorf("cannot marshal config: %v\n", err)
 		return 1
 	}
 
@@ -428,14 +1226,14 @@ func runShowConfig() int {
 func runSetCommand(cmd string, maybeValue string) int {
 	path, _, err := ensureConfigFileExists()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		errorf("%v\n", err)
 		return 1
 	}
 
 	cfg, err := loadConfigFile(path)
 	if err != nil {
 		// If file exists but is malformed, don't overwrite silently.
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		errorf("%v\n", err)
 		return 1
 	}
 
@@ -460,7 +1258,7 @@ func runSetCommand(cmd string, maybeValue string) int {
 	}
 
 	if value == "" {
-		fmt.Fprintln(os.Stderr, "Error: empty value not allowed")
+		errorf("empty value not allowed\n")
 		return 1
 	}
 
@@ -477,7 +1275,7 @@ func runSetCommand(cmd string, maybeValue string) int {
 	}
 
 	if err := writeConfigFile(path, cfg); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		errorf("%v\n", err)
 		return 1
 	}
 
@@ -485,72 +1283,6 @@ func runSetCommand(cmd string, maybeValue string) int {
 	return 0
 }
 
-const bashCompletion = `_askgpt_completion() {
-    local cur prev opts
-    COMPREPLY=()
-    cur="${COMP_WORDS[COMP_CWORD]}"
-    prev="${COMP_WORDS[COMP_CWORD-1]}"
-    opts="show-config set-url set-model set-key chat translate-en translate-zh summarize explain completion"
-
-    if [[ ${COMP_CWORD} -eq 1 ]]; then
-        COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
-        return 0
-    fi
-}
-complete -F _askgpt_completion askgpt
-`
-
-const zshCompletion = `#compdef askgpt
-
-_askgpt() {
-    local -a commands
-    commands=(
-        'show-config:Show current configuration'
-        'set-url:Set OpenAI API URL'
-        'set-model:Set OpenAI Model'
-        'set-key:Set OpenAI API Key'
-        'chat:Start a chat session without prompt template'
-        'translate-en:Translate text to English'
-        'translate-zh:Translate text to Chinese'
-        'summarize:Summarize content'
-        'explain:Explain content'
-        'completion:Generate completion script'
-    )
-    _describe -t commands 'commands' commands
-}
-
-_askgpt
-`
-
-const fishCompletion = `set -l commands show-config set-url set-model set-key chat translate-en translate-zh summarize explain completion
-complete -c askgpt -f
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "show-config" -d "Show current configuration"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "set-url" -d "Set OpenAI API URL"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "set-model" -d "Set OpenAI Model"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "set-key" -d "Set OpenAI API Key"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "chat" -d "Start a chat session without prompt template"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "translate-en" -d "Translate text to English"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "translate-zh" -d "Translate text to Chinese"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "summarize" -d "Summarize content"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "explain" -d "Explain content"
-complete -c askgpt -n "not __fish_seen_subcommand_from $commands" -a "completion" -d "Generate completion script"
-`
-
-func runCompletion(shell string) int {
-	switch shell {
-	case "bash":
-		fmt.Print(bashCompletion)
-	case "zsh":
-		fmt.Print(zshCompletion)
-	case "fish":
-		fmt.Print(fishCompletion)
-	default:
-		fmt.Fprintf(os.Stderr, "Unsupported shell: %s. Supported: bash, zsh, fish\n", shell)
-		return 1
-	}
-	return 0
-}
-
 func printTitle() {
 	titles := []string{
 		// starwars (backticks replaced with ~)
@@ -604,117 +1336,336 @@ AA   AA  SSSSS  KK  KK  GGGGGG PP        TTT   `,
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// exit ends askgpt with code from inside a command, flushing the spans and
+// closing the log as returning from run does.
+func exit(code int) {
+	flushTelemetry()
+	closeLog()
+	os.Exit(code)
+}
+
+// run runs the command askgpt was started with and returns its exit
+// status. Only exit ends askgpt from elsewhere, so that the spans are
+// flushed and the log is closed on every path.
+func run() int {
+	defer closeLog()
+	defer flushTelemetry()
+	initColors(loadConfigIfExists().Theme)
 	if len(os.Args) < 2 {
 		usage()
-		os.Exit(1)
+		return 1
 	}
 
 	cmd := os.Args[1]
 	switch cmd {
 	case "show-config":
-		os.Exit(runShowConfig())
+		return runShowConfig()
 	case "completion":
 		shell := ""
 		if len(os.Args) >= 3 {
 			shell = os.Args[2]
 		}
-		os.Exit(runCompletion(shell))
+		return runCompletion(shell)
+	case "integrate":
+		return runIntegrate(os.Args[2:])
+	case "personas":
+		return runPersonas(os.Args[2:])
+	case "translate":
+		return runTranslate(os.Args[2:])
+	case "edit":
+		return runEdit(os.Args[2:])
+	case "commit-msg":
+		return runCommitMsg(os.Args[2:])
+	case "pr-desc":
+		return runPRDesc(os.Args[2:])
+	case "resume":
+		return runResume(os.Args[2:])
+	case "sessions":
+		return runSessions(os.Args[2:])
+	case "bookmarks":
+		return runBookmarks(os.Args[2:])
+	case "distill":
+		return runDistill(os.Args[2:])
+	case "export":
+		return runExport(os.Args[2:])
+	case "import":
+		return runImport(os.Args[2:])
+	case "search":
+		return runSearch(os.Args[2:])
+	case "memory":
+		return runMemory(os.Args[2:])
+	case "tokens":
+		return runTokens(os.Args[2:])
+	case "usage":
+		return runUsage(os.Args[2:])
+	case "image":
+		return runImage(os.Args[2:])
+	case "transcribe":
+		return runTranscribe(os.Args[2:])
+	case "tts":
+		return runTTS(os.Args[2:])
+	case "embed":
+		return runEmbed(os.Args[2:])
+	case "index":
+		return runIndex(os.Args[2:])
 	case "-h", "help", "--help":
 		usage()
-		os.Exit(0)
+		return 0
 	case "set-url", "set-model", "set-key":
 		val := ""
 		if len(os.Args) >= 3 {
 			val = strings.Join(os.Args[2:], " ")
 		}
-		os.Exit(runSetCommand(cmd, val))
+		return runSetCommand(cmd, val)
 	}
 
 	// Normal task mode
-	task := cmd
+	task, taskArgs := cmd, os.Args[2:]
+	if strings.HasPrefix(cmd, "-") {
+		// Flags without a task, e.g. askgpt -p "question", run a chat.
+		task, taskArgs = "chat", os.Args[1:]
+	}
+	// The task's own flags must be known before parsing, so look it up in
+	// the config as far as it can be read at this point.
+	paramsDef, _ := lookupTask(loadConfigIfExists(), task)
+	opts, _, err := parseTaskFlags(taskArgs, paramsDef.Params)
+	if err != nil {
+		errorf("%v\n", err)
+		return 2
+	}
 
-	path, created, err := ensureConfigFileExists()
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	if err := cfgFile.Moderation.validate(); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	taskDef, _ := lookupTask(cfgFile, task)
+	if taskDef.Model != "" {
+		cfgFile.AskGPT.Model = taskDef.Model
+	}
+	trackSpending(cfgFile, task, opts.force)
+	opts.sampling, err = resolveSampling(cfgFile, task, opts.preset, cfgFile.AskGPT.Model)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		errorf("%v\n", err)
+		return 1
 	}
-	if created {
-		fmt.Fprintf(os.Stderr, "Created config template at %s\n", path)
-		fmt.Fprintln(os.Stderr, "Please fill url/model/key (edit the file or run set-url/set-model/set-key), then rerun.")
-		os.Exit(1)
+	if taskDef.Temperature != nil && opts.preset == "" {
+		opts.sampling.Temperature = taskDef.Temperature
 	}
 
-	cfgFile, err := loadConfigFile(path)
+	client := providerClient(cfgFile)
+	switch {
+	case opts.record != "" && opts.replay != "":
+		errorf("--record and --replay cannot be used together\n")
+		return 2
+	case opts.chaos && opts.dryRun:
+		errorf("--chaos and --dry-run cannot be used together; --dry-run sends nothing\n")
+		return 2
+	case opts.replay != "":
+		rt, err := newReplayTransport(opts.replay)
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		client.Transport = rt
+	case opts.record != "":
+		rt, err := newRecordTransport(client.Transport, opts.record)
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		client.Transport = rt
+	}
+	if opts.dryRun {
+		client.Transport = dryRunTransport{out: os.Stdout}
+	}
+	// The faults go around the cassette, so that a replay gets them too and
+	// a recording holds only what the provider answered.
+	if opts.chaos {
+		base := client.Transport
+		if base == nil {
+			base = http.DefaultTransport
+		}
+		client.Transport = newChaosTransport(base, ChaosConfig{
+			Rate: opts.chaosRate,
+			OnFault: func(f chaosFault) {
+				fmt.Fprintf(os.Stderr, "[chaos] injecting %s\n", f)
+			},
+		})
+		fmt.Fprintf(os.Stderr, "Chaos mode: injecting faults into %.0f%% of requests\n", opts.chaosRate*100)
+	}
+	switch {
+	case opts.debug:
+		traceLevel = traceDebug
+	case opts.verbose:
+		traceLevel = traceVerbose
+	}
+	logger.Info("start", "task", task, "model", cfgFile.AskGPT.Model, "url", cfgFile.AskGPT.URL)
+	if traceLevel > 0 || logEnabled(slog.LevelError) || telemetry != nil {
+		client.Transport = traceTransport{base: client.Transport}
+	}
+	personas, err := loadPersonas(cfgFile)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		errorf("%v\n", err)
+		return 1
 	}
-	if err := validateRuntimeConfig(cfgFile); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		fmt.Fprintf(os.Stderr, "Hint: edit %s or run set-url/set-model/set-key\n", path)
-		os.Exit(1)
+	var memory string
+	if !opts.noMemory {
+		if memory, err = loadMemory(); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
 	}
-
-	client := &http.Client{Timeout: httpTimeout}
-	var messages []Message
-
-	printTitle() // Display title art
-	fmt.Fprintln(os.Stderr, "Input tips:")
-	fmt.Fprintln(os.Stderr, "- Single line: type and press Enter")
-	fmt.Fprintln(os.Stderr, "- Multi line: end a line with \\ to continue, or type :paste then finish with :end")
-	fmt.Fprintln(os.Stderr, "- Quit: type quit and press Enter")
-	fmt.Fprintln(os.Stderr, "- Exit: press Ctrl+D")
-	fmt.Fprintln(os.Stderr, "")
-
-	userInput, err := readInput("Your message:\n> ")
+	persona := opts.persona
+	if persona != "" {
+		if _, err := lookupPersona(personas, persona); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+	images, err := loadImages(cfgFile.Images, opts.images)
 	if err != nil {
-		if errors.Is(err, io.EOF) {
-			fmt.Fprintln(os.Stderr, "Goodbye!")
-			return
+		errorf("%v\n", err)
+		return 1
+	}
+	reportImages(images)
+	var index *vectorIndex
+	if opts.index != "" {
+		if opts.topK < 1 {
+			errorf("--top must be at least 1\n")
+			return 2
 		}
-		fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
-		os.Exit(1)
+		if index, err = openIndex(opts.index, false); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		defer index.Close()
 	}
-	if strings.TrimSpace(userInput) == "" {
-		fmt.Fprintln(os.Stderr, "No input received.")
-		os.Exit(1)
+	redactor, err := useRedaction(cfgFile, opts.noRedact)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
 	}
-	if strings.TrimSpace(userInput) == "quit" {
-		fmt.Fprintln(os.Stderr, "Goodbye!")
-		return
+	if redactor != nil && cfgFile.Redact.Restore {
+		opts.restore = redactor
 	}
-
-	prompt := getPrompt(task, userInput)
-	messages = append(messages, Message{Role: "user", Content: prompt})
-
-	for {
-		respText, err := doStreamingChat(client, cfgFile.AskGPT, messages)
+	in := newChatInput(cfgFile)
+	userInput, fromArgs, err := argumentInput(opts)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	// A directory context is built up front, so its size is known before
+	// the first message is typed; it is sent along with that message.
+	var dirCtx string
+	if opts.dir != "" {
+		ctx, err := buildDirContext(dirContextOptions{Dir: opts.dir, Include: opts.include, Exclude: opts.exclude, Budget: opts.budget})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
+			errorf("%v\n", err)
+			return 1
 		}
+		fmt.Fprintf(os.Stderr, "Context from %s: %d files, ~%d tokens", opts.dir, ctx.Files, ctx.Tokens)
+		if ctx.Omitted > 0 {
+			fmt.Fprintf(os.Stderr, " (%d more over the --budget listed by name only)", ctx.Omitted)
+		}
+		if ctx.Skipped > 0 {
+			fmt.Fprintf(os.Stderr, " (%d binary skipped)", ctx.Skipped)
+		}
+		fmt.Fprintln(os.Stderr)
+		dirCtx = ctx.Text
+	}
 
-		messages = append(messages, Message{Role: "assistant", Content: respText})
-
-		fmt.Fprintln(os.Stderr, "\n---")
-		nextInput, err := readInput("Your next message:\n> ")
+	// Without a terminal there is nobody to chat with: piped stdin is the
+	// message, only the answer goes to stdout and askgpt exits after it, so
+	// it can be used in pipelines like `git diff | askgpt summarize`.
+	// -p and message arguments ask for a single answer as well. When stdout
+	// is piped it gets the answer alone, as with --raw. --interactive and
+	// --batch choose either way whatever the terminals are.
+	switch {
+	case opts.interactive:
+		opts.oneShot = false
+	case opts.batch:
+		opts.oneShot, opts.raw = true, true
+	default:
+		opts.oneShot = !isTerminal(os.Stdin) || !isTerminal(os.Stdout) || opts.prompt != "" || len(opts.args) > 0
+		if !isTerminal(os.Stdout) {
+			opts.raw = true
+		}
+	}
+	opts.pager = pagerCommand(cfgFile, opts)
+	if opts.oneShot && !fromArgs {
+		if isTerminal(os.Stdin) {
+			fmt.Fprintln(os.Stderr, "Type the message and end it with Ctrl-D on a line of its own.")
+		}
+		b, err := io.ReadAll(os.Stdin)
+		if err == nil {
+			userInput, err = decodeTextInput("stdin", b, opts.forceBase64)
+		}
 		if err != nil {
-			if errors.Is(err, io.EOF) {
-				fmt.Fprintln(os.Stderr, "Goodbye!")
-				break
-			}
-			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
-			os.Exit(1)
+			errorf("%v\n", err)
+			return 1
 		}
+		fromArgs = true
+	}
+	if fromArgs && strings.TrimSpace(userInput) == "" {
+		fmt.Fprintln(os.Stderr, "No input received.")
+		return 1
+	}
+	if !fromArgs && !opts.raw {
+		printTitle() // Display title art
+		fmt.Fprintln(os.Stderr, "Input tips:")
+		fmt.Fprintln(os.Stderr, "- Single line: type and press Enter")
+		fmt.Fprintln(os.Stderr, "- Multi line: end a line with \\ to continue, type /paste then finish with :end, or /edit to use $EDITOR")
+		fmt.Fprintln(os.Stderr, "- Attach a file: type @path/to/file (Tab completes the path), or an image with @image:path")
+		fmt.Fprintln(os.Stderr, "- Commands: type /help for a list")
+		fmt.Fprintln(os.Stderr, "- Quit: type /quit, or press Ctrl+D")
+		fmt.Fprintln(os.Stderr, "")
+	}
 
-		if strings.TrimSpace(nextInput) == "quit" {
-			break
+	s := &chatSession{
+		cfgFile:  cfgFile,
+		task:     task,
+		taskDef:  taskDef,
+		opts:     opts,
+		client:   client,
+		in:       in,
+		memory:   memory,
+		personas: personas,
+		persona:  persona,
+		dirCtx:   dirCtx,
+		images:   images,
+		index:    index,
+		redactor: redactor,
+	}
+	s.dirCtx = s.redactText(s.dirCtx)
+	if err := s.loadTools(opts.toolNames); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if opts.workspace != "" {
+		if err := s.loadWorkspace(opts.workspace); err != nil {
+			errorf("%v\n", err)
+			return 1
 		}
-		if strings.TrimSpace(nextInput) == "" {
-			continue
+	}
+	if err := s.loadMCP(opts.mcp); err != nil {
+		s.closeMCP()
+		errorf("%v\n", err)
+		return 1
+	}
+	defer s.closeMCP()
+	if task == "agent" {
+		if err := s.loadAgent(); err != nil {
+			errorf("%v\n", err)
+			return 1
 		}
-		messages = append(messages, Message{Role: "user", Content: nextInput})
 	}
-
-	fmt.Fprintln(os.Stderr, "\nGoodbye!")
+	s.run(userInput)
+	return 0
 }
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// bookmark marks the end of a turn of a session, set with /bookmark, to
+// list with askgpt bookmarks and branch from with askgpt resume --at.
+type bookmark struct {
+	Label string `json:"label" yaml:"label"`
+	// Turn is the number of the turn when it was marked.
+	Turn int `json:"turn" yaml:"turn"`
+	// At is the time of the question of the turn, which finds it even after
+	// /retry replaced the answer or the turns before it were summarized.
+	At time.Time `json:"at,omitempty" yaml:"at,omitempty"`
+}
+
+// bookmark handles "/bookmark <label>": the last turn is marked, in place
+// of another one with the same label.
+func (s *chatSession) bookmark(label string) error {
+	label = strings.TrimSpace(label)
+	if label == "" {
+		return errors.New("usage: /bookmark <label>")
+	}
+	i := lastQuestion(s.messages)
+	if i < 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to bookmark yet.")
+		return nil
+	}
+	b := bookmark{Label: label, Turn: countTurns(s.messages), At: s.messages[i].Time}
+	s.bookmarks = slices.DeleteFunc(s.bookmarks, func(o bookmark) bool { return o.Label == label })
+	s.bookmarks = append(s.bookmarks, b)
+	fmt.Fprintf(os.Stderr, "Bookmarked turn %d as %q; branch from it with: askgpt resume --at %q\n", b.Turn, label, label)
+	return nil
+}
+
+// lastQuestion returns the index of the last question, or -1.
+func lastQuestion(messages []chatMessage) int {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == "user" && !isSummary(messages[i].Message) {
+			return i
+		}
+	}
+	return -1
+}
+
+// bookmarksBefore returns the bookmarks of the turns asked before t, for
+// when the turns after it were undone.
+func bookmarksBefore(bookmarks []bookmark, t time.Time) []bookmark {
+	return slices.DeleteFunc(bookmarks, func(b bookmark) bool { return !b.At.Before(t) })
+}
+
+// bookmarkEnd returns how many of the messages the turn b marks ends after.
+func bookmarkEnd(messages []chatMessage, b bookmark) (int, error) {
+	start := -1
+	if b.At.IsZero() {
+		// Sessions from before messages had times count turns.
+		if b.Turn > 0 && b.Turn <= countTurns(messages) {
+			return len(firstTurns(messages, b.Turn)), nil
+		}
+	} else {
+		start = slices.IndexFunc(messages, func(m chatMessage) bool {
+			return m.Role == "user" && !isSummary(m.Message) && m.Time.Equal(b.At)
+		})
+	}
+	if start < 0 {
+		return 0, fmt.Errorf("the turn bookmarked as %q is no longer in the session; it was summarized or undone", b.Label)
+	}
+	for i := start + 1; i < len(messages); i++ {
+		if messages[i].Role == "user" {
+			return i, nil
+		}
+	}
+	return len(messages), nil
+}
+
+// findBookmark returns the session with the bookmark label and the
+// bookmark: of the session ref, or of any session when ref is "".
+func findBookmark(store sessionStore, ref, label string) (savedChat, bookmark, error) {
+	var ids []string
+	if ref != "" {
+		id, err := findSession(store, ref)
+		if err != nil {
+			return savedChat{}, bookmark{}, err
+		}
+		ids = []string{id}
+	} else {
+		var err error
+		if ids, err = store.IDs(); err != nil {
+			return savedChat{}, bookmark{}, err
+		}
+	}
+	var found []savedChat
+	var marks []bookmark
+	for _, id := range ids {
+		c, err := store.Load(id)
+		if err != nil && ref != "" {
+			return savedChat{}, bookmark{}, err
+		}
+		if err != nil {
+			warnf("%v\n", err)
+			continue
+		}
+		if i := slices.IndexFunc(c.Bookmarks, func(b bookmark) bool { return b.Label == label }); i >= 0 {
+			found, marks = append(found, c), append(marks, c.Bookmarks[i])
+		}
+	}
+	switch len(found) {
+	case 0:
+		if ref != "" {
+			return savedChat{}, bookmark{}, fmt.Errorf("session %s has no bookmark %q", ids[0], label)
+		}
+		return savedChat{}, bookmark{}, fmt.Errorf("no bookmark %q", label)
+	case 1:
+		return found[0], marks[0], nil
+	}
+	var in []string
+	for _, c := range found {
+		in = append(in, c.ID)
+	}
+	return savedChat{}, bookmark{}, fmt.Errorf("bookmark %q is in several sessions (%s); name one, as in askgpt resume %s --at %q",
+		label, strings.Join(in, ", "), in[0], label)
+}
+
+// branchAt saves the turns of c up to the bookmark b as a new session and
+// returns it.
+func branchAt(store sessionStore, c savedChat, b bookmark) (savedChat, error) {
+	end, err := bookmarkEnd(c.Messages, b)
+	if err != nil {
+		return c, err
+	}
+	// The bookmarks stay with the original, so that each names one turn.
+	c.Messages, c.Bookmarks = c.Messages[:end], nil
+	now := time.Now()
+	c.Title = forkTitle(c.Title, c.Messages, "")
+	c.CreatedAt, c.SavedAt, c.Source = now, now, ""
+	if c.ID, err = store.NewID(now); err != nil {
+		return c, err
+	}
+	if err := store.Save(c, now); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func runBookmarks(args []string) int {
+	if len(args) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt bookmarks [id|last]")
+		return 2
+	}
+	store, err := openConfiguredStore()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	ids, err := store.IDs()
+	if err == nil && len(args) == 1 {
+		var id string
+		id, err = findSession(store, args[0])
+		ids = []string{id}
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+
+	n := 0
+	// Most recently used first.
+	for i := len(ids) - 1; i >= 0; i-- {
+		c, err := store.Load(ids[i])
+		if err != nil {
+			warnf("%v\n", err)
+			continue
+		}
+		for _, b := range c.Bookmarks {
+			if n == 0 {
+				fmt.Printf("%-20s %5s  %-16s  %-20s  %s\n", "SESSION", "TURN", "ASKED", "LABEL", "TITLE")
+			}
+			fmt.Printf("%-20s %5d  %-16s  %-20s  %s\n", c.ID, b.Turn, formatTime(b.At), b.Label, sessionTitle(c.Title, c.Messages))
+			n++
+		}
+	}
+	if n == 0 {
+		fmt.Fprintln(os.Stderr, "No bookmarks yet; mark a turn in a chat with /bookmark <label>.")
+	}
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBookmarkEnd(t *testing.T) {
+	// Three turns asked a minute apart, the second answered twice as a
+	// tool call would be.
+	start := time.Date(2026, 1, 2, 3, 0, 0, 0, time.UTC)
+	var messages []chatMessage
+	for i, roles := range [][]string{{"user", "assistant"}, {"user", "assistant", "assistant"}, {"user", "assistant"}} {
+		for _, role := range roles {
+			m := newChatMessage(role, "text")
+			m.Time = start.Add(time.Duration(i) * time.Minute)
+			messages = append(messages, m)
+		}
+	}
+	tests := []struct {
+		name    string
+		b       bookmark
+		want    int
+		wantErr bool
+	}{
+		{"first turn", bookmark{Turn: 1, At: start}, 2, false},
+		{"middle turn", bookmark{Turn: 2, At: start.Add(time.Minute)}, 5, false},
+		{"last turn", bookmark{Turn: 3, At: start.Add(2 * time.Minute)}, 7, false},
+		{"turn found by time, not number", bookmark{Turn: 3, At: start}, 2, false},
+		{"undone turn", bookmark{Turn: 4, At: start.Add(3 * time.Minute)}, 0, true},
+		{"without a time", bookmark{Turn: 2}, 5, false},
+		{"without a time, past the end", bookmark{Turn: 4}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := bookmarkEnd(messages, tt.b)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("bookmarkEnd error = %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("bookmarkEnd = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
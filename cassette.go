@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// cassette is the file --record writes and --replay reads: the requests
+// askgpt made and the responses it got, in order. Request headers are left
+// out, so the key is never written.
+type cassette struct {
+	Interactions []interaction `yaml:"interactions"`
+}
+
+type interaction struct {
+	Request struct {
+		Method string `yaml:"method"`
+		URL    string `yaml:"url"`
+		Body   string `yaml:"body,omitempty"`
+	} `yaml:"request"`
+	Response struct {
+		Status      int    `yaml:"status"`
+		ContentType string `yaml:"content_type,omitempty"`
+		Body        string `yaml:"body"`
+	} `yaml:"response"`
+}
+
+// recordTransport sends requests through base and writes them, with their
+// responses, to a cassette. The file is rewritten as each response is read
+// to its end, so a run that exits early still leaves the exchanges so far.
+type recordTransport struct {
+	base http.RoundTripper
+	path string
+	mu   sync.Mutex
+	c    cassette
+}
+
+func newRecordTransport(base http.RoundTripper, path string) (*recordTransport, error) {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	t := &recordTransport{base: base, path: path}
+	// Write the empty cassette now so a path that cannot be written fails
+	// before anything is sent.
+	if err := t.save(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var in interaction
+	in.Request.Method, in.Request.URL = req.Method, maskURL(req.URL)
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		in.Request.Body = string(b)
+		req.Body = io.NopCloser(bytes.NewReader(b))
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	in.Response.Status, in.Response.ContentType = resp.StatusCode, resp.Header.Get("Content-Type")
+	resp.Body = &recordingBody{ReadCloser: resp.Body, done: func(body []byte) {
+		in.Response.Body = string(body)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.c.Interactions = append(t.c.Interactions, in)
+		if err := t.save(); err != nil {
+			warnf("%v\n", err)
+		}
+	}}
+	return resp, nil
+}
+
+func (t *recordTransport) save() error {
+	b, err := yaml.Marshal(&t.c)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(t.path, b, 0o600); err != nil {
+		return fmt.Errorf("cannot write cassette: %w", err)
+	}
+	return nil
+}
+
+// recordingBody keeps what is read of a response body and hands it to done
+// when the body is closed.
+type recordingBody struct {
+	io.ReadCloser
+	buf  bytes.Buffer
+	done func([]byte)
+	once sync.Once
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.buf.Write(p[:n])
+	return n, err
+}
+
+func (b *recordingBody) Close() error {
+	// What the caller left unread still belongs in the cassette.
+	io.Copy(&b.buf, b.ReadCloser)
+	b.once.Do(func() { b.done(b.buf.Bytes()) })
+	return b.ReadCloser.Close()
+}
+
+// replayTransport answers requests from a cassette without any network. A
+// request gets the first unused interaction with the same method, URL and
+// body or, failing that, the first unused one with the same method and URL,
+// so small changes to a prompt do not break a demo.
+type replayTransport struct {
+	mu   sync.Mutex
+	c    cassette
+	used []bool
+}
+
+func newReplayTransport(path string) (*replayTransport, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read cassette: %w", err)
+	}
+	t := &replayTransport{}
+	if err := yaml.Unmarshal(b, &t.c); err != nil {
+		return nil, fmt.Errorf("cannot parse cassette %s: %w", path, err)
+	}
+	t.used = make([]bool, len(t.c.Interactions))
+	return t, nil
+}
+
+func (t *replayTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body string
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = string(b)
+	}
+	url := maskURL(req.URL)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	match := -1
+	for i, in := range t.c.Interactions {
+		if t.used[i] || in.Request.Method != req.Method || in.Request.URL != url {
+			continue
+		}
+		if in.Request.Body == body {
+			match = i
+			break
+		}
+		if match < 0 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return nil, fmt.Errorf("the cassette has no response left for %s %s", req.Method, url)
+	}
+	t.used[match] = true
+	in := t.c.Interactions[match]
+	if in.Request.Body != body {
+		tracef(traceVerbose, "replaying interaction %d, whose request body differs", match+1)
+	}
+	h := http.Header{}
+	if in.Response.ContentType != "" {
+		h.Set("Content-Type", in.Response.ContentType)
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", in.Response.Status, http.StatusText(in.Response.Status)),
+		StatusCode:    in.Response.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(strings.NewReader(in.Response.Body)),
+		ContentLength: int64(len(in.Response.Body)),
+		Request:       req,
+	}, nil
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Chaos mode wraps the HTTP transport and randomly injects the failures a
+// flaky provider or proxy produces, so error handling can be exercised and
+// users can check how their setup copes with them. It is enabled with the
+// hidden --chaos flag, and works with --record and --replay, which makes
+// the runs repeatable offline.
+//
+// It is for inspecting by hand what each failure looks like: askgpt does not
+// retry rate limits or timeouts by itself (only a 401 with key_command is
+// retried), so a fault ends the answer with its error, and in a chat the
+// turn can be sent again with /retry.
+
+const (
+	defaultChaosRate  = 0.3
+	chaosTimeoutDelay = time.Second
+)
+
+type chaosFault int
+
+const (
+	chaosTimeout chaosFault = iota
+	chaosRateLimit
+	chaosMalformedChunk
+	chaosDisconnect
+)
+
+var allChaosFaults = []chaosFault{chaosTimeout, chaosRateLimit, chaosMalformedChunk, chaosDisconnect}
+
+func (f chaosFault) String() string {
+	switch f {
+	case chaosTimeout:
+		return "timeout"
+	case chaosRateLimit:
+		return "429 rate limit"
+	case chaosMalformedChunk:
+		return "malformed chunk"
+	case chaosDisconnect:
+		return "mid-stream disconnect"
+	default:
+		return "unknown"
+	}
+}
+
+type ChaosConfig struct {
+	Rate    float64          // probability that a request is disturbed
+	Faults  []chaosFault     // faults to pick from; all of them when empty
+	Rand    *rand.Rand       // random source; seeded from the clock when nil
+	OnFault func(chaosFault) // optional hook called for every injected fault
+}
+
+type chaosTransport struct {
+	base http.RoundTripper
+	cfg  ChaosConfig
+
+	mu sync.Mutex // guards cfg.Rand
+}
+
+func newChaosTransport(base http.RoundTripper, cfg ChaosConfig) *chaosTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	if len(cfg.Faults) == 0 {
+		cfg.Faults = allChaosFaults
+	}
+	if cfg.Rand == nil {
+		cfg.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	return &chaosTransport{base: base, cfg: cfg}
+}
+
+// pick decides whether the next request gets a fault, and which one. It also
+// returns a byte offset used by the stream faults.
+func (t *chaosTransport) pick() (chaosFault, int, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cfg.Rand.Float64() >= t.cfg.Rate {
+		return 0, 0, false
+	}
+	f := t.cfg.Faults[t.cfg.Rand.Intn(len(t.cfg.Faults))]
+	return f, 1 + t.cfg.Rand.Intn(512), true
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fault, offset, ok := t.pick()
+	if !ok {
+		return t.base.RoundTrip(req)
+	}
+	if t.cfg.OnFault != nil {
+		t.cfg.OnFault(fault)
+	}
+
+	switch fault {
+	case chaosTimeout:
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(chaosTimeoutDelay):
+		}
+		return nil, chaosTimeoutError{}
+	case chaosRateLimit:
+		body := `{"error":{"message":"chaos: rate limit exceeded","type":"rate_limit_error"}}`
+		return &http.Response{
+			Status:        "429 Too Many Requests",
+			StatusCode:    http.StatusTooManyRequests,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        http.Header{"Content-Type": {"application/json"}, "Retry-After": {"1"}},
+			Body:          io.NopCloser(strings.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	switch fault {
+	case chaosMalformedChunk:
+		resp.Body = &chaosBody{r: bufio.NewReader(resp.Body), c: resp.Body, left: offset, inject: "\ndata: {\"choices\":[{\"delta\":{\"content\":\n\n"}
+	case chaosDisconnect:
+		resp.Body = &chaosBody{r: bufio.NewReader(resp.Body), c: resp.Body, left: offset, cut: true}
+	}
+	return resp, nil
+}
+
+// chaosBody passes through the first left bytes of a response body, then
+// either splices in a garbage SSE event or drops the connection.
+type chaosBody struct {
+	r      *bufio.Reader
+	c      io.Closer
+	left   int
+	inject string
+	cut    bool
+}
+
+func (b *chaosBody) Read(p []byte) (int, error) {
+	if b.left == 0 {
+		if b.cut {
+			return 0, io.ErrUnexpectedEOF
+		}
+		if b.inject != "" {
+			n := copy(p, b.inject)
+			b.inject = b.inject[n:]
+			return n, nil
+		}
+		return b.r.Read(p)
+	}
+	if len(p) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.r.Read(p)
+	b.left -= n
+	return n, err
+}
+
+func (b *chaosBody) Close() error { return b.c.Close() }
+
+type chaosTimeoutError struct{}
+
+func (chaosTimeoutError) Error() string { return "chaos: injected request timeout" }
+func (chaosTimeoutError) Timeout() bool { return true }
@@ -0,0 +1,969 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// chatSession is the state of a conversation with the model, from the first
+// message to the last.
+type chatSession struct {
+	cfgFile ConfigFile
+	task    string
+	taskDef TaskConfig
+	opts    taskOptions
+	client  *http.Client
+	in      *inputReader
+
+	memory   string // the memory notes, see memory.go
+	personas map[string]string
+	persona  string
+	system   string // set with /system
+
+	// messages holds the conversation only; system prompts are added per
+	// request so they can change mid-session.
+	messages  []chatMessage
+	truncated bool    // the last answer hit max_tokens or was cancelled
+	usage     *Usage  // reported for the last request, if any
+	warned    bool    // the context window warning was shown
+	dropped   int     // turns left out of the last request to fit the context
+	cost      float64 // estimated dollars spent in this run, see cost.go
+
+	// id names the session the chat is saved to; it is assigned when there
+	// is something to save.
+	store      sessionStore
+	id         string
+	created    time.Time
+	title      string
+	bookmarks  []bookmark // set with /bookmark
+	saveFailed bool
+
+	// mu guards the fields shared with the signal handler.
+	mu       sync.Mutex
+	cancel   func()               // cancels the request in progress
+	snapshot savedChat            // the conversation as of the last checkpoint
+	dirCtx   string               // sent along with the first message
+	images   []Image              // from --image, sent along with the first message
+	index    *vectorIndex         // from --index, searched for every message
+	tools    map[string]localTool // the model may call, see tools.go
+	mcp      []*mcpClient         // servers connected with --mcp, see mcp.go
+	steps    int                  // the agent's step limit, see agent.go
+	redactor *redactor            // nil with --no-redact, see redact.go
+	input    string               // the first message, for show_diff
+}
+
+// turn is the next request of a chat: a new user message, or the last one
+// again for /retry and /continue.
+type turn struct {
+	message    string
+	images     []Image
+	retry      bool
+	continuing bool
+	// cfg and opts apply to this request only; /retry may override the
+	// model or temperature.
+	cfg  AskGPTConfig
+	opts taskOptions
+}
+
+// newChatInput returns the reader for chat input, with the saved input
+// history unless it is turned off.
+func newChatInput(cfg ConfigFile) *inputReader {
+	in := newInputReader(os.Stdin, os.Stderr)
+	if !cfg.History.Disabled {
+		if h, lines, err := openHistory(cfg.History); err != nil {
+			warnf("%v\n", err)
+		} else {
+			in.UseHistory(lines, h.Add)
+		}
+	}
+	return in
+}
+
+func (s *chatSession) newTurn() turn {
+	return turn{cfg: s.cfgFile.AskGPT, opts: s.opts}
+}
+
+// run chats until the user quits. A non-empty input is sent as the first
+// message without asking for one; in one-shot mode it is the only one.
+func (s *chatSession) run(input string) {
+	if !s.opts.oneShot {
+		if err := s.cfgFile.Context.validate(); err != nil {
+			warnf("%v\n", err)
+		}
+		if err := unlockSessions(s.cfgFile.Sessions); err != nil {
+			s.warnSave(err)
+		}
+		if h := s.cfgFile.History; h.Retention != "" || h.MaxSessions > 0 {
+			err := s.openStore()
+			if err == nil {
+				err = pruneSessions(s.store, h, s.id)
+			}
+			if err != nil {
+				warnf("%v\n", err)
+			}
+		}
+		s.handleSignals()
+	}
+	prompt := paint(os.Stderr, colors.user, "Your message:") + "\n> "
+	if len(s.messages) > 0 {
+		prompt = paint(os.Stderr, colors.user, "Your next message:") + "\n> "
+	}
+	for {
+		t := s.newTurn()
+		t.message = input
+		if input == "" {
+			var ok bool
+			if t, ok = s.readTurn(prompt); !ok {
+				fmt.Fprintln(os.Stderr)
+				s.printSessionCost()
+				if s.id != "" {
+					fmt.Fprintf(os.Stderr, "Continue this chat with: askgpt resume %s\n", s.id)
+				}
+				fmt.Fprintln(os.Stderr, "\nGoodbye!")
+				return
+			}
+		}
+		input = ""
+		if err := s.send(t); err != nil {
+			exitIfDryRun(err)
+			logger.Error("request failed", "task", s.task, "error", err.Error())
+			errorf("%v\n", err)
+			if s.opts.notify {
+				notifyDesktop("askgpt "+s.task+" failed", err.Error())
+			}
+			exit(1)
+		}
+		if s.opts.oneShot {
+			return
+		}
+		if !s.opts.raw {
+			fmt.Fprintln(os.Stderr, "\n---")
+		}
+		prompt = paint(os.Stderr, colors.user, "Your next message:") + "\n> "
+	}
+}
+
+// readTurn reads input until there is something to send, running the
+// commands typed in between. ok is false when the user quits.
+func (s *chatSession) readTurn(prompt string) (t turn, ok bool) {
+	for {
+		s.checkpoint()
+		sub, err := s.in.Next(prompt)
+		if err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, errInterrupted) {
+				return turn{}, false
+			}
+			fmt.Fprintf(os.Stderr, "Error reading input: %v\n", err)
+			exit(1)
+		}
+		if sub.Kind == inputCommand {
+			next, err := s.runCommand(sub.Command)
+			if errors.Is(err, errQuit) {
+				return turn{}, false
+			}
+			if err != nil {
+				errorf("%v\n", err)
+				continue
+			}
+			if next != nil {
+				return *next, true
+			}
+			continue
+		}
+		if strings.TrimSpace(sub.Text) == "" {
+			continue
+		}
+		text, images, err := expandImageMentions(s.cfgFile.Images, sub.Text)
+		if err == nil {
+			text, err = withMentions(text, s.opts)
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			continue
+		}
+		reportImages(images)
+		t = s.newTurn()
+		t.message, t.images = text, images
+		return t, true
+	}
+}
+
+// runCommand runs a chat command. It returns the turn to send for commands
+// that produce a request, nil for the others, and errQuit for /quit.
+func (s *chatSession) runCommand(c chatCommand) (*turn, error) {
+	t := s.newTurn()
+	switch c.Name {
+	case "help":
+		printCommandHelp(os.Stderr)
+	case "quit":
+		return nil, errQuit
+	case "system":
+		s.systemCommand(c.Arg)
+	case "model":
+		return nil, s.model(c.Arg)
+	case "persona":
+		persona, err := personaCommand(s.personas, s.persona, c.Fields())
+		if err != nil {
+			return nil, err
+		}
+		s.persona = persona
+	case "file":
+		text, err := fileMessage(c, s.opts)
+		if err != nil {
+			return nil, err
+		}
+		t.message = text
+		return &t, nil
+	case "clip", "edit":
+		text, err := messageCommand(c)
+		if err != nil {
+			return nil, err
+		}
+		t.message = text
+		return &t, nil
+	case "retry":
+		if !s.hasAnswer() {
+			fmt.Fprintln(os.Stderr, "Nothing to retry.")
+			return nil, nil
+		}
+		cfg, opts, err := retryOverrides(s.cfgFile, s.task, s.opts, c.Fields())
+		if err != nil {
+			return nil, err
+		}
+		t.cfg, t.opts, t.retry = cfg, opts, true
+		return &t, nil
+	case "continue":
+		if !s.truncated {
+			fmt.Fprintln(os.Stderr, "The last answer is complete; nothing to continue.")
+			return nil, nil
+		}
+		t.continuing = true
+		return &t, nil
+	case "undo":
+		before := s.messages
+		var ok bool
+		if s.messages, ok = undoExchange(s.messages); !ok {
+			fmt.Fprintln(os.Stderr, "Nothing to undo.")
+		} else {
+			// The question undone is the first message cut off.
+			s.bookmarks = bookmarksBefore(s.bookmarks, before[len(s.messages)].Time)
+			s.truncated = false
+			fmt.Fprintln(os.Stderr, "Removed the last exchange from the conversation.")
+		}
+	case "clear":
+		return nil, s.clear(c.Arg)
+	case "tokens":
+		s.printTokens()
+	case "save":
+		return nil, s.save(c.Arg)
+	case "load":
+		return nil, s.load(c.Arg)
+	case "fork":
+		return nil, s.fork(c.Arg)
+	case "bookmark":
+		return nil, s.bookmark(c.Arg)
+	case "copy":
+		if !s.hasAnswer() {
+			fmt.Fprintln(os.Stderr, "Nothing to copy.")
+			return nil, nil
+		}
+		return nil, copyAnswer(s.lastAnswer(), c.Arg)
+	case "apply":
+		if !s.hasAnswer() {
+			fmt.Fprintln(os.Stderr, "No answer yet.")
+			return nil, nil
+		}
+		return nil, s.applyDiff()
+	case "code":
+		if !s.hasAnswer() {
+			fmt.Fprintln(os.Stderr, "No answer yet.")
+			return nil, nil
+		}
+		return nil, s.printCode(c.Arg)
+	case "mcp":
+		s.mcpCommand()
+	case "run":
+		text, err := s.runCommandLine(c.Arg)
+		if errors.Is(err, errDeclined) {
+			fmt.Fprintln(os.Stderr, "Not run.")
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		t.message = text
+		return &t, nil
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command: /%s (type /help for a list)\n", c.Name)
+	}
+	return nil, nil
+}
+
+// systemCommand handles "/system [text|none]".
+func (s *chatSession) systemCommand(arg string) {
+	switch arg {
+	case "":
+		if s.system == "" {
+			fmt.Fprintln(os.Stderr, "No system prompt set.")
+		} else {
+			fmt.Fprintf(os.Stderr, "System prompt: %s\n", s.system)
+		}
+	case "none":
+		s.system = ""
+		fmt.Fprintln(os.Stderr, "System prompt cleared.")
+	default:
+		s.system = arg
+		fmt.Fprintln(os.Stderr, "System prompt set.")
+	}
+}
+
+// clear handles "/clear [all]": the conversation is emptied, so the next
+// message starts a new one. The system prompts are kept unless arg is
+// "all".
+func (s *chatSession) clear(arg string) error {
+	switch arg {
+	case "":
+	case "all":
+		s.system, s.persona = "", ""
+	default:
+		return fmt.Errorf("unknown clear option %q (use all or nothing)", arg)
+	}
+	n := len(s.messages)
+	s.messages, s.bookmarks, s.truncated, s.usage = nil, nil, false, nil
+	// The next message starts a new session; this one stays resumable.
+	s.id = ""
+	if arg == "all" {
+		fmt.Fprintf(os.Stderr, "Cleared %d message(s), the system prompt and the persona.\n", n)
+	} else {
+		fmt.Fprintf(os.Stderr, "Cleared %d message(s).\n", n)
+	}
+	return nil
+}
+
+// model handles "/model [name]". The new model is used from the next
+// request on, with the whole conversation so far.
+func (s *chatSession) model(name string) error {
+	if name == "" {
+		fmt.Fprintf(os.Stderr, "Current model: %s\n", s.cfgFile.AskGPT.Model)
+		return nil
+	}
+	sampling, err := resolveSampling(s.cfgFile, s.task, s.opts.preset, name)
+	if err != nil {
+		return err
+	}
+	if s.taskDef.Temperature != nil && s.opts.preset == "" {
+		sampling.Temperature = s.taskDef.Temperature
+	}
+	s.cfgFile.AskGPT.Model, s.opts.sampling = name, sampling
+	fmt.Fprintf(os.Stderr, "Model set to %s.\n", name)
+	return nil
+}
+
+// save handles "/save <file>".
+func (s *chatSession) save(name string) error {
+	if name == "" {
+		return errors.New("usage: /save <file>")
+	}
+	if len(s.messages) == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing to save.")
+		return nil
+	}
+	path := savedChatPath(name)
+	if err := writeSavedChat(path, s.savedChat()); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Saved %d message(s) to %s.\n", len(s.messages), path)
+	return nil
+}
+
+// savedChat returns the conversation as it is saved to a file.
+func (s *chatSession) savedChat() savedChat {
+	return savedChat{
+		Version:     savedChatVersion,
+		ID:          s.id,
+		CreatedAt:   s.created,
+		Title:       s.title,
+		SavedAt:     time.Now(),
+		Task:        s.task,
+		Model:       s.cfgFile.AskGPT.Model,
+		Preset:      s.opts.sampling.Preset,
+		Temperature: s.opts.sampling.Temperature,
+		TopP:        s.opts.sampling.TopP,
+		Persona:     s.persona,
+		System:      s.system,
+		Messages:    append([]chatMessage(nil), s.messages...),
+		Bookmarks:   slices.Clone(s.bookmarks),
+	}
+}
+
+// load handles "/load <file>": the saved conversation replaces the current
+// one, which goes on in the same session.
+func (s *chatSession) load(name string) error {
+	if name == "" {
+		return errors.New("usage: /load <file>")
+	}
+	path := name
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		path = savedChatPath(name)
+	}
+	c, err := readSavedChat(path)
+	if err != nil {
+		return err
+	}
+	if c.Encryption != "" {
+		// A copy of an encrypted session file.
+		if c, err = decryptChat(s.cfgFile.Sessions, c); err != nil {
+			return err
+		}
+	}
+	s.restore(c)
+	fmt.Fprintf(os.Stderr, "Loaded %d message(s) from %s (model %s).\n", len(c.Messages), path, s.cfgFile.AskGPT.Model)
+	return nil
+}
+
+// fork saves the conversation and continues it in a new session, so what
+// follows does not change the original.
+func (s *chatSession) fork(title string) error {
+	if len(s.messages) == 0 {
+		return errors.New("nothing to fork yet")
+	}
+	s.checkpoint()
+	if err := s.openStore(); err != nil {
+		return err
+	}
+	parent := s.id
+	created := time.Now()
+	id, err := s.store.NewID(created)
+	if err != nil {
+		return err
+	}
+	// The bookmarks stay with the original, so that each names one turn.
+	s.id, s.created, s.title, s.bookmarks = id, created, forkTitle(s.title, s.messages, title), nil
+	s.checkpoint()
+	fmt.Fprintf(os.Stderr, "Forked session %s into %s %q; the original is left as it was.\n", parent, s.id, s.title)
+	return nil
+}
+
+// restore replaces the conversation with a saved one, along with its model,
+// sampling parameters and system prompts.
+func (s *chatSession) restore(c savedChat) {
+	persona := c.Persona
+	if persona != "" {
+		if _, err := lookupPersona(s.personas, persona); err != nil {
+			warnf("%v; continuing without it\n", err)
+			persona = ""
+		}
+	}
+	if c.Model != "" {
+		s.cfgFile.AskGPT.Model = c.Model
+	}
+	s.opts.sampling = samplingParams{Preset: c.Preset, Temperature: c.Temperature, TopP: c.TopP}
+	s.persona, s.system = persona, c.System
+	s.messages, s.bookmarks, s.truncated, s.usage = c.Messages, c.Bookmarks, false, nil
+	s.title = c.Title
+}
+
+func (s *chatSession) hasAnswer() bool {
+	return len(s.messages) > 0 && s.messages[len(s.messages)-1].Role == "assistant"
+}
+
+// lastAnswer returns the last answer as it is shown, with the redacted
+// values put back when redact.restore is set.
+func (s *chatSession) lastAnswer() string {
+	answer := s.messages[len(s.messages)-1].Content
+	if s.opts.restore != nil {
+		answer = s.opts.restore.restore(answer)
+	}
+	return answer
+}
+
+// printCode prints the code blocks of the last answer, or its nth with n,
+// to stdout as they were written.
+func (s *chatSession) printCode(n string) error {
+	code, err := answerCode(s.lastAnswer(), n)
+	if err != nil {
+		return err
+	}
+	fmt.Println(code)
+	return nil
+}
+
+// applyDiff applies the diff in the last answer to the files in the
+// current directory, after showing it and asking, see patch.go.
+func (s *chatSession) applyDiff() error {
+	err := applyAnswerDiff(s.lastAnswer(), s.opts.yes)
+	if errors.Is(err, errDeclined) {
+		fmt.Fprintln(os.Stderr, "Not applied.")
+		return nil
+	}
+	return err
+}
+
+// send sends a turn and adds the answer to the conversation. In a chat,
+// Ctrl-C stops the answer; what arrived so far is kept and can be
+// completed with /continue.
+func (s *chatSession) send(t turn) error {
+	before := append([]chatMessage(nil), s.messages...)
+	switch {
+	case t.retry:
+		// Drop the answer and re-send the user message that produced it.
+		s.messages = s.messages[:len(s.messages)-1]
+	case t.continuing:
+	default:
+		content, images := t.message, t.images
+		if s.opts.fetchURLs {
+			var err error
+			if content, err = s.fetchPages(content); err != nil {
+				if s.opts.oneShot {
+					return err
+				}
+				errorf("%v\n", err)
+				return nil
+			}
+		}
+		if s.index != nil {
+			excerpts, err := s.retrieve(t.message)
+			if err != nil {
+				if s.opts.oneShot {
+					return err
+				}
+				errorf("%v\n", err)
+				return nil
+			}
+			if excerpts != "" {
+				content += "\n\n" + excerpts
+			}
+		}
+		content = s.redactText(content)
+		if len(s.messages) == 0 {
+			// The task's prompt, the directory context and the --image
+			// images go with the first message only.
+			if s.dirCtx != "" {
+				content += "\n\n" + s.dirCtx
+			}
+			for _, img := range s.images {
+				content += "\n\nImage: " + img.Name
+			}
+			images = slices.Concat(s.images, images)
+			s.input = content
+			prompt, err := getPrompt(s.cfgFile, s.task, content, s.opts.params)
+			if err != nil {
+				return err
+			}
+			content = prompt
+		}
+		if err := confirmLargeInput(s.cfgFile, t.cfg.Model, content, s.opts.yes); err != nil {
+			if s.opts.oneShot {
+				return err
+			}
+			// In a chat the message is dropped and another can be typed.
+			errorf("%v\n", err)
+			return nil
+		}
+		if chunking, ok := taskChunking(s.cfgFile, s.taskDef); ok && len(s.messages) == 0 {
+			notes, err := s.chunkedInput(t, s.input, chunking)
+			if err != nil {
+				return err
+			}
+			if notes != s.input {
+				if content, err = getPrompt(s.cfgFile, s.task, notes, s.opts.params); err != nil {
+					return err
+				}
+			}
+		}
+		if err := s.moderateText(s.cfgFile.Moderation.Input, "message", content); err != nil {
+			if s.opts.oneShot {
+				return err
+			}
+			errorf("%v\n", err)
+			return nil
+		}
+		msg := newChatMessage("user", content)
+		msg.Images = images
+		s.messages = append(s.messages, msg)
+	}
+
+	if s.cfgFile.Context.Strategy == "summarize" {
+		s.summarizeOld(t)
+	}
+	request, dropped := s.request(t.opts, t.cfg.Model)
+	if dropped > 0 && dropped != s.dropped {
+		fmt.Fprintf(os.Stderr, "[context] Leaving out the oldest %d turn(s) to fit the context window of %s.\n", dropped, t.cfg.Model)
+	}
+	s.dropped = dropped
+	if t.continuing {
+		request = append(request, Message{Role: "user", Content: continuePrompt})
+	}
+	if s.opts.oneShot && !t.opts.noUsage && !t.opts.raw {
+		// Show what the input costs before it is spent.
+		line := fmt.Sprintf("[tokens] Sending ~%d prompt tokens to %s", countTokens(t.cfg.Model, request), t.cfg.Model)
+		fmt.Fprintln(os.Stderr, paint(os.Stderr, colors.usage, line))
+	}
+	ctx, stop := context.Background(), func() {}
+	if !s.opts.oneShot {
+		s.checkpoint()
+		ctx, stop = s.requestContext()
+	}
+	ctx, sp := startSpan(ctx, "askgpt "+s.task, spanInternal)
+	sp.set("askgpt.task", s.task)
+	sp.set("gen_ai.request.model", t.cfg.Model)
+	start := time.Now()
+	res, err := s.chat(ctx, t, request)
+	latency := time.Since(start)
+	sp.end(err)
+	cancelled := err != nil && ctx.Err() != nil
+	stop()
+	if cancelled {
+		fmt.Println()
+		if res.Content == "" {
+			s.messages = before
+			fmt.Fprintln(os.Stderr, "[cancelled] Nothing was received; the conversation is unchanged.")
+			return nil
+		}
+	} else if err != nil {
+		return err
+	}
+
+	// A blocked answer has been shown as it streamed, but goes no further:
+	// the exchange is left out of the conversation.
+	if err := s.moderateText(s.cfgFile.Moderation.Output, "answer", res.Content); err != nil {
+		s.messages = before
+		s.addCost(t.cfg.Model, res.Usage, false)
+		if s.opts.oneShot {
+			return err
+		}
+		errorf("%v; it is left out of the conversation\n", err)
+		return nil
+	}
+
+	// A continuation is merged into the truncated answer so the history
+	// reads as if it had been generated in one go.
+	if t.continuing {
+		s.messages[len(s.messages)-1].Content += res.Content
+	} else {
+		s.messages = append(s.messages, newChatMessage("assistant", res.Content))
+	}
+	s.truncated = cancelled || res.FinishReason == "length"
+	if s.opts.output == "json" {
+		printEnvelope(t, res, latency)
+	}
+	if s.opts.codeOnly != "" {
+		if err := s.printCode(string(s.opts.codeOnly)); err != nil {
+			if s.opts.oneShot {
+				return err
+			}
+			errorf("%v\n", err)
+		}
+	}
+	if res.Usage != nil {
+		logger.Info("answer", "model", t.cfg.Model, "finish_reason", res.FinishReason, "cancelled", cancelled,
+			"prompt_tokens", res.Usage.PromptTokens, "completion_tokens", res.Usage.CompletionTokens)
+	} else {
+		logger.Info("answer", "model", t.cfg.Model, "finish_reason", res.FinishReason, "cancelled", cancelled)
+	}
+	s.usage = res.Usage
+	s.addCost(t.cfg.Model, res.Usage, false)
+	if s.cfgFile.TranscriptDir != "" {
+		s.logExchange(t, res.Content, cancelled)
+	}
+	if s.taskDef.ShowDiff && len(s.messages) == 2 && !s.truncated {
+		printInputDiff(s.input, res.Content)
+	}
+	if s.opts.copy && !s.truncated {
+		if err := copyAnswer(s.lastAnswer(), ""); err != nil {
+			errorf("%v\n", err)
+		}
+	}
+	if s.opts.apply && !s.truncated {
+		if err := s.applyDiff(); err != nil {
+			if s.opts.oneShot {
+				return err
+			}
+			errorf("%v\n", err)
+		}
+	}
+	if s.opts.notify && !cancelled {
+		notifyDesktop("askgpt "+s.task+" is done", s.messages[len(s.messages)-1].Content)
+	}
+	if s.opts.speak && !s.truncated {
+		s.speakAnswer(s.messages[len(s.messages)-1].Content)
+	}
+	switch {
+	case !s.truncated:
+	case cancelled:
+		fmt.Fprintln(os.Stderr, "[cancelled] The partial answer is kept. Type /continue to get the rest.")
+	case s.opts.oneShot:
+		fmt.Fprintln(os.Stderr, "[truncated] The answer hit the max_tokens limit.")
+	default:
+		fmt.Fprintln(os.Stderr, "[truncated] The answer hit the max_tokens limit. Type /continue to get the rest.")
+	}
+	if !s.opts.oneShot {
+		s.warnContext()
+	}
+	return nil
+}
+
+// logExchange appends the exchange just completed to the transcript
+// journal. A continuation is logged on its own, after the part before it.
+func (s *chatSession) logExchange(t turn, answer string, cancelled bool) {
+	question := ""
+	var notes []string
+	switch {
+	case t.continuing:
+		notes = append(notes, "continued")
+	case t.retry:
+		notes = append(notes, "retry")
+		fallthrough
+	default:
+		question = s.messages[len(s.messages)-2].Content
+	}
+	if cancelled {
+		notes = append(notes, "cancelled")
+	} else if s.truncated {
+		notes = append(notes, "truncated")
+	}
+	if err := appendTranscript(s.cfgFile.TranscriptDir, t.cfg, question, answer, strings.Join(notes, ", ")); err != nil {
+		warnf("%v\n", err)
+	}
+}
+
+// handleSignals makes sure the conversation is not lost when askgpt is
+// interrupted or its terminal goes away: it is saved to the sessions
+// directory before exiting. The first Ctrl-C during a request only cancels
+// the request (see requestContext).
+func (s *chatSession) handleSignals() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for v := range sig {
+			if v == os.Interrupt && s.cancelRequest() {
+				continue
+			}
+			s.in.Reset()
+			fmt.Fprintln(os.Stderr)
+			s.printSessionCost()
+			if id, err := s.autosave(); err != nil {
+				errorf("%v\n", err)
+			} else if id != "" {
+				fmt.Fprintf(os.Stderr, "Conversation saved; continue it with: askgpt resume %s\n", id)
+			}
+			fmt.Fprintln(os.Stderr, "Goodbye!")
+			code := 1
+			if n, ok := v.(syscall.Signal); ok {
+				code = 128 + int(n)
+			}
+			exit(code)
+		}
+	}()
+}
+
+// requestContext returns the context for a request, which Ctrl-C cancels.
+// done must be called once the request is over.
+func (s *chatSession) requestContext() (ctx context.Context, done func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.cancel = cancel
+	s.mu.Unlock()
+	return ctx, func() {
+		s.mu.Lock()
+		s.cancel = nil
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancelRequest cancels the request in progress and reports whether there
+// was one.
+func (s *chatSession) cancelRequest() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel == nil {
+		return false
+	}
+	s.cancel()
+	s.cancel = nil
+	return true
+}
+
+// checkpoint saves the conversation to its session. The signal
+// handler saves the same snapshot again before exiting, in case the chat
+// goroutine was interrupted while saving.
+func (s *chatSession) checkpoint() {
+	if len(s.messages) == 0 {
+		return
+	}
+	if err := s.openStore(); err != nil {
+		s.warnSave(err)
+		return
+	}
+	if s.id == "" {
+		s.created = time.Now()
+		id, err := s.store.NewID(s.created)
+		if err != nil {
+			s.warnSave(err)
+			return
+		}
+		s.id = id
+		s.title = sessionTitle(s.input, s.messages)
+	}
+	c := s.savedChat()
+	s.mu.Lock()
+	s.snapshot = c
+	s.mu.Unlock()
+	if _, err := s.autosave(); err != nil {
+		s.warnSave(err)
+	}
+}
+
+// openStore opens the session store on first use.
+func (s *chatSession) openStore() error {
+	if s.store != nil {
+		return nil
+	}
+	store, err := openSessionStore(s.cfgFile.Sessions)
+	if err != nil {
+		return err
+	}
+	s.store = store
+	return nil
+}
+
+// autosave writes the last checkpoint to the session store and returns the
+// session id, or "" when there was nothing to save.
+func (s *chatSession) autosave() (id string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.snapshot.ID == "" {
+		return "", nil
+	}
+	if err := s.store.Save(s.snapshot, time.Now()); err != nil {
+		return "", err
+	}
+	return s.snapshot.ID, nil
+}
+
+// warnSave reports the first failure to save the session.
+func (s *chatSession) warnSave(err error) {
+	if !s.saveFailed {
+		warnf("%v\n", err)
+		s.saveFailed = true
+	}
+}
+
+// systemPrompts returns the system prompts of the chat, of which the empty
+// ones are not sent. The memory notes come first, as a preamble.
+func (s *chatSession) systemPrompts() []string {
+	return []string{memoryPrompt(s.memory), s.personas[s.persona], s.system}
+}
+
+// request returns the messages to send to model: the system prompts, then
+// the conversation, less the turns the context strategy leaves out. It
+// also returns the number of turns left out.
+func (s *chatSession) request(opts taskOptions, model string) ([]Message, int) {
+	system := countTokens(model, withSystemPrompts(opts, s.systemPrompts(), nil))
+	messages, dropped := trimContext(s.cfgFile.Context, model, apiMessages(s.messages), system, contextWindow(s.cfgFile, model))
+	return withSystemPrompts(opts, s.systemPrompts(), messages), dropped
+}
+
+// summarizeOld replaces the oldest turns with a summary written by the
+// model, as often as needed to bring the request under the context
+// threshold. When that fails the turns are left out of the request instead.
+func (s *chatSession) summarizeOld(t turn) {
+	cfg := s.cfgFile.Context
+	limit := cfg.limit(contextWindow(s.cfgFile, t.cfg.Model))
+	system := countTokens(t.cfg.Model, withSystemPrompts(t.opts, s.systemPrompts(), nil))
+	for system+countTokens(t.cfg.Model, apiMessages(s.messages)) > limit {
+		n := cfg.summarizable(s.messages)
+		if n == 0 {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "[context] Summarizing the oldest turns to make room...")
+		ctx, stop := s.requestContext()
+		req := newChatRequest(t.cfg, summaryRequest(s.messages[:n]), taskOptions{noStream: true})
+		res, err := sendChat(ctx, s.client, t.cfg, req, nil)
+		stop()
+		s.addCost(t.cfg.Model, res.Usage, true)
+		if err == nil && strings.TrimSpace(res.Content) == "" {
+			err = errors.New("the model returned an empty summary")
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[context] Cannot summarize: %v\n", err)
+			return
+		}
+		summary := newChatMessage("user", summaryPrefix+strings.TrimSpace(res.Content))
+		s.messages = append([]chatMessage{summary}, s.messages[n:]...)
+	}
+}
+
+// contextSize returns the tokens of the next request, the context window
+// of the model and the turns left out to fit it.
+func (s *chatSession) contextSize() (tokens, window, dropped int) {
+	model := s.cfgFile.AskGPT.Model
+	request, dropped := s.request(s.opts, model)
+	return countTokens(model, request), contextWindow(s.cfgFile, model), dropped
+}
+
+// printTokens handles "/tokens".
+func (s *chatSession) printTokens() {
+	tokens, window, dropped := s.contextSize()
+	fmt.Fprintf(os.Stderr, "Context: ~%d of %d tokens (%d%%) for %s, %d message(s)\n",
+		tokens, window, tokens*100/window, s.cfgFile.AskGPT.Model, len(s.messages))
+	if dropped > 0 {
+		fmt.Fprintf(os.Stderr, "The oldest %d turn(s) are left out (context.strategy %s).\n", dropped, s.cfgFile.Context.Strategy)
+	}
+	if s.usage != nil {
+		fmt.Fprintf(os.Stderr, "Last request: prompt %d, completion %d tokens (as reported by the API)\n",
+			s.usage.PromptTokens, s.usage.CompletionTokens)
+	}
+}
+
+// warnContext warns once when the conversation gets close to filling the
+// model's context window, and again if it grows back after shrinking. With
+// a context strategy it only warns when leaving out turns is not enough.
+func (s *chatSession) warnContext() {
+	tokens, window, _ := s.contextSize()
+	full := tokens*100 >= window*contextWarnPercent
+	if s.cfgFile.Context.trims() {
+		full = tokens > s.cfgFile.Context.limit(window)
+	}
+	if !full {
+		s.warned = false
+		return
+	}
+	if !s.warned {
+		fmt.Fprintf(os.Stderr, "[context] The conversation uses ~%d of the %d tokens %s can take. Use /undo or /clear to make room.\n",
+			tokens, window, s.cfgFile.AskGPT.Model)
+		s.warned = true
+	}
+}
+
+// fileMessage handles "/file <path> [message]": the file, or the files
+// matching a glob, are attached after the message.
+func fileMessage(c chatCommand, opts taskOptions) (string, error) {
+	fields := c.Fields()
+	if len(fields) == 0 {
+		return "", errors.New("usage: /file <path> [message]")
+	}
+	text, files, err := messageFromArgs(fields[:1], opts.forceBase64)
+	if err != nil {
+		return "", err
+	}
+	if len(files) == 0 {
+		return "", fmt.Errorf("no file matches %s", fields[0])
+	}
+	if msg := strings.TrimSpace(strings.TrimPrefix(c.Arg, fields[0])); msg != "" {
+		text = msg + "\n\n" + text
+	}
+	reportAttachments(files, text)
+	return text, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ChunkingConfig says how chunked tasks split an input too long for the
+// context window, in the chunking: section of config.yaml or of a task,
+// which wins:
+//
+//	chunking:
+//	  by: paragraphs  # tokens (the default), paragraphs or symbols
+//	  size: 4000      # tokens per part at most; by default as many as fit
+//	  overlap: 200    # tokens of a part repeated at the start of the next
+//
+// tokens fills each part line by line, paragraphs keeps paragraphs
+// together, and symbols keeps the top-level declarations of source code
+// together, with their doc comments. Anything longer than a part is split
+// by lines.
+type ChunkingConfig struct {
+	By      string `yaml:"by,omitempty"`
+	Size    int    `yaml:"size,omitempty"`
+	Overlap int    `yaml:"overlap,omitempty"`
+}
+
+func (c ChunkingConfig) validate() error {
+	switch c.By {
+	case "", "tokens", "paragraphs", "symbols":
+	default:
+		return fmt.Errorf("unknown chunking.by %q (use tokens, paragraphs or symbols)", c.By)
+	}
+	if c.Size < 0 || c.Overlap < 0 {
+		return errors.New("chunking.size and chunking.overlap must not be negative")
+	}
+	if c.Size > 0 && c.Overlap >= c.Size {
+		return errors.New("chunking.overlap must be smaller than chunking.size")
+	}
+	return nil
+}
+
+// taskChunking returns the chunking settings of a task, and whether the
+// task is chunked at all.
+func taskChunking(cfg ConfigFile, t TaskConfig) (ChunkingConfig, bool) {
+	if t.Chunking != nil {
+		return *t.Chunking, true
+	}
+	return cfg.Chunking, t.Chunked
+}
+
+// splitChunks splits text into parts of at most size tokens for model, as
+// c says.
+func splitChunks(model, text string, c ChunkingConfig, size int) []string {
+	overlap := min(c.Overlap, size/2)
+	var units []string
+	switch c.By {
+	case "paragraphs":
+		units = paragraphUnits(text)
+	case "symbols":
+		units = symbolUnits(text)
+	default:
+		units = strings.SplitAfter(text, "\n")
+	}
+	return packUnits(model, fitUnits(model, units, size-overlap), size, overlap)
+}
+
+// fitUnits splits the units longer than size tokens by lines, and lines
+// longer than that by runes, about proportionally to their tokens.
+func fitUnits(model string, units []string, size int) []string {
+	var out []string
+	for _, u := range units {
+		if tokenLen(model, u) <= size {
+			out = append(out, u)
+			continue
+		}
+		for _, line := range strings.SplitAfter(u, "\n") {
+			n := tokenLen(model, line)
+			for n > size {
+				r := []rune(line)
+				cut := max(len(r)*size/n, 1)
+				out = append(out, string(r[:cut]))
+				line = string(r[cut:])
+				n = tokenLen(model, line)
+			}
+			if line != "" {
+				out = append(out, line)
+			}
+		}
+	}
+	return out
+}
+
+// packUnits joins units into parts of at most size tokens. Each part after
+// the first starts with the last units of the one before, up to overlap
+// tokens, so what spans a boundary is seen whole.
+func packUnits(model string, units []string, size, overlap int) []string {
+	var chunks, cur []string
+	curTokens, fresh := 0, 0
+	for _, u := range units {
+		n := tokenLen(model, u)
+		if curTokens+n > size && fresh > 0 {
+			chunks = append(chunks, strings.Join(cur, ""))
+			var keep []string
+			kept := 0
+			for i := len(cur) - 1; i >= 0; i-- {
+				k := tokenLen(model, cur[i])
+				if kept+k > overlap || kept+k+n > size {
+					break
+				}
+				keep = append([]string{cur[i]}, keep...)
+				kept += k
+			}
+			cur, curTokens, fresh = keep, kept, 0
+		}
+		cur = append(cur, u)
+		curTokens += n
+		fresh++
+	}
+	if fresh > 0 {
+		chunks = append(chunks, strings.Join(cur, ""))
+	}
+	return chunks
+}
+
+// paragraphUnits splits text after every blank line.
+func paragraphUnits(text string) []string {
+	var units []string
+	var cur strings.Builder
+	blank := false
+	for _, line := range strings.SplitAfter(text, "\n") {
+		isBlank := strings.TrimSpace(line) == ""
+		if blank && !isBlank {
+			units = append(units, cur.String())
+			cur.Reset()
+		}
+		cur.WriteString(line)
+		blank = isBlank
+	}
+	if cur.Len() > 0 {
+		units = append(units, cur.String())
+	}
+	return units
+}
+
+// symbolUnits splits source code before every top-level line, which in
+// most languages starts a declaration, keeping the comments, decorators
+// and attributes right above it with it. Closing brackets and "end" stay
+// with what they close.
+func symbolUnits(text string) []string {
+	var units []string
+	var cur strings.Builder
+	attached := false // the last top-level line belongs to what follows
+	for _, line := range strings.SplitAfter(text, "\n") {
+		s := strings.TrimRight(line, "\r\n")
+		word, _, _ := strings.Cut(s, " ")
+		top := s != "" && !strings.ContainsAny(s[:1], " \t})]") && word != "end"
+		if !top {
+			cur.WriteString(line)
+			continue
+		}
+		if !attached && cur.Len() > 0 {
+			units = append(units, cur.String())
+			cur.Reset()
+		}
+		cur.WriteString(line)
+		attached = hasAnyPrefix(s, "//", "/*", "#", "--", ";", "@")
+	}
+	if cur.Len() > 0 {
+		units = append(units, cur.String())
+	}
+	return units
+}
+
+func hasAnyPrefix(s string, prefixes ...string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
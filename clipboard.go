@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// clipboardTool is a command that reads or writes the system clipboard.
+type clipboardTool struct {
+	Paste []string // prints the clipboard
+	Copy  []string // sets the clipboard from stdin
+}
+
+// clipboardTools lists the clipboard tools for the current platform, in
+// order of preference.
+func clipboardTools() []clipboardTool {
+	switch runtime.GOOS {
+	case "darwin":
+		return []clipboardTool{{Paste: []string{"pbpaste"}, Copy: []string{"pbcopy"}}}
+	case "windows":
+		return []clipboardTool{{
+			Paste: []string{"powershell", "-NoProfile", "-Command", "Get-Clipboard -Raw"},
+			Copy: []string{"powershell", "-NoProfile", "-Command",
+				"[Console]::InputEncoding = [Text.Encoding]::UTF8; Set-Clipboard -Value ([Console]::In.ReadToEnd())"},
+		}}
+	default:
+		return []clipboardTool{
+			{Paste: []string{"wl-paste", "--no-newline"}, Copy: []string{"wl-copy"}},
+			{Paste: []string{"xclip", "-selection", "clipboard", "-o"}, Copy: []string{"xclip", "-selection", "clipboard", "-i"}},
+			{Paste: []string{"xsel", "--clipboard", "--output"}, Copy: []string{"xsel", "--clipboard", "--input"}},
+		}
+	}
+}
+
+// runClipboardTool runs the first installed command picked by pick from the
+// clipboard tools, with stdin as its input.
+func runClipboardTool(pick func(clipboardTool) []string, stdin string) (string, error) {
+	var tried []string
+	for _, t := range clipboardTools() {
+		c := pick(t)
+		path, err := exec.LookPath(c[0])
+		if err != nil {
+			tried = append(tried, c[0])
+			continue
+		}
+		cmd := exec.Command(path, c[1:]...)
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+				err = fmt.Errorf("%s", strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return "", fmt.Errorf("%s failed: %w", c[0], err)
+		}
+		return string(out), nil
+	}
+	return "", fmt.Errorf("none of %s is installed", strings.Join(tried, ", "))
+}
+
+// readClipboard returns the text on the system clipboard.
+func readClipboard() (string, error) {
+	out, err := runClipboardTool(func(t clipboardTool) []string { return t.Paste }, "")
+	if err != nil {
+		return "", fmt.Errorf("cannot read clipboard: %w", err)
+	}
+	return strings.ReplaceAll(out, "\r\n", "\n"), nil
+}
+
+// writeClipboard puts text on the system clipboard.
+func writeClipboard(text string) error {
+	if _, err := runClipboardTool(func(t clipboardTool) []string { return t.Copy }, text); err != nil {
+		return fmt.Errorf("cannot copy to clipboard: %w", err)
+	}
+	return nil
+}
+
+// codeBlocks returns the contents of the fenced code blocks in a Markdown
+// text.
+func codeBlocks(text string) []string {
+	var blocks []string
+	var fence string
+	var block []string
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence == "" {
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				fence = trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, trimmed[:1]))]
+				block = nil
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			blocks = append(blocks, strings.Join(block, "\n"))
+			fence = ""
+			continue
+		}
+		block = append(block, line)
+	}
+	return blocks
+}
+
+// copyAnswer puts the answer on the clipboard or, with what "code", its
+// last code block, and with "code n" its nth, as numbered when the answer
+// was rendered.
+func copyAnswer(answer, what string) error {
+	text := answer
+	if what != "" {
+		n, ok := strings.CutPrefix(what, "code")
+		if !ok {
+			return fmt.Errorf("unknown copy target %q (use code, code <n> or nothing)", what)
+		}
+		if n = strings.TrimSpace(n); n == "" {
+			// The last block, the one usually wanted.
+			n = strconv.Itoa(len(codeBlocks(answer)))
+		}
+		var err error
+		if text, err = answerCode(answer, n); err != nil {
+			return err
+		}
+	}
+	if err := writeClipboard(text); err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "(copied to clipboard)")
+	return nil
+}
+
+// clipboardMessage returns the clipboard text as a message, after the
+// instruction given with :clip, if any.
+func clipboardMessage(instruction string) (string, error) {
+	text, err := readClipboard()
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", errors.New("the clipboard is empty")
+	}
+	if instruction != "" {
+		text = instruction + "\n\n" + text
+	}
+	return text, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// codeOnly is the --code-only flag: "" when it is not given, "all" for
+// every code block of the answer, or the number of one, as in
+// --code-only=2.
+type codeOnly string
+
+func (c *codeOnly) String() string { return string(*c) }
+
+func (c *codeOnly) Set(v string) error {
+	switch v {
+	case "true":
+		*c = "all"
+	case "false":
+		*c = ""
+	default:
+		if n, err := strconv.Atoi(v); err != nil || n < 1 {
+			return fmt.Errorf("%s is not a code block number", v)
+		}
+		*c = codeOnly(v)
+	}
+	return nil
+}
+
+// IsBoolFlag lets --code-only go without a value.
+func (c *codeOnly) IsBoolFlag() bool { return true }
+
+// answerCode returns the code blocks of an answer: the nth with n, as
+// numbered when the answer was rendered, or all of them, a blank line
+// apart.
+func answerCode(answer, n string) (string, error) {
+	blocks := codeBlocks(answer)
+	if len(blocks) == 0 {
+		return "", errors.New("the last answer has no code block")
+	}
+	if n = strings.TrimSpace(n); n == "" || n == "all" {
+		return strings.Join(blocks, "\n\n"), nil
+	}
+	i, err := strconv.Atoi(n)
+	if err != nil || i < 1 || i > len(blocks) {
+		return "", fmt.Errorf("the last answer has no code block %s (it has %d)", n, len(blocks))
+	}
+	return blocks[i-1], nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// palette is the colors of a theme: the ANSI styles of the role labels,
+// errors, warnings and usage lines. An empty style leaves text as it is.
+type palette struct {
+	user      string
+	assistant string
+	err       string
+	warn      string
+	usage     string
+}
+
+// themes are the values of theme: in config.yaml. dark, the default, suits
+// a dark background and light a light one; none turns colors off.
+var themes = map[string]palette{
+	"dark": {
+		user:      "\x1b[1;32m",
+		assistant: "\x1b[1;36m",
+		err:       "\x1b[1;31m",
+		warn:      "\x1b[1;33m",
+		usage:     "\x1b[2m",
+	},
+	"light": {
+		user:      "\x1b[1;32m",
+		assistant: "\x1b[1;34m",
+		err:       "\x1b[1;31m",
+		warn:      "\x1b[1;35m",
+		usage:     "\x1b[90m",
+	},
+	"none": {},
+}
+
+// colors is the palette in use, and colorOutput whether there is one: it
+// is empty when NO_COLOR is set, the theme is none or stdout is not a
+// terminal.
+var (
+	colors      palette
+	colorOutput bool
+)
+
+// initColors picks the palette of theme, "" being dark.
+func initColors(theme string) {
+	if theme == "" {
+		theme = "dark"
+	}
+	if os.Getenv("NO_COLOR") != "" || theme == "none" || !isTerminal(os.Stdout) {
+		colors, colorOutput = palette{}, false
+		return
+	}
+	colors, colorOutput = themes[theme], true
+}
+
+// paint styles s for f, unless f is not a terminal.
+func paint(f *os.File, style, s string) string {
+	if style == "" || !isTerminal(f) {
+		return s
+	}
+	return style + s + styleReset
+}
+
+// errorf prints an error message on stderr, after a colored "Error:".
+func errorf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, paint(os.Stderr, colors.err, "Error:")+" "+format, args...)
+}
+
+// warnf prints a warning on stderr, after a colored "Warning:".
+func warnf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, paint(os.Stderr, colors.warn, "Warning:")+" "+format, args...)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// errQuit is returned by a chat command that ends the chat.
+var errQuit = errors.New("quit")
+
+// replCommand describes a command that can be typed at the chat prompt.
+type replCommand struct {
+	Name string
+	Args string // synopsis of the arguments, shown by /help
+	Help string
+}
+
+// replCommands lists the chat commands in the order /help shows them.
+var replCommands = []replCommand{
+	{Name: "help", Help: "List the commands"},
+	{Name: "system", Args: "[text|none]", Help: "Show or set a system prompt for this chat"},
+	{Name: "model", Args: "[name]", Help: "Show or switch the model"},
+	{Name: "persona", Args: "[name|none]", Help: "Show or switch the persona"},
+	{Name: "file", Args: "<path> [message]", Help: "Send a file (or glob), with an optional message"},
+	{Name: "paste", Help: "Paste multi-line text, finished by a line :end"},
+	{Name: "edit", Args: "[text]", Help: "Write the message in $EDITOR"},
+	{Name: "clip", Args: "[instruction]", Help: "Send the clipboard contents"},
+	{Name: "retry", Args: "[model] [temp]", Help: "Regenerate the last answer"},
+	{Name: "continue", Help: "Get the rest of a truncated answer"},
+	{Name: "undo", Help: "Drop the last question and answer"},
+	{Name: "clear", Args: "[all]", Help: "Start over; all also drops the system prompt and persona"},
+	{Name: "tokens", Help: "Show how much of the context window the chat uses"},
+	{Name: "save", Args: "<file>", Help: "Save the conversation (JSON, or YAML for .yaml)"},
+	{Name: "load", Args: "<file>", Help: "Continue a saved conversation"},
+	{Name: "fork", Args: "[title]", Help: "Continue in a new session, leaving this one as it is"},
+	{Name: "bookmark", Args: "<label>", Help: "Mark the last turn to branch from later with resume --at"},
+	{Name: "copy", Args: "[code [n]]", Help: "Copy the last answer, or a code block of it"},
+	{Name: "code", Args: "[n]", Help: "Print the code blocks of the last answer, or the nth"},
+	{Name: "apply", Help: "Apply the diff in the last answer to the files here, after asking"},
+	{Name: "mcp", Help: "List the MCP servers connected and their tools"},
+	{Name: "run", Args: "[command]", Help: "Run the last suggested command, after asking, and send its output"},
+	{Name: "quit", Help: "Leave the chat (or press Ctrl-D)"},
+}
+
+// chatCommand is a command line typed at the chat prompt.
+type chatCommand struct {
+	Name string // without the leading "/"
+	Arg  string // the rest of the line, trimmed
+}
+
+// Fields returns the arguments split on white space.
+func (c chatCommand) Fields() []string {
+	return strings.Fields(c.Arg)
+}
+
+// parseCommand recognizes a command line: "/name" followed by optional
+// arguments. The older ":name" spelling and a bare "quit" work too. The name
+// must be that of a command in replCommands, so a message that starts with
+// a path like /etc/hosts or a symbol like :foo is not taken for one.
+func parseCommand(line string) (chatCommand, bool) {
+	line = strings.TrimSpace(line)
+	if line == "quit" {
+		return chatCommand{Name: "quit"}, true
+	}
+	if len(line) < 2 || (line[0] != '/' && line[0] != ':') {
+		return chatCommand{}, false
+	}
+	name, arg := line[1:], ""
+	if i := strings.IndexFunc(name, unicode.IsSpace); i >= 0 {
+		name, arg = name[:i], strings.TrimSpace(name[i:])
+	}
+	name = strings.ToLower(name)
+	if !slices.ContainsFunc(replCommands, func(c replCommand) bool { return c.Name == name }) {
+		return chatCommand{}, false
+	}
+	return chatCommand{Name: name, Arg: arg}, true
+}
+
+// printCommandHelp writes the command list shown by /help.
+func printCommandHelp(w io.Writer) {
+	fmt.Fprintln(w, "Commands:")
+	for _, c := range replCommands {
+		fmt.Fprintf(w, "  %-26s %s\n", strings.TrimSpace("/"+c.Name+" "+c.Args), c.Help)
+	}
+	fmt.Fprintln(w, "End a line with \\ to continue it on the next one; type @path to attach a file.")
+}
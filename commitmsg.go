@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const commitMsgPrompt = "Write a commit message in the Conventional Commits style for the staged changes below. " +
+	"The subject line is \"type(scope): summary\", at most 72 characters, in the imperative mood, with type one of " +
+	"feat, fix, docs, style, refactor, perf, test, build, ci, chore or revert, and the scope left out if there is no " +
+	"clear one. If the change needs explaining, add a blank line and a short body saying what changed and why, " +
+	"wrapped at 72 columns. Write only the message, not in a code block."
+
+func runCommitMsg(args []string) int {
+	fs := flag.NewFlagSet("commit-msg", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	commit := fs.Bool("commit", false, "")
+	var edit, yes bool
+	fs.BoolVar(&edit, "e", false, "")
+	fs.BoolVar(&edit, "edit", false, "")
+	fs.BoolVar(&yes, "y", false, "")
+	fs.BoolVar(&yes, "yes", false, "")
+	force := fs.Bool("force", false, "")
+	noRedact := fs.Bool("no-redact", false, "")
+	if err := fs.Parse(args); err != nil {
+		errorf("%v\n", err)
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt commit-msg [-e] [--commit [-y]] [--no-redact]")
+		return 2
+	}
+
+	if err := checkGitRepo(); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	diff, err := gitOutput("diff", "--cached", "--no-color", "--no-ext-diff")
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if strings.TrimSpace(diff) == "" {
+		errorf("nothing is staged; git add the changes first\n")
+		return 1
+	}
+	stat, err := gitOutput("diff", "--cached", "--no-color", "--stat")
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "commit-msg", *force)
+	// The staged changes may hold a .env file or a key; they are redacted
+	// like a chat message is, notes on their parts included.
+	if _, err := useRedaction(cfgFile, *noRedact); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	sampling, err := resolveSampling(cfgFile, "commit-msg", "", cfgFile.AskGPT.Model)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	opts := taskOptions{noStream: true, sampling: sampling}
+	client := apiClient(cfgFile)
+	cfg := cfgFile.AskGPT
+
+	// The file list is always sent whole; a diff too long for the model is
+	// sent as notes on its parts.
+	model := cfg.Model
+	room := contextWindow(cfgFile, model) - defaultMaxToken - textTokens(model, commitMsgPrompt+stat) - messageOverhead
+	changes, err := fitDiff(client, cfg, opts, diff, room, commitMsgPrompt)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	prompt := fmt.Sprintf("%s\n\nFiles changed:\n%s\n---\n\n%s", commitMsgPrompt, stat, changes)
+	req := newChatRequest(cfg, []Message{{Role: "user", Content: prompt}}, opts)
+	stop := startSpinner(opts)
+	res, err := sendChat(context.Background(), client, cfg, req, nil)
+	stop()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	msg := commitMessage(res.Content)
+	if msg == "" {
+		errorf("the answer has no commit message\n")
+		return 1
+	}
+
+	if edit {
+		if msg, err = composeInEditor(msg); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+	if !*commit {
+		fmt.Println(msg)
+		return 0
+	}
+	if !yes {
+		if !isTerminal(os.Stdin) {
+			errorf("--commit asks before committing, which needs a terminal; add -y to commit without asking\n")
+			return 1
+		}
+		if msg, err = reviewMessage(msg, "Commit with this message?"); err != nil {
+			if errors.Is(err, errDeclined) {
+				fmt.Fprintln(os.Stderr, "Not committed.")
+				return 0
+			}
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+
+	cmd := exec.Command("git", "commit", "-F", "-")
+	cmd.Stdin = strings.NewReader(msg + "\n")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// commitMessage returns the message in an answer, without the code block
+// some models put it in anyway.
+func commitMessage(answer string) string {
+	answer = strings.TrimSpace(answer)
+	if blocks := codeBlocks(answer); len(blocks) == 1 && strings.HasPrefix(answer, "```") && strings.HasSuffix(answer, "```") {
+		answer = strings.TrimSpace(blocks[0])
+	}
+	return answer
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Compacting a session replaces all but its last turns with a summary, as
+// context.strategy summarize does during a chat, and moves the messages it
+// replaced to ~/.askgpt/archive/<id>.json.gz. A resumed session sends the
+// summary in their place, and askgpt search still finds them.
+
+const (
+	archiveDirName          = "archive"
+	defaultCompactOlderThan = "30d"
+)
+
+// archiveStore deletes the archive of a session along with the session.
+type archiveStore struct {
+	sessionStore
+}
+
+func (s archiveStore) Delete(id string) error {
+	if err := s.sessionStore.Delete(id); err != nil {
+		return err
+	}
+	path, err := archivePath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot delete the archive of session %s: %w", id, err)
+	}
+	return nil
+}
+
+// archiveDir returns ~/.askgpt/archive.
+func archiveDir() (string, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(cfgPath), archiveDirName), nil
+}
+
+func archivePath(id string) (string, error) {
+	dir, err := archiveDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, id+".json.gz"), nil
+}
+
+// readArchive returns the messages compacting the session id replaced, in
+// the order they were written; none if it was never compacted.
+func readArchive(cfg SessionsConfig, id string) ([]chatMessage, error) {
+	path, err := archivePath(id)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read the archive of session %s: %w", id, err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	var c savedChat
+	if err := json.NewDecoder(zr).Decode(&c); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	if c.Encryption != "" {
+		if c, err = decryptChat(cfg, c); err != nil {
+			return nil, err
+		}
+	}
+	return c.Messages, nil
+}
+
+// archiveMessages adds messages to the archive of the session id, encrypted
+// as the sessions are.
+func archiveMessages(cfg SessionsConfig, id string, messages []chatMessage) error {
+	archived, err := readArchive(cfg, id)
+	if err != nil {
+		return err
+	}
+	c := savedChat{Version: savedChatVersion, ID: id, SavedAt: time.Now(), Messages: append(archived, messages...)}
+	if cfg.Encrypt {
+		if c, err = encryptChat(cfg, c); err != nil {
+			return err
+		}
+	}
+	path, err := archivePath(id)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), configDirPerm); err != nil {
+		return fmt.Errorf("cannot create archive directory: %w", err)
+	}
+	// Written aside and renamed, so that a failure leaves the old archive.
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, configFilePerm)
+	if err != nil {
+		return fmt.Errorf("cannot write the archive of session %s: %w", id, err)
+	}
+	zw := gzip.NewWriter(f)
+	err = json.NewEncoder(zw).Encode(c)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write the archive of session %s: %w", id, err)
+	}
+	return nil
+}
+
+// compactCut returns how many of the first messages compacting replaces so
+// that only the last keep turns are left after the summary; 0 if that is
+// nothing or no more than a summary written before.
+func compactCut(messages []chatMessage, keep int) int {
+	starts := turnStarts(apiMessages(messages))
+	skip := 0
+	if len(messages) > 0 && isSummary(messages[0].Message) {
+		skip = 1
+	}
+	first := len(starts) - keep
+	if first <= skip {
+		return 0
+	}
+	return starts[first]
+}
+
+// runCompact handles "askgpt sessions compact": the sessions given, or those
+// not used for --older-than, are compacted.
+func runCompact(store sessionStore, sessions SessionsConfig, args []string) int {
+	fs := flag.NewFlagSet("compact", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	keep := fs.Int("keep-turns", defaultKeepTurns, "")
+	olderThan := fs.String("older-than", defaultCompactOlderThan, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	force := fs.Bool("force", false, "")
+
+	// Allow flags after the session ids.
+	var refs []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		refs = append(refs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if *keep < 1 {
+		errorf("--keep-turns must be at least 1\n")
+		return 2
+	}
+	age, err := parseAge(*olderThan)
+	if err != nil {
+		errorf("%v\n", err)
+		return 2
+	}
+
+	var ids []string
+	if len(refs) > 0 {
+		for _, ref := range refs {
+			id, err := findSession(store, ref)
+			if err != nil {
+				errorf("%v\n", err)
+				return 1
+			}
+			ids = append(ids, id)
+		}
+	} else {
+		all, err := store.IDs()
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		cutoff := time.Now().Add(-age)
+		for _, id := range all {
+			used, err := store.Used(id)
+			if err != nil {
+				errorf("%v\n", err)
+				return 1
+			}
+			if used.Before(cutoff) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	// The sessions with anything to compact are found first, so that a dry
+	// run sends nothing.
+	var chats []savedChat
+	for _, id := range ids {
+		c, err := store.Load(id)
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		if compactCut(c.Messages, *keep) > 0 {
+			chats = append(chats, c)
+		}
+	}
+	if len(chats) == 0 {
+		fmt.Fprintln(os.Stderr, "No sessions to compact.")
+		return 0
+	}
+	if *dryRun {
+		for _, c := range chats {
+			fmt.Printf("%s  %d turn(s)  %s\n", c.ID, countTurns(c.Messages), sessionTitle(c.Title, c.Messages))
+		}
+		fmt.Fprintf(os.Stderr, "Would compact %d session(s) to their last %d turn(s).\n", len(chats), *keep)
+		return 0
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "compact", *force)
+	sampling, err := resolveSampling(cfgFile, "compact", "", cfgFile.AskGPT.Model)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	opts := taskOptions{noStream: true, sampling: sampling}
+	client := apiClient(cfgFile)
+	for _, c := range chats {
+		fmt.Fprintf(os.Stderr, "Compacting session %s (%d turns)...\n", c.ID, countTurns(c.Messages))
+		if err := compactSession(client, cfgFile, opts, store, sessions, c, *keep); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+	dir, _ := archiveDir()
+	fmt.Fprintf(os.Stderr, "Compacted %d session(s); the messages replaced are kept in %s.\n", len(chats), dir)
+	return 0
+}
+
+// compactSession replaces all but the last keep turns of c with a summary.
+// Turns too long to summarize in one request are summarized a few at a
+// time, each summary going into the next. The session is only saved once
+// the messages replaced are in its archive.
+func compactSession(client *http.Client, cfgFile ConfigFile, opts taskOptions, store sessionStore, sessions SessionsConfig, c savedChat, keep int) error {
+	cfg := cfgFile.AskGPT
+	room := contextWindow(cfgFile, cfg.Model) - defaultMaxToken - textTokens(cfg.Model, summarizePrompt)
+	messages := c.Messages
+	var archived []chatMessage
+	for cut := compactCut(messages, keep); cut > 0; cut = compactCut(messages, keep) {
+		// As many whole turns as fit, and at least one besides a summary.
+		skip := 0
+		if isSummary(messages[0].Message) {
+			skip = 1
+		}
+		starts := turnStarts(apiMessages(messages[:cut]))
+		n := cut
+		for i := len(starts) - 1; i > skip && countTokens(cfg.Model, apiMessages(messages[:n])) > room; i-- {
+			n = starts[i]
+		}
+		req := newChatRequest(cfg, summaryRequest(messages[:n]), opts)
+		stop := startSpinner(opts)
+		res, err := sendChat(context.Background(), client, cfg, req, nil)
+		stop()
+		if err == nil && res.FinishReason == "length" {
+			err = errors.New("the summary was truncated by the model's output limit")
+		}
+		if err == nil && strings.TrimSpace(res.Content) == "" {
+			err = errors.New("the model returned an empty summary")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot compact session %s: %w", c.ID, err)
+		}
+		// A summary, written in an earlier round or when the session was
+		// compacted or summarized before, is not one of the messages.
+		replaced := messages[:n]
+		if isSummary(replaced[0].Message) {
+			replaced = replaced[1:]
+		}
+		archived = append(archived, replaced...)
+		// The summary takes the time of the last message it covers, and
+		// the secrets the model saw placeholders for.
+		summary := chatMessage{
+			Message: Message{Role: "user", Content: summaryPrefix + strings.TrimSpace(restoreOutgoing(res.Content))},
+			Time:    messages[n-1].Time,
+		}
+		messages = append([]chatMessage{summary}, messages[n:]...)
+	}
+	if err := archiveMessages(sessions, c.ID, archived); err != nil {
+		return err
+	}
+	c.Messages = messages
+	// Compacting is not using the session; keep its place in the "last" order.
+	return store.Save(c, time.Time{})
+}
@@ -0,0 +1,82 @@
+package main
+
+import "testing"
+
+// testTurns returns a conversation of n questions and answers, after a summary
+// if summarized is set.
+func testTurns(n int, summarized bool) []chatMessage {
+	var messages []chatMessage
+	if summarized {
+		messages = append(messages, newChatMessage("user", summaryPrefix+"earlier"))
+	}
+	for i := 0; i < n; i++ {
+		messages = append(messages, newChatMessage("user", "q"), newChatMessage("assistant", "a"))
+	}
+	return messages
+}
+
+func TestCompactCut(t *testing.T) {
+	tests := []struct {
+		name       string
+		messages   []chatMessage
+		keep, want int
+	}{
+		{"empty", nil, 2, 0},
+		{"fewer turns than kept", testTurns(2, false), 3, 0},
+		{"as many turns as kept", testTurns(3, false), 3, 0},
+		{"one turn more", testTurns(4, false), 3, 2},
+		{"many turns", testTurns(10, false), 1, 18},
+		{"summary and as many turns as kept", testTurns(3, true), 3, 0},
+		{"summary and one turn more", testTurns(4, true), 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := compactCut(tt.messages, tt.keep); got != tt.want {
+				t.Errorf("compactCut = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompactSessionTwice(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	cfgFile := ConfigFile{AskGPT: AskGPTConfig{URL: mockURL, Model: mockModel, Key: "mock", Provider: "mock"}}
+	client := providerClient(cfgFile)
+	store := fileStore{dir: t.TempDir()}
+	opts := taskOptions{noStream: true}
+
+	c := savedChat{Version: savedChatVersion, ID: "20260101-000000", Messages: testTurns(4, false)}
+	if err := compactSession(client, cfgFile, opts, store, SessionsConfig{}, c, 2); err != nil {
+		t.Fatalf("first compactSession: %v", err)
+	}
+	c, err := store.Load(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Messages = append(c.Messages, testTurns(2, false)...)
+	if err := compactSession(client, cfgFile, opts, store, SessionsConfig{}, c, 2); err != nil {
+		t.Fatalf("second compactSession: %v", err)
+	}
+
+	c, err = store.Load(c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Messages) != 5 || !isSummary(c.Messages[0].Message) {
+		t.Errorf("compacted session has %d messages, want a summary and 2 turns", len(c.Messages))
+	}
+	archived, err := readArchive(SessionsConfig{}, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both compactions replaced 2 turns; the summary the second replaced is
+	// not archived.
+	if len(archived) != 8 {
+		t.Errorf("archive has %d messages, want 8", len(archived))
+	}
+	for i, m := range archived {
+		if isSummary(m.Message) {
+			t.Errorf("archived message %d is a summary", i)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// subcommands lists the non-task commands offered by shell completion.
+var subcommands = []struct{ Name, Description string }{
+	{"show-config", "Show current configuration"},
+	{"set-url", "Set OpenAI API URL"},
+	{"set-model", "Set OpenAI Model"},
+	{"set-key", "Set OpenAI API Key"},
+	{"completion", "Generate completion script"},
+	{"integrate", "Add file-manager context menu entries"},
+	{"personas", "List personas"},
+	{"translate", "Translate files into several languages"},
+	{"edit", "Edit a file as instructed"},
+	{"commit-msg", "Write a commit message for the staged changes"},
+	{"pr-desc", "Write a pull request description for the branch"},
+	{"resume", "Continue a saved chat session"},
+	{"sessions", "Manage saved chat sessions"},
+	{"bookmarks", "List bookmarked turns"},
+	{"distill", "Turn a chat session into a task"},
+	{"export", "Export a chat session"},
+	{"import", "Import ChatGPT or Claude conversations"},
+	{"search", "Search saved chat sessions"},
+	{"memory", "Manage the notes sent with every chat"},
+	{"tokens", "Count the tokens of files"},
+	{"usage", "Report tokens and cost"},
+	{"image", "Generate images"},
+	{"transcribe", "Transcribe audio"},
+	{"tts", "Read text out loud"},
+	{"embed", "Print embeddings of text"},
+	{"index", "Index a directory of documents"},
+}
+
+// completionWords returns every command and task (including the user's own
+// tasks from config) with its description.
+func completionWords(cfg ConfigFile) [][2]string {
+	var words [][2]string
+	for _, c := range subcommands {
+		words = append(words, [2]string{c.Name, c.Description})
+	}
+	for _, t := range taskList(cfg) {
+		words = append(words, [2]string{t.Name, t.Task.Description})
+	}
+	return words
+}
+
+func bashCompletion(words [][2]string) string {
+	names := make([]string, len(words))
+	for i, w := range words {
+		names[i] = w[0]
+	}
+	return fmt.Sprintf(`_askgpt_completion() {
+    local cur prev opts
+    COMPREPLY=()
+    cur="${COMP_WORDS[COMP_CWORD]}"
+    prev="${COMP_WORDS[COMP_CWORD-1]}"
+    opts="%s"
+
+    if [[ ${COMP_CWORD} -eq 1 ]]; then
+        COMPREPLY=( $(compgen -W "${opts}" -- ${cur}) )
+        return 0
+    fi
+}
+complete -F _askgpt_completion askgpt
+`, strings.Join(names, " "))
+}
+
+func zshCompletion(words [][2]string) string {
+	var b strings.Builder
+	b.WriteString("#compdef askgpt\n\n_askgpt() {\n    local -a commands\n    commands=(\n")
+	for _, w := range words {
+		entry := strings.ReplaceAll(w[0], ":", `\:`) + ":" + w[1]
+		fmt.Fprintf(&b, "        '%s'\n", strings.ReplaceAll(entry, "'", `'\''`))
+	}
+	b.WriteString("    )\n    _describe -t commands 'commands' commands\n}\n\n_askgpt\n")
+	return b.String()
+}
+
+func fishCompletion(words [][2]string) string {
+	names := make([]string, len(words))
+	for i, w := range words {
+		names[i] = w[0]
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "set -l commands %s\n", strings.Join(names, " "))
+	b.WriteString("complete -c askgpt -f\n")
+	for _, w := range words {
+		fmt.Fprintf(&b, "complete -c askgpt -n \"not __fish_seen_subcommand_from $commands\" -a %s -d %s\n", fishQuote(w[0]), fishQuote(w[1]))
+	}
+	return b.String()
+}
+
+func fishQuote(s string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(s) + "'"
+}
+
+func runCompletion(shell string) int {
+	words := completionWords(loadConfigIfExists())
+	switch shell {
+	case "bash":
+		fmt.Print(bashCompletion(words))
+	case "zsh":
+		fmt.Print(zshCompletion(words))
+	case "fish":
+		fmt.Print(fishCompletion(words))
+	default:
+		fmt.Fprintf(os.Stderr, "Unsupported shell: %s. Supported: bash, zsh, fish\n", shell)
+		return 1
+	}
+	return 0
+}
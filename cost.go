@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"os"
+)
+
+// Price is what a model costs in US dollars per million tokens. The prices:
+// section of config.yaml adds to and overrides the built-in table, by model
+// name or name prefix:
+//
+//	prices:
+//	  gpt-4o: {input: 2.50, output: 10.00}
+//	  llama3: {input: 0, output: 0}
+type Price struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+// builtinPrices are the list prices of OpenAI's models at the time of
+// writing. They only feed estimates; the bill is what counts.
+var builtinPrices = map[string]Price{
+	"gpt-3.5-turbo": {0.50, 1.50},
+	"gpt-4":         {30.00, 60.00},
+	"gpt-4-turbo":   {10.00, 30.00},
+	"gpt-4o":        {2.50, 10.00},
+	"gpt-4o-mini":   {0.15, 0.60},
+	"gpt-4.1":       {2.00, 8.00},
+	"gpt-4.1-mini":  {0.40, 1.60},
+	"gpt-4.1-nano":  {0.10, 0.40},
+	"gpt-5":         {1.25, 10.00},
+	"gpt-5-mini":    {0.25, 2.00},
+	"gpt-5-nano":    {0.05, 0.40},
+	"gpt-image-1":   {5.00, 40.00},
+	"o1":            {15.00, 60.00},
+	"o1-mini":       {1.10, 4.40},
+	"o3":            {2.00, 8.00},
+	"o3-mini":       {1.10, 4.40},
+	"o4-mini":       {1.10, 4.40},
+
+	"text-embedding-3-small": {0.02, 0},
+	"text-embedding-3-large": {0.13, 0},
+	"text-embedding-ada-002": {0.10, 0},
+}
+
+// modelPrice returns the price of model, if it is known.
+func modelPrice(cfg ConfigFile, model string) (Price, bool) {
+	prices := maps.Clone(builtinPrices)
+	maps.Copy(prices, cfg.Prices)
+	return lookupModel(prices, model)
+}
+
+// usageCost returns the estimated cost of a request to model in dollars.
+// ok is false when the price of the model or the usage is not known.
+func usageCost(cfg ConfigFile, model string, u *Usage) (cost float64, ok bool) {
+	p, ok := modelPrice(cfg, model)
+	if !ok || u == nil {
+		return 0, false
+	}
+	return (float64(u.PromptTokens)*p.Input + float64(u.CompletionTokens)*p.Output) / 1e6, true
+}
+
+// formatCost prints a cost with enough digits to tell small requests apart.
+func formatCost(c float64) string {
+	if c < 0.01 {
+		return fmt.Sprintf("$%.4f", c)
+	}
+	return fmt.Sprintf("$%.2f", c)
+}
+
+// addCost adds the cost of a request to the session's total and, unless
+// quiet, prints it.
+func (s *chatSession) addCost(model string, u *Usage, quiet bool) {
+	cost, ok := usageCost(s.cfgFile, model, u)
+	if !ok {
+		return
+	}
+	s.cost += cost
+	if quiet || s.opts.noCost || s.opts.raw {
+		return
+	}
+	if s.opts.oneShot {
+		fmt.Fprintln(os.Stderr, paint(os.Stderr, colors.usage, "[cost] ~"+formatCost(cost)))
+		return
+	}
+	line := fmt.Sprintf("[cost] ~%s (session ~%s)", formatCost(cost), formatCost(s.cost))
+	fmt.Fprintln(os.Stderr, paint(os.Stderr, colors.usage, line))
+}
+
+// printSessionCost prints the total when a chat ends.
+func (s *chatSession) printSessionCost() {
+	if s.cost > 0 && !s.opts.noCost {
+		fmt.Fprintf(os.Stderr, "Estimated cost of this session: ~%s\n", formatCost(s.cost))
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// maxDiffCells bounds the size of the LCS table; texts beyond it are too long
+// for a word diff to be readable anyway.
+const maxDiffCells = 4_000_000
+
+// wordDiff returns b with the changes from a marked inline the way
+// `git diff --word-diff=plain` does: [-removed-] and {+added+}. ok is false
+// when the texts are too long to diff.
+func wordDiff(a, b string) (diff string, ok bool) {
+	x, y := splitWords(a), splitWords(b)
+	lcs, ok := lcsTable(x, y)
+	if !ok {
+		return "", false
+	}
+
+	var out, del, ins strings.Builder
+	flush := func() {
+		if del.Len() > 0 {
+			out.WriteString("[-" + del.String() + "-]")
+			del.Reset()
+		}
+		if ins.Len() > 0 {
+			out.WriteString("{+" + ins.String() + "+}")
+			ins.Reset()
+		}
+	}
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			flush()
+			out.WriteString(x[i])
+			i++
+			j++
+		case j < len(y) && (i == len(x) || lcs[i][j+1] >= lcs[i+1][j]):
+			ins.WriteString(y[j])
+			j++
+		default:
+			del.WriteString(x[i])
+			i++
+		}
+	}
+	flush()
+	return out.String(), true
+}
+
+// lcsTable returns the table whose [i][j] is the length of the longest
+// common subsequence of x[i:] and y[j:]. ok is false when it would be
+// larger than maxDiffCells.
+func lcsTable(x, y []string) (lcs [][]int32, ok bool) {
+	if (len(x)+1)*(len(y)+1) > maxDiffCells {
+		return nil, false
+	}
+	lcs = make([][]int32, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int32, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+	return lcs, true
+}
+
+// unifiedDiffContext is how many unchanged lines unifiedDiff shows around
+// a change.
+const unifiedDiffContext = 3
+
+// unifiedDiff returns the changes from old to updated as a unified diff of
+// the file name, as diff -u writes it. ok is false when the texts are too
+// long to diff.
+func unifiedDiff(name, old, updated string) (diff string, ok bool) {
+	a, b := splitLines(old), splitLines(updated)
+	lcs, ok := lcsTable(a, b)
+	if !ok {
+		return "", false
+	}
+	// ops are the lines of both, each after " ", "-" or "+"; aAt and bAt
+	// are how many lines of a and b come before each.
+	var ops []string
+	var aAt, bAt []int
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		aAt, bAt = append(aAt, i), append(bAt, j)
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			ops = append(ops, " "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			ops = append(ops, "-"+a[i])
+			i++
+		default:
+			ops = append(ops, "+"+b[j])
+			j++
+		}
+	}
+
+	var out strings.Builder
+	fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", name, name)
+	for k := 0; k < len(ops); {
+		if ops[k][0] == ' ' {
+			k++
+			continue
+		}
+		// A hunk runs from a few lines before a change to a few lines after
+		// the last change that is not far from the one before it.
+		start, end := max(k-unifiedDiffContext, 0), k
+		for end < len(ops) {
+			if ops[end][0] != ' ' {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run][0] == ' ' {
+				run++
+			}
+			if run == len(ops) || run-end > 2*unifiedDiffContext {
+				end = min(end+unifiedDiffContext, len(ops))
+				break
+			}
+			end = run
+		}
+		oldLines, newLines := 0, 0
+		for _, op := range ops[start:end] {
+			if op[0] != '+' {
+				oldLines++
+			}
+			if op[0] != '-' {
+				newLines++
+			}
+		}
+		oldStart, newStart := aAt[start], bAt[start]
+		if oldLines > 0 {
+			oldStart++
+		}
+		if newLines > 0 {
+			newStart++
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(oldStart, oldLines), hunkRange(newStart, newLines))
+		for _, op := range ops[start:end] {
+			out.WriteString(op + "\n")
+		}
+		k = end
+	}
+	return out.String(), true
+}
+
+// hunkRange formats the lines a hunk covers in its header, leaving out a
+// count of one as diff -u does.
+func hunkRange(start, lines int) string {
+	if lines == 1 {
+		return strconv.Itoa(start)
+	}
+	return fmt.Sprintf("%d,%d", start, lines)
+}
+
+// paintDiffLine colors a line of a unified diff for stderr: removed lines
+// as errors, added ones as the user's, and the rest of the markup dim.
+func paintDiffLine(line string) string {
+	switch {
+	case strings.HasPrefix(line, "---") || strings.HasPrefix(line, "+++") || strings.HasPrefix(line, "@@"):
+		return paint(os.Stderr, colors.usage, line)
+	case strings.HasPrefix(line, "-"):
+		return paint(os.Stderr, colors.err, line)
+	case strings.HasPrefix(line, "+"):
+		return paint(os.Stderr, colors.user, line)
+	}
+	return line
+}
+
+// splitWords splits s into runs of whitespace and of other characters, so
+// joining the parts gives s back. CJK characters are parts of their own, as
+// those scripts do not separate words with spaces.
+func splitWords(s string) []string {
+	var parts []string
+	start, prevSpace := 0, false
+	for i, r := range s {
+		space := unicode.IsSpace(r)
+		if i > start && (space != prevSpace || isCJK(r) || isCJK(lastRune(s[start:i]))) {
+			parts = append(parts, s[start:i])
+			start = i
+		}
+		prevSpace = space
+	}
+	if start < len(s) {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, unicode.Hangul)
+}
+
+func lastRune(s string) rune {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return r
+}
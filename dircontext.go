@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+const defaultContextBudget = 50000 // tokens
+
+// stringList is a flag that can be given several times.
+type stringList []string
+
+func (s *stringList) String() string { return strings.Join(*s, ",") }
+
+func (s *stringList) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+// dirContextOptions selects the files for buildDirContext.
+type dirContextOptions struct {
+	Dir     string
+	Include []string // if set, a file must match one of these
+	Exclude []string // gitignore syntax, on top of the .gitignore files
+	Budget  int      // token budget for the file contents
+}
+
+// dirContext is a directory rendered as a file map plus file contents.
+type dirContext struct {
+	Text    string
+	Files   int // files whose contents are included
+	Omitted int // files listed in the map only, as they did not fit the budget
+	Skipped int // binary files
+	Tokens  int
+}
+
+// buildDirContext walks opts.Dir, honoring .gitignore files and the include
+// and exclude patterns, and renders the text files it finds into a context of
+// at most opts.Budget tokens. Files that do not fit are still named in the
+// file map so the model knows they exist.
+func buildDirContext(opts dirContextOptions) (dirContext, error) {
+	var ctx dirContext
+	if fi, err := os.Stat(opts.Dir); err != nil {
+		return ctx, fmt.Errorf("cannot read directory %s: %w", opts.Dir, err)
+	} else if !fi.IsDir() {
+		return ctx, fmt.Errorf("%s is not a directory", opts.Dir)
+	}
+
+	var excludes ignoreList
+	for _, p := range opts.Exclude {
+		if r, ok := parseIgnoreLine("", p); ok {
+			excludes = append(excludes, r)
+		}
+	}
+	ignores := ignoreList{}
+
+	type entry struct {
+		rel     string
+		size    int
+		text    string
+		omitted bool
+	}
+	var entries []entry
+	used := 0
+	err := filepath.WalkDir(opts.Dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // skip unreadable entries
+		}
+		rel, _ := filepath.Rel(opts.Dir, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel != "." && (d.Name() == ".git" || ignores.ignored(rel, true) || excludes.ignored(rel, true)) {
+				return filepath.SkipDir
+			}
+			ignores = ignores.loadGitignore(p, rel)
+			return nil
+		}
+		if !d.Type().IsRegular() || ignores.ignored(rel, false) || excludes.ignored(rel, false) {
+			return nil
+		}
+		if len(opts.Include) > 0 && !matchesAny(opts.Include, rel) {
+			return nil
+		}
+
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		b = bytes.TrimPrefix(b, []byte{0xEF, 0xBB, 0xBF})
+		if bytes.ContainsRune(b, 0) || !utf8.Valid(b) {
+			ctx.Skipped++
+			return nil
+		}
+		e := entry{rel: rel, size: len(b), text: string(b)}
+		block := fenceFile(rel, e.text)
+		if t := estimateTokens(block); used+t <= opts.Budget {
+			used += t
+			ctx.Files++
+		} else {
+			e.omitted = true
+			ctx.Omitted++
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	if err != nil {
+		return ctx, fmt.Errorf("cannot read directory %s: %w", opts.Dir, err)
+	}
+	if len(entries) == 0 {
+		return ctx, fmt.Errorf("no text files found in %s", opts.Dir)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Directory: %s\nFile map (%d files):\n", opts.Dir, len(entries))
+	for _, e := range entries {
+		note := ""
+		if e.omitted {
+			note = ", contents omitted"
+		}
+		fmt.Fprintf(&b, "  %s (%s%s)\n", e.rel, formatBytes(e.size), note)
+	}
+	for _, e := range entries {
+		if !e.omitted {
+			b.WriteString("\n")
+			b.WriteString(fenceFile(e.rel, e.text))
+			b.WriteString("\n")
+		}
+	}
+	ctx.Text = strings.TrimRight(b.String(), "\n")
+	ctx.Tokens = estimateTokens(ctx.Text)
+	return ctx, nil
+}
+
+// matchesAny reports whether rel matches one of the patterns. A pattern
+// without "/" is matched against the file name, others against the whole
+// relative path ("**" allowed).
+func matchesAny(patterns []string, rel string) bool {
+	for _, p := range patterns {
+		if !strings.Contains(p, "/") {
+			if ok, _ := path.Match(p, path.Base(rel)); ok {
+				return true
+			}
+			continue
+		}
+		if matchSegments(strings.Split(strings.Trim(p, "/"), "/"), strings.Split(rel, "/")) {
+			return true
+		}
+	}
+	return false
+}
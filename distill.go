@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+const distillPrompt = "The conversation below worked out, by trial and correction, what the user wants. Write one " +
+	"reusable prompt that gets the final result in a single request: state the task, and every requirement, " +
+	"constraint, format and example the conversation settled on, as instructions. Leave out the dead ends and " +
+	"whatever was only about this one case. Where the material to work on goes, write {{input}} on a line by " +
+	"itself. On the first line write only a description of the prompt of at most 60 characters; after a blank " +
+	"line write the prompt. Write nothing else."
+
+// runDistill handles "askgpt distill": a session is turned into a prompt and
+// saved as the task file ~/.askgpt/tasks/<name>.tmpl, to run with
+// askgpt <name>.
+func runDistill(args []string) int {
+	fs := flag.NewFlagSet("distill", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	name := fs.String("name", "", "")
+	overwrite := fs.Bool("overwrite", false, "")
+	force := fs.Bool("force", false, "")
+	noRedact := fs.Bool("no-redact", false, "")
+
+	// Allow flags after the session id.
+	var refs []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		refs = append(refs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(refs) != 1 || *name == "" {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt distill <id|last> --name <task> [--overwrite]")
+		return 2
+	}
+	if !indexNameRe.MatchString(*name) {
+		errorf("invalid task name %q (use letters, digits, '.', '_' and '-')\n", *name)
+		return 2
+	}
+	if slices.ContainsFunc(subcommands, func(c struct{ Name, Description string }) bool { return c.Name == *name }) {
+		errorf("%s is an askgpt command, so a task of that name could not be run; choose another --name\n", *name)
+		return 2
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	path, err := taskFilePath(*name)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if _, exists := lookupTask(cfgFile, *name); exists && !*overwrite {
+		errorf("there is a task %s already; add --overwrite to replace it with %s\n", *name, path)
+		return 1
+	}
+	store, err := openSessionStore(cfgFile.Sessions)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	id, err := findSession(store, refs[0])
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	c, err := store.Load(id)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if countTurns(c.Messages) == 0 {
+		errorf("session %s has no turns to distill\n", id)
+		return 1
+	}
+
+	trackSpending(cfgFile, "distill", *force)
+	if _, err := useRedaction(cfgFile, *noRedact); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	sampling, err := resolveSampling(cfgFile, "distill", "", cfgFile.AskGPT.Model)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	opts := taskOptions{noStream: true, sampling: sampling}
+	client := apiClient(cfgFile)
+	cfg := cfgFile.AskGPT
+
+	// The requirements a conversation ends up with are in its last turns, so
+	// a conversation too long for the model loses its first ones.
+	room := contextWindow(cfgFile, cfg.Model) - defaultMaxToken - textTokens(cfg.Model, distillPrompt) - messageOverhead
+	messages, left := fitForDistill(cfg.Model, c.Messages, room)
+	if left > 0 {
+		warnf("session %s is too long for %s; its first %d turn(s) are left out\n", id, cfg.Model, left)
+	}
+	req := newChatRequest(cfg, distillRequest(messages), opts)
+	stop := startSpinner(opts)
+	res, err := sendChat(context.Background(), client, cfg, req, nil)
+	stop()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if res.FinishReason == "length" {
+		errorf("the prompt was truncated by the model's output limit\n")
+		return 1
+	}
+	description, prompt := prDescription(restoreOutgoing(res.Content))
+	if prompt == "" {
+		errorf("the answer has no prompt\n")
+		return 1
+	}
+	// A prompt that does not parse would only fail when the task runs.
+	if _, err := template.New("prompt").Funcs(template.FuncMap{"input": func() string { return "" }}).Parse(prompt); err != nil {
+		errorf("the prompt the model wrote is not a valid template: %v\n", err)
+		return 1
+	}
+
+	if err := writeTaskFile(path, description, c.Model, prompt); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Saved the prompt distilled from session %s to %s; run it with: askgpt %s\n", id, path, *name)
+	return 0
+}
+
+// fitForDistill returns the last of messages that fit in room tokens, after
+// the summary they start with if any, and how many turns were left out.
+func fitForDistill(model string, messages []chatMessage, room int) ([]chatMessage, int) {
+	var head []chatMessage
+	if len(messages) > 0 && isSummary(messages[0].Message) {
+		head, messages = messages[:1], messages[1:]
+	}
+	starts := turnStarts(apiMessages(messages))
+	if len(starts) == 0 {
+		return append(head, messages...), 0
+	}
+	room -= countTokens(model, apiMessages(head))
+	left := 0
+	// The last turn is always sent; a request too long with it fails.
+	for left < len(starts)-1 && countTokens(model, apiMessages(messages[starts[left]:])) > room {
+		left++
+	}
+	return append(head, messages[starts[left]:]...), left
+}
+
+// distillRequest asks for the prompt the conversation in messages worked
+// out, which it is given as a transcript like summaryRequest gives it.
+func distillRequest(messages []chatMessage) []Message {
+	return []Message{
+		{Role: "system", Content: distillPrompt},
+		{Role: "user", Content: conversationText(messages)},
+	}
+}
+
+// taskFilePath returns the file of the task called name.
+func taskFilePath(name string) (string, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(cfgPath), tasksDirName, name+taskFileExt), nil
+}
+
+// writeTaskFile writes a task file: the prompt after front matter with the
+// description and the model to run it with, when there is one.
+func writeTaskFile(path, description, model, prompt string) error {
+	meta, err := yaml.Marshal(struct {
+		Description string `yaml:"description,omitempty"`
+		Model       string `yaml:"model,omitempty"`
+	}{description, model})
+	if err != nil {
+		return err
+	}
+	content := frontMatterLine + "\n" + string(meta) + frontMatterLine + "\n" + prompt + "\n"
+	if err := os.MkdirAll(filepath.Dir(path), configDirPerm); err != nil {
+		return fmt.Errorf("cannot create tasks directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(content), configFilePerm); err != nil {
+		return fmt.Errorf("cannot write task %s: %w", path, err)
+	}
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"unicode"
+
+	"github.com/ledongthuc/pdf"
+)
+
+// maxDocumentPart is how much of a single file inside a DOCX, ODT or EPUB
+// archive is read, against archives that unpack to far more than they
+// weigh.
+const maxDocumentPart = 64 << 20
+
+// documentText returns the text of b when it is a document askgpt can
+// read, with ok set: a PDF, a Word (DOCX) or OpenDocument (ODT) text, or an
+// EPUB book. Anything else is left to decodeTextInput.
+func documentText(name string, b []byte) (text string, ok bool, err error) {
+	if bytes.HasPrefix(b, []byte("%PDF-")) {
+		text, err = pdfText(name, b)
+		return text, true, err
+	}
+	if !bytes.HasPrefix(b, []byte("PK\x03\x04")) {
+		return "", false, nil
+	}
+	z, err := zip.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", false, nil
+	}
+	files := map[string]*zip.File{}
+	for _, f := range z.File {
+		files[f.Name] = f
+	}
+	var kind string
+	switch {
+	case files["word/document.xml"] != nil:
+		kind = "a Word document"
+		text, err = xmlFileText(files, "word/document.xml", docxRules)
+	case strings.HasPrefix(zipFileHead(files, "mimetype"), "application/vnd.oasis.opendocument.text"):
+		kind = "an OpenDocument text"
+		text, err = xmlFileText(files, "content.xml", odtRules)
+	case files["META-INF/container.xml"] != nil:
+		kind = "an EPUB book"
+		text, err = epubText(files)
+	default:
+		return "", false, nil
+	}
+	if err != nil {
+		return "", true, fmt.Errorf("cannot read %s: %w", name, err)
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", true, errors.New(name + " has no text to extract")
+	}
+	fmt.Fprintf(os.Stderr, "Note: %s is %s, extracted its text.\n", name, kind)
+	return text, true, nil
+}
+
+// pdfText extracts the text of a PDF page by page, in reading order from
+// the top of each page, with a "[Page n]" line before each page.
+func pdfText(name string, b []byte) (text string, err error) {
+	// The PDF reader panics on some malformed files.
+	defer func() {
+		if r := recover(); r != nil {
+			text, err = "", fmt.Errorf("cannot read PDF %s: %v", name, r)
+		}
+	}()
+	r, err := pdf.NewReader(bytes.NewReader(b), int64(len(b)))
+	if err != nil {
+		return "", fmt.Errorf("cannot read PDF %s: %w", name, err)
+	}
+
+	var out strings.Builder
+	pages, empty := r.NumPage(), true
+	for i := 1; i <= pages; i++ {
+		p := r.Page(i)
+		if p.V.IsNull() {
+			continue
+		}
+		rows, err := p.GetTextByRow()
+		if err != nil {
+			return "", fmt.Errorf("cannot read page %d of PDF %s: %w", i, name, err)
+		}
+		fmt.Fprintf(&out, "[Page %d]\n", i)
+		for _, row := range rows {
+			var line strings.Builder
+			for _, t := range row.Content {
+				line.WriteString(t.S)
+			}
+			if s := strings.TrimSpace(line.String()); s != "" {
+				out.WriteString(s + "\n")
+				empty = false
+			}
+		}
+		out.WriteString("\n")
+	}
+	if empty {
+		return "", errors.New(name + " has no text to extract; if it is scanned, run OCR on it first")
+	}
+	fmt.Fprintf(os.Stderr, "Note: %s is a PDF, extracted the text of its %d page(s).\n", name, pages)
+	return out.String(), nil
+}
+
+// xmlRules says how the elements of an XML document, by local name, turn
+// into plain text: blocks end a line, chars stand for the given text, and
+// skip is left out with everything inside.
+type xmlRules struct {
+	blocks map[string]bool
+	chars  map[string]string
+	skip   map[string]bool
+}
+
+var (
+	docxRules = xmlRules{
+		blocks: map[string]bool{"p": true},
+		chars:  map[string]string{"tab": "\t", "br": "\n", "cr": "\n"},
+		skip:   map[string]bool{"instrText": true, "delText": true},
+	}
+	odtRules = xmlRules{
+		blocks: map[string]bool{"p": true, "h": true},
+		chars:  map[string]string{"tab": "\t", "s": " ", "line-break": "\n"},
+		skip:   map[string]bool{"tracked-changes": true},
+	}
+	htmlRules = xmlRules{
+		blocks: map[string]bool{"p": true, "div": true, "li": true, "tr": true, "blockquote": true, "pre": true,
+			"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true},
+		chars: map[string]string{"br": "\n", "td": "\t", "th": "\t"},
+		skip:  map[string]bool{"head": true, "script": true, "style": true},
+	}
+)
+
+// xmlText returns the text of an XML or XHTML document as rules say, with
+// runs of white space collapsed and blank lines between blocks.
+func xmlText(r io.Reader, rules xmlRules) (string, error) {
+	d := xml.NewDecoder(r)
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	var out strings.Builder
+	skipping := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			switch {
+			case skipping > 0 || rules.skip[t.Name.Local]:
+				skipping++
+			case rules.chars[t.Name.Local] != "":
+				out.WriteString(rules.chars[t.Name.Local])
+			}
+		case xml.EndElement:
+			switch {
+			case skipping > 0:
+				skipping--
+			case rules.blocks[t.Name.Local]:
+				out.WriteString("\n\n")
+			}
+		case xml.CharData:
+			if skipping > 0 {
+				break
+			}
+			s := strings.Join(strings.Fields(string(t)), " ")
+			if len(t) > 0 && unicode.IsSpace(rune(t[0])) && !strings.HasSuffix(out.String(), " ") {
+				out.WriteString(" ")
+			}
+			out.WriteString(s)
+			if s != "" && unicode.IsSpace(rune(t[len(t)-1])) {
+				out.WriteString(" ")
+			}
+		}
+	}
+	return tidyLines(out.String()), nil
+}
+
+// tidyLines trims the lines of s and leaves at most one blank line in a row.
+func tidyLines(s string) string {
+	var out strings.Builder
+	blank := true
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" && blank {
+			continue
+		}
+		out.WriteString(line + "\n")
+		blank = line == ""
+	}
+	return strings.TrimRight(out.String(), "\n") + "\n"
+}
+
+func openZipFile(files map[string]*zip.File, name string) (io.ReadCloser, error) {
+	f := files[name]
+	if f == nil {
+		return nil, fmt.Errorf("%s is missing", name)
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(rc, maxDocumentPart), rc}, nil
+}
+
+// zipFileHead returns the first bytes of a file in the archive, or "".
+func zipFileHead(files map[string]*zip.File, name string) string {
+	rc, err := openZipFile(files, name)
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+	b := make([]byte, 64)
+	n, _ := io.ReadFull(rc, b)
+	return string(b[:n])
+}
+
+func xmlFileText(files map[string]*zip.File, name string, rules xmlRules) (string, error) {
+	rc, err := openZipFile(files, name)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	return xmlText(rc, rules)
+}
+
+// epubText returns the text of the chapters of an EPUB book in reading
+// order, as its package document lists them.
+func epubText(files map[string]*zip.File) (string, error) {
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xmlFileDecode(files, "META-INF/container.xml", &container); err != nil {
+		return "", err
+	}
+	if len(container.Rootfiles) == 0 {
+		return "", errors.New("the book lists no package document")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	var pkg struct {
+		Manifest []struct {
+			ID   string `xml:"id,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"manifest>item"`
+		Spine []struct {
+			IDRef string `xml:"idref,attr"`
+		} `xml:"spine>itemref"`
+	}
+	if err := xmlFileDecode(files, opfPath, &pkg); err != nil {
+		return "", err
+	}
+	hrefs := map[string]string{}
+	for _, item := range pkg.Manifest {
+		hrefs[item.ID] = item.Href
+	}
+	var chapters []string
+	for _, ref := range pkg.Spine {
+		href, err := url.PathUnescape(hrefs[ref.IDRef])
+		if err != nil || href == "" {
+			continue
+		}
+		text, err := xmlFileText(files, path.Join(path.Dir(opfPath), href), htmlRules)
+		if err != nil {
+			return "", err
+		}
+		if strings.TrimSpace(text) != "" {
+			chapters = append(chapters, text)
+		}
+	}
+	return strings.Join(chapters, "\n"), nil
+}
+
+func xmlFileDecode(files map[string]*zip.File, name string, v any) error {
+	rc, err := openZipFile(files, name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	if err := xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("cannot parse %s: %w", name, err)
+	}
+	return nil
+}
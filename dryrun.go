@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// errDryRun stops a request that --dry-run has printed.
+var errDryRun = errors.New("dry run: the request was not sent")
+
+// dryRunTransport prints the first request instead of sending it, for
+// --dry-run: the endpoint, the headers with the key masked, and the body.
+type dryRunTransport struct {
+	out io.Writer
+}
+
+func (t dryRunTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	fmt.Fprintf(t.out, "%s %s\n", req.Method, req.URL)
+	var names []string
+	for name := range req.Header {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, v := range req.Header[name] {
+			fmt.Fprintf(t.out, "%s: %s\n", name, maskHeader(name, v))
+		}
+	}
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, b, "", "  ") == nil {
+			b = pretty.Bytes()
+		}
+		fmt.Fprintf(t.out, "\n%s\n", b)
+	}
+	return nil, errDryRun
+}
+
+// maskHeader hides the secret in the value of an authentication header,
+// keeping enough of it to tell which key it is.
+func maskHeader(name, value string) string {
+	switch strings.ToLower(name) {
+	case "authorization", "api-key", "x-api-key", "proxy-authorization":
+	default:
+		return value
+	}
+	scheme, secret, ok := strings.Cut(value, " ")
+	if !ok {
+		scheme, secret = "", value
+	} else {
+		scheme += " "
+	}
+	if len(secret) <= 12 {
+		return scheme + strings.Repeat("*", len(secret))
+	}
+	return scheme + secret[:3] + "..." + secret[len(secret)-4:]
+}
+
+// exitIfDryRun ends a --dry-run once its request has been printed.
+func exitIfDryRun(err error) {
+	if errors.Is(err, errDryRun) {
+		fmt.Fprintln(os.Stderr, "(dry run: nothing was sent)")
+		exit(0)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+func runEdit(args []string) int {
+	fs := flag.NewFlagSet("edit", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	var yes bool
+	fs.BoolVar(&yes, "y", false, "")
+	fs.BoolVar(&yes, "yes", false, "")
+	asDiff := fs.Bool("diff", false, "")
+	force := fs.Bool("force", false, "")
+	noRedact := fs.Bool("no-redact", false, "")
+
+	// Allow flags after the file and the instruction, like task mode does.
+	var words []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(words) < 2 {
+		fmt.Fprintln(os.Stderr, `Usage: askgpt edit <file> "instruction" [--diff] [-y] [--no-redact]`)
+		return 2
+	}
+	name, instruction := words[0], strings.Join(words[1:], " ")
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		errorf("cannot read %s: %v\n", name, unwrapPathError(err))
+		return 1
+	}
+	// The file is written back as it is read, so it has to be UTF-8 already.
+	if bytes.ContainsRune(b, 0) || !utf8.Valid(b) {
+		errorf("%s is not a UTF-8 text file\n", name)
+		return 1
+	}
+	fi, err := os.Stat(name)
+	if err != nil {
+		errorf("%v\n", unwrapPathError(err))
+		return 1
+	}
+	old := string(b)
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "edit", *force)
+	if _, err := useRedaction(cfgFile, *noRedact); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	sampling, err := resolveSampling(cfgFile, "edit", "", cfgFile.AskGPT.Model)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	opts := taskOptions{noStream: true, sampling: sampling}
+	updated, err := editFile(apiClient(cfgFile), cfgFile.AskGPT, opts, name, old, instruction, *asDiff)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if updated == old {
+		fmt.Fprintln(os.Stderr, "No changes.")
+		return 0
+	}
+
+	if diff, ok := unifiedDiff(name, old, updated); ok {
+		for _, l := range strings.Split(strings.TrimSuffix(diff, "\n"), "\n") {
+			fmt.Fprintln(os.Stderr, paintDiffLine(l))
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "%s is too long to show the changes; it goes from %d to %d lines.\n",
+			name, len(splitLines(old)), len(splitLines(updated)))
+	}
+	if !yes {
+		if err := askYesNo(fmt.Sprintf("Write the changes to %s?", name)); err != nil {
+			if errors.Is(err, errDeclined) {
+				fmt.Fprintln(os.Stderr, "Not written.")
+				return 0
+			}
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+
+	backup := name + ".bak"
+	if err := os.WriteFile(backup, b, fi.Mode().Perm()); err != nil {
+		errorf("cannot write %s: %v\n", backup, unwrapPathError(err))
+		return 1
+	}
+	if err := os.WriteFile(name, []byte(updated), fi.Mode().Perm()); err != nil {
+		errorf("cannot write %s: %v\n", name, unwrapPathError(err))
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Wrote %s (the old version is in %s)\n", name, backup)
+	return 0
+}
+
+// editFile asks the model to change text, the content of the file name, as
+// the instruction says, and returns the revised text. With asDiff the model
+// answers with a unified diff instead of the whole file, which is shorter
+// for small changes to long files.
+func editFile(client *http.Client, cfg AskGPTConfig, opts taskOptions, name, text, instruction string, asDiff bool) (string, error) {
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Edit the file %s as the instruction says. Change nothing else.\n", name)
+	if asDiff {
+		fmt.Fprintf(&prompt, "Answer with only a unified diff of the change, with --- a/%s and +++ b/%s lines, in one ```diff code block.\n", name, name)
+	} else {
+		prompt.WriteString("Answer with only the whole revised file, in one code block.\n")
+	}
+	fmt.Fprintf(&prompt, "\nInstruction: %s\n\n---\n\n%s", instruction, text)
+
+	req := newChatRequest(cfg, []Message{{Role: "user", Content: prompt.String()}}, opts)
+	req.MaxTokens = 0 // the whole file may come back; let the provider use its limit
+	stop := startSpinner(opts)
+	res, err := sendChat(context.Background(), client, cfg, req, nil)
+	stop()
+	if err != nil {
+		return "", err
+	}
+	if res.FinishReason == "length" {
+		return "", errors.New("the revised file was truncated by the model's output limit; try --diff")
+	}
+	// The model saw placeholders for the secrets in the file, which must not
+	// end up in it.
+	answer := restoreOutgoing(res.Content)
+
+	// Whichever the model answers with is taken, asked for or not.
+	if diff, ok := findDiff(answer); ok {
+		patches, err := parseDiff(diff)
+		if err != nil {
+			return "", err
+		}
+		var hunks []hunk
+		for _, p := range patches {
+			hunks = append(hunks, p.hunks...)
+		}
+		return applyHunks(name, text, hunks)
+	}
+	// The longest code block is the file; a model that left out the fence
+	// answered with the file alone.
+	var updated string
+	blocks := codeBlocks(answer)
+	for _, block := range blocks {
+		if len(block) > len(updated) {
+			updated = block
+		}
+	}
+	if len(blocks) == 0 {
+		updated = strings.TrimSpace(answer)
+	}
+	if updated == "" {
+		return "", errors.New("the answer has no revised file")
+	}
+	updated = strings.TrimRight(updated, "\n")
+	if strings.HasSuffix(text, "\n") {
+		updated += "\n"
+	}
+	return updated, nil
+}
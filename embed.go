@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+const (
+	defaultEmbeddingModel = "text-embedding-3-small"
+	// defaultEmbeddingBatch is how many inputs go in one request.
+	defaultEmbeddingBatch = 100
+	// maxEmbeddingInput is the most tokens the embedding models take in one
+	// input, and maxEmbeddingBatchTokens in one request.
+	maxEmbeddingInput       = 8191
+	maxEmbeddingBatchTokens = 300000
+)
+
+// EmbeddingsConfig is the embeddings: section of config.yaml: the model
+// askgpt embed uses, and the size of its vectors for models that can
+// shorten them.
+//
+//	embeddings:
+//	  model: text-embedding-3-large
+//	  dimensions: 1024
+type EmbeddingsConfig struct {
+	Model      string `yaml:"model,omitempty"`
+	Dimensions int    `yaml:"dimensions,omitempty"`
+}
+
+type embeddingRequest struct {
+	Model      string   `json:"model"`
+	Input      []string `json:"input"`
+	Dimensions int      `json:"dimensions,omitempty"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Index     int       `json:"index"`
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+	Usage *Usage `json:"usage"`
+}
+
+// embedding is a vector askgpt embed prints: the input it is of, by name,
+// and with --lines the line number and text.
+type embedding struct {
+	Source    string    `json:"source"`
+	Line      int       `json:"line,omitempty"`
+	Text      string    `json:"text,omitempty"`
+	Embedding []float32 `json:"embedding"`
+}
+
+// embedTexts returns the embeddings of texts, sent in batches of at most
+// batch inputs. progress, when set, is called after every batch with the
+// number of texts done.
+func embedTexts(ctx context.Context, client *http.Client, cfg ConfigFile, texts []string, batch int, progress func(done int)) ([][]float32, error) {
+	model := cfg.Embeddings.Model
+	if model == "" {
+		model = defaultEmbeddingModel
+	}
+	if batch <= 0 {
+		batch = defaultEmbeddingBatch
+	}
+	vectors := make([][]float32, 0, len(texts))
+	for start := 0; start < len(texts); {
+		end, tokens := start, 0
+		for end < len(texts) && end-start < batch {
+			n := textTokens(model, texts[end])
+			if n > maxEmbeddingInput {
+				return nil, fmt.Errorf("input %d is %d tokens, over the %d %s takes", end+1, n, maxEmbeddingInput, model)
+			}
+			if end > start && tokens+n > maxEmbeddingBatchTokens {
+				break
+			}
+			tokens += n
+			end++
+		}
+		got, err := embedBatch(ctx, client, cfg.AskGPT, embeddingRequest{
+			Model: model, Input: texts[start:end], Dimensions: cfg.Embeddings.Dimensions,
+		})
+		if err != nil {
+			return nil, err
+		}
+		vectors = append(vectors, got...)
+		start = end
+		if progress != nil {
+			progress(start)
+		}
+	}
+	return vectors, nil
+}
+
+// embedBatch sends one request to the embeddings endpoint and returns the
+// vectors in the order of req.Input.
+func embedBatch(ctx context.Context, client *http.Client, cfg AskGPTConfig, req embeddingRequest) ([][]float32, error) {
+	if err := checkBudget(); err != nil {
+		return nil, err
+	}
+	req.Input = slices.Clone(req.Input)
+	for i := range req.Input {
+		req.Input[i] = redactOutgoing(req.Input[i])
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doAPIRequest(ctx, client, cfg, apiEndpoint(cfg, "embeddings"), "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("cannot decode response: %w", err)
+	}
+	var messages []Message
+	if out.Usage == nil {
+		for _, in := range req.Input {
+			messages = append(messages, Message{Role: "user", Content: in})
+		}
+	}
+	recordUsage(req.Model, out.Usage, messages, "")
+
+	vectors := make([][]float32, len(req.Input))
+	for _, d := range out.Data {
+		if d.Index >= 0 && d.Index < len(vectors) {
+			vectors[d.Index] = d.Embedding
+		}
+	}
+	for _, v := range vectors {
+		if v == nil {
+			return nil, errors.New("the response is missing embeddings")
+		}
+	}
+	return vectors, nil
+}
+
+// runEmbed handles "askgpt embed [file|-]...": it prints the embedding of
+// every file, or of every line with --lines, as JSON or JSON Lines.
+func runEmbed(args []string) int {
+	fs := flag.NewFlagSet("embed", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	model := fs.String("model", "", "")
+	dimensions := fs.Int("dimensions", 0, "")
+	format := fs.String("format", "jsonl", "")
+	lines := fs.Bool("lines", false, "")
+	batch := fs.Int("batch", defaultEmbeddingBatch, "")
+	force := fs.Bool("force", false, "")
+
+	// Allow flags after the files.
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) == 0 {
+		if isTerminal(os.Stdin) {
+			fmt.Fprintln(os.Stderr, "Usage: askgpt embed <file|-> ... [--lines] [--format json|jsonl] [--model name] [--dimensions n]")
+			return 2
+		}
+		files = []string{"-"}
+	}
+	if *format != "json" && *format != "jsonl" {
+		errorf("unknown format %q (use json or jsonl)\n", *format)
+		return 2
+	}
+
+	var inputs []embedding
+	var texts []string
+	for _, name := range files {
+		var b []byte
+		var err error
+		if name == "-" {
+			b, err = io.ReadAll(os.Stdin)
+			name = "stdin"
+		} else {
+			b, err = os.ReadFile(name)
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		text, err := decodeTextInput(name, b, false)
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		if !*lines {
+			if strings.TrimSpace(text) != "" {
+				inputs = append(inputs, embedding{Source: name})
+				texts = append(texts, text)
+			}
+			continue
+		}
+		for i, line := range strings.Split(text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				inputs = append(inputs, embedding{Source: name, Line: i + 1, Text: line})
+				texts = append(texts, line)
+			}
+		}
+	}
+	if len(texts) == 0 {
+		fmt.Fprintln(os.Stderr, "No input received.")
+		return 1
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "embed", *force)
+	if *model != "" {
+		cfgFile.Embeddings.Model = *model
+	}
+	if *dimensions > 0 {
+		cfgFile.Embeddings.Dimensions = *dimensions
+	}
+	client := apiClient(cfgFile)
+	var progress func(int)
+	if len(texts) > *batch {
+		progress = func(done int) {
+			fmt.Fprintf(os.Stderr, "[embed] %d of %d inputs embedded\n", done, len(texts))
+		}
+	}
+	vectors, err := embedTexts(context.Background(), client, cfgFile, texts, *batch, progress)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	for i := range inputs {
+		inputs[i].Embedding = vectors[i]
+	}
+
+	// Both formats keep one vector to a line; a JSON array just wraps them.
+	sep, end := "\n", ""
+	if *format == "json" {
+		fmt.Print("[\n")
+		sep, end = ",\n", "]\n"
+	}
+	for i, in := range inputs {
+		b, err := json.Marshal(in)
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		if i == len(inputs)-1 && *format == "json" {
+			sep = "\n"
+		}
+		fmt.Print(string(b), sep)
+	}
+	fmt.Print(end)
+	return 0
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// answerEnvelope is what --output json prints for each answer, on one
+// line, so programs get the answer with its metadata instead of scraping
+// text. ID is the completion's id and RequestID the provider's request id,
+// when they are given.
+type answerEnvelope struct {
+	Content      string `json:"content"`
+	Model        string `json:"model"`
+	FinishReason string `json:"finish_reason,omitempty"`
+	Usage        *Usage `json:"usage,omitempty"`
+	LatencyMS    int64  `json:"latency_ms"`
+	ID           string `json:"id,omitempty"`
+	RequestID    string `json:"request_id,omitempty"`
+}
+
+// printEnvelope prints the envelope of an answer that took latency.
+func printEnvelope(t turn, res chatResult, latency time.Duration) {
+	env := answerEnvelope{
+		Content:      res.Content,
+		Model:        res.Model,
+		FinishReason: res.FinishReason,
+		Usage:        res.Usage,
+		LatencyMS:    latency.Milliseconds(),
+		ID:           res.ID,
+		RequestID:    res.RequestID,
+	}
+	if env.Model == "" {
+		env.Model = t.cfg.Model
+	}
+	if t.opts.restore != nil {
+		env.Content = t.opts.restore.restore(env.Content)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(env); err != nil {
+		errorf("%v\n", err)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"html"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const exportTimeFormat = "2006-01-02 15:04"
+
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	format := fs.String("format", "", "")
+	output := fs.String("o", "", "")
+	fs.StringVar(output, "output", "", "")
+
+	// Allow flags after the session id.
+	var refs []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		refs = append(refs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(refs) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt export [id|last] [--format md|json|html] [-o file]")
+		return 2
+	}
+	ref := "last"
+	if len(refs) == 1 {
+		ref = refs[0]
+	}
+	if *format == "" {
+		// Without --format, the output file's extension decides.
+		*format = "md"
+		switch strings.ToLower(filepath.Ext(*output)) {
+		case ".json":
+			*format = "json"
+		case ".html", ".htm":
+			*format = "html"
+		}
+	}
+
+	store, err := openConfiguredStore()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	id, err := findSession(store, ref)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	c, err := store.Load(id)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+
+	var out string
+	switch *format {
+	case "md", "markdown":
+		out = exportMarkdown(c)
+	case "json":
+		b, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		out = string(b) + "\n"
+	case "html":
+		out = exportHTML(c)
+	default:
+		errorf("unknown format %q (use md, json or html)\n", *format)
+		return 2
+	}
+
+	if *output == "" {
+		fmt.Print(out)
+		return 0
+	}
+	if err := os.WriteFile(*output, []byte(out), 0o644); err != nil {
+		errorf("cannot write %s: %v\n", *output, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Exported session %s to %s\n", c.ID, *output)
+	return 0
+}
+
+func roleName(role string) string {
+	if role == "assistant" {
+		return "Assistant"
+	}
+	return "You"
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Local().Format(exportTimeFormat)
+}
+
+// exportDetails returns the session's header fields, in order.
+func exportDetails(c savedChat) [][2]string {
+	details := [][2]string{{"Session", c.ID}}
+	if t := formatTime(c.CreatedAt); t != "" {
+		details = append(details, [2]string{"Created", t})
+	}
+	details = append(details, [2]string{"Model", c.Model})
+	if c.Persona != "" {
+		details = append(details, [2]string{"Persona", c.Persona})
+	}
+	if c.System != "" {
+		details = append(details, [2]string{"System prompt", c.System})
+	}
+	return details
+}
+
+// exportMarkdown writes the conversation as Markdown. Messages are copied
+// verbatim, so their code blocks stay fenced.
+func exportMarkdown(c savedChat) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", sessionTitle(c.Title, c.Messages))
+	for _, d := range exportDetails(c) {
+		fmt.Fprintf(&b, "- **%s:** %s\n", d[0], d[1])
+	}
+	for _, m := range c.Messages {
+		fmt.Fprintf(&b, "\n## %s", roleName(m.Role))
+		if t := formatTime(m.Time); t != "" {
+			fmt.Fprintf(&b, " · %s", t)
+		}
+		fmt.Fprintf(&b, "\n\n%s\n", strings.TrimRight(m.Content, "\n"))
+	}
+	return b.String()
+}
+
+// exportHTML writes the conversation as a standalone HTML page. Fenced code
+// blocks become <pre> blocks; other text keeps its line breaks.
+func exportHTML(c savedChat) string {
+	title := html.EscapeString(sessionTitle(c.Title, c.Messages))
+	var b strings.Builder
+	fmt.Fprintf(&b, `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>%s</title>
+<style>
+body { font-family: system-ui, sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; line-height: 1.5; color: #222; }
+.details { color: #666; font-size: 0.9em; }
+.message { border-top: 1px solid #ddd; padding: 0.5em 0; }
+.message h2 { font-size: 1em; margin: 0.5em 0; }
+.message h2 span { color: #888; font-weight: normal; }
+.assistant h2 { color: #0b6e4f; }
+.text { white-space: pre-wrap; margin: 0.5em 0; }
+pre { background: #f5f5f5; padding: 0.75em; overflow-x: auto; }
+</style>
+</head>
+<body>
+<h1>%s</h1>
+<ul class="details">
+`, title, title)
+	for _, d := range exportDetails(c) {
+		fmt.Fprintf(&b, "<li><b>%s:</b> %s</li>\n", d[0], html.EscapeString(d[1]))
+	}
+	b.WriteString("</ul>\n")
+	for _, m := range c.Messages {
+		fmt.Fprintf(&b, "<div class=\"message %s\">\n<h2>%s", html.EscapeString(m.Role), roleName(m.Role))
+		if t := formatTime(m.Time); t != "" {
+			fmt.Fprintf(&b, " <span>%s</span>", t)
+		}
+		b.WriteString("</h2>\n")
+		for _, block := range splitFences(m.Content) {
+			if block.code {
+				class := ""
+				if block.lang != "" {
+					class = fmt.Sprintf(` class="language-%s"`, html.EscapeString(block.lang))
+				}
+				fmt.Fprintf(&b, "<pre><code%s>%s</code></pre>\n", class, html.EscapeString(block.text))
+			} else if strings.TrimSpace(block.text) != "" {
+				fmt.Fprintf(&b, "<div class=\"text\">%s</div>\n", html.EscapeString(strings.Trim(block.text, "\n")))
+			}
+		}
+		b.WriteString("</div>\n")
+	}
+	b.WriteString("</body>\n</html>\n")
+	return b.String()
+}
+
+// textBlock is a run of plain text or a fenced code block.
+type textBlock struct {
+	text string
+	code bool
+	lang string
+}
+
+// splitFences splits Markdown text into plain text and fenced code blocks.
+// An unclosed fence runs to the end of the text.
+func splitFences(text string) []textBlock {
+	var blocks []textBlock
+	var cur []string
+	var fence, lang string
+	flush := func(code bool) {
+		blocks = append(blocks, textBlock{text: strings.Join(cur, "\n"), code: code, lang: lang})
+		cur = nil
+	}
+	for _, line := range strings.Split(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if fence == "" {
+			if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+				flush(false)
+				fence = trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, trimmed[:1]))]
+				lang = strings.TrimSpace(trimmed[len(fence):])
+				continue
+			}
+		} else if strings.HasPrefix(trimmed, fence) && strings.Trim(trimmed, fence[:1]) == "" {
+			flush(true)
+			fence, lang = "", ""
+			continue
+		}
+		cur = append(cur, line)
+	}
+	flush(fence != "")
+	return blocks
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// confirmTokens is the size of a message above which it needs
+// confirmation (or --yes) before it is sent, unless large_input says
+// otherwise.
+const confirmTokens = 20000
+
+// LargeInputConfig is the large_input: section of config.yaml: messages
+// larger than either limit, such as a whole log file piped in, are only
+// sent after confirmation, or with --yes when there is nobody to ask.
+//
+//	large_input:
+//	  tokens: 20000
+//	  bytes: 500000   # off by default
+type LargeInputConfig struct {
+	Tokens int `yaml:"tokens,omitempty"`
+	Bytes  int `yaml:"bytes,omitempty"`
+}
+
+// attachment is a file added to the message.
+type attachment struct {
+	Name string
+	Text string
+}
+
+// messageFromArgs builds the message from positional arguments. Arguments
+// naming existing files, or glob patterns matching some, are attached with
+// their contents; the other arguments are joined as the text of the message.
+func messageFromArgs(args []string, forceBase64 bool) (string, []attachment, error) {
+	var words []string
+	var files []attachment
+	seen := map[string]bool{}
+	for _, a := range args {
+		paths := []string{a}
+		if fi, err := os.Stat(a); err != nil || !fi.Mode().IsRegular() {
+			paths = nil
+			if hasGlobMeta(a) {
+				var err error
+				if paths, err = expandGlob(a); err != nil {
+					return "", nil, err
+				}
+			}
+		}
+		// Text that is neither a file nor a matching pattern, e.g. "why?".
+		if len(paths) == 0 {
+			words = append(words, a)
+			continue
+		}
+		for _, p := range paths {
+			if seen[p] {
+				continue
+			}
+			seen[p] = true
+			b, err := os.ReadFile(p)
+			if err != nil {
+				return "", nil, fmt.Errorf("cannot read input %s: %w", p, err)
+			}
+			text, err := decodeTextInput(p, b, forceBase64)
+			if err != nil {
+				return "", nil, err
+			}
+			files = append(files, attachment{Name: p, Text: text})
+		}
+	}
+
+	var blocks []string
+	if len(words) > 0 {
+		blocks = append(blocks, strings.Join(words, " "))
+	}
+	for _, f := range files {
+		blocks = append(blocks, fenceFile(f.Name, f.Text))
+	}
+	return strings.Join(blocks, "\n\n"), files, nil
+}
+
+// fenceFile labels content with its file name and puts it in a Markdown code
+// fence that is longer than any backtick run inside it.
+func fenceFile(name, content string) string {
+	fence := "```"
+	for strings.Contains(content, fence) {
+		fence += "`"
+	}
+	return fmt.Sprintf("File: %s\n%s\n%s\n%s", name, fence, strings.TrimRight(content, "\n"), fence)
+}
+
+// estimateTokens is a rough token count, about four bytes per token for
+// English text and code.
+func estimateTokens(s string) int {
+	return (len(s) + 3) / 4
+}
+
+// reportAttachments prints the size of the attached files. Whether the
+// message is too large to send without asking is up to confirmLargeInput.
+func reportAttachments(files []attachment, message string) {
+	if len(files) == 0 {
+		return
+	}
+	size := 0
+	for _, f := range files {
+		size += len(f.Text)
+	}
+	fmt.Fprintf(os.Stderr, "Attaching %d file(s), %s (~%d tokens)\n", len(files), formatBytes(size), estimateTokens(message))
+}
+
+// confirmLargeInput asks before a message larger than the large_input
+// limits is sent to model, unless yes is set. Without a terminal to ask on
+// it fails instead.
+func confirmLargeInput(cfg ConfigFile, model, message string, yes bool) error {
+	limit := cfg.LargeInput
+	if limit.Tokens <= 0 {
+		limit.Tokens = confirmTokens
+	}
+	tokens := textTokens(model, message)
+	if yes || tokens <= limit.Tokens && (limit.Bytes <= 0 || len(message) <= limit.Bytes) {
+		return nil
+	}
+	size := fmt.Sprintf("%s, %d tokens", formatBytes(len(message)), tokens)
+	if cost, ok := usageCost(cfg, model, &Usage{PromptTokens: tokens}); ok {
+		size += ", ~" + formatCost(cost) + " to send"
+	}
+	if !isTerminal(os.Stdin) {
+		return fmt.Errorf("input is large (%s); pass --yes to send it anyway", size)
+	}
+	answer, err := readSingleLine(fmt.Sprintf("The message is large (%s). Send it? [y/N] ", size))
+	if err != nil {
+		return err
+	}
+	if a := strings.ToLower(answer); a != "y" && a != "yes" {
+		return errors.New("cancelled")
+	}
+	return nil
+}
+
+func formatBytes(n int) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// expandGlob returns the regular files matching pattern in sorted order.
+// Besides the filepath.Match syntax, a "**" path element matches any number
+// of directories, e.g. src/**/*.go. Hidden directories are only entered when
+// the pattern names them.
+func expandGlob(pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	if !strings.Contains(pattern, "**") {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %s: %w", pattern, err)
+		}
+		var files []string
+		for _, m := range matches {
+			if fi, err := os.Stat(m); err == nil && fi.Mode().IsRegular() {
+				files = append(files, m)
+			}
+		}
+		return files, nil
+	}
+
+	// Walk from the longest leading part without metacharacters.
+	segs := strings.Split(pattern, "/")
+	root := 0
+	for root < len(segs) && !hasGlobMeta(segs[root]) {
+		root++
+	}
+	base := strings.Join(segs[:root], "/")
+	if base == "" {
+		base = "."
+		if strings.HasPrefix(pattern, "/") {
+			base = "/"
+		}
+	}
+	rest := segs[root:]
+	for _, s := range rest {
+		if _, err := filepath.Match(s, ""); err != nil {
+			return nil, fmt.Errorf("bad pattern %s: %w", pattern, err)
+		}
+	}
+
+	var files []string
+	err := filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == base {
+				return err
+			}
+			return nil // skip unreadable entries
+		}
+		rel, _ := filepath.Rel(base, path)
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if strings.HasPrefix(d.Name(), ".") && !strings.Contains("/"+pattern, "/.") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.Type().IsRegular() && matchSegments(rest, strings.Split(filepath.ToSlash(rel), "/")) {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("cannot expand %s: %w", pattern, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// matchSegments matches path elements against pattern elements, where "**"
+// stands for zero or more elements.
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	ok, _ := filepath.Match(pattern[0], path[0])
+	return ok && matchSegments(pattern[1:], path[1:])
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// gitOutput runs git with args in the current directory and returns what it
+// prints, or an error with what it printed on stderr.
+func gitOutput(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", errors.New("git is not installed")
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return "", fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return string(out), nil
+}
+
+// checkGitRepo returns an error unless the current directory is in a git
+// work tree; git's own for that is its whole usage.
+func checkGitRepo() error {
+	if _, err := gitOutput("rev-parse", "--is-inside-work-tree"); err != nil {
+		if strings.Contains(err.Error(), "not a git repository") {
+			return errors.New("this is not a git repository")
+		}
+		return err
+	}
+	return nil
+}
+
+// reviewMessage shows a message askgpt wrote and asks whether to go ahead
+// with it, letting the user edit it in $EDITOR first as often as they like.
+// It returns the message as it was agreed to, or errDeclined.
+func reviewMessage(msg, question string) (string, error) {
+	for {
+		fmt.Fprintf(os.Stderr, "\n%s\n\n", msg)
+		answer, err := readSingleLine(question + " (e to edit it) [y/N/e] ")
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToLower(answer) {
+		case "y", "yes":
+			return msg, nil
+		case "e", "edit":
+			if msg, err = composeInEditor(msg); err != nil {
+				return "", err
+			}
+		default:
+			return "", errDeclined
+		}
+	}
+}
+
+// fitDiff returns diff, or notes on it when it takes more than room tokens
+// of cfg's model, as chunkedInput does for a long input. The diff is split
+// between files where it can be, so that each part has whole files.
+func fitDiff(client *http.Client, cfg AskGPTConfig, opts taskOptions, diff string, room int, task string) (string, error) {
+	model := cfg.Model
+	tokens := tokenLen(model, diff)
+	if tokens <= room {
+		return diff, nil
+	}
+	size := room - textTokens(model, chunkPrompt+task)
+	if size <= 0 {
+		return "", fmt.Errorf("the context window of %s leaves no room for the changes", model)
+	}
+	units := diffUnits(diff)
+	for round := 1; ; round++ {
+		chunks := packUnits(model, fitUnits(model, units, size), size, 0)
+		if round == 1 {
+			fmt.Fprintf(os.Stderr, "[chunks] The changes are too long for %s; writing notes on %d parts of up to %d tokens...\n",
+				model, len(chunks), size)
+		} else {
+			fmt.Fprintf(os.Stderr, "[chunks] The notes are still too long; condensing them in %d parts...\n", len(chunks))
+		}
+		notes, _, err := writeChunkNotes(context.Background(), client, cfg, opts, chunks, task)
+		if err != nil {
+			return "", err
+		}
+		text := notesHeader + strings.Join(notes, "\n\n")
+		n := tokenLen(model, text)
+		if n <= room {
+			return text, nil
+		}
+		if n >= tokens {
+			return "", errors.New("the notes on the changes do not get shorter than the context window")
+		}
+		tokens, units = n, paragraphUnits(text)
+	}
+}
+
+// diffUnits splits a git diff before every file.
+func diffUnits(diff string) []string {
+	var units []string
+	var cur strings.Builder
+	for _, line := range strings.SplitAfter(diff, "\n") {
+		if strings.HasPrefix(line, "diff --git ") && cur.Len() > 0 {
+			units = append(units, cur.String())
+			cur.Reset()
+		}
+		cur.WriteString(line)
+	}
+	if cur.Len() > 0 {
+		units = append(units, cur.String())
+	}
+	return units
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is one .gitignore line. Paths are slash-separated and relative
+// to the root of the walk.
+type ignoreRule struct {
+	base     string   // directory of the .gitignore, "" for the root
+	pattern  []string // path elements; "**" matches any number of them
+	negate   bool     // "!pattern" re-includes a path
+	dirOnly  bool     // "pattern/" only matches directories
+	anchored bool     // the pattern contains a "/", so it is relative to base
+}
+
+// parseIgnoreLine parses a .gitignore line; ok is false for blank lines and
+// comments.
+func parseIgnoreLine(base, line string) (ignoreRule, bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return ignoreRule{}, false
+	}
+	r := ignoreRule{base: base}
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	}
+	line = strings.TrimPrefix(line, `\`)
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		r.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return ignoreRule{}, false
+	}
+	r.pattern = strings.Split(line, "/")
+	return r, true
+}
+
+func (r ignoreRule) matches(rel string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(rel, r.base+"/") {
+			return false
+		}
+		rel = rel[len(r.base)+1:]
+	}
+	if r.anchored {
+		return matchSegments(r.pattern, strings.Split(rel, "/"))
+	}
+	ok, _ := path.Match(r.pattern[0], path.Base(rel))
+	return ok
+}
+
+// ignoreList holds the rules seen so far; later rules win, like in git.
+type ignoreList []ignoreRule
+
+func (l ignoreList) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, r := range l {
+		if r.matches(rel, isDir) {
+			ignored = !r.negate
+		}
+	}
+	return ignored
+}
+
+// loadGitignore appends the rules from dir/.gitignore, if there is one; rel
+// is dir relative to the root of the walk.
+func (l ignoreList) loadGitignore(dir, rel string) ignoreList {
+	f, err := os.Open(filepath.Join(dir, ".gitignore"))
+	if err != nil {
+		return l
+	}
+	defer f.Close()
+	if rel == "." {
+		rel = ""
+	}
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if r, ok := parseIgnoreLine(rel, sc.Text()); ok {
+			l = append(l, r)
+		}
+	}
+	return l
+}
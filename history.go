@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	historyFileName    = "history"
+	defaultHistorySize = 1000
+)
+
+// HistoryConfig is the history: section of config.yaml:
+//
+//	history:
+//	  size: 5000          # entries to keep, default 1000
+//	  disabled: true      # do not save input at all
+//	  retention: 30d      # delete sessions not used for this long
+//	  max_sessions: 200   # and all but the most recently used ones
+type HistoryConfig struct {
+	Size        int    `yaml:"size,omitempty"`
+	Disabled    bool   `yaml:"disabled,omitempty"`
+	Retention   string `yaml:"retention,omitempty"`
+	MaxSessions int    `yaml:"max_sessions,omitempty"`
+}
+
+// inputHistory keeps the lines typed at the prompt in ~/.askgpt/history so
+// they can be recalled in later sessions. Lines starting with a space are
+// not saved, as in shells.
+type inputHistory struct {
+	path string
+}
+
+// openHistory returns the history file and its most recent entries. The file
+// is trimmed to the configured size when it has grown past it.
+func openHistory(cfg HistoryConfig) (*inputHistory, []string, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &inputHistory{path: filepath.Join(filepath.Dir(cfgPath), historyFileName)}
+	limit := cfg.Size
+	if limit <= 0 {
+		limit = defaultHistorySize
+	}
+
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return h, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read history: %w", err)
+	}
+	var lines []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	f.Close()
+	if err := sc.Err(); err != nil {
+		return nil, nil, fmt.Errorf("cannot read history: %w", err)
+	}
+
+	if len(lines) > limit {
+		lines = lines[len(lines)-limit:]
+		data := strings.Join(lines, "\n") + "\n"
+		if err := os.WriteFile(h.path, []byte(data), 0o600); err != nil {
+			return nil, nil, fmt.Errorf("cannot write history: %w", err)
+		}
+	}
+	return h, lines, nil
+}
+
+// Add appends a line to the history file. Failures are not worth
+// interrupting the chat for, so they are ignored.
+func (h *inputHistory) Add(line string) {
+	if strings.HasPrefix(line, " ") || strings.ContainsAny(line, "\r\n") {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, line)
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultImageModel = "gpt-image-1"
+	defaultImageSize  = "1024x1024"
+	defaultImageOut   = "image.png"
+	// imagePartials is how many partial images a streamed generation sends
+	// before the final one.
+	imagePartials = 2
+)
+
+type imageRequest struct {
+	Model          string `json:"model"`
+	Prompt         string `json:"prompt"`
+	N              int    `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`
+	Quality        string `json:"quality,omitempty"`
+	OutputFormat   string `json:"output_format,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+	Stream         bool   `json:"stream,omitempty"`
+	PartialImages  int    `json:"partial_images,omitempty"`
+}
+
+// imageData is a generated image: GPT image models return it base64
+// encoded, DALL-E models may return a URL to fetch it from.
+type imageData struct {
+	B64JSON string `json:"b64_json"`
+	URL     string `json:"url"`
+}
+
+// imageUsage is the usage image models report, in tokens of their own.
+type imageUsage struct {
+	InputTokens  int `json:"input_tokens"`
+	OutputTokens int `json:"output_tokens"`
+}
+
+type imageResponse struct {
+	Data  []imageData `json:"data"`
+	Usage *imageUsage `json:"usage"`
+}
+
+// imageEvent is an event of a streamed generation: a partial image, or the
+// completed one.
+type imageEvent struct {
+	Type              string      `json:"type"`
+	B64JSON           string      `json:"b64_json"`
+	PartialImageIndex int         `json:"partial_image_index"`
+	Usage             *imageUsage `json:"usage"`
+}
+
+// runImage handles "askgpt image <prompt>": it generates images with the
+// images endpoint and saves them, numbered when there are several.
+func runImage(args []string) int {
+	fs := flag.NewFlagSet("image", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	size := fs.String("size", defaultImageSize, "")
+	n := fs.Int("n", 1, "")
+	out := fs.String("o", defaultImageOut, "")
+	fs.StringVar(out, "out", defaultImageOut, "")
+	model := fs.String("model", "", "")
+	quality := fs.String("quality", "", "")
+	noStream := fs.Bool("no-stream", false, "")
+	force := fs.Bool("force", false, "")
+
+	// Allow flags after the prompt.
+	var words []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	prompt := strings.TrimSpace(strings.Join(words, " "))
+	if prompt == "" || *n < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt image <prompt> [--size 1024x1024] [-n count] [-o file.png] [--model name] [--quality q]")
+		return 2
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "image", *force)
+	if *model == "" {
+		*model = cfgFile.Images.Model
+	}
+	if *model == "" {
+		*model = defaultImageModel
+	}
+	req := imageRequest{Model: *model, Prompt: prompt, N: *n, Size: *size, Quality: *quality}
+	if strings.HasPrefix(*model, "gpt-image") {
+		// Only the GPT image models stream, one image at a time; they
+		// always return base64 and can write other formats than PNG.
+		req.Stream = !*noStream && *n == 1
+		switch strings.ToLower(filepath.Ext(*out)) {
+		case ".jpg", ".jpeg":
+			req.OutputFormat = "jpeg"
+		case ".webp":
+			req.OutputFormat = "webp"
+		}
+	} else {
+		req.ResponseFormat = "b64_json"
+	}
+	if req.Stream {
+		req.PartialImages = imagePartials
+	}
+
+	client := apiClient(cfgFile)
+	fmt.Fprintf(os.Stderr, "[image] Generating %d image(s) with %s...\n", *n, *model)
+	paths := imagePaths(*out, *n)
+	saved, err := generateImages(context.Background(), client, cfgFile.AskGPT, req, paths)
+	for _, p := range saved {
+		fmt.Println(p)
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// imagePaths returns where to save n images: out itself for one, and out
+// numbered before its extension for more, e.g. fox-1.png and fox-2.png.
+func imagePaths(out string, n int) []string {
+	if n == 1 {
+		return []string{out}
+	}
+	ext := filepath.Ext(out)
+	paths := make([]string, n)
+	for i := range paths {
+		paths[i] = fmt.Sprintf("%s-%d%s", strings.TrimSuffix(out, ext), i+1, ext)
+	}
+	return paths
+}
+
+// generateImages sends req and saves the images to paths, returning those
+// saved. A streamed image is written to its path as every partial image
+// arrives, so it can be watched sharpening.
+func generateImages(ctx context.Context, client *http.Client, cfg AskGPTConfig, req imageRequest, paths []string) ([]string, error) {
+	if err := checkBudget(); err != nil {
+		return nil, err
+	}
+	req.Prompt = redactOutgoing(req.Prompt)
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doAPIRequest(ctx, client, cfg, apiEndpoint(cfg, "images/generations"), "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var usage *imageUsage
+	defer func() { recordImageUsage(req.Model, usage) }()
+
+	if !req.Stream {
+		var out imageResponse
+		if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+			return nil, fmt.Errorf("cannot decode response: %w", err)
+		}
+		usage = out.Usage
+		if len(out.Data) == 0 {
+			return nil, errors.New("response contains no images")
+		}
+		var saved []string
+		for i, d := range out.Data {
+			if i == len(paths) {
+				break
+			}
+			b, err := imageBytes(ctx, client, d)
+			if err == nil {
+				err = os.WriteFile(paths[i], b, 0o644)
+			}
+			if err != nil {
+				return saved, fmt.Errorf("cannot save %s: %w", paths[i], err)
+			}
+			saved = append(saved, paths[i])
+		}
+		return saved, nil
+	}
+
+	reader := bufio.NewReader(resp.Body)
+	for {
+		line, err := reader.ReadString('\n')
+		if errors.Is(err, io.EOF) {
+			return nil, errors.New("the stream ended before the image was complete")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("stream read error: %w", err)
+		}
+		data, ok := strings.CutPrefix(line, "data:")
+		if !ok {
+			continue
+		}
+		var ev imageEvent
+		if json.Unmarshal([]byte(strings.TrimSpace(data)), &ev) != nil || ev.B64JSON == "" {
+			continue
+		}
+		b, err := imageBytes(ctx, client, imageData{B64JSON: ev.B64JSON})
+		if err == nil {
+			err = os.WriteFile(paths[0], b, 0o644)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot save %s: %w", paths[0], err)
+		}
+		if ev.Type == "image_generation.completed" {
+			usage = ev.Usage
+			return paths[:1], nil
+		}
+		fmt.Fprintf(os.Stderr, "[image] Partial image %d of %d written to %s\n", ev.PartialImageIndex+1, imagePartials, paths[0])
+	}
+}
+
+// imageBytes decodes a generated image, or downloads it when the API only
+// gave its URL.
+func imageBytes(ctx context.Context, client *http.Client, d imageData) ([]byte, error) {
+	if d.B64JSON != "" {
+		return base64.StdEncoding.DecodeString(d.B64JSON)
+	}
+	if d.URL == "" {
+		return nil, errors.New("the response has neither the image nor its URL")
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "GET", d.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// recordImageUsage logs a generation in the usage log, in the image
+// model's tokens when it reports them.
+func recordImageUsage(model string, u *imageUsage) {
+	var usage *Usage
+	if u != nil {
+		usage = &Usage{PromptTokens: u.InputTokens, CompletionTokens: u.OutputTokens, TotalTokens: u.InputTokens + u.OutputTokens}
+	}
+	recordUsage(model, usage, nil, "")
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"strings"
+
+	_ "image/gif"
+
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+)
+
+// defaultImageMaxSize is the longest side in pixels attached images are
+// scaled down to, unless images.max_size says otherwise.
+const defaultImageMaxSize = 1024
+
+// ImagesConfig is the images: section of config.yaml. Attached images are
+// scaled down to max_size pixels on their longer side before they are sent,
+// as their token cost grows with their size; detail is passed on to the
+// API. model is what askgpt image generates images with.
+//
+//	images:
+//	  max_size: 1024
+//	  detail: auto   # low, high or auto
+//	  model: gpt-image-1
+type ImagesConfig struct {
+	MaxSize int    `yaml:"max_size,omitempty"`
+	Detail  string `yaml:"detail,omitempty"`
+	Model   string `yaml:"model,omitempty"`
+}
+
+// Image is an image attached to a user message, sent as a data URL.
+type Image struct {
+	Name          string
+	URL           string
+	Detail        string
+	Width, Height int
+}
+
+// imageMentionPrefix starts the @image:path mentions that attach an image
+// in a chat.
+const imageMentionPrefix = "@image:"
+
+// loadImage reads a PNG, JPEG, GIF or WebP image to attach, scaled down to
+// fit cfg.MaxSize. Scaled images are sent as JPEG when they were JPEG and
+// as PNG otherwise.
+func loadImage(cfg ImagesConfig, path string) (Image, error) {
+	switch cfg.Detail {
+	case "", "low", "high", "auto":
+	default:
+		return Image{}, fmt.Errorf("unknown images.detail %q (use low, high or auto)", cfg.Detail)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Image{}, fmt.Errorf("cannot read image %s: %w", path, err)
+	}
+	src, format, err := image.Decode(bytes.NewReader(b))
+	if err != nil {
+		return Image{}, fmt.Errorf("%s is not a PNG, JPEG, GIF or WebP image: %w", path, err)
+	}
+	limit := cfg.MaxSize
+	if limit <= 0 {
+		limit = defaultImageMaxSize
+	}
+	img := Image{Name: path, Detail: cfg.Detail, Width: src.Bounds().Dx(), Height: src.Bounds().Dy()}
+	mime := "image/" + format
+	if img.Width > limit || img.Height > limit {
+		if img.Width >= img.Height {
+			img.Width, img.Height = limit, max(img.Height*limit/img.Width, 1)
+		} else {
+			img.Width, img.Height = max(img.Width*limit/img.Height, 1), limit
+		}
+		dst := image.NewRGBA(image.Rect(0, 0, img.Width, img.Height))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), draw.Over, nil)
+		var buf bytes.Buffer
+		if format == "jpeg" {
+			err = jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 85})
+		} else {
+			err, mime = png.Encode(&buf, dst), "image/png"
+		}
+		if err != nil {
+			return Image{}, fmt.Errorf("cannot scale image %s: %w", path, err)
+		}
+		b = buf.Bytes()
+	}
+	img.URL = "data:" + mime + ";base64," + base64.StdEncoding.EncodeToString(b)
+	return img, nil
+}
+
+// imageTokens estimates the tokens an image takes up the way OpenAI counts
+// them: 85, plus 170 for every 512-pixel tile of the image once it is fit
+// into 2048x2048 and its shorter side into 768, unless the detail is low.
+func imageTokens(img Image) int {
+	if img.Detail == "low" {
+		return 85
+	}
+	w, h := float64(img.Width), float64(img.Height)
+	if s := 2048 / max(w, h); s < 1 {
+		w, h = w*s, h*s
+	}
+	if s := 768 / min(w, h); s < 1 {
+		w, h = w*s, h*s
+	}
+	tiles := (int(w) + 511) / 512 * ((int(h) + 511) / 512)
+	return 85 + 170*tiles
+}
+
+// reportImages prints the size of the attached images.
+func reportImages(images []Image) {
+	for _, img := range images {
+		fmt.Fprintf(os.Stderr, "Attaching image %s, %dx%d (~%d tokens)\n", img.Name, img.Width, img.Height, imageTokens(img))
+	}
+}
+
+// loadImages loads the images named by --image.
+func loadImages(cfg ImagesConfig, paths []string) ([]Image, error) {
+	var images []Image
+	for _, p := range paths {
+		img, err := loadImage(cfg, p)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	return images, nil
+}
+
+// expandImageMentions attaches the images named as @image:path in a
+// message. The mention is replaced by the bare path, like file mentions.
+func expandImageMentions(cfg ImagesConfig, text string) (string, []Image, error) {
+	var images []Image
+	var firstErr error
+	text = mentionRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mentionRe.FindStringSubmatch(m)
+		path, ok := strings.CutPrefix("@"+sub[2], imageMentionPrefix)
+		if !ok || firstErr != nil {
+			return m
+		}
+		img, err := loadImage(cfg, strings.TrimRight(path, ".,;:!?)'\""))
+		if err != nil {
+			firstErr = err
+			return m
+		}
+		images = append(images, img)
+		return sub[1] + path
+	})
+	return text, images, firstErr
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// importedChat is a conversation read from another app's export.
+type importedChat struct {
+	Source   string // "<app>:<id>", to recognize it when imported again
+	Title    string
+	Model    string
+	Created  time.Time
+	Messages []chatMessage
+}
+
+func runImport(args []string) int {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	from := fs.String("from", "", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt import <export.zip|conversations.json> [--from chatgpt|claude]")
+		return 2
+	}
+
+	data, err := readExportFile(fs.Arg(0))
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	chats, err := parseExport(data, *from)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+
+	store, err := openConfiguredStore()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	known, err := importedSources(store)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	imported, skipped, empty := 0, 0, 0
+	for _, c := range chats {
+		switch {
+		case len(c.Messages) == 0:
+			empty++
+			continue
+		case known[c.Source]:
+			skipped++
+			continue
+		}
+		created := c.Created
+		if created.IsZero() {
+			created = time.Now()
+		}
+		id, err := store.NewID(created)
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		saved := savedChat{
+			Version:   savedChatVersion,
+			ID:        id,
+			CreatedAt: created,
+			SavedAt:   time.Now(),
+			Title:     c.Title,
+			Source:    c.Source,
+			Model:     c.Model,
+			Messages:  c.Messages,
+		}
+		// Date the session like the conversation, so the imports do not
+		// all become the "last" session.
+		last := created
+		if n := len(c.Messages); !c.Messages[n-1].Time.IsZero() {
+			last = c.Messages[n-1].Time
+		}
+		if err := store.Save(saved, last); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		known[c.Source] = true
+		imported++
+	}
+
+	fmt.Fprintf(os.Stderr, "Imported %d conversation(s)", imported)
+	if skipped > 0 {
+		fmt.Fprintf(os.Stderr, ", skipped %d already imported", skipped)
+	}
+	if empty > 0 {
+		fmt.Fprintf(os.Stderr, ", %d without text messages", empty)
+	}
+	fmt.Fprintln(os.Stderr, ". See them with: askgpt sessions list")
+	return 0
+}
+
+// readExportFile returns conversations.json, read directly or from the zip
+// archive the apps offer for download.
+func readExportFile(path string) ([]byte, error) {
+	if !strings.EqualFold(filepath.Ext(path), ".zip") {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", path, err)
+		}
+		return b, nil
+	}
+	zr, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	defer zr.Close()
+	for _, f := range zr.File {
+		if filepath.Base(f.Name) != "conversations.json" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %w", f.Name, err)
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, fmt.Errorf("%s contains no conversations.json", path)
+}
+
+// parseExport reads the conversations of a ChatGPT or Claude export. from
+// names the app, or is empty to tell it from the data.
+func parseExport(data []byte, from string) ([]importedChat, error) {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		return nil, fmt.Errorf("not a conversations export: %w", err)
+	}
+	if from == "" && len(items) > 0 {
+		var first map[string]json.RawMessage
+		_ = json.Unmarshal(items[0], &first)
+		switch {
+		case first["mapping"] != nil:
+			from = "chatgpt"
+		case first["chat_messages"] != nil:
+			from = "claude"
+		default:
+			return nil, errors.New("unknown export format; use --from chatgpt or --from claude")
+		}
+	}
+
+	var chats []importedChat
+	for _, b := range items {
+		var c importedChat
+		var err error
+		switch from {
+		case "chatgpt":
+			c, err = parseChatGPTConversation(b)
+		case "claude":
+			c, err = parseClaudeConversation(b)
+		default:
+			return nil, fmt.Errorf("unknown export source %q (use chatgpt or claude)", from)
+		}
+		if err != nil {
+			return nil, err
+		}
+		chats = append(chats, c)
+	}
+	return chats, nil
+}
+
+// chatGPTConversation is a conversation in ChatGPT's conversations.json. The
+// messages form a tree, since edited questions and regenerated answers
+// branch off; current_node is the last message of the branch shown.
+type chatGPTConversation struct {
+	ID          string  `json:"id"`
+	Title       string  `json:"title"`
+	CreateTime  float64 `json:"create_time"`
+	CurrentNode string  `json:"current_node"`
+	Model       string  `json:"default_model_slug"`
+	Mapping     map[string]struct {
+		Parent  string `json:"parent"`
+		Message *struct {
+			Author struct {
+				Role string `json:"role"`
+			} `json:"author"`
+			CreateTime float64 `json:"create_time"`
+			Content    struct {
+				ContentType string `json:"content_type"`
+				Parts       []any  `json:"parts"`
+			} `json:"content"`
+			Metadata struct {
+				ModelSlug string `json:"model_slug"`
+			} `json:"metadata"`
+		} `json:"message"`
+	} `json:"mapping"`
+}
+
+func parseChatGPTConversation(b []byte) (importedChat, error) {
+	var conv chatGPTConversation
+	if err := json.Unmarshal(b, &conv); err != nil {
+		return importedChat{}, fmt.Errorf("cannot parse ChatGPT conversation: %w", err)
+	}
+	c := importedChat{
+		Source:  "chatgpt:" + conv.ID,
+		Title:   conv.Title,
+		Model:   conv.Model,
+		Created: unixSeconds(conv.CreateTime),
+	}
+	// Walk up from the current node, then reverse into reading order.
+	seen := map[string]bool{}
+	for id := conv.CurrentNode; id != "" && !seen[id]; id = conv.Mapping[id].Parent {
+		seen[id] = true
+		m := conv.Mapping[id].Message
+		if m == nil || (m.Author.Role != "user" && m.Author.Role != "assistant") {
+			continue
+		}
+		var parts []string
+		for _, p := range m.Content.Parts {
+			// Images and other attachments are objects; keep the text.
+			if s, ok := p.(string); ok && strings.TrimSpace(s) != "" {
+				parts = append(parts, s)
+			}
+		}
+		if len(parts) == 0 {
+			continue
+		}
+		if m.Author.Role == "assistant" && m.Metadata.ModelSlug != "" {
+			c.Model = m.Metadata.ModelSlug
+		}
+		msg := newChatMessage(m.Author.Role, strings.Join(parts, "\n\n"))
+		msg.Time = unixSeconds(m.CreateTime)
+		c.Messages = append(c.Messages, msg)
+	}
+	for i, j := 0, len(c.Messages)-1; i < j; i, j = i+1, j-1 {
+		c.Messages[i], c.Messages[j] = c.Messages[j], c.Messages[i]
+	}
+	return c, nil
+}
+
+// claudeConversation is a conversation in Claude's conversations.json.
+type claudeConversation struct {
+	UUID      string    `json:"uuid"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	Messages  []struct {
+		Sender    string    `json:"sender"`
+		Text      string    `json:"text"`
+		CreatedAt time.Time `json:"created_at"`
+		Content   []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	} `json:"chat_messages"`
+}
+
+func parseClaudeConversation(b []byte) (importedChat, error) {
+	var conv claudeConversation
+	if err := json.Unmarshal(b, &conv); err != nil {
+		return importedChat{}, fmt.Errorf("cannot parse Claude conversation: %w", err)
+	}
+	c := importedChat{
+		Source:  "claude:" + conv.UUID,
+		Title:   conv.Name,
+		Created: conv.CreatedAt,
+	}
+	for _, m := range conv.Messages {
+		role := "user"
+		if m.Sender == "assistant" {
+			role = "assistant"
+		}
+		text := m.Text
+		if strings.TrimSpace(text) == "" {
+			var parts []string
+			for _, p := range m.Content {
+				if p.Type == "text" && strings.TrimSpace(p.Text) != "" {
+					parts = append(parts, p.Text)
+				}
+			}
+			text = strings.Join(parts, "\n\n")
+		}
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		msg := newChatMessage(role, text)
+		msg.Time = m.CreatedAt
+		c.Messages = append(c.Messages, msg)
+	}
+	return c, nil
+}
+
+func unixSeconds(sec float64) time.Time {
+	if sec <= 0 {
+		return time.Time{}
+	}
+	whole, frac := math.Modf(sec)
+	return time.Unix(int64(whole), int64(frac*1e9))
+}
+
+// importedSources returns the sources of the sessions imported before.
+func importedSources(store sessionStore) (map[string]bool, error) {
+	ids, err := store.IDs()
+	if err != nil {
+		return nil, err
+	}
+	known := map[string]bool{}
+	for _, id := range ids {
+		c, err := store.Load(id)
+		if err == nil && c.Source != "" {
+			known[c.Source] = true
+		}
+	}
+	return known, nil
+}
@@ -0,0 +1,634 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	indexesDirName = "indexes"
+	// indexVersion is the schema version of index files, kept in PRAGMA
+	// user_version.
+	indexVersion = 1
+	// defaultIndexChunkSize and defaultIndexOverlap are the tokens of the
+	// parts files are indexed in, and of a part repeated in the next.
+	defaultIndexChunkSize = 800
+	defaultIndexOverlap   = 100
+)
+
+// indexSchema is the layout of an index file. meta holds the directory and
+// the settings it was indexed with, files what each file was when it was
+// last indexed, so only changed files are indexed again, and chunks the
+// parts of the files with their embeddings as little-endian float32s.
+const indexSchema = `
+CREATE TABLE meta (
+	key   TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE files (
+	path     TEXT PRIMARY KEY,
+	size     INTEGER NOT NULL,
+	mod_time INTEGER NOT NULL,
+	hash     TEXT NOT NULL
+);
+CREATE TABLE chunks (
+	path      TEXT NOT NULL,
+	seq       INTEGER NOT NULL,
+	line      INTEGER NOT NULL,
+	text      TEXT NOT NULL,
+	embedding BLOB NOT NULL,
+	PRIMARY KEY (path, seq)
+);
+`
+
+var indexNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// indexSettings are what an index was built with; when any of them changes
+// every file is indexed again. They are kept in the meta table, next to
+// when the index was last updated.
+type indexSettings struct {
+	Root       string
+	Model      string
+	Dimensions int
+	ChunkSize  int
+	Overlap    int
+	Include    string // patterns, one to a line
+	Exclude    string
+}
+
+func (s indexSettings) meta() map[string]string {
+	return map[string]string{
+		"root":       s.Root,
+		"model":      s.Model,
+		"dimensions": strconv.Itoa(s.Dimensions),
+		"chunk_size": strconv.Itoa(s.ChunkSize),
+		"overlap":    strconv.Itoa(s.Overlap),
+		"include":    s.Include,
+		"exclude":    s.Exclude,
+	}
+}
+
+// vectorIndex is a local index of the files of a directory, kept in
+// ~/.askgpt/indexes/<name>.db.
+type vectorIndex struct {
+	name string
+	db   *sql.DB
+}
+
+func indexesDir() (string, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(cfgPath), indexesDirName), nil
+}
+
+// indexPath returns the file of the index called name.
+func indexPath(name string) (string, error) {
+	if !indexNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid index name %q (use letters, digits, '.', '_' and '-')", name)
+	}
+	dir, err := indexesDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, name+".db"), nil
+}
+
+// openIndex opens the index called name, creating it when create is set.
+func openIndex(name string, create bool) (*vectorIndex, error) {
+	path, err := indexPath(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) && !create {
+		return nil, fmt.Errorf("no index named %q (create it with askgpt index <dir> --name %s)", name, name)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), configDirPerm); err != nil {
+		return nil, fmt.Errorf("cannot create dir %s: %w", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, configFilePerm)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	f.Close()
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	var version int
+	err = db.QueryRow("PRAGMA user_version").Scan(&version)
+	switch {
+	case err != nil:
+	case version == 0:
+		_, err = db.Exec(indexSchema + fmt.Sprintf("PRAGMA user_version = %d;", indexVersion))
+	case version != indexVersion:
+		err = fmt.Errorf("it was created by a newer askgpt (version %d)", version)
+	}
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	return &vectorIndex{name: name, db: db}, nil
+}
+
+func (x *vectorIndex) Close() error { return x.db.Close() }
+
+// settings returns what the index was built with, and whether it was built
+// at all.
+func (x *vectorIndex) settings() (indexSettings, bool, error) {
+	rows, err := x.db.Query("SELECT key, value FROM meta")
+	if err != nil {
+		return indexSettings{}, false, err
+	}
+	defer rows.Close()
+	meta := map[string]string{}
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return indexSettings{}, false, err
+		}
+		meta[k] = v
+	}
+	if err := rows.Err(); err != nil || len(meta) == 0 {
+		return indexSettings{}, false, err
+	}
+	s := indexSettings{Root: meta["root"], Model: meta["model"], Include: meta["include"], Exclude: meta["exclude"]}
+	s.Dimensions, _ = strconv.Atoi(meta["dimensions"])
+	s.ChunkSize, _ = strconv.Atoi(meta["chunk_size"])
+	s.Overlap, _ = strconv.Atoi(meta["overlap"])
+	return s, true, nil
+}
+
+// indexedFile is a file as it was last indexed.
+type indexedFile struct {
+	size    int64
+	modTime int64
+	hash    string
+}
+
+func (x *vectorIndex) files() (map[string]indexedFile, error) {
+	rows, err := x.db.Query("SELECT path, size, mod_time, hash FROM files")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	files := map[string]indexedFile{}
+	for rows.Next() {
+		var path string
+		var f indexedFile
+		if err := rows.Scan(&path, &f.size, &f.modTime, &f.hash); err != nil {
+			return nil, err
+		}
+		files[path] = f
+	}
+	return files, rows.Err()
+}
+
+// indexChunk is a part of a file: the line it starts at and its text.
+type indexChunk struct {
+	Line int
+	Text string
+}
+
+// pendingFile is a new or changed file waiting for its embeddings.
+type pendingFile struct {
+	path   string
+	file   indexedFile
+	chunks []indexChunk
+}
+
+// store replaces the chunks of files with the given ones and their
+// embeddings, in order, and records the files as indexed.
+func (x *vectorIndex) store(files []pendingFile, vectors [][]float32) error {
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, f := range files {
+		if _, err := tx.Exec("DELETE FROM chunks WHERE path = ?", f.path); err != nil {
+			return err
+		}
+		for i, c := range f.chunks {
+			if _, err := tx.Exec("INSERT INTO chunks (path, seq, line, text, embedding) VALUES (?, ?, ?, ?, ?)",
+				f.path, i, c.Line, c.Text, encodeVector(vectors[0])); err != nil {
+				return err
+			}
+			vectors = vectors[1:]
+		}
+		if _, err := tx.Exec("INSERT OR REPLACE INTO files (path, size, mod_time, hash) VALUES (?, ?, ?, ?)",
+			f.path, f.file.size, f.file.modTime, f.file.hash); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// remove drops files from the index.
+func (x *vectorIndex) remove(paths []string) error {
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, p := range paths {
+		if _, err := tx.Exec("DELETE FROM chunks WHERE path = ?", p); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM files WHERE path = ?", p); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// reset empties the index and records the settings it is now built with.
+func (x *vectorIndex) reset(s indexSettings) error {
+	tx, err := x.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM chunks; DELETE FROM files; DELETE FROM meta;"); err != nil {
+		return err
+	}
+	for k, v := range s.meta() {
+		if _, err := tx.Exec("INSERT INTO meta (key, value) VALUES (?, ?)", k, v); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func encodeVector(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(f))
+	}
+	return b
+}
+
+func decodeVector(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
+
+// fileChunks splits the text of a file into the parts it is indexed in,
+// each with the line it starts at.
+func fileChunks(model, text string, s indexSettings) []indexChunk {
+	var chunks []indexChunk
+	from := 0
+	for _, part := range splitChunks(model, text, ChunkingConfig{By: "paragraphs", Overlap: s.Overlap}, s.ChunkSize) {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		// Parts are pieces of the text, later ones starting after earlier.
+		line := 0
+		if i := strings.Index(text[from:], part); i >= 0 {
+			line = strings.Count(text[:from+i], "\n") + 1
+			from += i
+		}
+		chunks = append(chunks, indexChunk{Line: line, Text: part})
+	}
+	return chunks
+}
+
+// indexableText returns the text of a file to index, or false for files
+// that are neither text nor a document askgpt can read.
+func indexableText(name string, b []byte) (string, bool) {
+	if text, ok, err := documentText(name, b); ok {
+		return text, err == nil
+	}
+	b = bytes.TrimPrefix(b, []byte{0xEF, 0xBB, 0xBF})
+	if bytes.ContainsRune(b, 0) || !utf8.Valid(b) {
+		return "", false
+	}
+	return string(b), true
+}
+
+// indexStats counts what an indexing run did.
+type indexStats struct {
+	added, changed, removed, unchanged, skipped, chunks int
+}
+
+// updateIndex brings the index up to date with the files under s.Root:
+// new and changed files are indexed, and removed ones dropped. Files are
+// stored as their embeddings arrive, so an interrupted run keeps what it
+// did.
+func updateIndex(ctx context.Context, client *http.Client, cfg ConfigFile, x *vectorIndex, s indexSettings) (indexStats, error) {
+	var stats indexStats
+	cfg.Embeddings = EmbeddingsConfig{Model: s.Model, Dimensions: s.Dimensions}
+	old, built, err := x.settings()
+	if err != nil {
+		return stats, err
+	}
+	if !built || old != s {
+		if built {
+			fmt.Fprintf(os.Stderr, "[index] The settings of %s changed; indexing every file again.\n", x.name)
+		}
+		if err := x.reset(s); err != nil {
+			return stats, err
+		}
+	}
+	known, err := x.files()
+	if err != nil {
+		return stats, err
+	}
+
+	var include []string
+	if s.Include != "" {
+		include = strings.Split(s.Include, "\n")
+	}
+	var excludes ignoreList
+	for _, p := range strings.Split(s.Exclude, "\n") {
+		if r, ok := parseIgnoreLine("", p); ok {
+			excludes = append(excludes, r)
+		}
+	}
+	ignores := ignoreList{}
+	seen := map[string]bool{}
+	var pending []pendingFile
+	pendingChunks := 0
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		var texts []string
+		for _, f := range pending {
+			for _, c := range f.chunks {
+				texts = append(texts, c.Text)
+			}
+		}
+		vectors, err := embedTexts(ctx, client, cfg, texts, defaultEmbeddingBatch, nil)
+		if err != nil {
+			return err
+		}
+		if err := x.store(pending, vectors); err != nil {
+			return err
+		}
+		stats.chunks += len(texts)
+		fmt.Fprintf(os.Stderr, "[index] %d chunks embedded\n", stats.chunks)
+		pending, pendingChunks = nil, 0
+		return nil
+	}
+
+	err = filepath.WalkDir(s.Root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // skip unreadable entries
+		}
+		rel, _ := filepath.Rel(s.Root, p)
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel != "." && (d.Name() == ".git" || ignores.ignored(rel, true) || excludes.ignored(rel, true)) {
+				return filepath.SkipDir
+			}
+			ignores = ignores.loadGitignore(p, rel)
+			return nil
+		}
+		if !d.Type().IsRegular() || ignores.ignored(rel, false) || excludes.ignored(rel, false) {
+			return nil
+		}
+		if len(include) > 0 && !matchesAny(include, rel) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		seen[rel] = true
+		f := indexedFile{size: info.Size(), modTime: info.ModTime().UnixNano()}
+		prev, ok := known[rel]
+		if ok && prev.size == f.size && prev.modTime == f.modTime {
+			stats.unchanged++
+			return nil
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil
+		}
+		sum := sha256.Sum256(b)
+		f.hash = hex.EncodeToString(sum[:])
+		if ok && prev.hash == f.hash {
+			// Touched but not changed: remember the new time only.
+			stats.unchanged++
+			_, err := x.db.Exec("UPDATE files SET size = ?, mod_time = ? WHERE path = ?", f.size, f.modTime, rel)
+			return err
+		}
+		if ok {
+			stats.changed++
+		} else {
+			stats.added++
+		}
+		file := pendingFile{path: rel, file: f}
+		if text, ok := indexableText(rel, b); ok {
+			file.chunks = fileChunks(s.Model, text, s)
+		} else {
+			stats.skipped++
+		}
+		// Files with no text are recorded too, so they are not read again.
+		pending = append(pending, file)
+		pendingChunks += len(file.chunks)
+		if pendingChunks >= defaultEmbeddingBatch {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return stats, err
+	}
+
+	var removed []string
+	for p := range known {
+		if !seen[p] {
+			removed = append(removed, p)
+		}
+	}
+	stats.removed = len(removed)
+	if err := x.remove(removed); err != nil {
+		return stats, err
+	}
+	_, err = x.db.Exec("INSERT OR REPLACE INTO meta (key, value) VALUES ('updated', ?)", time.Now().Format(time.DateTime))
+	return stats, err
+}
+
+// runIndex handles "askgpt index <dir> --name <name>": it indexes the
+// files of a directory for askgpt ask --index, or brings an index up to
+// date. --list lists the indexes.
+func runIndex(args []string) int {
+	fs := flag.NewFlagSet("index", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	name := fs.String("name", "", "")
+	var include, exclude stringList
+	fs.Var(&include, "include", "")
+	fs.Var(&exclude, "exclude", "")
+	model := fs.String("model", "", "")
+	chunkSize := fs.Int("chunk-size", defaultIndexChunkSize, "")
+	overlap := fs.Int("overlap", defaultIndexOverlap, "")
+	list := fs.Bool("list", false, "")
+	force := fs.Bool("force", false, "")
+
+	// Allow flags after the directory.
+	var dirs []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		dirs = append(dirs, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if *list {
+		return listIndexes()
+	}
+	if len(dirs) > 1 || (len(dirs) == 0 && *name == "") || *chunkSize < 1 || *overlap < 0 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt index <dir> [--name name] [--include pattern] [--exclude pattern] [--chunk-size n] [--overlap n]")
+		fmt.Fprintln(os.Stderr, "       askgpt index --name name   (update an index)")
+		fmt.Fprintln(os.Stderr, "       askgpt index --list")
+		return 2
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "index", *force)
+	if cfgFile.Embeddings.Model == "" {
+		cfgFile.Embeddings.Model = defaultEmbeddingModel
+	}
+	if *name == "" {
+		abs, err := filepath.Abs(dirs[0])
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		*name = filepath.Base(abs)
+	}
+
+	x, err := openIndex(*name, len(dirs) == 1)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	defer x.Close()
+	// An index keeps the settings it was built with, unless flags change
+	// them.
+	s, built, err := x.settings()
+	if err != nil {
+		errorf("cannot read index %s: %v\n", *name, err)
+		return 1
+	}
+	if !built {
+		s = indexSettings{
+			Model: cfgFile.Embeddings.Model, Dimensions: cfgFile.Embeddings.Dimensions,
+			ChunkSize: *chunkSize, Overlap: *overlap,
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "model":
+			s.Model = *model
+		case "chunk-size":
+			s.ChunkSize = *chunkSize
+		case "overlap":
+			s.Overlap = *overlap
+		case "include":
+			s.Include = strings.Join(include, "\n")
+		case "exclude":
+			s.Exclude = strings.Join(exclude, "\n")
+		}
+	})
+	if s.Overlap >= s.ChunkSize {
+		errorf("--overlap must be smaller than --chunk-size\n")
+		return 2
+	}
+	if len(dirs) == 1 {
+		if s.Root, err = filepath.Abs(dirs[0]); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+	if fi, err := os.Stat(s.Root); err != nil || !fi.IsDir() {
+		errorf("%s is not a directory\n", s.Root)
+		return 1
+	}
+
+	fmt.Fprintf(os.Stderr, "[index] Indexing %s as %s with %s...\n", s.Root, *name, s.Model)
+	client := apiClient(cfgFile)
+	stats, err := updateIndex(context.Background(), client, cfgFile, x, s)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "[index] %s: %d new, %d changed, %d removed, %d unchanged file(s); %d chunk(s) embedded",
+		*name, stats.added, stats.changed, stats.removed, stats.unchanged, stats.chunks)
+	if stats.skipped > 0 {
+		fmt.Fprintf(os.Stderr, "; %d file(s) without text skipped", stats.skipped)
+	}
+	fmt.Fprintln(os.Stderr)
+	return 0
+}
+
+// listIndexes prints the indexes with their size, when they were last
+// updated, and what they index.
+func listIndexes() int {
+	dir, err := indexesDir()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	matches, _ := filepath.Glob(filepath.Join(dir, "*.db"))
+	if len(matches) == 0 {
+		fmt.Fprintln(os.Stderr, "No indexes yet; create one with askgpt index <dir> --name <name>.")
+		return 0
+	}
+	for _, m := range matches {
+		name := strings.TrimSuffix(filepath.Base(m), ".db")
+		x, err := openIndex(name, false)
+		if err != nil {
+			errorf("%v\n", err)
+			continue
+		}
+		s, _, err := x.settings()
+		var files, chunks int
+		var updated string
+		if err == nil {
+			err = x.db.QueryRow(`SELECT (SELECT COUNT(*) FROM files), (SELECT COUNT(*) FROM chunks),
+				COALESCE((SELECT value FROM meta WHERE key = 'updated'), '')`).Scan(&files, &chunks, &updated)
+		}
+		x.Close()
+		if err != nil {
+			errorf("cannot read index %s: %v\n", name, err)
+			continue
+		}
+		fmt.Printf("%-16s %5d files %6d chunks  %s  %s  %s\n", name, files, chunks, updated, s.Model, s.Root)
+	}
+	return 0
+}
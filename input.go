@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// inputKind tells the chat loop what a submission is.
+type inputKind int
+
+const (
+	inputMessage inputKind = iota // text to send to the model
+	inputCommand                  // a chat command such as "/retry gpt-4o"
+)
+
+// submission is one complete unit of user input.
+type submission struct {
+	Kind    inputKind
+	Text    string
+	Command chatCommand // for inputCommand
+}
+
+// inputReader turns raw lines into submissions. It owns the only buffered
+// reader on its input for the whole session, so nothing read ahead for one
+// prompt is lost before the next.
+//
+// Input rules:
+//   - A single line is submitted when Enter is pressed.
+//   - A line ending in a backslash continues on the next line.
+//   - "/paste" starts paste mode, which ends with a line ":end" (or EOF);
+//     everything in between is one message, verbatim.
+//   - Command lines (see parseCommand) are only commands as the first line
+//     of a submission; inside a continuation or paste they are ordinary text.
+//   - EOF submits whatever was pending; on an empty prompt it returns io.EOF.
+type inputReader struct {
+	r      *bufio.Reader
+	editor *lineEditor // set when reading from a terminal
+	prompt io.Writer
+	eof    bool
+}
+
+// newInputReader reads from in. On a terminal, lines are read with the line
+// editor, which completes @file mentions on Tab.
+func newInputReader(in io.Reader, prompt io.Writer) *inputReader {
+	ir := &inputReader{r: bufio.NewReader(in), prompt: prompt}
+	if f, ok := in.(*os.File); ok {
+		if ir.editor = newLineEditor(f, prompt); ir.editor != nil {
+			ir.editor.complete = completeMention
+		}
+	}
+	return ir
+}
+
+// UseHistory makes earlier lines recallable with Up and passes new ones to
+// onAdd. It does nothing when the input is not a terminal.
+func (ir *inputReader) UseHistory(lines []string, onAdd func(string)) {
+	if ir.editor != nil {
+		ir.editor.history, ir.editor.onAdd = lines, onAdd
+	}
+}
+
+// Reset puts the terminal back in its normal mode, for when askgpt exits
+// while a line is being read.
+func (ir *inputReader) Reset() {
+	if ir.editor != nil {
+		ir.editor.Reset()
+	}
+}
+
+// readLine prints prompt and returns the next line without its line ending.
+// A final line without a newline is returned with a nil error; io.EOF is only
+// returned once nothing is left.
+func (ir *inputReader) readLine(prompt string) (string, error) {
+	if ir.eof {
+		return "", io.EOF
+	}
+	if ir.editor != nil {
+		line, err := ir.editor.ReadLine(prompt)
+		if errors.Is(err, io.EOF) {
+			ir.eof = true
+		}
+		return line, err
+	}
+	fmt.Fprint(ir.prompt, prompt)
+	line, err := ir.r.ReadString('\n')
+	if errors.Is(err, io.EOF) {
+		ir.eof = true
+		if line == "" {
+			return "", io.EOF
+		}
+		err = nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// Next prints prompt and reads the next submission.
+func (ir *inputReader) Next(prompt string) (submission, error) {
+	// The line editor redraws the last line of the prompt while editing.
+	if i := strings.LastIndex(prompt, "\n"); i >= 0 {
+		fmt.Fprint(ir.prompt, prompt[:i+1])
+		prompt = prompt[i+1:]
+	}
+	line, err := ir.readLine(prompt)
+	if err != nil {
+		return submission{}, err
+	}
+
+	if c, ok := parseCommand(line); ok {
+		if c.Name == "paste" {
+			return ir.readPaste()
+		}
+		return submission{Kind: inputCommand, Text: strings.TrimSpace(line), Command: c}, nil
+	}
+
+	var lines []string
+	for strings.HasSuffix(line, `\`) {
+		lines = append(lines, strings.TrimSuffix(line, `\`))
+		line, err = ir.readLine("")
+		if errors.Is(err, io.EOF) {
+			line = ""
+			break
+		}
+		if err != nil {
+			return submission{}, err
+		}
+	}
+	lines = append(lines, line)
+	return submission{Kind: inputMessage, Text: strings.Join(lines, "\n")}, nil
+}
+
+func (ir *inputReader) readPaste() (submission, error) {
+	fmt.Fprint(ir.prompt, "Paste mode: end with a single line \":end\"\n")
+	var lines []string
+	for {
+		line, err := ir.readLine("")
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return submission{}, err
+		}
+		if strings.TrimSpace(line) == ":end" {
+			break
+		}
+		lines = append(lines, line)
+	}
+	return submission{Kind: inputMessage, Text: strings.Join(lines, "\n")}, nil
+}
+
+// isTerminal reports whether f is an interactive terminal rather than a pipe,
+// a file or /dev/null.
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// readAll reads submissions from input until io.EOF.
+func readAll(t *testing.T, input string) []submission {
+	t.Helper()
+	ir := newInputReader(strings.NewReader(input), io.Discard)
+	var subs []submission
+	for {
+		sub, err := ir.Next("> ")
+		if errors.Is(err, io.EOF) {
+			return subs
+		}
+		if err != nil {
+			t.Fatalf("Next: %v", err)
+		}
+		subs = append(subs, sub)
+	}
+}
+
+func message(text string) submission {
+	return submission{Kind: inputMessage, Text: text}
+}
+
+func command(line, name, arg string) submission {
+	return submission{Kind: inputCommand, Text: line, Command: chatCommand{Name: name, Arg: arg}}
+}
+
+func TestInputReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []submission
+	}{
+		{"single line", "hello\n", []submission{message("hello")}},
+		{"last line without newline", "hello", []submission{message("hello")}},
+		{"lines are separate", "one\ntwo\n", []submission{message("one"), message("two")}},
+		{"continuation", "one\\\ntwo\\\nthree\nnext\n", []submission{message("one\ntwo\nthree"), message("next")}},
+		{"EOF mid-continuation", "one\\\n", []submission{message("one\n")}},
+		{
+			// The whole paste is one submission, and the line after :end
+			// is the next one.
+			"paste", "/paste\nfirst\n\nsecond\n:end\nafter\n",
+			[]submission{message("first\n\nsecond"), message("after")},
+		},
+		{"EOF mid-paste", "/paste\nfirst\nsecond", []submission{message("first\nsecond")}},
+		{"command", "/retry gpt-4o\n", []submission{command("/retry gpt-4o", "retry", "gpt-4o")}},
+		{"old command spelling", ":undo\n", []submission{command(":undo", "undo", "")}},
+		{"bare quit", "quit\n", []submission{command("quit", "quit", "")}},
+		{"command after continuation", "look at this\\\n/retry\n", []submission{message("look at this\n/retry")}},
+		{"command in paste", "/paste\n/retry\n:end\n", []submission{message("/retry")}},
+		{"path", "/etc/hosts is empty\n", []submission{message("/etc/hosts is empty")}},
+		{"unknown command", ":foo is a symbol in Ruby\n", []submission{message(":foo is a symbol in Ruby")}},
+		{"empty", "", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := readAll(t, tt.input)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %d submissions %q, want %d %q", len(got), got, len(tt.want), tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("submission %d = %q, want %q", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestInputReaderEOF(t *testing.T) {
+	ir := newInputReader(strings.NewReader(""), io.Discard)
+	for i := 0; i < 2; i++ {
+		if _, err := ir.Next("> "); !errors.Is(err, io.EOF) {
+			t.Fatalf("Next on an empty prompt: got %v, want io.EOF", err)
+		}
+	}
+}
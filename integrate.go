@@ -0,0 +1,183 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// contextAction is one file-manager menu entry, run on the selected files.
+type contextAction struct {
+	ID    string
+	Label string
+	Task  string
+}
+
+var contextActions = []contextAction{
+	{ID: "summarize", Label: "Summarize with askgpt", Task: "summarize"},
+	{ID: "translate", Label: "Translate with askgpt", Task: "translate-en"},
+	{ID: "explain", Label: "Explain with askgpt", Task: "explain"},
+}
+
+func runIntegrate(args []string) int {
+	fs := flag.NewFlagSet("integrate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	target := fs.String("target", "", "")
+	dir := fs.String("dir", "", "")
+	if err := fs.Parse(args); err != nil {
+		errorf("%v\n", err)
+		return 2
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		errorf("cannot locate askgpt binary: %v\n", err)
+		return 1
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	switch *target {
+	case "nautilus":
+		err = integrateNautilus(exe, *dir)
+	case "finder":
+		err = integrateFinder(exe, *dir)
+	case "explorer":
+		err = integrateExplorer(exe, *dir)
+	default:
+		fmt.Fprintf(os.Stderr, "Unsupported target: %q. Supported: nautilus, finder, explorer\n", *target)
+		return 2
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// shellQuote quotes s for POSIX sh.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func writeExecutable(path, content string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("cannot create dir %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	return nil
+}
+
+// integrateNautilus installs one script per action into the Nautilus scripts
+// folder; they show up under "Scripts" in the context menu. Each selected file
+// opens a terminal that prints the task's one answer for it, with --batch
+// so that a file given on a terminal does not start a chat.
+func integrateNautilus(exe, dir string) error {
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("cannot resolve home dir: %w", err)
+		}
+		dir = filepath.Join(home, ".local", "share", "nautilus", "scripts")
+	}
+	for _, a := range contextActions {
+		script := fmt.Sprintf(`#!/bin/sh
+# %s - generated by: askgpt integrate --target nautilus
+run='"$0" %s --batch --file "$1"; printf "\nPress Enter to close..."; read _'
+for f in "$@"; do
+	if command -v gnome-terminal >/dev/null 2>&1; then
+		gnome-terminal -- sh -c "$run" %s "$f"
+	else
+		x-terminal-emulator -e sh -c "$run" %s "$f"
+	fi
+done
+`, a.Label, a.Task, shellQuote(exe), shellQuote(exe))
+		path := filepath.Join(dir, a.Label)
+		if err := writeExecutable(path, script); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Installed %s\n", path)
+	}
+	return nil
+}
+
+// integrateFinder writes shell scripts meant for Automator Quick Actions.
+// Finder services are Automator bundles, so the last step is done by hand.
+func integrateFinder(exe, dir string) error {
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return fmt.Errorf("cannot resolve home dir: %w", err)
+		}
+		dir = filepath.Join(home, "Library", "Application Support", "askgpt", "finder")
+	}
+	for _, a := range contextActions {
+		script := fmt.Sprintf(`#!/bin/sh
+# %s - generated by: askgpt integrate --target finder
+for f in "$@"; do
+	osascript \
+		-e 'on run argv' \
+		-e 'tell application "Terminal" to do script (quoted form of item 1 of argv) & " %s --batch --file " & (quoted form of item 2 of argv)' \
+		-e 'tell application "Terminal" to activate' \
+		-e 'end run' %s "$f"
+done
+`, a.Label, a.Task, shellQuote(exe))
+		path := filepath.Join(dir, "askgpt-"+a.ID+".sh")
+		if err := writeExecutable(path, script); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+	}
+	fmt.Fprintln(os.Stderr, "\nTo add them to Finder's context menu, for each script:")
+	fmt.Fprintln(os.Stderr, "  1. Open Automator and create a new Quick Action")
+	fmt.Fprintln(os.Stderr, "  2. Set \"Workflow receives current\" to \"files or folders\" in \"Finder\"")
+	fmt.Fprintln(os.Stderr, "  3. Add \"Run Shell Script\" with \"Pass input: as arguments\" and the body: sh <script path> \"$@\"")
+	fmt.Fprintln(os.Stderr, "  4. Save it under the action name, e.g. \"Summarize with askgpt\"")
+	return nil
+}
+
+// integrateExplorer writes .reg files that add (and remove) per-user
+// context-menu entries for all file types.
+func integrateExplorer(exe, dir string) error {
+	if dir == "" {
+		dir = "."
+	}
+	regEscape := func(s string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(s, `\`, `\\`), `"`, `\"`)
+	}
+
+	var add, remove strings.Builder
+	add.WriteString("Windows Registry Editor Version 5.00\r\n")
+	remove.WriteString("Windows Registry Editor Version 5.00\r\n")
+	for _, a := range contextActions {
+		key := `HKEY_CURRENT_USER\Software\Classes\*\shell\askgpt.` + a.ID
+		// cmd /k keeps the window open so the answer can be read.
+		command := fmt.Sprintf(`cmd.exe /k ""%s" %s --batch --file "%%1""`, exe, a.Task)
+		fmt.Fprintf(&add, "\r\n[%s]\r\n@=\"%s\"\r\n", key, regEscape(a.Label))
+		fmt.Fprintf(&add, "\r\n[%s\\command]\r\n@=\"%s\"\r\n", key, regEscape(command))
+		fmt.Fprintf(&remove, "\r\n[-%s]\r\n", key)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return fmt.Errorf("cannot create dir %s: %w", dir, err)
+	}
+	files := []struct{ name, content string }{
+		{"askgpt-context-menu.reg", add.String()},
+		{"askgpt-context-menu-remove.reg", remove.String()},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, []byte(f.content), 0o644); err != nil {
+			return fmt.Errorf("cannot write %s: %w", path, err)
+		}
+		fmt.Fprintf(os.Stderr, "Wrote %s\n", path)
+	}
+	fmt.Fprintln(os.Stderr, "Double-click askgpt-context-menu.reg to add the entries to Explorer.")
+	return nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// errInterrupted is returned by the line editor when Ctrl-C is pressed.
+var errInterrupted = errors.New("interrupted")
+
+// completer proposes a completion for the line at the cursor. It returns
+// the new line and cursor position, plus the candidates to list when the
+// completion is ambiguous.
+type completer func(line []rune, pos int) (newLine []rune, newPos int, candidates []string)
+
+// lineEditor reads lines from a terminal in raw mode with readline-style
+// editing:
+//
+//	Left/Right, Ctrl-B/Ctrl-F   move by character
+//	Alt-B/Alt-F                 move by word
+//	Home/End, Ctrl-A/Ctrl-E     move to the start/end of the line
+//	Up/Down, Ctrl-P/Ctrl-N      recall earlier lines
+//	Backspace, Delete, Ctrl-D   delete a character (Ctrl-D on an empty line is EOF)
+//	Ctrl-W                      delete the word before the cursor
+//	Ctrl-U/Ctrl-K               delete to the start/end of the line
+//	Ctrl-L                      clear the screen
+//	Tab                         complete (see completer)
+//
+// The terminal is only raw while a line is being read; answers are printed
+// in the normal mode.
+type lineEditor struct {
+	fd       int
+	cooked   *term.State // the terminal's normal mode
+	in       io.Reader
+	out      io.Writer
+	complete completer
+	pending  []byte // read from the terminal but not yet handled
+
+	history []string
+	histPos int               // index into history while browsing it
+	draft   []rune            // the line being typed before browsing history
+	onAdd   func(line string) // called for each line added to history
+
+	prompt    string
+	line      []rune
+	pos       int
+	cursorRow int // row of the cursor relative to the prompt's first row
+}
+
+// newLineEditor returns an editor for f, or nil if f is not a terminal.
+func newLineEditor(f *os.File, out io.Writer) *lineEditor {
+	if !isTerminal(f) {
+		return nil
+	}
+	fd := int(f.Fd())
+	cooked, err := term.GetState(fd)
+	if err != nil {
+		return nil
+	}
+	return &lineEditor{fd: fd, cooked: cooked, in: f, out: out}
+}
+
+// Reset restores the terminal's normal mode. It is safe to call from
+// another goroutine while ReadLine runs.
+func (e *lineEditor) Reset() {
+	term.Restore(e.fd, e.cooked)
+}
+
+// AddHistory appends a line to the history recalled with Up.
+func (e *lineEditor) AddHistory(line string) {
+	if strings.TrimSpace(line) == "" || (len(e.history) > 0 && e.history[len(e.history)-1] == line) {
+		return
+	}
+	e.history = append(e.history, line)
+	if e.onAdd != nil {
+		e.onAdd(line)
+	}
+}
+
+// ReadLine shows prompt and returns the line typed after it. It returns
+// io.EOF for Ctrl-D on an empty line and errInterrupted for Ctrl-C.
+func (e *lineEditor) ReadLine(prompt string) (string, error) {
+	state, err := term.MakeRaw(e.fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(e.fd, state)
+
+	e.prompt, e.line, e.pos, e.cursorRow = prompt, nil, 0, 0
+	e.histPos, e.draft = len(e.history), nil
+	fmt.Fprint(e.out, prompt)
+	for {
+		r, err := e.readRune()
+		if err != nil {
+			return "", err
+		}
+		switch r {
+		case '\r', '\n':
+			e.moveToEnd()
+			fmt.Fprint(e.out, "\r\n")
+			line := string(e.line)
+			e.AddHistory(line)
+			return line, nil
+		case ctrl('C'):
+			e.moveToEnd()
+			fmt.Fprint(e.out, "^C\r\n")
+			return "", errInterrupted
+		case ctrl('D'):
+			if len(e.line) == 0 {
+				fmt.Fprint(e.out, "\r\n")
+				return "", io.EOF
+			}
+			e.deleteRange(e.pos, e.pos+1)
+		case 127, ctrl('H'):
+			e.deleteRange(e.pos-1, e.pos)
+		case ctrl('A'):
+			e.setPos(0)
+		case ctrl('E'):
+			e.setPos(len(e.line))
+		case ctrl('B'):
+			e.setPos(e.pos - 1)
+		case ctrl('F'):
+			e.setPos(e.pos + 1)
+		case ctrl('P'):
+			e.recall(-1)
+		case ctrl('N'):
+			e.recall(+1)
+		case ctrl('W'):
+			e.deleteRange(e.wordStart(), e.pos)
+		case ctrl('U'):
+			e.deleteRange(0, e.pos)
+		case ctrl('K'):
+			e.deleteRange(e.pos, len(e.line))
+		case ctrl('L'):
+			fmt.Fprint(e.out, "\x1b[H\x1b[2J")
+			e.cursorRow = 0
+			e.refresh()
+		case '\t':
+			e.tab()
+		case 27:
+			e.escape()
+		default:
+			if r >= ' ' {
+				e.insert(r)
+			}
+		}
+	}
+}
+
+func ctrl(c byte) rune { return rune(c & 0x1f) }
+
+// escape handles the key sequences starting with ESC. Keys without a
+// binding are dropped rather than echoed.
+func (e *lineEditor) escape() {
+	r, err := e.readRune()
+	if err != nil {
+		return
+	}
+	switch r {
+	case 'b':
+		e.setPos(e.wordStart())
+		return
+	case 'f':
+		e.setPos(e.wordEnd())
+		return
+	case '[', 'O':
+	default:
+		return
+	}
+
+	// CSI/SS3: parameters, then a final byte in 0x40-0x7E.
+	var params []rune
+	for {
+		r, err = e.readRune()
+		if err != nil {
+			return
+		}
+		if r >= 0x40 && r <= 0x7E {
+			break
+		}
+		params = append(params, r)
+	}
+	switch r {
+	case 'A':
+		e.recall(-1)
+	case 'B':
+		e.recall(+1)
+	case 'C':
+		if string(params) == "1;5" || string(params) == "1;3" { // Ctrl/Alt-Right
+			e.setPos(e.wordEnd())
+		} else {
+			e.setPos(e.pos + 1)
+		}
+	case 'D':
+		if string(params) == "1;5" || string(params) == "1;3" {
+			e.setPos(e.wordStart())
+		} else {
+			e.setPos(e.pos - 1)
+		}
+	case 'H':
+		e.setPos(0)
+	case 'F':
+		e.setPos(len(e.line))
+	case '~':
+		switch string(params) {
+		case "1", "7":
+			e.setPos(0)
+		case "4", "8":
+			e.setPos(len(e.line))
+		case "3":
+			e.deleteRange(e.pos, e.pos+1)
+		}
+	}
+}
+
+func (e *lineEditor) insert(r rune) {
+	e.line = append(e.line[:e.pos], append([]rune{r}, e.line[e.pos:]...)...)
+	e.pos++
+	cur := displayWidth(e.prompt) + displayWidth(string(e.line))
+	if e.pos == len(e.line) && cur%e.width() != 0 {
+		// Typing at the end of the line needs no redraw.
+		fmt.Fprint(e.out, string(r))
+		e.cursorRow = cur / e.width()
+		return
+	}
+	e.refresh()
+}
+
+func (e *lineEditor) deleteRange(from, to int) {
+	from, to = max(from, 0), min(to, len(e.line))
+	if from >= to {
+		return
+	}
+	e.line = append(e.line[:from], e.line[to:]...)
+	e.pos = from
+	e.refresh()
+}
+
+func (e *lineEditor) setPos(pos int) {
+	pos = max(0, min(pos, len(e.line)))
+	if pos != e.pos {
+		e.pos = pos
+		e.refresh()
+	}
+}
+
+func (e *lineEditor) wordStart() int {
+	i := e.pos
+	for i > 0 && unicode.IsSpace(e.line[i-1]) {
+		i--
+	}
+	for i > 0 && !unicode.IsSpace(e.line[i-1]) {
+		i--
+	}
+	return i
+}
+
+func (e *lineEditor) wordEnd() int {
+	i := e.pos
+	for i < len(e.line) && unicode.IsSpace(e.line[i]) {
+		i++
+	}
+	for i < len(e.line) && !unicode.IsSpace(e.line[i]) {
+		i++
+	}
+	return i
+}
+
+// recall replaces the line with an older (dir -1) or newer (+1) history
+// entry; going past the newest entry restores the line being typed.
+func (e *lineEditor) recall(dir int) {
+	next := e.histPos + dir
+	if next < 0 || next > len(e.history) {
+		return
+	}
+	if e.histPos == len(e.history) {
+		e.draft = append([]rune{}, e.line...)
+	}
+	e.histPos = next
+	if next == len(e.history) {
+		e.line = append([]rune{}, e.draft...)
+	} else {
+		e.line = []rune(e.history[next])
+	}
+	e.pos = len(e.line)
+	e.refresh()
+}
+
+func (e *lineEditor) tab() {
+	if e.complete == nil {
+		return
+	}
+	line, pos, candidates := e.complete(e.line, e.pos)
+	if len(candidates) > 1 {
+		e.moveToEnd()
+		fmt.Fprint(e.out, "\r\n"+strings.Join(candidates, "  ")+"\r\n")
+		e.cursorRow = 0
+	}
+	e.line, e.pos = line, pos
+	e.refresh()
+}
+
+func (e *lineEditor) width() int {
+	if w, _, err := term.GetSize(e.fd); err == nil && w > 0 {
+		return w
+	}
+	return 80
+}
+
+// refresh redraws the prompt and the line, which may wrap over several
+// rows, and puts the cursor in place.
+func (e *lineEditor) refresh() {
+	width := e.width()
+	if e.cursorRow > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dA", e.cursorRow)
+	}
+	fmt.Fprintf(e.out, "\r%s%s\x1b[J", e.prompt, string(e.line))
+
+	end := displayWidth(e.prompt) + displayWidth(string(e.line))
+	if end > 0 && end%width == 0 {
+		// At the right margin the terminal only wraps on the next
+		// character; wrap now so the cursor can be placed below.
+		fmt.Fprint(e.out, "\r\n")
+	}
+	cur := displayWidth(e.prompt) + displayWidth(string(e.line[:e.pos]))
+	if up := end/width - cur/width; up > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dA", up)
+	}
+	fmt.Fprint(e.out, "\r")
+	if col := cur % width; col > 0 {
+		fmt.Fprintf(e.out, "\x1b[%dC", col)
+	}
+	e.cursorRow = cur / width
+}
+
+// moveToEnd puts the cursor after the last character of the line, so
+// output that follows does not overwrite it.
+func (e *lineEditor) moveToEnd() {
+	if e.pos != len(e.line) {
+		e.pos = len(e.line)
+		e.refresh()
+	}
+}
+
+func (e *lineEditor) readRune() (rune, error) {
+	for !utf8.FullRune(e.pending) {
+		buf := make([]byte, 256)
+		n, err := e.in.Read(buf)
+		if n == 0 && err != nil {
+			if len(e.pending) == 0 {
+				return 0, err
+			}
+			break
+		}
+		e.pending = append(e.pending, buf[:n]...)
+	}
+	r, size := utf8.DecodeRune(e.pending)
+	e.pending = e.pending[size:]
+	return r, nil
+}
+
+// displayWidth is the number of terminal columns s takes up.
+func displayWidth(s string) int {
+	w := 0
+	for _, r := range s {
+		w += runeWidth(r)
+	}
+	return w
+}
+
+func runeWidth(r rune) int {
+	switch {
+	case r == 0 || r == 0x200B || unicode.In(r, unicode.Mn, unicode.Me, unicode.Cf):
+		return 0
+	case r >= 0x1100 && r <= 0x115F, // Hangul Jamo
+		r >= 0x2E80 && r <= 0xA4CF && r != 0x303F, // CJK ... Yi
+		r >= 0xAC00 && r <= 0xD7A3,                // Hangul syllables
+		r >= 0xF900 && r <= 0xFAFF,                // CJK compatibility ideographs
+		r >= 0xFE30 && r <= 0xFE4F,                // CJK compatibility forms
+		r >= 0xFF00 && r <= 0xFF60,                // fullwidth forms
+		r >= 0xFFE0 && r <= 0xFFE6,
+		r >= 0x1F300 && r <= 0x1F64F, // emoji
+		r >= 0x1F900 && r <= 0x1F9FF,
+		r >= 0x20000 && r <= 0x3FFFD:
+		return 2
+	}
+	return 1
+}
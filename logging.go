@@ -0,0 +1,148 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+const (
+	defaultLogMaxSize  = 10 // MB
+	defaultLogMaxFiles = 3
+)
+
+// LogConfig is the log: section of config.yaml. With a file, each request
+// and its outcome, retries and errors are logged to it, one JSON object a
+// line, so failures can be looked into after the fact. Level is debug,
+// info (the default), warn or error; debug adds the headers and streamed
+// lines --debug traces. The file is rotated when it reaches max_size MB,
+// keeping max_files old ones as file.1, file.2 and so on.
+//
+//	log:
+//	  file: ~/.askgpt/askgpt.log
+//	  level: info
+//	  max_size: 10
+//	  max_files: 3
+type LogConfig struct {
+	File     string `yaml:"file,omitempty"`
+	Level    string `yaml:"level,omitempty"`
+	MaxSize  int    `yaml:"max_size,omitempty"`
+	MaxFiles int    `yaml:"max_files,omitempty"`
+}
+
+// logger is where askgpt logs; it discards everything unless log.file is
+// set.
+var logger = slog.New(slog.NewJSONHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+
+// logEnabled reports whether anything is logged at level.
+func logEnabled(level slog.Level) bool {
+	return logger.Enabled(context.Background(), level)
+}
+
+// logFile is the file logger writes to, if any.
+var logFile *rotatingFile
+
+// openLog points logger at the file of cfg, if any, until closeLog.
+func openLog(cfg LogConfig) error {
+	if cfg.File == "" || logFile != nil {
+		return nil
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cmp.Or(cfg.Level, "info"))); err != nil {
+		return fmt.Errorf("unknown log.level %q in config.yaml (use debug, info, warn or error)", cfg.Level)
+	}
+	path, err := expandHome(cfg.File)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("cannot create log dir: %w", err)
+	}
+	w := &rotatingFile{path: path, maxSize: int64(cmp.Or(cfg.MaxSize, defaultLogMaxSize)) << 20, maxFiles: cmp.Or(cfg.MaxFiles, defaultLogMaxFiles)}
+	if err := w.open(); err != nil {
+		return err
+	}
+	logFile = w
+	logger = slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})).With("pid", os.Getpid())
+	return nil
+}
+
+// closeLog closes the file openLog opened.
+func closeLog() {
+	if logFile != nil {
+		logFile.Close()
+	}
+}
+
+// rotatingFile is a log file that is moved aside once it reaches maxSize,
+// keeping maxFiles old files.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("cannot open log file: %w", err)
+	}
+	r.f, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate moves the file to path.1, path.1 to path.2 and so on, dropping
+// the oldest, and starts a new file. Another askgpt may have rotated it
+// already; the renames then move whatever is there.
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+	r.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", r.path, r.maxFiles))
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot rotate log file: %w", err)
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// chunkParallel is how many parts of a long input are sent at once.
+	chunkParallel = 4
+	// notesHeader starts the combined notes that stand in for a long input.
+	notesHeader = "The text was too long to send at once, so here are notes on each of its parts, in order:\n\n"
+	chunkPrompt = "This is part %d of %d of a text too long to read at once. Write notes on it that keep its " +
+		"key points, facts, names, numbers and code, so the task below can be done on the whole text from the " +
+		"notes of all parts. Write only the notes.\n\nTask: %s\n\n---\n\n%s"
+)
+
+// chunkedInput returns what stands in for input when the task's prompt
+// with it does not fit the context window of the model: notes on its
+// parts, split as chunking says, written by the model in parallel and
+// condensed again until they fit. Input that fits is returned as it is.
+func (s *chatSession) chunkedInput(t turn, input string, chunking ChunkingConfig) (string, error) {
+	if err := chunking.validate(); err != nil {
+		return "", err
+	}
+	model := t.cfg.Model
+	system := countTokens(model, withSystemPrompts(t.opts, s.systemPrompts(), nil))
+	// The room left for the input in a request, after the system prompts,
+	// the task prompt and the answer.
+	room := contextWindow(s.cfgFile, model) - system - defaultMaxToken - textTokens(model, s.taskDef.Prompt) - messageOverhead
+	tokens := tokenLen(model, input)
+	if room <= 0 || tokens <= room {
+		return input, nil
+	}
+
+	task := strings.TrimSpace(strings.ReplaceAll(s.taskDef.Prompt, inputPlaceholder, ""))
+	// Each part is sent with the chunk prompt instead of the task prompt.
+	size := room - textTokens(model, chunkPrompt+task)
+	if size <= 0 {
+		return "", errors.New("the task prompt leaves no room for the input")
+	}
+	if chunking.Size > 0 {
+		size = min(size, chunking.Size)
+	}
+	for round := 1; ; round++ {
+		chunks := splitChunks(model, input, chunking, size)
+		if round == 1 {
+			fmt.Fprintf(os.Stderr, "[chunks] The input is too long for %s; writing notes on %d parts of up to %d tokens...\n",
+				model, len(chunks), size)
+		} else {
+			fmt.Fprintf(os.Stderr, "[chunks] The notes are still too long; condensing them in %d parts...\n", len(chunks))
+		}
+		parts, err := s.chunkNotes(t, chunks, task)
+		if err != nil {
+			return "", err
+		}
+		input = notesHeader + strings.Join(parts, "\n\n")
+		n := tokenLen(model, input)
+		if n <= room {
+			fmt.Fprintln(os.Stderr, "[chunks] Combining the notes...")
+			return input, nil
+		}
+		if n >= tokens {
+			return "", errors.New("the notes on the input do not get shorter than the context window")
+		}
+		// The notes are condensed in parts of whole notes.
+		tokens, chunking = n, ChunkingConfig{By: "paragraphs"}
+	}
+}
+
+// chunkNotes asks for notes on every chunk, chunkParallel at a time, and
+// returns them in order.
+func (s *chatSession) chunkNotes(t turn, chunks []string, task string) ([]string, error) {
+	ctx, stop := s.requestContext()
+	defer stop()
+	opts := taskOptions{noStream: true, sampling: t.opts.sampling}
+	notes, usage, err := writeChunkNotes(ctx, s.client, t.cfg, opts, chunks, task)
+	for _, u := range usage {
+		s.addCost(t.cfg.Model, u, true)
+	}
+	return notes, err
+}
+
+// writeChunkNotes does the work of chunkNotes outside a chat. It returns
+// the usage of every request, including those of a failed run.
+func writeChunkNotes(ctx context.Context, client *http.Client, cfg AskGPTConfig, opts taskOptions, chunks []string, task string) ([]string, []*Usage, error) {
+	notes := make([]string, len(chunks))
+	usage := make([]*Usage, len(chunks))
+	errs := make([]error, len(chunks))
+	jobs := make(chan int)
+	var mu sync.Mutex
+	done := 0
+	var wg sync.WaitGroup
+	for w := 0; w < min(chunkParallel, len(chunks)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				prompt := fmt.Sprintf(chunkPrompt, i+1, len(chunks), task, chunks[i])
+				req := newChatRequest(cfg, []Message{{Role: "user", Content: prompt}}, opts)
+				res, err := sendChat(ctx, client, cfg, req, nil)
+				if err == nil && res.FinishReason == "length" {
+					err = errors.New("the notes were cut off by the output limit")
+				}
+				notes[i], usage[i], errs[i] = fmt.Sprintf("Part %d:\n%s", i+1, strings.TrimSpace(res.Content)), res.Usage, err
+				mu.Lock()
+				done++
+				fmt.Fprintf(os.Stderr, "[chunks] %d of %d parts done\n", done, len(chunks))
+				mu.Unlock()
+			}
+		}()
+	}
+	for i := range chunks {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return nil, usage, fmt.Errorf("part %d: %w", i+1, err)
+		}
+	}
+	return notes, usage, nil
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// ANSI styles the Markdown renderer uses.
+const (
+	styleReset     = "\x1b[0m"
+	styleBold      = "\x1b[1m"
+	styleDim       = "\x1b[2m"
+	styleItalic    = "\x1b[3m"
+	styleUnderline = "\x1b[4m"
+	styleHeading   = "\x1b[1;35m"
+	styleCode      = "\x1b[36m"
+	styleKeyword   = "\x1b[1;34m"
+	styleString    = "\x1b[32m"
+	styleNumber    = "\x1b[33m"
+	styleComment   = "\x1b[2;37m"
+)
+
+// renderMarkdown reports whether answers are rendered: when there are
+// colors, unless --plain or --raw says otherwise.
+func renderMarkdown(opts taskOptions) bool {
+	return !opts.plain && !opts.raw && colorOutput
+}
+
+// mdRenderer renders streamed Markdown for the terminal a line at a time.
+// The line being streamed is shown as it comes and redrawn rendered once it
+// is complete; table rows are held back until the table ends, so that its
+// columns can be lined up.
+type mdRenderer struct {
+	w       io.Writer
+	width   int
+	height  int
+	hints   bool   // say how to copy code blocks
+	whole   bool   // rendering a whole text, not a stream: nothing is redrawn
+	wrap    bool   // wrap text at word boundaries to the width of the terminal
+	col     int    // the column the current line starts at
+	shown   string // the incomplete line, as shown
+	partial string // the incomplete line
+	fence   string // the fence of the code block we are in, if any
+	lang    string
+	table   []string
+	// The code block being streamed: its lines, the rows it takes up on
+	// screen with its header, and the column the header starts at.
+	block     []string
+	blockRows int
+	blockCol  int
+	blocks    int // code blocks rendered
+	// newline is owed for the last line rendered. It is written with what
+	// comes next, so the answer does not end with a blank line.
+	newline bool
+}
+
+// newMDRenderer returns a renderer writing to w, whose current line already
+// has col columns of other text, such as a prompt. With hints, code blocks
+// say how to copy them.
+func newMDRenderer(w io.Writer, col int, hints bool) *mdRenderer {
+	width, height := 80, 24
+	if cols, rows, err := term.GetSize(int(os.Stdout.Fd())); err == nil && cols > 0 {
+		width, height = cols, rows
+	}
+	return &mdRenderer{w: w, width: width, height: height, col: col, hints: hints}
+}
+
+func (r *mdRenderer) Write(p []byte) (int, error) {
+	r.write(string(p))
+	return len(p), nil
+}
+
+func (r *mdRenderer) write(s string) {
+	r.partial += s
+	for {
+		i := strings.IndexByte(r.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := r.partial[:i]
+		r.partial = r.partial[i+1:]
+		r.erase()
+		r.line(line)
+	}
+	if r.partial != r.shown && !r.holding() {
+		// Only what is new is printed; the rest is on screen.
+		if strings.HasPrefix(r.partial, r.shown) {
+			r.print(r.partial[len(r.shown):])
+		} else {
+			r.erase()
+			r.print(r.partial)
+		}
+		r.shown = r.partial
+	}
+}
+
+// render renders a whole text at once, for output that cannot be redrawn.
+func (r *mdRenderer) render(text string) {
+	r.whole = true
+	for _, line := range strings.Split(strings.TrimSuffix(text, "\n"), "\n") {
+		r.line(line)
+	}
+	if r.fence != "" {
+		r.endBlock()
+	}
+	r.endTable()
+}
+
+// holding reports whether the incomplete line is kept back: it may be a
+// table row.
+func (r *mdRenderer) holding() bool {
+	return r.fence == "" && strings.HasPrefix(strings.TrimSpace(r.partial), "|")
+}
+
+// flush renders what is left at the end of an answer.
+func (r *mdRenderer) flush() {
+	if r.partial != "" {
+		r.erase()
+		line := r.partial
+		r.partial = ""
+		r.line(line)
+	}
+	r.endTable()
+}
+
+// erase removes the incomplete line shown.
+func (r *mdRenderer) erase() {
+	if r.shown == "" {
+		return
+	}
+	end := r.col + displayWidth(r.shown)
+	if up := (end - 1) / r.width; up > 0 {
+		fmt.Fprintf(r.w, "\x1b[%dA", up)
+	}
+	fmt.Fprint(r.w, "\r")
+	if r.col > 0 {
+		fmt.Fprintf(r.w, "\x1b[%dC", r.col)
+	}
+	fmt.Fprint(r.w, "\x1b[J")
+	r.shown = ""
+}
+
+var (
+	headingRe = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	bulletRe  = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	orderedRe = regexp.MustCompile(`^(\s*)(\d+[.)])\s+(.*)$`)
+	ruleRe    = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+	tableSep  = regexp.MustCompile(`^\s*\|?\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+)
+
+// line renders a complete line.
+func (r *mdRenderer) line(line string) {
+	if r.wrap {
+		r.width = terminalWidth()
+	}
+	trimmed := strings.TrimSpace(line)
+	if r.fence != "" {
+		if strings.HasPrefix(trimmed, r.fence) && strings.Trim(trimmed, r.fence[:1]) == "" {
+			r.endBlock()
+			return
+		}
+		line = strings.ReplaceAll(line, "\t", "    ")
+		r.block = append(r.block, line)
+		r.blockRows += r.rows(2 + displayWidth(line))
+		if !r.whole {
+			r.emit(styleDim + "│ " + styleReset + highlightCode(r.lang, line))
+		}
+		return
+	}
+	if strings.HasPrefix(trimmed, "|") {
+		r.table = append(r.table, trimmed)
+		return
+	}
+	r.endTable()
+	if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+		r.fence = trimmed[:len(trimmed)-len(strings.TrimLeft(trimmed, trimmed[:1]))]
+		r.lang = strings.TrimSpace(trimmed[len(r.fence):])
+		r.block, r.blockCol = nil, r.col
+		r.blockRows = r.rows(r.col + 2 + displayWidth(r.lang))
+		if !r.whole {
+			r.emit(styleDim + "┌ " + r.lang + styleReset)
+		}
+		return
+	}
+	switch {
+	case headingRe.MatchString(line):
+		m := headingRe.FindStringSubmatch(line)
+		style := styleHeading
+		if len(m[1]) == 1 {
+			style += styleUnderline
+		}
+		r.emitText(style+stripInline(m[2])+styleReset, "")
+	case ruleRe.MatchString(line):
+		r.emit(styleDim + strings.Repeat("─", min(r.width, 40)) + styleReset)
+	case bulletRe.MatchString(line):
+		m := bulletRe.FindStringSubmatch(line)
+		r.emitText(m[1]+"• "+renderInline(m[2]), m[1]+"  ")
+	case orderedRe.MatchString(line):
+		m := orderedRe.FindStringSubmatch(line)
+		r.emitText(m[1]+styleBold+m[2]+styleReset+" "+renderInline(m[3]), m[1]+strings.Repeat(" ", len(m[2])+1))
+	case strings.HasPrefix(trimmed, ">"):
+		// The quote's style is set again after the border of each row.
+		quote := styleItalic + renderInline(strings.TrimSpace(strings.TrimPrefix(trimmed, ">"))) + styleReset
+		r.emitText(styleDim+"│ "+styleReset+quote, styleDim+"│ "+styleReset+styleItalic)
+	default:
+		r.emitText(renderInline(line), "")
+	}
+}
+
+// endBlock ends a code block. Its lines were highlighted one at a time as
+// they came; now that it is whole it is drawn again, highlighted as a whole
+// and numbered for /copy code, unless it no longer fits on the screen.
+func (r *mdRenderer) endBlock() {
+	r.blocks++
+	lang, block := r.lang, r.block
+	r.fence, r.lang, r.block = "", "", nil
+	footer := styleDim + "└" + strings.Repeat("─", min(r.width-1, 40)) + styleReset
+	if !r.whole {
+		if r.blockRows >= r.height {
+			r.emit(footer)
+			return
+		}
+		up := r.blockRows
+		if r.newline {
+			// The cursor is still on the last line of the block.
+			up--
+			r.newline = false
+		}
+		if up > 0 {
+			fmt.Fprintf(r.w, "\x1b[%dA", up)
+		}
+		fmt.Fprint(r.w, "\r")
+		if r.blockCol > 0 {
+			fmt.Fprintf(r.w, "\x1b[%dC", r.blockCol)
+		}
+		fmt.Fprint(r.w, "\x1b[J")
+	}
+
+	header := "┌─"
+	if lang != "" {
+		header += " " + lang + " ─"
+	}
+	if r.hints {
+		header += fmt.Sprintf(" /copy code %d ─", r.blocks)
+	}
+	r.emit(styleDim + header + styleReset)
+	for _, line := range strings.Split(highlightCode(lang, strings.Join(block, "\n")), "\n") {
+		r.emit(styleDim + "│ " + styleReset + line)
+	}
+	r.emit(footer)
+}
+
+// rows is how many rows of the screen a line of width columns takes up.
+func (r *mdRenderer) rows(width int) int {
+	return max(1, (width+r.width-1)/r.width)
+}
+
+// emitText writes a rendered line of text, wrapped if r.wrap is set with
+// indent in front of the rows after the first.
+func (r *mdRenderer) emitText(s, indent string) {
+	if r.wrap {
+		s = wrapLine(s, r.width, r.col, indent)
+	}
+	r.emit(s)
+}
+
+// emit writes a rendered line.
+func (r *mdRenderer) emit(s string) {
+	r.print(s)
+	r.newline, r.col = true, 0
+}
+
+func (r *mdRenderer) print(s string) {
+	if r.newline {
+		io.WriteString(r.w, "\n")
+		r.newline = false
+	}
+	io.WriteString(r.w, s)
+}
+
+// endTable renders the table rows held back, with the columns lined up.
+func (r *mdRenderer) endTable() {
+	if len(r.table) == 0 {
+		return
+	}
+	var rows [][]string
+	header := -1
+	for i, line := range r.table {
+		if tableSep.MatchString(line) && i == 1 {
+			header = 0
+			continue
+		}
+		line = strings.TrimSuffix(strings.TrimPrefix(line, "|"), "|")
+		var cells []string
+		for _, c := range strings.Split(line, "|") {
+			cells = append(cells, renderInline(strings.TrimSpace(c)))
+		}
+		rows = append(rows, cells)
+	}
+	r.table = nil
+	var widths []int
+	for _, row := range rows {
+		for i, c := range row {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], displayWidth(stripANSI(c)))
+		}
+	}
+	border := func(left, mid, right string) {
+		var parts []string
+		for _, w := range widths {
+			parts = append(parts, strings.Repeat("─", w+2))
+		}
+		r.emit(styleDim + left + strings.Join(parts, mid) + right + styleReset)
+	}
+	border("┌", "┬", "┐")
+	for i, row := range rows {
+		var b strings.Builder
+		b.WriteString(styleDim + "│" + styleReset)
+		for j, w := range widths {
+			c := ""
+			if j < len(row) {
+				c = row[j]
+			}
+			if i == header {
+				c = styleBold + c + styleReset
+			}
+			b.WriteString(" " + c + strings.Repeat(" ", w-displayWidth(stripANSI(c))) + " " + styleDim + "│" + styleReset)
+		}
+		r.emit(b.String())
+		if i == header {
+			border("├", "┼", "┤")
+		}
+	}
+	border("└", "┴", "┘")
+}
+
+var (
+	inlineCodeRe = regexp.MustCompile("`([^`]+)`")
+	boldRe       = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	italicRe     = regexp.MustCompile(`(^|[^*\w])\*([^*\s][^*]*)\*|(^|[^_\w])_([^_\s][^_]*)_`)
+	linkRe       = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	ansiRe       = regexp.MustCompile(`\x1b\[[0-9;]*[A-Za-z]`)
+)
+
+// renderInline styles code spans, bold, italics and links. Code spans are
+// set aside first so their contents are left alone.
+func renderInline(s string) string {
+	var spans []string
+	s = inlineCodeRe.ReplaceAllStringFunc(s, func(m string) string {
+		spans = append(spans, styleCode+m[1:len(m)-1]+styleReset)
+		return fmt.Sprintf("\x00%d\x00", len(spans)-1)
+	})
+	s = linkRe.ReplaceAllString(s, styleUnderline+"$1"+styleReset+styleDim+" ($2)"+styleReset)
+	s = boldRe.ReplaceAllString(s, styleBold+"$1$2"+styleReset)
+	s = italicRe.ReplaceAllString(s, "$1$3"+styleItalic+"$2$4"+styleReset)
+	for i, span := range spans {
+		s = strings.Replace(s, fmt.Sprintf("\x00%d\x00", i), span, 1)
+	}
+	return s
+}
+
+// stripInline drops the Markdown marks of inline styles, for text that is
+// styled as a whole.
+func stripInline(s string) string {
+	return stripANSI(renderInline(s))
+}
+
+func stripANSI(s string) string {
+	return ansiRe.ReplaceAllString(s, "")
+}
+
+// codeKeywords are the keywords highlighted in code blocks, by language.
+var codeKeywords = map[string][]string{
+	"go":     {"break", "case", "chan", "const", "continue", "default", "defer", "else", "fallthrough", "for", "func", "go", "goto", "if", "import", "interface", "map", "package", "range", "return", "select", "struct", "switch", "type", "var", "nil", "true", "false"},
+	"python": {"and", "as", "assert", "async", "await", "break", "class", "continue", "def", "del", "elif", "else", "except", "finally", "for", "from", "global", "if", "import", "in", "is", "lambda", "None", "nonlocal", "not", "or", "pass", "raise", "return", "True", "False", "try", "while", "with", "yield"},
+	"js":     {"async", "await", "break", "case", "catch", "class", "const", "continue", "default", "delete", "do", "else", "export", "extends", "false", "finally", "for", "function", "if", "import", "in", "instanceof", "let", "new", "null", "return", "switch", "this", "throw", "true", "try", "typeof", "undefined", "var", "void", "while", "yield", "interface", "type"},
+	"rust":   {"as", "async", "await", "break", "const", "continue", "crate", "else", "enum", "extern", "false", "fn", "for", "if", "impl", "in", "let", "loop", "match", "mod", "move", "mut", "pub", "ref", "return", "self", "Self", "static", "struct", "trait", "true", "type", "unsafe", "use", "where", "while"},
+	"c":      {"auto", "break", "case", "char", "class", "const", "continue", "default", "do", "double", "else", "enum", "extends", "false", "final", "float", "for", "if", "import", "int", "long", "namespace", "new", "null", "nullptr", "private", "protected", "public", "return", "short", "signed", "sizeof", "static", "struct", "switch", "template", "this", "throw", "true", "try", "typedef", "union", "unsigned", "void", "while"},
+	"sh":     {"case", "do", "done", "elif", "else", "esac", "export", "fi", "for", "function", "if", "in", "local", "return", "then", "until", "while"},
+	"sql":    {"select", "from", "where", "insert", "into", "values", "update", "set", "delete", "create", "table", "drop", "alter", "join", "left", "right", "inner", "outer", "on", "group", "by", "order", "having", "limit", "and", "or", "not", "null", "as", "distinct", "union", "index", "primary", "key"},
+}
+
+// codeLanguages maps the names code blocks are labeled with to those of
+// codeKeywords.
+var codeLanguages = map[string]string{
+	"go": "go", "golang": "go",
+	"python": "python", "py": "python",
+	"javascript": "js", "js": "js", "typescript": "js", "ts": "js", "jsx": "js", "tsx": "js",
+	"rust": "rust", "rs": "rust",
+	"c": "c", "cpp": "c", "c++": "c", "h": "c", "java": "c", "cs": "c", "csharp": "c", "kotlin": "c",
+	"sh": "sh", "bash": "sh", "zsh": "sh", "shell": "sh",
+	"sql": "sql",
+}
+
+// codeTokenRe matches the tokens highlightCode colors. Block comments and
+// triple-quoted or backquoted strings may span lines.
+var codeTokenRe = regexp.MustCompile(`(?m)(/\*[\s\S]*?(?:\*/|\z)|//.*$|#.*$|--.*$)` +
+	`|("""[\s\S]*?(?:"""|\z)|'''[\s\S]*?(?:'''|\z)|"(?:[^"\\\n]|\\.)*"|'(?:[^'\\\n]|\\.)*'|` + "`[^`]*`)" +
+	`|\b(\d+(?:\.\d+)?)\b|([A-Za-z_]\w*)`)
+
+// highlightCode colors code: comments, strings, numbers and the keywords
+// of lang. A language it does not know only gets the first three. Each
+// line of a token that spans lines is colored on its own, so the lines can
+// be printed with a border in front.
+func highlightCode(lang, code string) string {
+	family := codeLanguages[strings.ToLower(lang)]
+	keywords := map[string]bool{}
+	for _, k := range codeKeywords[family] {
+		keywords[k] = true
+		if family == "sql" {
+			keywords[strings.ToUpper(k)] = true
+		}
+	}
+	comments := map[string][]string{
+		"go": {"//", "/*"}, "js": {"//", "/*"}, "rust": {"//", "/*"}, "c": {"//", "/*"},
+		"python": {"#"}, "sh": {"#"}, "sql": {"--", "/*"},
+	}[family]
+	style := func(st, tok string) string {
+		return st + strings.ReplaceAll(tok, "\n", styleReset+"\n"+st) + styleReset
+	}
+	return codeTokenRe.ReplaceAllStringFunc(code, func(tok string) string {
+		switch {
+		case strings.HasPrefix(tok, "/") || strings.HasPrefix(tok, "#") || strings.HasPrefix(tok, "--"):
+			if !slices.ContainsFunc(comments, func(c string) bool { return strings.HasPrefix(tok, c) }) {
+				// Not a comment here: # in Go, or -- in a shell flag.
+				return tok[:1] + highlightCode(lang, tok[1:])
+			}
+			return style(styleComment, tok)
+		case strings.ContainsAny(tok[:1], "\"'`"):
+			return style(styleString, tok)
+		case tok[0] >= '0' && tok[0] <= '9':
+			return styleNumber + tok + styleReset
+		case keywords[tok]:
+			return styleKeyword + tok + styleReset
+		}
+		return tok
+	})
+}
@@ -0,0 +1,677 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// mcpProtocolVersion is the version of the Model Context Protocol
+	// askgpt speaks.
+	mcpProtocolVersion = "2024-11-05"
+	// mcpConnectTimeout is how long a server has to start and answer.
+	mcpConnectTimeout = 30 * time.Second
+)
+
+// MCPServer is an entry of the mcp_servers: section of config.yaml: a
+// Model Context Protocol server, either a command askgpt starts and talks
+// to over its stdin and stdout, or the URL of a server's SSE endpoint.
+//
+//	mcp_servers:
+//	  files:
+//	    command: npx
+//	    args: [-y, "@modelcontextprotocol/server-filesystem", /home/me/notes]
+//	  tracker:
+//	    url: https://mcp.example.com/sse
+//	    headers:
+//	      Authorization: Bearer xyz
+type MCPServer struct {
+	Command string            `yaml:"command,omitempty"`
+	Args    []string          `yaml:"args,omitempty"`
+	Env     map[string]string `yaml:"env,omitempty"`
+	URL     string            `yaml:"url,omitempty"`
+	Headers map[string]string `yaml:"headers,omitempty"`
+}
+
+// mcpNameRe matches what may not be in a tool name sent to the API.
+var mcpNameRe = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+// mcpMessage is a JSON-RPC 2.0 request, notification or response.
+type mcpMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  any             `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *mcpError       `json:"error,omitempty"`
+}
+
+type mcpError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *mcpError) Error() string { return e.Message }
+
+// mcpTool is a tool a server offers.
+type mcpTool struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	InputSchema json.RawMessage `json:"inputSchema"`
+}
+
+// mcpResource is a document a server offers.
+type mcpResource struct {
+	URI         string `json:"uri"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	MimeType    string `json:"mimeType,omitempty"`
+}
+
+// mcpContent is a part of what a tool returns or a resource holds.
+type mcpContent struct {
+	Type     string       `json:"type"`
+	Text     string       `json:"text"`
+	MimeType string       `json:"mimeType"`
+	Resource *mcpContents `json:"resource"`
+}
+
+type mcpContents struct {
+	URI      string `json:"uri"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text"`
+	Blob     string `json:"blob"`
+}
+
+// mcpClient is a connection to an MCP server. Messages are sent with
+// send, and those the server sends are passed to receive by the transport.
+type mcpClient struct {
+	name      string
+	send      func(ctx context.Context, msg []byte) error
+	close     func() error
+	resources bool // the server has resources
+	tools     []mcpTool
+
+	mu      sync.Mutex
+	nextID  int
+	pending map[string]chan mcpMessage
+	done    chan struct{} // closed when the connection is lost
+	err     error         // why it was lost
+}
+
+func newMCPClient(name string) *mcpClient {
+	return &mcpClient{name: name, pending: map[string]chan mcpMessage{}, done: make(chan struct{})}
+}
+
+// connectMCP starts or connects to a server and goes through the MCP
+// handshake.
+func connectMCP(name string, srv MCPServer) (*mcpClient, error) {
+	c := newMCPClient(name)
+	var err error
+	switch {
+	case srv.Command != "" && srv.URL != "":
+		return nil, fmt.Errorf("MCP server %s has both a command and a url", name)
+	case srv.Command != "":
+		err = c.startStdio(srv)
+	case srv.URL != "":
+		err = c.connectSSE(srv)
+	default:
+		return nil, fmt.Errorf("MCP server %s has neither a command nor a url", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to MCP server %s: %w", name, err)
+	}
+	if err := c.initialize(); err != nil {
+		c.close()
+		return nil, fmt.Errorf("cannot connect to MCP server %s: %w", name, err)
+	}
+	return c, nil
+}
+
+// startStdio starts the server's command. Messages go one to a line both
+// ways; what the server writes to stderr is kept to explain a failure.
+func (c *mcpClient) startStdio(srv MCPServer) error {
+	cmd := exec.Command(srv.Command, srv.Args...)
+	cmd.Env = os.Environ()
+	for k, v := range srv.Env {
+		cmd.Env = append(cmd.Env, k+"="+v)
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr := &tailBuffer{max: 4096}
+	cmd.Stderr = stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	var wmu sync.Mutex
+	c.send = func(ctx context.Context, msg []byte) error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		if _, err := stdin.Write(append(msg, '\n')); err != nil {
+			// The server has likely exited; what it said is more useful
+			// than a broken pipe.
+			select {
+			case <-c.done:
+				return c.err
+			case <-time.After(time.Second):
+				return err
+			}
+		}
+		return nil
+	}
+	c.close = func() error {
+		stdin.Close()
+		timer := time.AfterFunc(2*time.Second, func() { cmd.Process.Kill() })
+		defer timer.Stop()
+		return cmd.Wait()
+	}
+	go func() {
+		r := bufio.NewReader(stdout)
+		for {
+			line, err := r.ReadBytes('\n')
+			if len(bytes.TrimSpace(line)) > 0 {
+				c.receive(line)
+			}
+			if err != nil {
+				msg := "the server exited"
+				if s := strings.TrimSpace(stderr.String()); s != "" {
+					msg += ": " + s
+				}
+				c.lost(errors.New(msg))
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// connectSSE opens the server's event stream. Its first event names the
+// endpoint to post messages to; the answers come back on the stream.
+func (c *mcpClient) connectSSE(srv MCPServer) error {
+	base, err := url.Parse(srv.URL)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", srv.URL, nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	for k, v := range srv.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cancel()
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		cancel()
+		return errors.New(resp.Status)
+	}
+	c.close = func() error {
+		cancel()
+		return resp.Body.Close()
+	}
+
+	endpoint := make(chan string, 1)
+	go func() {
+		err := readSSE(resp.Body, func(event, data string) {
+			switch event {
+			case "endpoint":
+				select {
+				case endpoint <- data:
+				default:
+				}
+			case "", "message":
+				c.receive([]byte(data))
+			}
+		})
+		if err == nil {
+			err = errors.New("the server closed the connection")
+		}
+		c.lost(err)
+	}()
+	var post *url.URL
+	select {
+	case e := <-endpoint:
+		if post, err = base.Parse(e); err != nil {
+			c.close()
+			return fmt.Errorf("bad endpoint %q: %w", e, err)
+		}
+	case <-c.done:
+		return c.err
+	case <-time.After(mcpConnectTimeout):
+		c.close()
+		return errors.New("the server sent no endpoint")
+	}
+
+	client := &http.Client{Timeout: httpTimeout}
+	c.send = func(ctx context.Context, msg []byte) error {
+		req, err := http.NewRequestWithContext(ctx, "POST", post.String(), bytes.NewReader(msg))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range srv.Headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+		if resp.StatusCode/100 != 2 {
+			return errors.New(resp.Status)
+		}
+		return nil
+	}
+	return nil
+}
+
+// readSSE calls handle with every event of a text/event-stream.
+func readSSE(r io.Reader, handle func(event, data string)) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16<<20)
+	var event string
+	var data []string
+	for sc.Scan() {
+		line := sc.Text()
+		switch {
+		case line == "":
+			if len(data) > 0 {
+				handle(event, strings.Join(data, "\n"))
+			}
+			event, data = "", nil
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return sc.Err()
+}
+
+// receive handles a message from the server: an answer to a request of
+// ours, or a request of its own.
+func (c *mcpClient) receive(b []byte) {
+	var m mcpMessage
+	if err := json.Unmarshal(b, &m); err != nil {
+		return
+	}
+	if m.Method == "" {
+		c.mu.Lock()
+		ch := c.pending[string(m.ID)]
+		delete(c.pending, string(m.ID))
+		c.mu.Unlock()
+		if ch != nil {
+			ch <- m
+		}
+		return
+	}
+	if m.ID == nil {
+		return // a notification
+	}
+	// askgpt offers the server nothing, but answers its pings.
+	reply := mcpMessage{JSONRPC: "2.0", ID: m.ID}
+	if m.Method == "ping" {
+		reply.Result = json.RawMessage("{}")
+	} else {
+		reply.Error = &mcpError{Code: -32601, Message: "method not found"}
+	}
+	if b, err := json.Marshal(reply); err == nil {
+		go c.send(context.Background(), b)
+	}
+}
+
+// lost records that the connection is gone and fails the requests
+// waiting on it.
+func (c *mcpClient) lost(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	c.err = err
+	close(c.done)
+}
+
+// call sends a request and decodes its result into result.
+func (c *mcpClient) call(ctx context.Context, method string, params, result any) error {
+	c.mu.Lock()
+	c.nextID++
+	id := json.RawMessage(fmt.Sprint(c.nextID))
+	ch := make(chan mcpMessage, 1)
+	c.pending[string(id)] = ch
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, string(id))
+		c.mu.Unlock()
+	}()
+
+	b, err := json.Marshal(mcpMessage{JSONRPC: "2.0", ID: id, Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	if err := c.send(ctx, b); err != nil {
+		return err
+	}
+	select {
+	case m := <-ch:
+		if m.Error != nil {
+			return m.Error
+		}
+		if result == nil {
+			return nil
+		}
+		return json.Unmarshal(m.Result, result)
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		c.notify("notifications/cancelled", map[string]any{"requestId": id})
+		return ctx.Err()
+	}
+}
+
+// notify sends a notification, which has no answer.
+func (c *mcpClient) notify(method string, params any) error {
+	b, err := json.Marshal(mcpMessage{JSONRPC: "2.0", Method: method, Params: params})
+	if err != nil {
+		return err
+	}
+	return c.send(context.Background(), b)
+}
+
+// initialize goes through the handshake and fetches the server's tools.
+func (c *mcpClient) initialize() error {
+	ctx, cancel := context.WithTimeout(context.Background(), mcpConnectTimeout)
+	defer cancel()
+	var res struct {
+		Capabilities struct {
+			Tools     *struct{} `json:"tools"`
+			Resources *struct{} `json:"resources"`
+		} `json:"capabilities"`
+	}
+	err := c.call(ctx, "initialize", map[string]any{
+		"protocolVersion": mcpProtocolVersion,
+		"capabilities":    map[string]any{},
+		"clientInfo":      map[string]string{"name": "askgpt", "version": "1.0"},
+	}, &res)
+	if err != nil {
+		return err
+	}
+	if err := c.notify("notifications/initialized", nil); err != nil {
+		return err
+	}
+	c.resources = res.Capabilities.Resources != nil
+	if res.Capabilities.Tools == nil {
+		return nil
+	}
+	var cursor string
+	for {
+		var page struct {
+			Tools      []mcpTool `json:"tools"`
+			NextCursor string    `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "tools/list", cursorParams(cursor), &page); err != nil {
+			return fmt.Errorf("cannot list tools: %w", err)
+		}
+		c.tools = append(c.tools, page.Tools...)
+		if cursor = page.NextCursor; cursor == "" {
+			return nil
+		}
+	}
+}
+
+func cursorParams(cursor string) any {
+	if cursor == "" {
+		return nil
+	}
+	return map[string]string{"cursor": cursor}
+}
+
+// callTool runs one of the server's tools and returns what it said.
+func (c *mcpClient) callTool(ctx context.Context, name, args string) (string, error) {
+	if strings.TrimSpace(args) == "" {
+		args = "{}"
+	}
+	var res struct {
+		Content []mcpContent `json:"content"`
+		IsError bool         `json:"isError"`
+	}
+	err := c.call(ctx, "tools/call", map[string]any{"name": name, "arguments": json.RawMessage(args)}, &res)
+	if err != nil {
+		return "", err
+	}
+	text := mcpText(res.Content)
+	if res.IsError {
+		return "", errors.New(text)
+	}
+	return text, nil
+}
+
+// listResources returns the documents the server offers.
+func (c *mcpClient) listResources(ctx context.Context) ([]mcpResource, error) {
+	var all []mcpResource
+	var cursor string
+	for {
+		var page struct {
+			Resources  []mcpResource `json:"resources"`
+			NextCursor string        `json:"nextCursor"`
+		}
+		if err := c.call(ctx, "resources/list", cursorParams(cursor), &page); err != nil {
+			return nil, err
+		}
+		all = append(all, page.Resources...)
+		if cursor = page.NextCursor; cursor == "" {
+			return all, nil
+		}
+	}
+}
+
+// readResource returns the text of a document the server offers.
+func (c *mcpClient) readResource(ctx context.Context, uri string) (string, error) {
+	var res struct {
+		Contents []mcpContents `json:"contents"`
+	}
+	if err := c.call(ctx, "resources/read", map[string]string{"uri": uri}, &res); err != nil {
+		return "", err
+	}
+	var parts []string
+	for _, r := range res.Contents {
+		parts = append(parts, mcpContentsText(r))
+	}
+	return strings.Join(parts, "\n\n"), nil
+}
+
+// mcpText renders the content a tool returned as text for the model.
+func mcpText(content []mcpContent) string {
+	var parts []string
+	for _, p := range content {
+		switch {
+		case p.Type == "text":
+			parts = append(parts, p.Text)
+		case p.Type == "resource" && p.Resource != nil:
+			parts = append(parts, mcpContentsText(*p.Resource))
+		default:
+			parts = append(parts, fmt.Sprintf("[%s %s]", p.Type, p.MimeType))
+		}
+	}
+	return strings.Join(parts, "\n\n")
+}
+
+func mcpContentsText(r mcpContents) string {
+	if r.Blob != "" && r.Text == "" {
+		return fmt.Sprintf("[%s: binary %s]", r.URI, r.MimeType)
+	}
+	return r.Text
+}
+
+// mcpToolName is the name a server's tool goes by for the model: the
+// server's name and the tool's, so that two servers may have tools of the
+// same name.
+func mcpToolName(server, tool string) string {
+	name := mcpNameRe.ReplaceAllString(server+"__"+tool, "_")
+	return name[:min(len(name), 64)]
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	mu  sync.Mutex
+	max int
+	b   []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.b = append(t.b, p...)
+	if len(t.b) > t.max {
+		t.b = t.b[len(t.b)-t.max:]
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return string(t.b)
+}
+
+// loadMCP connects to the MCP servers tools.mcp and --mcp name, and gives
+// the model their tools, and tools to list and read their resources.
+func (s *chatSession) loadMCP(names []string) error {
+	seen := map[string]bool{}
+	for _, list := range slices.Concat(s.cfgFile.Tools.MCP, names) {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			srv, ok := s.cfgFile.MCPServers[name]
+			if !ok {
+				return fmt.Errorf("no MCP server named %q in mcp_servers", name)
+			}
+			c, err := connectMCP(name, srv)
+			if err != nil {
+				return err
+			}
+			s.mcp = append(s.mcp, c)
+			s.addMCPTools(c)
+			fmt.Fprintf(os.Stderr, "[mcp] %s: %d tools", name, len(c.tools))
+			if c.resources {
+				fmt.Fprint(os.Stderr, ", resources")
+			}
+			fmt.Fprintln(os.Stderr)
+		}
+	}
+	return nil
+}
+
+func (s *chatSession) addMCPTools(c *mcpClient) {
+	for _, t := range c.tools {
+		params := t.InputSchema
+		if len(params) == 0 {
+			params = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+		name := t.Name
+		s.addTool(localTool{
+			Def: Tool{Type: "function", Function: ToolFunction{Name: mcpToolName(c.name, name), Description: t.Description, Parameters: params}},
+			Run: func(ctx context.Context, args string) (string, error) { return c.callTool(ctx, name, args) },
+		})
+	}
+	if !c.resources {
+		return
+	}
+	s.addTool(newTool(mcpToolName(c.name, "list_resources"), "Lists the documents the "+c.name+" server offers, by URI.", `{"type":"object","properties":{}}`,
+		func(ctx context.Context, args string) (string, error) {
+			resources, err := c.listResources(ctx)
+			if err != nil {
+				return "", err
+			}
+			var b strings.Builder
+			for _, r := range resources {
+				fmt.Fprintf(&b, "%s (%s)", r.URI, r.Name)
+				if r.Description != "" {
+					fmt.Fprintf(&b, ": %s", r.Description)
+				}
+				b.WriteString("\n")
+			}
+			if b.Len() == 0 {
+				return "There are no resources.", nil
+			}
+			return b.String(), nil
+		}))
+	s.addTool(newTool(mcpToolName(c.name, "read_resource"), "Returns the text of a document the "+c.name+" server offers.",
+		`{"type":"object","properties":{"uri":{"type":"string"}},"required":["uri"]}`,
+		func(ctx context.Context, args string) (string, error) {
+			var in struct {
+				URI string `json:"uri"`
+			}
+			if err := decodeToolArgs(args, &in); err != nil {
+				return "", err
+			}
+			return c.readResource(ctx, in.URI)
+		}))
+}
+
+// closeMCP disconnects from the MCP servers, stopping those askgpt started.
+func (s *chatSession) closeMCP() {
+	for _, c := range s.mcp {
+		c.close()
+	}
+	s.mcp = nil
+}
+
+// mcpCommand handles "/mcp": it lists the servers connected and their
+// tools.
+func (s *chatSession) mcpCommand() {
+	if len(s.mcp) == 0 {
+		fmt.Fprintln(os.Stderr, "No MCP servers connected (see --mcp).")
+		return
+	}
+	for _, c := range s.mcp {
+		state := "connected"
+		select {
+		case <-c.done:
+			state = "disconnected: " + c.err.Error()
+		default:
+		}
+		fmt.Fprintf(os.Stderr, "%s (%s)\n", c.name, state)
+		for _, t := range c.tools {
+			fmt.Fprintf(os.Stderr, "  %-24s %s\n", mcpToolName(c.name, t.Name), firstLine(t.Description, 60))
+		}
+		if c.resources {
+			fmt.Fprintf(os.Stderr, "  %-24s %s\n", mcpToolName(c.name, "list_resources"), "Lists its resources")
+			fmt.Fprintf(os.Stderr, "  %-24s %s\n", mcpToolName(c.name, "read_resource"), "Reads one of them")
+		}
+	}
+}
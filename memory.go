@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	memoryFileName = "memory.md"
+	// memoryPreamble introduces the memory notes to the model.
+	memoryPreamble = "Notes the user wants you to remember in every conversation:\n\n"
+)
+
+// memoryPath returns ~/.askgpt/memory.md: notes such as the user's name,
+// preferences and projects, sent as a system prompt in every chat.
+func memoryPath() (string, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(cfgPath), memoryFileName), nil
+}
+
+// loadMemory returns the memory notes, or "" when there are none.
+func loadMemory() (string, error) {
+	path, err := memoryPath()
+	if err != nil {
+		return "", err
+	}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+// memoryPrompt returns the system prompt carrying the memory notes, or ""
+// when there are none.
+func memoryPrompt(notes string) string {
+	if notes == "" {
+		return ""
+	}
+	return memoryPreamble + notes
+}
+
+func runMemory(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt memory show|edit|add <note>|clear")
+		return 2
+	}
+	path, err := memoryPath()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	switch args[0] {
+	case "show":
+		var notes string
+		if notes, err = loadMemory(); err != nil {
+			break
+		}
+		if notes == "" {
+			fmt.Fprintln(os.Stderr, "No memory notes. Add some with: askgpt memory add <note>")
+			return 0
+		}
+		fmt.Println(notes)
+		return 0
+	case "edit":
+		err = editMemory(path)
+	case "add":
+		note := strings.TrimSpace(strings.Join(args[1:], " "))
+		if note == "" {
+			fmt.Fprintln(os.Stderr, "Usage: askgpt memory add <note>")
+			return 2
+		}
+		if err = addMemory(path, note); err == nil {
+			fmt.Fprintf(os.Stderr, "Added to %s.\n", path)
+		}
+	case "clear":
+		err = os.Remove(path)
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		if err == nil {
+			fmt.Fprintln(os.Stderr, "Memory cleared.")
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown memory command %q (use show, edit, add or clear)\n", args[0])
+		return 2
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// editMemory opens memory.md in the editor, creating it first so the
+// editor has something to open.
+func editMemory(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), configDirPerm); err != nil {
+		return fmt.Errorf("cannot create dir %s: %w", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, configFilePerm)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	f.Close()
+	return runEditor(path)
+}
+
+// addMemory appends note to memory.md as a list item.
+func addMemory(path, note string) error {
+	if strings.ContainsAny(note, "\r\n") {
+		return errors.New("a note must be a single line; use askgpt memory edit for more")
+	}
+	notes, err := loadMemory()
+	if err != nil {
+		return err
+	}
+	if notes != "" {
+		notes += "\n"
+	}
+	notes += "- " + note + "\n"
+	if err := os.MkdirAll(filepath.Dir(path), configDirPerm); err != nil {
+		return fmt.Errorf("cannot create dir %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, []byte(notes), configFilePerm); err != nil {
+		return fmt.Errorf("cannot write %s: %w", path, err)
+	}
+	return nil
+}
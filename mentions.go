@@ -0,0 +1,125 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// mentionRe matches an @mention at the start of a word.
+var mentionRe = regexp.MustCompile(`(^|\s)@(\S+)`)
+
+// expandMentions attaches the files named as @path in a message. The mention
+// is replaced by the bare path and the file follows the text, fenced and
+// labeled with its name. Mentions of paths that are not files, like @someone,
+// are left alone.
+func expandMentions(text string, forceBase64 bool) (string, []attachment, error) {
+	var files []attachment
+	var firstErr error
+	seen := map[string]bool{}
+	text = mentionRe.ReplaceAllStringFunc(text, func(m string) string {
+		sub := mentionRe.FindStringSubmatch(m)
+		// Allow punctuation after the mention, e.g. "look at @main.go, please".
+		path := strings.TrimRight(sub[2], ".,;:!?)'\"")
+		fi, err := os.Stat(path)
+		if err != nil || !fi.Mode().IsRegular() {
+			return m
+		}
+		if !seen[path] && firstErr == nil {
+			seen[path] = true
+			b, err := os.ReadFile(path)
+			if err == nil {
+				var content string
+				if content, err = decodeTextInput(path, b, forceBase64); err == nil {
+					files = append(files, attachment{Name: path, Text: content})
+				}
+			}
+			firstErr = err
+		}
+		return sub[1] + sub[2]
+	})
+	if firstErr != nil {
+		return "", nil, firstErr
+	}
+
+	var b strings.Builder
+	b.WriteString(text)
+	for _, f := range files {
+		b.WriteString("\n\n")
+		b.WriteString(fenceFile(f.Name, f.Text))
+	}
+	return b.String(), files, nil
+}
+
+// withMentions expands the @file mentions in a typed message, reporting the
+// size of what is attached like file arguments do.
+func withMentions(text string, opts taskOptions) (string, error) {
+	text, files, err := expandMentions(text, opts.forceBase64)
+	if err == nil {
+		reportAttachments(files, text)
+	}
+	return text, err
+}
+
+// completeMention completes the @path word before the cursor with the file
+// names in its directory.
+func completeMention(line []rune, pos int) ([]rune, int, []string) {
+	start := pos
+	for start > 0 && !unicode.IsSpace(line[start-1]) {
+		start--
+	}
+	word := string(line[start:pos])
+	mention := "@"
+	if strings.HasPrefix(word, imageMentionPrefix) {
+		mention = imageMentionPrefix
+	}
+	if !strings.HasPrefix(word, mention) {
+		return line, pos, nil
+	}
+	partial := word[len(mention):]
+	dir, prefix := filepath.Split(partial)
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	entries, err := os.ReadDir(readDir)
+	if err != nil {
+		return line, pos, nil
+	}
+
+	var names []string
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, prefix) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(prefix, ".")) {
+			continue
+		}
+		if e.IsDir() {
+			name += string(filepath.Separator)
+		}
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return line, pos, nil
+	}
+	sort.Strings(names)
+
+	common := names[0]
+	for _, n := range names[1:] {
+		for !strings.HasPrefix(n, common) {
+			common = common[:len(common)-1]
+		}
+	}
+	completed := []rune(mention + dir + common)
+	if len(names) == 1 && !strings.HasSuffix(common, string(filepath.Separator)) {
+		completed = append(completed, ' ')
+	}
+	newLine := append(append(append([]rune{}, line[:start]...), completed...), line[pos:]...)
+	newPos := start + len(completed)
+	if len(names) > 1 && common == prefix {
+		return newLine, newPos, names
+	}
+	return newLine, newPos, nil
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	mockURL            = "http://mock.askgpt/v1"
+	mockModel          = "mock"
+	defaultMockChunk   = 8 // characters
+	defaultMockDelay   = 20 * time.Millisecond
+	mockEmbeddingWidth = 64
+)
+
+// MockConfig is the mock: section of config.yaml, for provider: mock under
+// askgpt. The mock provider answers without a key or network: each
+// message gets the reply of the first of responses whose match, a regular
+// expression, matches it (no match matches everything), and otherwise is
+// echoed. {{message}} in a reply stands for the message. Answers are
+// streamed in chunks of chunk_size characters, chunk_delay apart, after
+// latency.
+//
+//	askgpt:
+//	  provider: mock
+//	mock:
+//	  latency: 300ms
+//	  chunk_delay: 30ms
+//	  chunk_size: 4
+//	  responses:
+//	    - match: '(?i)\bhello\b'
+//	      reply: Hello! How can I help?
+//	    - reply: 'You said: {{message}}'
+type MockConfig struct {
+	Latency    string         `yaml:"latency,omitempty"`
+	ChunkDelay string         `yaml:"chunk_delay,omitempty"`
+	ChunkSize  int            `yaml:"chunk_size,omitempty"`
+	Responses  []MockResponse `yaml:"responses,omitempty"`
+}
+
+type MockResponse struct {
+	Match string `yaml:"match,omitempty"`
+	Reply string `yaml:"reply"`
+}
+
+// mockProvider is a RoundTripper that plays an OpenAI-compatible API: it
+// answers chat completions, embeddings and moderations.
+type mockProvider struct {
+	latency    time.Duration
+	chunkDelay time.Duration
+	chunkSize  int
+	matches    []*regexp.Regexp
+	replies    []string
+}
+
+func newMockProvider(cfg MockConfig) (*mockProvider, error) {
+	m := &mockProvider{chunkDelay: defaultMockDelay, chunkSize: defaultMockChunk}
+	for _, d := range []struct {
+		name  string
+		value string
+		to    *time.Duration
+	}{{"latency", cfg.Latency, &m.latency}, {"chunk_delay", cfg.ChunkDelay, &m.chunkDelay}} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("mock.%s %q in config.yaml is not a duration such as 50ms", d.name, d.value)
+		}
+		*d.to = v
+	}
+	if cfg.ChunkSize > 0 {
+		m.chunkSize = cfg.ChunkSize
+	}
+	for i, r := range cfg.Responses {
+		re, err := regexp.Compile(r.Match)
+		if err != nil {
+			return nil, fmt.Errorf("mock.responses[%d].match in config.yaml: %w", i, err)
+		}
+		m.matches = append(m.matches, re)
+		m.replies = append(m.replies, r.Reply)
+	}
+	return m, nil
+}
+
+// apiClient returns the client for API requests, which answers them itself
+// with provider: mock, and logs and traces them when there is a log or
+// telemetry.
+func apiClient(cfg ConfigFile) *http.Client {
+	client := providerClient(cfg)
+	if logEnabled(slog.LevelError) || telemetry != nil {
+		client.Transport = traceTransport{base: client.Transport}
+	}
+	return client
+}
+
+// providerClient is apiClient without the logging and tracing, for task mode to add
+// its own transports under it.
+func providerClient(cfg ConfigFile) *http.Client {
+	client := &http.Client{Timeout: httpTimeout}
+	if cfg.AskGPT.Provider == "mock" {
+		// The config was checked when it was loaded.
+		if m, err := newMockProvider(cfg.Mock); err == nil {
+			client.Transport = m
+		}
+	}
+	return client
+}
+
+func (m *mockProvider) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		b, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = b
+	}
+	if err := sleepContext(req.Context(), m.latency); err != nil {
+		return nil, err
+	}
+	path := req.URL.Path
+	switch {
+	case strings.HasSuffix(path, "/chat/completions"):
+		var cr mockChatRequest
+		if err := json.Unmarshal(body, &cr); err != nil {
+			return mockError(req, http.StatusBadRequest, "invalid request: "+err.Error()), nil
+		}
+		return m.chat(req, cr), nil
+	case strings.HasSuffix(path, "/embeddings"):
+		return m.embeddings(req, body), nil
+	case strings.HasSuffix(path, "/moderations"):
+		return mockJSON(req, map[string]any{"results": []any{map[string]any{"flagged": false, "categories": map[string]bool{}}}}), nil
+	}
+	return mockError(req, http.StatusNotFound, "the mock provider does not answer "+path), nil
+}
+
+// reply picks the answer to message.
+func (m *mockProvider) reply(message string) string {
+	for i, re := range m.matches {
+		if re.MatchString(message) {
+			return strings.ReplaceAll(m.replies[i], "{{message}}", message)
+		}
+	}
+	return "This is a mock answer to: " + message
+}
+
+// mockChatRequest is the part of a chat completion request the mock
+// provider looks at. Content is a string, or a list of parts when there are
+// images.
+type mockChatRequest struct {
+	Model         string         `json:"model"`
+	Stream        bool           `json:"stream"`
+	StreamOptions *StreamOptions `json:"stream_options"`
+	Messages      []struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"messages"`
+}
+
+func (m *mockProvider) chat(req *http.Request, cr mockChatRequest) *http.Response {
+	var message string
+	prompt := 0
+	for _, msg := range cr.Messages {
+		var text string
+		if json.Unmarshal(msg.Content, &text) != nil {
+			var parts []struct {
+				Text string `json:"text"`
+			}
+			json.Unmarshal(msg.Content, &parts)
+			for _, p := range parts {
+				text += p.Text
+			}
+		}
+		prompt += textTokens(cr.Model, text) + messageOverhead
+		if msg.Role == "user" {
+			message = text
+		}
+	}
+	answer := m.reply(message)
+	usage := &Usage{PromptTokens: prompt, CompletionTokens: textTokens(cr.Model, answer)}
+	usage.TotalTokens = usage.PromptTokens + usage.CompletionTokens
+
+	if !cr.Stream {
+		return mockJSON(req, map[string]any{
+			"id":    "mock",
+			"model": cr.Model,
+			"choices": []any{map[string]any{
+				"message":       map[string]any{"role": "assistant", "content": answer},
+				"finish_reason": "stop",
+			}},
+			"usage": usage,
+		})
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		event := func(v any) error {
+			b, _ := json.Marshal(v)
+			_, err := fmt.Fprintf(pw, "data: %s\n\n", b)
+			return err
+		}
+		chunk := func(delta map[string]any, finish any) map[string]any {
+			return map[string]any{"id": "mock", "model": cr.Model, "choices": []any{map[string]any{"index": 0, "delta": delta, "finish_reason": finish}}}
+		}
+		runes := []rune(answer)
+		for i := 0; i < len(runes); i += m.chunkSize {
+			if i > 0 {
+				if err := sleepContext(req.Context(), m.chunkDelay); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+			}
+			piece := string(runes[i:min(i+m.chunkSize, len(runes))])
+			if event(chunk(map[string]any{"content": piece}, nil)) != nil {
+				return
+			}
+		}
+		event(chunk(map[string]any{}, "stop"))
+		if cr.StreamOptions != nil && cr.StreamOptions.IncludeUsage {
+			event(map[string]any{"choices": []any{}, "usage": usage})
+		}
+		fmt.Fprint(pw, "data: [DONE]\n\n")
+		pw.Close()
+	}()
+	// Closing the body stops the writer.
+	resp := mockResponse(req, http.StatusOK, "text/event-stream", nil)
+	resp.Body, resp.ContentLength = pr, -1
+	return resp
+}
+
+// embeddings answers with vectors made from a hash of each input, so the
+// same text always gets the same vector.
+func (m *mockProvider) embeddings(req *http.Request, body []byte) *http.Response {
+	var er struct {
+		Input any `json:"input"`
+	}
+	if err := json.Unmarshal(body, &er); err != nil {
+		return mockError(req, http.StatusBadRequest, "invalid request: "+err.Error())
+	}
+	var inputs []string
+	switch in := er.Input.(type) {
+	case string:
+		inputs = []string{in}
+	case []any:
+		for _, v := range in {
+			inputs = append(inputs, fmt.Sprint(v))
+		}
+	}
+	var data []any
+	for i, text := range inputs {
+		vec := make([]float32, mockEmbeddingWidth)
+		var norm float64
+		for j := range vec {
+			h := fnv.New32a()
+			fmt.Fprintf(h, "%d:%s", j, text)
+			vec[j] = float32(h.Sum32())/math.MaxUint32*2 - 1
+			norm += float64(vec[j]) * float64(vec[j])
+		}
+		for j := range vec {
+			vec[j] /= float32(math.Sqrt(norm))
+		}
+		data = append(data, map[string]any{"index": i, "embedding": vec})
+	}
+	return mockJSON(req, map[string]any{"data": data, "usage": map[string]int{"prompt_tokens": 0, "total_tokens": 0}})
+}
+
+func mockJSON(req *http.Request, v any) *http.Response {
+	b, _ := json.Marshal(v)
+	resp := mockResponse(req, http.StatusOK, "application/json", strings.NewReader(string(b)))
+	resp.ContentLength = int64(len(b))
+	return resp
+}
+
+func mockError(req *http.Request, status int, message string) *http.Response {
+	b, _ := json.Marshal(map[string]any{"error": map[string]string{"message": message, "type": "mock_error"}})
+	return mockResponse(req, status, "application/json", strings.NewReader(string(b)))
+}
+
+func mockResponse(req *http.Request, status int, contentType string, body io.Reader) *http.Response {
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		StatusCode: status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": {contentType}},
+		Body:       io.NopCloser(body),
+		Request:    req,
+	}
+}
+
+// sleepContext waits for d, or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
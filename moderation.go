@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+const defaultModerationModel = "omni-moderation-latest"
+
+// ModerationConfig is the moderation: section of config.yaml. Messages,
+// with input, and answers, with output, are checked with the moderations
+// endpoint; flagged ones are sent or kept with a warning (warn), or not at
+// all (block).
+//
+//	moderation:
+//	  input: block
+//	  output: warn
+//	  model: omni-moderation-latest
+type ModerationConfig struct {
+	Input  string `yaml:"input,omitempty"`
+	Output string `yaml:"output,omitempty"`
+	Model  string `yaml:"model,omitempty"`
+}
+
+func (c ModerationConfig) validate() error {
+	for _, m := range []struct{ name, value string }{{"input", c.Input}, {"output", c.Output}} {
+		switch m.value {
+		case "", "off", "warn", "block":
+		default:
+			return fmt.Errorf("unknown moderation.%s %q in config.yaml (use off, warn or block)", m.name, m.value)
+		}
+	}
+	return nil
+}
+
+type moderationResponse struct {
+	Results []struct {
+		Flagged    bool            `json:"flagged"`
+		Categories map[string]bool `json:"categories"`
+	} `json:"results"`
+}
+
+// moderate checks text with the moderations endpoint and returns the
+// categories it is flagged for, none if it is not.
+func moderate(ctx context.Context, client *http.Client, cfg ConfigFile, text string) ([]string, error) {
+	model := cfg.Moderation.Model
+	if model == "" {
+		model = defaultModerationModel
+	}
+	body, err := json.Marshal(map[string]string{"model": model, "input": redactOutgoing(text)})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doAPIRequest(ctx, client, cfg.AskGPT, apiEndpoint(cfg.AskGPT, "moderations"), "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var out moderationResponse
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return nil, fmt.Errorf("cannot decode response: %w", err)
+	}
+	var flagged []string
+	for _, r := range out.Results {
+		if !r.Flagged {
+			continue
+		}
+		for category, on := range r.Categories {
+			if on && !slices.Contains(flagged, category) {
+				flagged = append(flagged, category)
+			}
+		}
+		if len(flagged) == 0 {
+			flagged = append(flagged, "unspecified")
+		}
+	}
+	slices.Sort(flagged)
+	return flagged, nil
+}
+
+// moderateText checks the text of a message ("message") or an answer
+// ("answer") as mode says. It returns an error if the text is blocked:
+// because it was flagged, or, since blocking must not be skipped quietly,
+// because it could not be checked.
+func (s *chatSession) moderateText(mode, what, text string) error {
+	if mode == "" || mode == "off" || strings.TrimSpace(text) == "" {
+		return nil
+	}
+	ctx, stop := context.Background(), func() {}
+	if !s.opts.oneShot {
+		ctx, stop = s.requestContext()
+	}
+	defer stop()
+	flagged, err := moderate(ctx, s.client, s.cfgFile, text)
+	switch {
+	case err != nil && mode == "block":
+		return fmt.Errorf("cannot check the %s with the moderations endpoint: %w", what, err)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "[moderation] Cannot check the %s: %v\n", what, err)
+	case len(flagged) > 0 && mode == "block":
+		return fmt.Errorf("the %s was flagged by moderation (%s)", what, strings.Join(flagged, ", "))
+	case len(flagged) > 0:
+		fmt.Fprintf(os.Stderr, "[moderation] The %s was flagged for: %s.\n", what, strings.Join(flagged, ", "))
+	}
+	return nil
+}
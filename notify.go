@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// notifyBodyLength bounds the part of an answer a notification shows.
+const notifyBodyLength = 120
+
+// notifyCommand returns the command that shows a desktop notification on
+// the current platform. The title and body are passed as arguments or in
+// the environment, never spliced into a script.
+func notifyCommand(title, body string) *exec.Cmd {
+	switch runtime.GOOS {
+	case "darwin":
+		return exec.Command("osascript",
+			"-e", "on run argv",
+			"-e", "display notification (item 2 of argv) with title (item 1 of argv)",
+			"-e", "end run",
+			title, body)
+	case "windows":
+		cmd := exec.Command("powershell", "-NoProfile", "-Command",
+			"Add-Type -AssemblyName System.Windows.Forms; "+
+				"$n = New-Object System.Windows.Forms.NotifyIcon; "+
+				"$n.Icon = [System.Drawing.SystemIcons]::Information; $n.Visible = $true; "+
+				"$n.ShowBalloonTip(10000, $env:ASKGPT_NOTIFY_TITLE, $env:ASKGPT_NOTIFY_BODY, 'Info'); "+
+				"Start-Sleep -Seconds 10; $n.Dispose()")
+		cmd.Env = append(os.Environ(), "ASKGPT_NOTIFY_TITLE="+title, "ASKGPT_NOTIFY_BODY="+body)
+		return cmd
+	default:
+		return exec.Command("notify-send", "--app-name=askgpt", title, body)
+	}
+}
+
+// notifyDesktop shows a desktop notification for --notify. It does not wait
+// for the notification to go away, which on Windows takes a while.
+func notifyDesktop(title, body string) {
+	body = strings.Join(strings.Fields(body), " ")
+	if r := []rune(body); len(r) > notifyBodyLength {
+		body = string(r[:notifyBodyLength-1]) + "…"
+	}
+	cmd := notifyCommand(title, body)
+	if err := cmd.Start(); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			warnf("cannot show a notification: %s is not installed\n", cmd.Args[0])
+			return
+		}
+		warnf("cannot show a notification: %v\n", err)
+		return
+	}
+	go cmd.Wait()
+}
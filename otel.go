@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TelemetryConfig is the telemetry: section of config.yaml. With an
+// endpoint, askgpt sends OpenTelemetry spans of its API calls to it over
+// OTLP/HTTP: one for each message, one for each request to the model with
+// the model, tokens and finish reason, and one for each HTTP request and
+// tool call. Endpoint is the collector's base URL, to which /v1/traces is
+// added unless it already names a path; headers are sent with every
+// export, for collectors that need a key.
+//
+//	telemetry:
+//	  endpoint: http://localhost:4318
+//	  service_name: askgpt
+//	  headers:
+//	    x-honeycomb-team: ...
+type TelemetryConfig struct {
+	Endpoint    string            `yaml:"endpoint,omitempty"`
+	ServiceName string            `yaml:"service_name,omitempty"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+}
+
+// exportTimeout bounds how long exporting spans may delay askgpt.
+const exportTimeout = 5 * time.Second
+
+// Span kinds and status codes, as OTLP numbers them.
+const (
+	spanInternal = 1
+	spanClient   = 3
+
+	statusOK    = 1
+	statusError = 2
+)
+
+// telemetry exports the spans; it is nil unless telemetry.endpoint is set,
+// and then startSpan makes no spans.
+var telemetry *spanExporter
+
+type spanExporter struct {
+	url     string
+	headers map[string]string
+	service string
+	client  *http.Client
+	pending sync.WaitGroup
+}
+
+// openTelemetry starts exporting spans if cfg names an endpoint.
+func openTelemetry(cfg TelemetryConfig) error {
+	if cfg.Endpoint == "" || telemetry != nil {
+		return nil
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("telemetry.endpoint %q in config.yaml is not a URL", cfg.Endpoint)
+	}
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+	}
+	telemetry = &spanExporter{
+		url:     u.String(),
+		headers: cfg.Headers,
+		service: cmp.Or(cfg.ServiceName, "askgpt"),
+		client:  &http.Client{Timeout: exportTimeout},
+	}
+	return nil
+}
+
+// flushTelemetry waits for the spans being exported.
+func flushTelemetry() {
+	if telemetry != nil {
+		telemetry.pending.Wait()
+	}
+}
+
+// span is a span being recorded. The methods of a nil span do nothing.
+type span struct {
+	traceID [16]byte
+	id      [8]byte
+	parent  *span
+	name    string
+	kind    int
+	start   time.Time
+	attrs   []otlpAttr
+	mu      sync.Mutex
+	done    []otlpSpan // ended descendants, exported with the span
+}
+
+type spanKey struct{}
+
+// startSpan starts a span, a child of the one in ctx if there is one, and
+// returns ctx with it. A span without a parent is exported with its
+// children when it ends.
+func startSpan(ctx context.Context, name string, kind int) (context.Context, *span) {
+	if telemetry == nil {
+		return ctx, nil
+	}
+	sp := &span{name: name, kind: kind, start: time.Now()}
+	rand.Read(sp.id[:])
+	if parent, _ := ctx.Value(spanKey{}).(*span); parent != nil {
+		sp.parent, sp.traceID = parent, parent.traceID
+	} else {
+		rand.Read(sp.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, sp), sp
+}
+
+// set adds an attribute; value is a string, an int or a bool.
+func (sp *span) set(key string, value any) {
+	if sp == nil {
+		return
+	}
+	var v map[string]any
+	switch value := value.(type) {
+	case string:
+		v = map[string]any{"stringValue": value}
+	case int:
+		v = map[string]any{"intValue": strconv.Itoa(value)}
+	case bool:
+		v = map[string]any{"boolValue": value}
+	default:
+		v = map[string]any{"stringValue": fmt.Sprint(value)}
+	}
+	sp.mu.Lock()
+	sp.attrs = append(sp.attrs, otlpAttr{key, v})
+	sp.mu.Unlock()
+}
+
+// end ends the span, with an error status if err is not nil.
+func (sp *span) end(err error) {
+	if sp == nil {
+		return
+	}
+	rec := otlpSpan{
+		TraceID: hex.EncodeToString(sp.traceID[:]),
+		SpanID:  hex.EncodeToString(sp.id[:]),
+		Name:    sp.name,
+		Kind:    sp.kind,
+		Start:   strconv.FormatInt(sp.start.UnixNano(), 10),
+		End:     strconv.FormatInt(time.Now().UnixNano(), 10),
+		Status:  otlpStatus{Code: statusOK},
+	}
+	if err != nil {
+		rec.Status = otlpStatus{Code: statusError, Message: err.Error()}
+	}
+	if sp.parent != nil {
+		rec.ParentSpanID = hex.EncodeToString(sp.parent.id[:])
+	}
+	sp.mu.Lock()
+	rec.Attributes = sp.attrs
+	done := append(sp.done, rec)
+	sp.mu.Unlock()
+	if sp.parent != nil {
+		sp.parent.mu.Lock()
+		sp.parent.done = append(sp.parent.done, done...)
+		sp.parent.mu.Unlock()
+		return
+	}
+	telemetry.export(done)
+}
+
+// export sends spans to the collector in the background. A failure is
+// logged, never shown: telemetry must not get in the way.
+func (e *spanExporter) export(spans []otlpSpan) {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttr{
+				{"service.name", map[string]any{"stringValue": e.service}},
+				{"host.name", map[string]any{"stringValue": hostname()}},
+			}},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "askgpt"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		logger.Warn("cannot export spans", "error", err.Error())
+		return
+	}
+	e.pending.Add(1)
+	go func() {
+		defer e.pending.Done()
+		req, err := http.NewRequest("POST", e.url, bytes.NewReader(body))
+		if err != nil {
+			logger.Warn("cannot export spans", "error", err.Error())
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range e.headers {
+			req.Header.Set(k, v)
+		}
+		resp, err := e.client.Do(req)
+		if err != nil {
+			logger.Warn("cannot export spans", "error", err.Error())
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			logger.Warn("cannot export spans", "status", resp.StatusCode)
+		}
+	}()
+}
+
+func hostname() string {
+	name, _ := os.Hostname()
+	return name
+}
+
+type otlpAttr struct {
+	Key   string         `json:"key"`
+	Value map[string]any `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID      string     `json:"traceId"`
+	SpanID       string     `json:"spanId"`
+	ParentSpanID string     `json:"parentSpanId,omitempty"`
+	Name         string     `json:"name"`
+	Kind         int        `json:"kind"`
+	Start        string     `json:"startTimeUnixNano"`
+	End          string     `json:"endTimeUnixNano"`
+	Attributes   []otlpAttr `json:"attributes,omitempty"`
+	Status       otlpStatus `json:"status"`
+}
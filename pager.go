@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// pagerCommand returns the pager answers taller than the screen are shown
+// in, or "" for none. The pager setting of config.yaml is off by default;
+// "on" uses $PAGER, or less -R, and anything else is the command to run.
+// --no-pager, --raw and output that is not a terminal turn it off.
+func pagerCommand(cfg ConfigFile, opts taskOptions) string {
+	if opts.noPager || opts.raw || !isTerminal(os.Stdout) {
+		return ""
+	}
+	switch setting := strings.TrimSpace(cfg.Pager); setting {
+	case "", "off":
+		return ""
+	case "on":
+		if p := strings.TrimSpace(os.Getenv("PAGER")); p != "" {
+			return p
+		}
+		if runtime.GOOS == "windows" {
+			return "more"
+		}
+		return "less -R"
+	default:
+		return setting
+	}
+}
+
+// pageAnswer shows an answer that has been printed again in the pager, if
+// it takes up more rows than the screen has, so it can be scrolled through
+// from the start.
+func pageAnswer(pager, answer string, opts taskOptions) {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || width <= 0 {
+		return
+	}
+	var out bytes.Buffer
+	if renderMarkdown(opts) {
+		newMDRenderer(&out, 0, !opts.oneShot).render(answer)
+		out.WriteString("\n")
+	} else {
+		out.WriteString(answer + "\n")
+	}
+	rows := 0
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		rows += max(1, (displayWidth(stripANSI(line))+width-1)/width)
+	}
+	if rows < height {
+		return
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", pager)
+	} else {
+		cmd = exec.Command("sh", "-c", pager)
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = &out, os.Stdout, os.Stderr
+	cmd.Env = os.Environ()
+	if os.Getenv("LESS") == "" {
+		// Keep the colors of rendered answers.
+		cmd.Env = append(cmd.Env, "LESS=-R")
+	}
+	if err := cmd.Run(); err != nil {
+		warnf("pager %q failed: %v\n", pager, err)
+	}
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// filePatch is the part of a unified diff that changes one file. A path is
+// "" for /dev/null: the file is created or deleted.
+type filePatch struct {
+	oldPath, newPath string
+	hunks            []hunk
+}
+
+// hunk is a change to some lines of a file. Its lines keep their " ", "-"
+// or "+" in front; the counts in its header are not trusted, as models get
+// them wrong.
+type hunk struct {
+	oldStart int // the line the change starts at in the file, from 1
+	lines    []string
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,\d+)? \+\d+(?:,\d+)? @@`)
+
+// findDiff returns the unified diff in an answer: its code blocks that
+// hold one or, failing that, the answer itself if it is nothing but a diff.
+func findDiff(answer string) (string, bool) {
+	var diffs []string
+	for _, b := range codeBlocks(answer) {
+		if looksLikeDiff(b) {
+			diffs = append(diffs, b)
+		}
+	}
+	if len(diffs) > 0 {
+		return strings.Join(diffs, "\n"), true
+	}
+	trimmed := strings.TrimSpace(answer)
+	if (strings.HasPrefix(trimmed, "diff ") || strings.HasPrefix(trimmed, "--- ")) && looksLikeDiff(trimmed) {
+		return trimmed, true
+	}
+	return "", false
+}
+
+// looksLikeDiff reports whether text has the file header and a hunk of a
+// unified diff.
+func looksLikeDiff(text string) bool {
+	lines := strings.Split(text, "\n")
+	for i := 0; i+1 < len(lines); i++ {
+		if strings.HasPrefix(lines[i], "--- ") && strings.HasPrefix(lines[i+1], "+++ ") {
+			return strings.Contains(text, "\n@@")
+		}
+	}
+	return false
+}
+
+// parseDiff reads a unified diff, as diff -u or git diff writes it. Lines
+// that belong to neither a header nor a hunk, such as git's index lines,
+// are skipped.
+func parseDiff(text string) ([]filePatch, error) {
+	lines := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+	var patches []filePatch
+	var h *hunk
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			patches = append(patches, filePatch{oldPath: diffPath(line[4:]), newPath: diffPath(lines[i+1][4:])})
+			h = nil
+			i++
+		case strings.HasPrefix(line, "@@"):
+			if len(patches) == 0 {
+				return nil, errors.New("the diff has a hunk before any --- and +++ lines")
+			}
+			m := hunkHeaderRe.FindStringSubmatch(line)
+			if m == nil {
+				return nil, fmt.Errorf("cannot read the hunk header %q", line)
+			}
+			start, _ := strconv.Atoi(m[1])
+			p := &patches[len(patches)-1]
+			p.hunks = append(p.hunks, hunk{oldStart: start})
+			h = &p.hunks[len(p.hunks)-1]
+		case h == nil:
+		case line == "":
+			// A blank context line whose space got lost.
+			h.lines = append(h.lines, " ")
+		case line[0] == ' ' || line[0] == '-' || line[0] == '+':
+			h.lines = append(h.lines, line)
+		case line[0] == '\\':
+			// \ No newline at end of file
+		default:
+			h = nil
+		}
+	}
+	for i := range patches {
+		p := &patches[i]
+		if p.oldPath == "" && p.newPath == "" {
+			return nil, errors.New("the diff has a file that is neither old nor new")
+		}
+		for j := range p.hunks {
+			// The blank line that ends a code block is not context.
+			l := p.hunks[j].lines
+			for len(l) > 0 && l[len(l)-1] == " " {
+				l = l[:len(l)-1]
+			}
+			p.hunks[j].lines = l
+		}
+	}
+	if len(patches) == 0 {
+		return nil, errors.New("the diff changes no file")
+	}
+	return patches, nil
+}
+
+// diffPath returns the path of a --- or +++ line, without git's a/ and b/
+// and the timestamp diff -u adds.
+func diffPath(s string) string {
+	s, _, _ = strings.Cut(s, "\t")
+	s = strings.TrimSpace(s)
+	if s == "/dev/null" {
+		return ""
+	}
+	if strings.HasPrefix(s, "a/") || strings.HasPrefix(s, "b/") {
+		s = s[2:]
+	}
+	return s
+}
+
+// applyHunks returns text with the hunks applied, or an error naming the
+// first that does not fit. A hunk goes where its header says if its lines
+// are there, and otherwise where they are nearest to it; lines that differ
+// only in trailing spaces still match.
+func applyHunks(name, text string, hunks []hunk) (string, error) {
+	lines := splitLines(text)
+	var out []string
+	pos := 0
+	for n, h := range hunks {
+		var from, to []string
+		for _, l := range h.lines {
+			switch l[0] {
+			case ' ':
+				from, to = append(from, l[1:]), append(to, l[1:])
+			case '-':
+				from = append(from, l[1:])
+			case '+':
+				to = append(to, l[1:])
+			}
+		}
+		at := findLines(lines, from, pos, h.oldStart-1)
+		if at < 0 {
+			return "", fmt.Errorf("hunk %d of %s does not apply: the lines it changes are not in the file", n+1, name)
+		}
+		out = append(out, lines[pos:at]...)
+		out = append(out, to...)
+		pos = at + len(from)
+	}
+	out = append(out, lines[pos:]...)
+	result := strings.Join(out, "\n")
+	if len(out) > 0 && (text == "" || strings.HasSuffix(text, "\n")) {
+		result += "\n"
+	}
+	return result, nil
+}
+
+// findLines returns where want is in lines at or after from, as near to
+// hint as possible, or -1.
+func findLines(lines, want []string, from, hint int) int {
+	if len(want) == 0 {
+		return min(max(hint, from), len(lines))
+	}
+	for _, same := range []func(a, b string) bool{
+		func(a, b string) bool { return a == b },
+		func(a, b string) bool { return strings.TrimRight(a, " \t") == strings.TrimRight(b, " \t") },
+	} {
+		best := -1
+		for at := from; at+len(want) <= len(lines); at++ {
+			match := true
+			for i, w := range want {
+				if !same(lines[at+i], w) {
+					match = false
+					break
+				}
+			}
+			if match && (best < 0 || abs(at-hint) < abs(best-hint)) {
+				best = at
+			}
+		}
+		if best >= 0 {
+			return best
+		}
+	}
+	return -1
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// fileChange is what a diff does to one file.
+type fileChange struct {
+	abs, rel string
+	old, new string
+	perm     fs.FileMode
+	create   bool
+	remove   bool
+	patch    filePatch
+}
+
+// planDiff works out the changes a diff makes to the files under dir,
+// without making them. If any hunk does not apply, none of the diff does.
+func planDiff(dir, diff string) ([]fileChange, error) {
+	patches, err := parseDiff(diff)
+	if err != nil {
+		return nil, err
+	}
+	ws, err := openWorkspace(dir)
+	if err != nil {
+		return nil, err
+	}
+	var changes []fileChange
+	for _, p := range patches {
+		name := p.newPath
+		if name == "" {
+			name = p.oldPath
+		}
+		c := fileChange{patch: p, perm: 0o644, create: p.oldPath == "", remove: p.newPath == ""}
+		if c.abs, c.rel, err = ws.resolve(name); err != nil {
+			return nil, err
+		}
+		fi, err := os.Stat(c.abs)
+		switch {
+		case c.create && err == nil:
+			return nil, fmt.Errorf("%s already exists", c.rel)
+		case c.create:
+		case err != nil:
+			return nil, fmt.Errorf("cannot read %s: %w", c.rel, unwrapPathError(err))
+		default:
+			if _, _, c.old, err = ws.readText(name); err != nil {
+				return nil, err
+			}
+			c.perm = fi.Mode().Perm()
+		}
+		if c.new, err = applyHunks(c.rel, c.old, p.hunks); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, nil
+}
+
+// printDiffPreview shows the changes as the diff has them.
+func printDiffPreview(changes []fileChange) {
+	for _, c := range changes {
+		switch {
+		case c.create:
+			fmt.Fprintf(os.Stderr, "New file %s:\n", c.rel)
+		case c.remove:
+			fmt.Fprintf(os.Stderr, "Delete %s:\n", c.rel)
+		default:
+			fmt.Fprintf(os.Stderr, "Change to %s:\n", c.rel)
+		}
+		for _, h := range c.patch.hunks {
+			fmt.Fprintln(os.Stderr, paintDiffLine(fmt.Sprintf("@@ line %d @@", max(h.oldStart, 1))))
+			for _, l := range h.lines {
+				fmt.Fprintln(os.Stderr, paintDiffLine(l))
+			}
+		}
+	}
+}
+
+// applyChanges makes the changes planDiff worked out.
+func applyChanges(changes []fileChange) error {
+	for _, c := range changes {
+		var err error
+		switch {
+		case c.remove:
+			err = os.Remove(c.abs)
+		case c.create:
+			if err = os.MkdirAll(filepath.Dir(c.abs), 0o755); err == nil {
+				err = createFile(c.abs, []byte(c.new), c.perm)
+			}
+		default:
+			err = os.WriteFile(c.abs, []byte(c.new), c.perm)
+		}
+		if err != nil {
+			return fmt.Errorf("cannot change %s: %w", c.rel, unwrapPathError(err))
+		}
+	}
+	return nil
+}
+
+// applyAnswerDiff applies the diff in an answer to the files in the current
+// directory once the user has seen it and agrees, or without asking with
+// yes.
+func applyAnswerDiff(answer string, yes bool) error {
+	diff, ok := findDiff(answer)
+	if !ok {
+		return errors.New("the last answer has no unified diff")
+	}
+	changes, err := planDiff(".", diff)
+	if err != nil {
+		return err
+	}
+	printDiffPreview(changes)
+	if !yes {
+		if err := askYesNo("Apply it?"); err != nil {
+			return err
+		}
+	}
+	if err := applyChanges(changes); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Changed %d file(s).\n", len(changes))
+	return nil
+}
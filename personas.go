@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const personasDirName = "personas"
+
+// loadPersonas returns the named system prompts from the personas: section
+// of config.yaml and from ~/.askgpt/personas/<name>.md. A file wins over a
+// config entry of the same name.
+func loadPersonas(cfg ConfigFile) (map[string]string, error) {
+	personas := map[string]string{}
+	for name, prompt := range cfg.Personas {
+		personas[name] = strings.TrimSpace(prompt)
+	}
+
+	cfgPath, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(filepath.Dir(cfgPath), personasDirName)
+	files, err := filepath.Glob(filepath.Join(dir, "*.md"))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read persona %s: %w", f, err)
+		}
+		personas[strings.TrimSuffix(filepath.Base(f), ".md")] = strings.TrimSpace(string(b))
+	}
+	return personas, nil
+}
+
+func personaNames(personas map[string]string) []string {
+	names := make([]string, 0, len(personas))
+	for n := range personas {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func lookupPersona(personas map[string]string, name string) (string, error) {
+	prompt, ok := personas[name]
+	if !ok {
+		if len(personas) == 0 {
+			return "", fmt.Errorf("unknown persona %q (none defined)", name)
+		}
+		return "", fmt.Errorf("unknown persona %q (available: %s)", name, strings.Join(personaNames(personas), ", "))
+	}
+	return prompt, nil
+}
+
+func runPersonas(args []string) int {
+	if len(args) == 0 || args[0] != "list" {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt personas list")
+		return 2
+	}
+
+	path, _, err := ensureConfigFileExists()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	personas, err := loadPersonas(cfg)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if len(personas) == 0 {
+		fmt.Fprintf(os.Stderr, "No personas defined. Add a personas: section to %s or files to %s.\n",
+			path, filepath.Join(filepath.Dir(path), personasDirName))
+		return 0
+	}
+	for _, name := range personaNames(personas) {
+		fmt.Printf("%-20s %s\n", name, firstLine(personas[name], 60))
+	}
+	return 0
+}
+
+// firstLine returns the first line of s, cut to at most max runes.
+func firstLine(s string, max int) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(s), "\n")
+	if r := []rune(line); len(r) > max {
+		return string(r[:max-1]) + "…"
+	}
+	return line
+}
+
+// personaCommand handles "/persona [name|none]" and returns the new persona.
+func personaCommand(personas map[string]string, current string, args []string) (string, error) {
+	if len(args) == 0 {
+		if current == "" {
+			fmt.Fprintln(os.Stderr, "No persona active.")
+		} else {
+			fmt.Fprintf(os.Stderr, "Current persona: %s\n", current)
+		}
+		if len(personas) > 0 {
+			fmt.Fprintf(os.Stderr, "Available: %s\n", strings.Join(personaNames(personas), ", "))
+		}
+		return current, nil
+	}
+	if args[0] == "none" {
+		fmt.Fprintln(os.Stderr, "Persona cleared.")
+		return "", nil
+	}
+	if _, err := lookupPersona(personas, args[0]); err != nil {
+		return current, err
+	}
+	fmt.Fprintf(os.Stderr, "Persona set to %s.\n", args[0])
+	return args[0], nil
+}
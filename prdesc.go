@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const prDescPrompt = "Write the description of a pull request for the branch below, from its commits and its changes. " +
+	"On the first line write only the title: at most 72 characters, saying what the branch does. After a blank line " +
+	"write the body in Markdown with these sections: \"## Summary\" (what the change does and why, in a few " +
+	"sentences), \"## Changes\" (a bullet list of the notable changes) and \"## Testing\" (how it was or can be " +
+	"tested, as far as the commits and changes tell). Write only the title and the body."
+
+func runPRDesc(args []string) int {
+	fs := flag.NewFlagSet("pr-desc", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	create := fs.Bool("create", false, "")
+	var edit, yes bool
+	fs.BoolVar(&edit, "e", false, "")
+	fs.BoolVar(&edit, "edit", false, "")
+	fs.BoolVar(&yes, "y", false, "")
+	fs.BoolVar(&yes, "yes", false, "")
+	force := fs.Bool("force", false, "")
+	noRedact := fs.Bool("no-redact", false, "")
+
+	// Allow flags after the base branch, like task mode does.
+	var rest []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		rest = append(rest, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(rest) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt pr-desc [base-branch] [-e] [--create [-y]] [--no-redact]")
+		return 2
+	}
+
+	if err := checkGitRepo(); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	var base string
+	if len(rest) == 1 {
+		base = rest[0]
+		if _, err := gitOutput("rev-parse", "--verify", "--quiet", base); err != nil {
+			errorf("there is no branch %s\n", base)
+			return 1
+		}
+	} else {
+		var err error
+		if base, err = defaultBaseBranch(); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+	commits, err := gitOutput("log", "--no-color", "--reverse", "--format=- %s%n%w(0,2,2)%b", base+"..HEAD")
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if strings.TrimSpace(commits) == "" {
+		errorf("the branch has no commits that are not on %s\n", base)
+		return 1
+	}
+	// Changes are taken from where the branch left base, so that what was
+	// merged into base since is not part of them.
+	diff, err := gitOutput("diff", "--no-color", "--no-ext-diff", base+"...HEAD")
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	stat, err := gitOutput("diff", "--no-color", "--stat", base+"...HEAD")
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "pr-desc", *force)
+	// The commits and changes are redacted like a chat message is, notes on
+	// their parts included.
+	if _, err := useRedaction(cfgFile, *noRedact); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	sampling, err := resolveSampling(cfgFile, "pr-desc", "", cfgFile.AskGPT.Model)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	opts := taskOptions{noStream: true, sampling: sampling}
+	client := apiClient(cfgFile)
+	cfg := cfgFile.AskGPT
+
+	// The commits and the file list are always sent whole; changes too long
+	// for the model are sent as notes on their parts.
+	model := cfg.Model
+	room := contextWindow(cfgFile, model) - defaultMaxToken - textTokens(model, prDescPrompt+commits+stat) - messageOverhead
+	changes, err := fitDiff(client, cfg, opts, diff, room, prDescPrompt)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	prompt := fmt.Sprintf("%s\n\nCommits:\n%s\nFiles changed:\n%s\n---\n\n%s", prDescPrompt, commits, stat, changes)
+	req := newChatRequest(cfg, []Message{{Role: "user", Content: prompt}}, opts)
+	stop := startSpinner(opts)
+	res, err := sendChat(context.Background(), client, cfg, req, nil)
+	stop()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if res.FinishReason == "length" {
+		errorf("the description was truncated by the model's output limit\n")
+		return 1
+	}
+	title, body := prDescription(res.Content)
+	if title == "" {
+		errorf("the answer has no pull request title\n")
+		return 1
+	}
+
+	desc := title + "\n\n" + body
+	if edit {
+		if desc, err = composeInEditor(desc); err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+	if !*create {
+		fmt.Println(desc)
+		return 0
+	}
+	if !yes {
+		if !isTerminal(os.Stdin) {
+			errorf("--create asks before creating the pull request, which needs a terminal; add -y to create it without asking\n")
+			return 1
+		}
+		if desc, err = reviewMessage(desc, "Create the pull request?"); err != nil {
+			if errors.Is(err, errDeclined) {
+				fmt.Fprintln(os.Stderr, "Not created.")
+				return 0
+			}
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+
+	// The title and body take the place of those --fill-first would take
+	// from the first commit; the body is passed on stdin.
+	title, body = prDescription(desc)
+	cmd := exec.Command("gh", "pr", "create", "--fill-first", "--base", strings.TrimPrefix(base, "origin/"),
+		"--title", title, "--body-file", "-")
+	cmd.Stdin = strings.NewReader(body + "\n")
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		if errors.Is(err, exec.ErrNotFound) {
+			errorf("gh is not installed; see https://cli.github.com\n")
+			return 1
+		}
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// defaultBaseBranch returns the branch a pull request goes into when none
+// is given: the remote's default branch, or else main or master.
+func defaultBaseBranch() (string, error) {
+	if ref, err := gitOutput("rev-parse", "--abbrev-ref", "origin/HEAD"); err == nil {
+		if ref = strings.TrimSpace(ref); ref != "" && ref != "origin/HEAD" {
+			return ref, nil
+		}
+	}
+	for _, b := range []string{"main", "master"} {
+		if _, err := gitOutput("rev-parse", "--verify", "--quiet", b); err == nil {
+			return b, nil
+		}
+	}
+	return "", errors.New("cannot tell the base branch; name it, as in askgpt pr-desc main")
+}
+
+// prDescription splits an answer into the title on its first line and the
+// body after it. A title some models set as a heading or label is unwrapped.
+func prDescription(answer string) (title, body string) {
+	title, body, _ = strings.Cut(strings.TrimSpace(answer), "\n")
+	title = strings.TrimSpace(strings.TrimLeft(title, "#"))
+	title = strings.TrimSpace(strings.TrimPrefix(title, "Title:"))
+	title = strings.Trim(title, "*`\"")
+	return title, strings.TrimSpace(body)
+}
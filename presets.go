@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Preset is a named set of sampling parameters. Models can override the
+// values, e.g. for reasoning models that only accept temperature 1.
+type Preset struct {
+	Temperature *float32          `yaml:"temperature,omitempty"`
+	TopP        *float32          `yaml:"top_p,omitempty"`
+	Models      map[string]Preset `yaml:"models,omitempty"`
+}
+
+const defaultPreset = "balanced"
+
+func float32Ptr(f float32) *float32 { return &f }
+
+var builtinPresets = map[string]Preset{
+	"creative": {Temperature: float32Ptr(1.0)},
+	"balanced": {Temperature: float32Ptr(0.3)}, // what every request used before presets
+	"precise":  {Temperature: float32Ptr(0.2)},
+}
+
+// builtinTaskPresets gives the built-in tasks a sensible category; tasks not
+// listed here (and direct prompts) use defaultPreset.
+var builtinTaskPresets = map[string]string{
+	"translate":    "precise",
+	"translate-en": "precise",
+	"translate-zh": "precise",
+	"summarize":    "balanced",
+	"explain":      "balanced",
+	"proofread":    "precise",
+	"rewrite":      "balanced",
+	"shorten":      "balanced",
+}
+
+// samplingParams are the resolved values sent with each request.
+type samplingParams struct {
+	Preset      string
+	Temperature *float32
+	TopP        *float32
+}
+
+// resolveSampling picks the preset for a run: the --preset flag wins, then the
+// task's own preset, then the task_presets mapping from config, then the
+// built-in task defaults. Presets from config override built-in ones of the
+// same name.
+func resolveSampling(cfg ConfigFile, task, flagPreset, model string) (samplingParams, error) {
+	name := flagPreset
+	if name == "" {
+		name = cfg.Tasks[task].Preset
+	}
+	if name == "" {
+		name = cfg.TaskPresets[task]
+	}
+	if name == "" {
+		name = builtinTaskPresets[task]
+	}
+	if name == "" {
+		name = defaultPreset
+	}
+
+	p, ok := cfg.Presets[name]
+	if !ok {
+		p, ok = builtinPresets[name]
+	}
+	if !ok {
+		return samplingParams{}, fmt.Errorf("unknown preset %q (available: %s)", name, strings.Join(presetNames(cfg), ", "))
+	}
+
+	params := samplingParams{Preset: name, Temperature: p.Temperature, TopP: p.TopP}
+	if m, ok := p.Models[model]; ok {
+		if m.Temperature != nil {
+			params.Temperature = m.Temperature
+		}
+		if m.TopP != nil {
+			params.TopP = m.TopP
+		}
+	}
+	return params, nil
+}
+
+func presetNames(cfg ConfigFile) []string {
+	seen := map[string]bool{}
+	var names []string
+	for _, m := range []map[string]Preset{builtinPresets, cfg.Presets} {
+		for n := range m {
+			if !seen[n] {
+				seen[n] = true
+				names = append(names, n)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retentionPolicy says which sessions to keep: those used within maxAge
+// and, of those, the most recent max. Zero values do not limit.
+type retentionPolicy struct {
+	maxAge time.Duration
+	max    int
+}
+
+func (p retentionPolicy) isSet() bool {
+	return p.maxAge > 0 || p.max > 0
+}
+
+// historyRetention reads the retention settings of the history: section.
+func historyRetention(cfg HistoryConfig) (retentionPolicy, error) {
+	p := retentionPolicy{max: cfg.MaxSessions}
+	if cfg.Retention != "" {
+		d, err := parseAge(cfg.Retention)
+		if err != nil {
+			return p, fmt.Errorf("history.retention in config.yaml: %w", err)
+		}
+		p.maxAge = d
+	}
+	if p.max < 0 {
+		return p, errors.New("history.max_sessions in config.yaml must not be negative")
+	}
+	return p, nil
+}
+
+// parseAge parses a duration such as "30d", "2w" or "12h".
+func parseAge(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for suffix, unit := range units {
+		if n, ok := strings.CutSuffix(s, suffix); ok {
+			v, err := strconv.Atoi(n)
+			if err != nil || v <= 0 {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(v) * unit, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q (use e.g. 30d, 2w or 12h)", s)
+	}
+	return d, nil
+}
+
+// expiredSessions returns the ids of the sessions the policy does not keep,
+// oldest first. The session keep, if any, is never expired.
+func expiredSessions(store sessionStore, p retentionPolicy, keep string) ([]string, error) {
+	ids, err := store.IDs()
+	if err != nil {
+		return nil, err
+	}
+	var expired, kept []string
+	cutoff := time.Now().Add(-p.maxAge)
+	for _, id := range ids {
+		if id == keep {
+			continue
+		}
+		if p.maxAge > 0 {
+			used, err := store.Used(id)
+			if err != nil {
+				return nil, err
+			}
+			if used.Before(cutoff) {
+				expired = append(expired, id)
+				continue
+			}
+		}
+		kept = append(kept, id)
+	}
+	limit := p.max
+	if keep != "" && limit > 0 {
+		limit-- // keep counts against max_sessions
+	}
+	if p.max > 0 && len(kept) > limit {
+		expired = append(expired, kept[:len(kept)-limit]...)
+	}
+	return expired, nil
+}
+
+// pruneSessions deletes the sessions the history: settings do not keep,
+// apart from keep. It is run whenever a chat starts.
+func pruneSessions(store sessionStore, cfg HistoryConfig, keep string) error {
+	p, err := historyRetention(cfg)
+	if err != nil || !p.isSet() {
+		return err
+	}
+	ids, err := expiredSessions(store, p, keep)
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := store.Delete(id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		fmt.Fprintf(os.Stderr, "Deleted %d old session(s) as set in config.yaml.\n", len(ids))
+	}
+	return nil
+}
+
+// runPrune handles "askgpt sessions prune": the history: settings, or the
+// flags given instead, decide what to delete.
+func runPrune(store sessionStore, args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	olderThan := fs.String("older-than", "", "")
+	keep := fs.Int("keep", 0, "")
+	dryRun := fs.Bool("dry-run", false, "")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		return fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+
+	cfg, err := readConfigIfExists()
+	if err != nil {
+		return err
+	}
+	p, err := historyRetention(cfg.History)
+	if err != nil {
+		return err
+	}
+	if *olderThan != "" || *keep > 0 {
+		p = retentionPolicy{max: *keep}
+		if *olderThan != "" {
+			if p.maxAge, err = parseAge(*olderThan); err != nil {
+				return err
+			}
+		}
+	}
+	if !p.isSet() {
+		return errors.New("nothing to prune by: pass --older-than or --keep, or set history.retention or history.max_sessions in config.yaml")
+	}
+
+	ids, err := expiredSessions(store, p, "")
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 {
+		fmt.Fprintln(os.Stderr, "No sessions to prune.")
+		return nil
+	}
+	for _, id := range ids {
+		if *dryRun {
+			fmt.Println(id)
+			continue
+		}
+		if err := store.Delete(id); err != nil {
+			return err
+		}
+	}
+	if *dryRun {
+		fmt.Fprintf(os.Stderr, "Would delete %d session(s).\n", len(ids))
+	} else {
+		fmt.Fprintf(os.Stderr, "Deleted %d session(s).\n", len(ids))
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// RedactConfig is the redact: section of config.yaml. Secrets found in what
+// is sent to the model, such as API keys and private keys, are replaced
+// with placeholders first. Detect adds personal data of the kinds
+// piiRules names, and rules patterns of one's own; disabled turns it all
+// off (--no-redact does for one run). With restore, the values are put
+// back where the answers shown use the placeholders; the conversation keeps
+// the placeholders, and the values are never written anywhere.
+//
+//	redact:
+//	  detect: [email, phone, ip]
+//	  restore: true
+//	  rules:
+//	    - name: internal-token
+//	      pattern: 'itk_[A-Za-z0-9]{32}'
+type RedactConfig struct {
+	Disabled bool         `yaml:"disabled,omitempty"`
+	Detect   []string     `yaml:"detect,omitempty"`
+	Restore  bool         `yaml:"restore,omitempty"`
+	Rules    []RedactRule `yaml:"rules,omitempty"`
+}
+
+// RedactRule is a pattern to redact. When it has a group, only the text of
+// the first group is replaced, so the pattern can take in its context.
+type RedactRule struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+}
+
+// secretRules are the secrets redacted unless redact.disabled is set.
+var secretRules = []RedactRule{
+	{"private-key", `-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?-----END [A-Z ]*PRIVATE KEY-----`},
+	{"aws-access-key", `\b((?:AKIA|ASIA)[0-9A-Z]{16})\b`},
+	{"aws-secret-key", `(?i)aws_?secret_?access_?key["']?\s*[:=]\s*["']?([A-Za-z0-9/+=]{40})\b`},
+	{"jwt", `\beyJ[A-Za-z0-9_-]{8,}\.eyJ[A-Za-z0-9_-]{8,}\.[A-Za-z0-9_-]{8,}`},
+	{"api-key", `\b(sk-[A-Za-z0-9_-]{20,})`},
+	{"github-token", `\b((?:ghp|gho|ghu|ghs|ghr)_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{50,})\b`},
+	{"slack-token", `\b(xox[abposr]-[A-Za-z0-9-]{10,})`},
+	{"google-api-key", `\b(AIza[0-9A-Za-z_-]{35})`},
+}
+
+// piiRules are the kinds of personal data redact.detect can name.
+var piiRules = []RedactRule{
+	{"email", `[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`},
+	{"phone", `\+\d[\d .-]{6,16}\d|\(?\b\d{3}\)?[ .-]\d{3}[ .-]\d{4}\b|\b1[3-9]\d{9}\b`},
+	{"ip", `\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b|\b(?:[0-9A-Fa-f]{1,4}:){7}[0-9A-Fa-f]{1,4}\b|\b(?:[0-9A-Fa-f]{1,4}:){1,6}(?::[0-9A-Fa-f]{1,4}){1,6}\b`},
+}
+
+// placeholderRe matches the placeholders a redactor makes.
+var placeholderRe = regexp.MustCompile(`\[REDACTED_[A-Z0-9_]+_\d+\]`)
+
+type redactRule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+// redactor replaces what its rules match with placeholders such as
+// [REDACTED_API_KEY_1]. A value gets the same placeholder every time it is
+// seen in a session. It is safe for concurrent use.
+type redactor struct {
+	mu           sync.Mutex
+	rules        []redactRule
+	placeholders map[string]string // by value
+	values       map[string]string // by placeholder
+	counts       map[string]int    // placeholders made, by rule
+}
+
+// newRedactor compiles the built-in rules and those of cfg.
+func newRedactor(cfg RedactConfig) (*redactor, error) {
+	r := &redactor{placeholders: map[string]string{}, values: map[string]string{}, counts: map[string]int{}}
+	rules := secretRules
+	for _, name := range cfg.Detect {
+		i := slices.IndexFunc(piiRules, func(r RedactRule) bool { return r.Name == name })
+		if i < 0 {
+			return nil, fmt.Errorf("unknown redact.detect %q in config.yaml (use email, phone or ip)", name)
+		}
+		rules = append(rules[:len(rules):len(rules)], piiRules[i])
+	}
+	for _, rule := range slices.Concat(rules, cfg.Rules) {
+		if rule.Name == "" || rule.Pattern == "" {
+			return nil, fmt.Errorf("redact.rules in config.yaml: every rule needs a name and a pattern")
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redact rule %s in config.yaml: %w", rule.Name, err)
+		}
+		r.rules = append(r.rules, redactRule{rule.Name, re})
+	}
+	return r, nil
+}
+
+// redact returns text with what the rules match replaced, and the names of
+// the rules that matched.
+func (r *redactor) redact(text string) (string, []string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var found []string
+	for _, rule := range r.rules {
+		matches := rule.re.FindAllStringSubmatchIndex(text, -1)
+		if matches == nil {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			if len(m) >= 4 && m[2] >= 0 {
+				start, end = m[2], m[3]
+			}
+			b.WriteString(text[last:start])
+			b.WriteString(r.placeholder(rule.name, text[start:end]))
+			last = end
+		}
+		b.WriteString(text[last:])
+		text = b.String()
+		if !slices.Contains(found, rule.name) {
+			found = append(found, rule.name)
+		}
+	}
+	return text, found
+}
+
+func (r *redactor) placeholder(rule, value string) string {
+	if p, ok := r.placeholders[value]; ok {
+		return p
+	}
+	r.counts[rule]++
+	p := fmt.Sprintf("[REDACTED_%s_%d]", strings.ToUpper(strings.ReplaceAll(rule, "-", "_")), r.counts[rule])
+	r.placeholders[value] = p
+	r.values[p] = value
+	return p
+}
+
+// restore puts the values back in place of the placeholders in text.
+func (r *redactor) restore(text string) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return placeholderRe.ReplaceAllStringFunc(text, func(p string) string {
+		if v, ok := r.values[p]; ok {
+			return v
+		}
+		return p
+	})
+}
+
+// restoreWriter writes streamed text with the placeholders restored. A
+// placeholder split between two pieces is held back until it is whole.
+type restoreWriter struct {
+	r       *redactor
+	w       io.Writer
+	pending string
+}
+
+func (rw *restoreWriter) write(s string) {
+	s = rw.pending + s
+	rw.pending = ""
+	if i := strings.LastIndexByte(s, '['); i >= 0 && !strings.Contains(s[i:], "]") && len(s)-i < 64 {
+		tail := s[i:]
+		if strings.HasPrefix(tail, "[REDACTED_") || strings.HasPrefix("[REDACTED_", tail) {
+			s, rw.pending = s[:i], tail
+		}
+	}
+	io.WriteString(rw.w, rw.r.restore(s))
+}
+
+// flush writes what is held back.
+func (rw *restoreWriter) flush() {
+	io.WriteString(rw.w, rw.r.restore(rw.pending))
+	rw.pending = ""
+}
+
+// outgoing is the redactor all text sent to the provider goes through, in
+// sendChat and the other requests that carry text, so that no command can
+// leave it out. It is nil with redaction off.
+var outgoing struct {
+	sync.Mutex
+	r     *redactor
+	noted []string // the rules that have been reported
+}
+
+// useRedaction sets up outgoing from the redact: section of cfg, or turns
+// redaction off when it is disabled there or off is set, as --no-redact
+// does. It returns the redactor, or nil.
+func useRedaction(cfg ConfigFile, off bool) (*redactor, error) {
+	var r *redactor
+	if !cfg.Redact.Disabled && !off {
+		var err error
+		if r, err = newRedactor(cfg.Redact); err != nil {
+			return nil, err
+		}
+	}
+	outgoing.Lock()
+	defer outgoing.Unlock()
+	outgoing.r, outgoing.noted = r, nil
+	return r, nil
+}
+
+// outgoingRedactor returns the redactor useRedaction set up, or nil.
+func outgoingRedactor() *redactor {
+	outgoing.Lock()
+	defer outgoing.Unlock()
+	return outgoing.r
+}
+
+// redactOutgoing redacts text on its way to the provider, saying so the
+// first time each rule matches.
+func redactOutgoing(text string) string {
+	r := outgoingRedactor()
+	if r == nil {
+		return text
+	}
+	text, found := r.redact(text)
+	outgoing.Lock()
+	var fresh []string
+	for _, name := range found {
+		if !slices.Contains(outgoing.noted, name) {
+			outgoing.noted = append(outgoing.noted, name)
+			fresh = append(fresh, name)
+		}
+	}
+	outgoing.Unlock()
+	if len(fresh) > 0 {
+		fmt.Fprintf(os.Stderr, "[redact] Replaced %s with placeholders before sending.\n", strings.Join(fresh, ", "))
+	}
+	return text
+}
+
+// restoreOutgoing puts the values outgoing redacted back into text, for
+// what is written to local files, which must not keep the placeholders.
+func restoreOutgoing(text string) string {
+	if r := outgoingRedactor(); r != nil {
+		return r.restore(text)
+	}
+	return text
+}
+
+// redactText redacts text on its way to the model, saying so when it
+// changes anything.
+func (s *chatSession) redactText(text string) string {
+	if s.redactor == nil {
+		return text
+	}
+	text, found := s.redactor.redact(text)
+	if len(found) > 0 {
+		fmt.Fprintf(os.Stderr, "[redact] Replaced %s with placeholders; --no-redact sends them as they are.\n", strings.Join(found, ", "))
+	}
+	return text
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyResize does nothing: there is no signal for a resized terminal
+// here, and the width is the one askgpt started with.
+func notifyResize(c chan<- os.Signal) {}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// defaultTopK is how many parts of an index are sent with each message.
+const defaultTopK = 5
+
+// indexHit is a part of an indexed file found for a question.
+type indexHit struct {
+	Path  string
+	Line  int
+	Text  string
+	Score float64 // cosine similarity to the question
+}
+
+// searchIndex returns the k parts of the index closest to query. The query
+// is embedded with the model the index was built with.
+func searchIndex(ctx context.Context, client *http.Client, cfg ConfigFile, x *vectorIndex, query string, k int) ([]indexHit, error) {
+	s, built, err := x.settings()
+	if err != nil || !built {
+		return nil, fmt.Errorf("cannot read index %s: %v", x.name, err)
+	}
+	cfg.Embeddings = EmbeddingsConfig{Model: s.Model, Dimensions: s.Dimensions}
+	// Only the start of a long question is embedded.
+	query = splitChunks(s.Model, query, ChunkingConfig{}, maxEmbeddingInput)[0]
+	vectors, err := embedTexts(ctx, client, cfg, []string{query}, 1, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := vectors[0]
+
+	rows, err := x.db.QueryContext(ctx, "SELECT path, line, text, embedding FROM chunks")
+	if err != nil {
+		return nil, fmt.Errorf("cannot search index %s: %w", x.name, err)
+	}
+	defer rows.Close()
+	var hits []indexHit
+	for rows.Next() {
+		var h indexHit
+		var b []byte
+		if err := rows.Scan(&h.Path, &h.Line, &h.Text, &b); err != nil {
+			return nil, fmt.Errorf("cannot search index %s: %w", x.name, err)
+		}
+		h.Score = cosine(q, decodeVector(b))
+		// Keep the k best so far, best first.
+		i, _ := slices.BinarySearchFunc(hits, h, func(a, b indexHit) int { return cmp.Compare(b.Score, a.Score) })
+		if i < k {
+			hits = slices.Insert(hits, i, h)
+			hits = hits[:min(len(hits), k)]
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot search index %s: %w", x.name, err)
+	}
+	return hits, nil
+}
+
+func cosine(a, b []float32) float64 {
+	var dot, na, nb float64
+	for i := range min(len(a), len(b)) {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return dot / math.Sqrt(na*nb)
+}
+
+// hitSource names where a hit is from, e.g. guide/install.md:12.
+func hitSource(h indexHit) string {
+	if h.Line > 0 {
+		return fmt.Sprintf("%s:%d", h.Path, h.Line)
+	}
+	return h.Path
+}
+
+// indexContext renders hits as numbered excerpts for the model to answer
+// from and cite.
+func indexContext(name string, hits []indexHit) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Excerpts from the documents in %q that may help. Answer from them where they do, citing them by number, e.g. [1]; say so when they do not hold the answer.\n", name)
+	for i, h := range hits {
+		fmt.Fprintf(&b, "\n[%d] %s\n", i+1, fenceFile(hitSource(h), h.Text))
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// retrieve finds the parts of the --index index that go with a message,
+// lists them and returns them as context for it.
+func (s *chatSession) retrieve(message string) (string, error) {
+	ctx, stop := context.Background(), func() {}
+	if !s.opts.oneShot {
+		ctx, stop = s.requestContext()
+	}
+	defer stop()
+	hits, err := searchIndex(ctx, s.client, s.cfgFile, s.index, message, s.opts.topK)
+	if err != nil {
+		return "", err
+	}
+	if len(hits) == 0 {
+		fmt.Fprintf(os.Stderr, "[index] %s is empty.\n", s.index.name)
+		return "", nil
+	}
+	fmt.Fprintf(os.Stderr, "[index] Sources from %s:\n", s.index.name)
+	for i, h := range hits {
+		fmt.Fprintf(os.Stderr, "  [%d] %s (%.2f)\n", i+1, hitSource(h), h.Score)
+	}
+	return indexContext(s.index.name, hits), nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const savedChatVersion = 1
+
+// savedChat is a conversation written by /save and read back by /load, and
+// the format of the session files. The file is YAML when its name ends in
+// .yaml or .yml and JSON otherwise.
+type savedChat struct {
+	Version     int       `json:"version" yaml:"version"`
+	ID          string    `json:"id,omitempty" yaml:"id,omitempty"`
+	CreatedAt   time.Time `json:"created_at,omitempty" yaml:"created_at,omitempty"`
+	SavedAt     time.Time `json:"saved_at" yaml:"saved_at"`
+	Title       string    `json:"title,omitempty" yaml:"title,omitempty"`
+	Source      string    `json:"source,omitempty" yaml:"source,omitempty"` // e.g. "chatgpt:<id>" when imported
+	Task        string    `json:"task,omitempty" yaml:"task,omitempty"`
+	Model       string    `json:"model" yaml:"model"`
+	Preset      string    `json:"preset,omitempty" yaml:"preset,omitempty"`
+	Temperature *float32  `json:"temperature,omitempty" yaml:"temperature,omitempty"`
+	TopP        *float32  `json:"top_p,omitempty" yaml:"top_p,omitempty"`
+	Persona     string    `json:"persona,omitempty" yaml:"persona,omitempty"`
+	System      string    `json:"system,omitempty" yaml:"system,omitempty"`
+	// Encryption is set when Title, System and the message contents are
+	// encrypted; see cryptStore.
+	Encryption string        `json:"encryption,omitempty" yaml:"encryption,omitempty"`
+	Messages   []chatMessage `json:"messages" yaml:"messages"`
+	Bookmarks  []bookmark    `json:"bookmarks,omitempty" yaml:"bookmarks,omitempty"`
+	// Tags are set with askgpt sessions tag. They are not encrypted, so
+	// that sessions can be listed by them.
+	Tags []string `json:"tags,omitempty" yaml:"tags,omitempty"`
+}
+
+// chatMessage is a message of a conversation with the time it was written.
+// Only the Message is sent to the API.
+type chatMessage struct {
+	Message `yaml:",inline"`
+	Time    time.Time `json:"time" yaml:"time,omitempty"`
+}
+
+func newChatMessage(role, content string) chatMessage {
+	return chatMessage{Message: Message{Role: role, Content: content}, Time: time.Now()}
+}
+
+// apiMessages returns the messages of a conversation as they are sent.
+func apiMessages(messages []chatMessage) []Message {
+	out := make([]Message, len(messages))
+	for i, m := range messages {
+		out[i] = m.Message
+	}
+	return out
+}
+
+func isYAMLFile(path string) bool {
+	ext := strings.ToLower(filepath.Ext(path))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// savedChatPath adds the .json extension to a bare name.
+func savedChatPath(name string) string {
+	if filepath.Ext(name) == "" {
+		return name + ".json"
+	}
+	return name
+}
+
+func writeSavedChat(path string, c savedChat) error {
+	var b []byte
+	var err error
+	if isYAMLFile(path) {
+		b, err = yaml.Marshal(c)
+	} else {
+		b, err = json.MarshalIndent(c, "", "  ")
+		b = append(b, '\n')
+	}
+	if err != nil {
+		return fmt.Errorf("cannot encode conversation: %w", err)
+	}
+	if err := os.WriteFile(path, b, configFilePerm); err != nil {
+		return fmt.Errorf("cannot save conversation: %w", err)
+	}
+	return nil
+}
+
+func readSavedChat(path string) (savedChat, error) {
+	var c savedChat
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("cannot load conversation: %w", err)
+	}
+	if isYAMLFile(path) {
+		err = yaml.Unmarshal(b, &c)
+	} else {
+		err = json.Unmarshal(b, &c)
+	}
+	if err != nil {
+		return c, fmt.Errorf("cannot parse %s: %w", path, err)
+	}
+	if c.Version > savedChatVersion {
+		return c, fmt.Errorf("%s was saved by a newer askgpt (version %d)", path, c.Version)
+	}
+	for _, m := range c.Messages {
+		if m.Role != "user" && m.Role != "assistant" {
+			return c, fmt.Errorf("%s: unexpected message role %q", path, m.Role)
+		}
+	}
+	return c, nil
+}
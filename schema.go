@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// outputSchema is a user supplied JSON Schema the answer must satisfy.
+type outputSchema struct {
+	Name string
+	Raw  json.RawMessage
+	Root map[string]any
+}
+
+var schemaNameInvalid = regexp.MustCompile(`[^a-zA-Z0-9_-]+`)
+
+func loadOutputSchema(path string) (*outputSchema, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read schema %s: %w", path, err)
+	}
+	var root map[string]any
+	if err := json.Unmarshal(b, &root); err != nil {
+		return nil, fmt.Errorf("cannot parse schema %s: %w", path, err)
+	}
+
+	// response_format requires a name matching ^[a-zA-Z0-9_-]+$.
+	name := strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	if title, ok := root["title"].(string); ok && title != "" {
+		name = title
+	}
+	name = strings.Trim(schemaNameInvalid.ReplaceAllString(name, "_"), "_")
+	if name == "" {
+		name = "response"
+	}
+	return &outputSchema{Name: name, Raw: b, Root: root}, nil
+}
+
+// schemaUnsupported reports whether the provider rejected the json_schema
+// response format, in which case tool-call emulation is used instead.
+func schemaUnsupported(err error) bool {
+	var ae *apiError
+	if !errors.As(err, &ae) || ae.StatusCode < 400 || ae.StatusCode >= 500 {
+		return false
+	}
+	body := strings.ToLower(ae.Body)
+	return strings.Contains(body, "response_format") || strings.Contains(body, "json_schema")
+}
+
+func requestSchemaOutput(ctx context.Context, client *http.Client, cfg AskGPTConfig, messages []Message, opts taskOptions, viaTools bool) (chatResult, error) {
+	req := newChatRequest(cfg, messages, opts)
+	req.ResponseFormat = nil
+	if viaTools {
+		req.Tools = []Tool{{
+			Type: "function",
+			Function: ToolFunction{
+				Name:        opts.schema.Name,
+				Description: "Return the answer as structured data.",
+				Parameters:  opts.schema.Raw,
+			},
+		}}
+		req.ToolChoice = map[string]any{
+			"type":     "function",
+			"function": map[string]string{"name": opts.schema.Name},
+		}
+	} else {
+		req.ResponseFormat = &ResponseFormat{
+			Type:       "json_schema",
+			JSONSchema: &JSONSchemaFormat{Name: opts.schema.Name, Schema: opts.schema.Raw},
+		}
+	}
+
+	res, err := sendChat(ctx, client, cfg, req, nil)
+	if err != nil {
+		return res, err
+	}
+	if viaTools && res.ToolArgs != "" {
+		res.Content = res.ToolArgs
+	}
+	return res, nil
+}
+
+// doSchemaChat asks for output matching opts.schema, validates it locally and
+// retries once with the validation errors when the model gets it wrong.
+func doSchemaChat(ctx context.Context, client *http.Client, cfg AskGPTConfig, messages []Message, opts taskOptions) (chatResult, error) {
+	viaTools := false
+	attempt := messages
+	for try := 0; ; try++ {
+		res, err := requestSchemaOutput(ctx, client, cfg, attempt, opts, viaTools)
+		if err != nil && !viaTools && schemaUnsupported(err) {
+			fmt.Fprintln(os.Stderr, "Provider does not support json_schema, emulating it with a tool call.")
+			viaTools = true
+			tracef(traceVerbose, "retrying with a tool call after: %v", err)
+			logger.Info("retry", "reason", "json_schema unsupported", "error", err.Error())
+			res, err = requestSchemaOutput(ctx, client, cfg, attempt, opts, viaTools)
+		}
+		if err != nil {
+			return res, err
+		}
+		if !opts.noUsage && !opts.raw {
+			printUsage(res.Usage)
+		}
+		text := res.Content
+
+		pretty, err := formatJSONResponse(text)
+		if err == nil {
+			var v any
+			_ = json.Unmarshal([]byte(pretty), &v)
+			if problems := validateJSONSchema(opts.schema.Root, opts.schema.Root, v, "$"); len(problems) > 0 {
+				err = fmt.Errorf("response does not match schema: %s", strings.Join(problems, "; "))
+			}
+		}
+		if err == nil {
+			fmt.Println(pretty)
+			return res, nil
+		}
+		if try > 0 {
+			fmt.Fprintf(os.Stderr, "Raw response:\n%s\n", text)
+			return res, err
+		}
+
+		fmt.Fprintf(os.Stderr, "%v\nRetrying once...\n", err)
+		tracef(traceVerbose, "retrying with the validation errors, attempt 2 of 2")
+		logger.Info("retry", "reason", "schema validation", "error", err.Error())
+		attempt = append(append([]Message(nil), messages...),
+			Message{Role: "assistant", Content: text},
+			Message{Role: "user", Content: "Your previous reply was rejected: " + err.Error() +
+				"\nReply again with only the corrected JSON."},
+		)
+	}
+}
+
+// validateJSONSchema checks v against schema and returns a description of
+// every violation. It covers the commonly used subset of JSON Schema: type,
+// enum, const, properties, required, additionalProperties, items, length and
+// range bounds, pattern, allOf/anyOf/oneOf/not and local $ref pointers.
+func validateJSONSchema(root, schema map[string]any, v any, at string) []string {
+	return validateSchemaAt(root, schema, v, at, nil)
+}
+
+// validateSchemaAt is validateJSONSchema with refs, the $refs followed at
+// this place in v so far. A schema that reaches one of them again before
+// going into a property or item would never end, as {"$ref": "#"} would.
+func validateSchemaAt(root, schema map[string]any, v any, at string, refs []string) []string {
+	if ref, ok := schema["$ref"].(string); ok {
+		if slices.Contains(refs, ref) {
+			return []string{fmt.Sprintf("%s: $ref %q refers back to itself", at, ref)}
+		}
+		target, err := resolveSchemaRef(root, ref)
+		if err != nil {
+			return []string{fmt.Sprintf("%s: %v", at, err)}
+		}
+		return validateSchemaAt(root, target, v, at, append(refs[:len(refs):len(refs)], ref))
+	}
+
+	var problems []string
+	fail := func(format string, args ...any) {
+		problems = append(problems, at+": "+fmt.Sprintf(format, args...))
+	}
+
+	if t, ok := schema["type"]; ok {
+		var types []string
+		switch tt := t.(type) {
+		case string:
+			types = []string{tt}
+		case []any:
+			for _, x := range tt {
+				if s, ok := x.(string); ok {
+					types = append(types, s)
+				}
+			}
+		}
+		matched := false
+		for _, want := range types {
+			if jsonTypeMatches(want, v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			fail("expected %s, got %s", strings.Join(types, " or "), jsonTypeName(v))
+			return problems
+		}
+	}
+
+	if enum, ok := schema["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			if jsonEqual(e, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			fail("value not in enum")
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, v) {
+		fail("value does not equal const")
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		props, _ := schema["properties"].(map[string]any)
+		if req, ok := schema["required"].([]any); ok {
+			for _, r := range req {
+				if name, ok := r.(string); ok {
+					if _, present := val[name]; !present {
+						fail("missing required property %q", name)
+					}
+				}
+			}
+		}
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if ps, ok := props[k].(map[string]any); ok {
+				problems = append(problems, validateJSONSchema(root, ps, val[k], at+"."+k)...)
+				continue
+			}
+			switch ap := schema["additionalProperties"].(type) {
+			case bool:
+				if !ap {
+					fail("unexpected property %q", k)
+				}
+			case map[string]any:
+				problems = append(problems, validateJSONSchema(root, ap, val[k], at+"."+k)...)
+			}
+		}
+	case []any:
+		if n, ok := schemaNumber(schema, "minItems"); ok && float64(len(val)) < n {
+			fail("expected at least %v items, got %d", n, len(val))
+		}
+		if n, ok := schemaNumber(schema, "maxItems"); ok && float64(len(val)) > n {
+			fail("expected at most %v items, got %d", n, len(val))
+		}
+		if items, ok := schema["items"].(map[string]any); ok {
+			for i, item := range val {
+				problems = append(problems, validateJSONSchema(root, items, item, fmt.Sprintf("%s[%d]", at, i))...)
+			}
+		}
+	case string:
+		length := float64(len([]rune(val)))
+		if n, ok := schemaNumber(schema, "minLength"); ok && length < n {
+			fail("string shorter than %v", n)
+		}
+		if n, ok := schemaNumber(schema, "maxLength"); ok && length > n {
+			fail("string longer than %v", n)
+		}
+		if p, ok := schema["pattern"].(string); ok {
+			if re, err := regexp.Compile(p); err == nil && !re.MatchString(val) {
+				fail("string does not match pattern %q", p)
+			}
+		}
+	case float64:
+		if n, ok := schemaNumber(schema, "minimum"); ok && val < n {
+			fail("%v is less than minimum %v", val, n)
+		}
+		if n, ok := schemaNumber(schema, "maximum"); ok && val > n {
+			fail("%v is greater than maximum %v", val, n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMinimum"); ok && val <= n {
+			fail("%v is not greater than %v", val, n)
+		}
+		if n, ok := schemaNumber(schema, "exclusiveMaximum"); ok && val >= n {
+			fail("%v is not less than %v", val, n)
+		}
+	}
+
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			if s, ok := sub.(map[string]any); ok {
+				problems = append(problems, validateSchemaAt(root, s, v, at, refs)...)
+			}
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]any); ok && countSchemaMatches(root, anyOf, v, at, refs) == 0 {
+		fail("value matches none of anyOf")
+	}
+	if oneOf, ok := schema["oneOf"].([]any); ok {
+		if n := countSchemaMatches(root, oneOf, v, at, refs); n != 1 {
+			fail("value matches %d of oneOf, expected exactly 1", n)
+		}
+	}
+	if not, ok := schema["not"].(map[string]any); ok && len(validateSchemaAt(root, not, v, at, refs)) == 0 {
+		fail("value must not match schema in not")
+	}
+	return problems
+}
+
+func countSchemaMatches(root map[string]any, schemas []any, v any, at string, refs []string) int {
+	n := 0
+	for _, sub := range schemas {
+		if s, ok := sub.(map[string]any); ok && len(validateSchemaAt(root, s, v, at, refs)) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+func resolveSchemaRef(root map[string]any, ref string) (map[string]any, error) {
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("unsupported $ref %q (only local references are supported)", ref)
+	}
+	var cur any = root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/") {
+		if part == "" {
+			continue
+		}
+		part = strings.ReplaceAll(strings.ReplaceAll(part, "~1", "/"), "~0", "~")
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("cannot resolve $ref %q", ref)
+		}
+		cur = m[part]
+	}
+	target, ok := cur.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("cannot resolve $ref %q", ref)
+	}
+	return target, nil
+}
+
+func schemaNumber(schema map[string]any, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+func jsonTypeMatches(want string, v any) bool {
+	switch want {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == math.Trunc(n)
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "null":
+		return v == nil
+	}
+	return false
+}
+
+func jsonTypeName(v any) string {
+	switch v.(type) {
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case nil:
+		return "null"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func jsonEqual(a, b any) bool {
+	x, err1 := json.Marshal(a)
+	y, err2 := json.Marshal(b)
+	return err1 == nil && err2 == nil && string(x) == string(y)
+}
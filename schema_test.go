@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestValidateJSONSchemaRefs(t *testing.T) {
+	tests := []struct {
+		name    string
+		schema  string
+		value   string
+		problem string // a part of the only problem wanted, or "" for none
+	}{
+		{"self", `{"$ref": "#"}`, `1`, `$ref "#" refers back to itself`},
+		{"through allOf", `{"allOf": [{"$ref": "#"}]}`, `1`, `$ref "#" refers back to itself`},
+		{
+			"two definitions", `{"$ref": "#/$defs/a", "$defs": {"a": {"$ref": "#/$defs/b"}, "b": {"$ref": "#/$defs/a"}}}`,
+			`1`, `$ref "#/$defs/a" refers back to itself`,
+		},
+		{
+			// A tree refers to itself for its children, which ends with the value.
+			"recursive", `{"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#"}}}}`,
+			`{"children": [{"children": []}, {"children": [{}]}]}`, "",
+		},
+		{
+			"recursive mismatch", `{"type": "object", "properties": {"children": {"type": "array", "items": {"$ref": "#"}}}}`,
+			`{"children": [{"children": [1]}]}`, "$.children[0].children[0]: expected object, got number",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var schema map[string]any
+			var v any
+			if err := json.Unmarshal([]byte(tt.schema), &schema); err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal([]byte(tt.value), &v); err != nil {
+				t.Fatal(err)
+			}
+			problems := validateJSONSchema(schema, schema, v, "$")
+			if tt.problem == "" {
+				if len(problems) > 0 {
+					t.Fatalf("got problems %q, want none", problems)
+				}
+				return
+			}
+			if len(problems) != 1 || !strings.Contains(problems[0], tt.problem) {
+				t.Fatalf("got problems %q, want one with %q", problems, tt.problem)
+			}
+		})
+	}
+}
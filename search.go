@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+)
+
+// snippetContext is the number of characters shown on each side of a match.
+const snippetContext = 40
+
+func runSearch(args []string) int {
+	fs := flag.NewFlagSet("search", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	role := fs.String("role", "", "")
+
+	// Allow flags after the query.
+	var words []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	query := strings.TrimSpace(strings.Join(words, " "))
+	if query == "" {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt search <text> [--role user|assistant]")
+		return 2
+	}
+	switch *role {
+	case "", "user", "assistant":
+	default:
+		errorf("unknown role %q (use user or assistant)\n", *role)
+		return 2
+	}
+
+	cfg, err := readConfigIfExists()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	store, err := openSessionStore(cfg.Sessions)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	ids, err := searchIDs(store, query, *role)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+
+	matches, sessions := 0, 0
+	// Most recently used first.
+	for i := len(ids) - 1; i >= 0; i-- {
+		c, err := store.Load(ids[i])
+		if err != nil {
+			warnf("%v\n", err)
+			continue
+		}
+		// The messages compacting replaced come before those left.
+		archived, err := readArchive(cfg.Sessions, ids[i])
+		if err != nil {
+			warnf("%v\n", err)
+		}
+		found := false
+		for _, m := range append(archived, c.Messages...) {
+			if *role != "" && m.Role != *role {
+				continue
+			}
+			snippet, ok := matchSnippet(m.Content, query)
+			if !ok {
+				continue
+			}
+			if !found {
+				if sessions > 0 {
+					fmt.Println()
+				}
+				fmt.Printf("%s  %s\n", ids[i], sessionTitle(c.Title, c.Messages))
+				found = true
+			}
+			fmt.Printf("  %-16s  %s: %s\n", formatTime(m.Time), roleName(m.Role), snippet)
+			matches++
+		}
+		if found {
+			sessions++
+		}
+	}
+	if matches == 0 {
+		fmt.Fprintln(os.Stderr, "No matches.")
+		return 0
+	}
+	fmt.Fprintf(os.Stderr, "%d match(es) in %d session(s). Open one with: askgpt sessions show <id>\n", matches, sessions)
+	return 0
+}
+
+// searchIDs returns the ids of the sessions to look for query in, most
+// recently used last. The SQLite store narrows them down with its search
+// index; the sessions compacting archived messages of are always looked in.
+func searchIDs(store sessionStore, query, role string) ([]string, error) {
+	db, ok := storeBackend(store).(*sqliteStore)
+	if !ok {
+		return store.IDs()
+	}
+	found, err := db.searchIDs(query, role)
+	if err != nil {
+		return nil, err
+	}
+	look := make(map[string]bool, len(found))
+	for _, id := range found {
+		look[id] = true
+	}
+	dir, err := archiveDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if id, ok := strings.CutSuffix(e.Name(), ".json.gz"); ok {
+			look[id] = true
+		}
+	}
+	ids, err := store.IDs()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(ids, func(id string) bool { return !look[id] }), nil
+}
+
+// matchSnippet finds query in text, ignoring case, and returns the first
+// match with some context on one line.
+func matchSnippet(text, query string) (string, bool) {
+	// ToLower maps rune for rune, so a position counted in runes is the
+	// same in both.
+	lower := strings.ToLower(text)
+	i := strings.Index(lower, strings.ToLower(query))
+	if i < 0 {
+		return "", false
+	}
+	runes := []rune(text)
+	at := utf8.RuneCountInString(lower[:i])
+	n := utf8.RuneCountInString(query)
+	start, end := max(at-snippetContext, 0), min(at+n+snippetContext, len(runes))
+	snippet := strings.Join(strings.Fields(string(runes[start:end])), " ")
+	if start > 0 {
+		snippet = "…" + snippet
+	}
+	if end < len(runes) {
+		snippet += "…"
+	}
+	return snippet, true
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+const (
+	// sessionCipher names how a session's text is encrypted: AES-256-GCM
+	// with a key derived from the passphrase by Argon2id.
+	sessionCipher      = "argon2id-aes256gcm"
+	sessionKeyFileName = "sessions.key"
+	passphraseEnv      = "ASKGPT_PASSPHRASE"
+	passphraseCheck    = "askgpt"
+)
+
+// sessionKeyFile is ~/.askgpt/sessions.key. It holds the salt new sessions
+// are encrypted with and a check value that tells a mistyped passphrase
+// from the one used so far. Each session carries its own salt, so sessions
+// can still be opened if the file is lost.
+type sessionKeyFile struct {
+	Salt  []byte `json:"salt"`
+	Check []byte `json:"check"`
+}
+
+// sessionKeys caches the passphrase and the keys derived from it for the
+// lifetime of the process, so it is asked for at most once.
+var sessionKeys struct {
+	sync.Mutex
+	passphrase string
+	err        error
+	salt       []byte // for new sessions
+	bySalt     map[string]cipher.AEAD
+}
+
+// cryptStore encrypts the text of the sessions it saves when
+// sessions.encrypt is set, and decrypts encrypted sessions when loading
+// them whatever the setting.
+type cryptStore struct {
+	sessionStore
+	cfg SessionsConfig
+}
+
+func (s cryptStore) Load(id string) (savedChat, error) {
+	c, err := s.sessionStore.Load(id)
+	if err != nil || c.Encryption == "" {
+		return c, err
+	}
+	return decryptChat(s.cfg, c)
+}
+
+func (s cryptStore) Save(c savedChat, used time.Time) error {
+	if s.cfg.Encrypt {
+		var err error
+		if c, err = encryptChat(s.cfg, c); err != nil {
+			return err
+		}
+	}
+	return s.sessionStore.Save(c, used)
+}
+
+// unlockSessions asks for the passphrase up front when sessions are
+// encrypted, rather than in the middle of a chat.
+func unlockSessions(cfg SessionsConfig) error {
+	if !cfg.Encrypt {
+		return nil
+	}
+	_, err := sessionSalt(cfg, true)
+	return err
+}
+
+// encryptChat returns c with its title, system prompt, messages and
+// bookmark labels encrypted. The session id is authenticated along with
+// each of them, so text cannot be moved between sessions unnoticed.
+func encryptChat(cfg SessionsConfig, c savedChat) (savedChat, error) {
+	salt, err := sessionSalt(cfg, true)
+	if err != nil {
+		return c, err
+	}
+	aead, err := sessionCipherFor(cfg, salt)
+	if err != nil {
+		return c, err
+	}
+	seal := func(s string) (string, error) {
+		if s == "" {
+			return "", nil
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", fmt.Errorf("cannot encrypt session: %w", err)
+		}
+		return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(s), []byte(c.ID))), nil
+	}
+	out, err := mapChatText(c, seal)
+	if err != nil {
+		return c, err
+	}
+	out.Encryption = sessionCipher + ":" + base64.StdEncoding.EncodeToString(salt)
+	return out, nil
+}
+
+func decryptChat(cfg SessionsConfig, c savedChat) (savedChat, error) {
+	scheme, salt64, _ := strings.Cut(c.Encryption, ":")
+	salt, err := base64.StdEncoding.DecodeString(salt64)
+	if scheme != sessionCipher || err != nil {
+		return c, fmt.Errorf("session %s: unknown encryption %q", c.ID, c.Encryption)
+	}
+	// Check the passphrase once against sessions.key, rather than failing
+	// on every session.
+	if _, err := sessionSalt(cfg, false); err != nil {
+		return c, err
+	}
+	aead, err := sessionCipherFor(cfg, salt)
+	if err != nil {
+		return c, err
+	}
+	open := func(s string) (string, error) {
+		if s == "" {
+			return "", nil
+		}
+		b, err := base64.StdEncoding.DecodeString(s)
+		if err != nil || len(b) < aead.NonceSize() {
+			return "", fmt.Errorf("session %s is damaged", c.ID)
+		}
+		plain, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(c.ID))
+		if err != nil {
+			return "", fmt.Errorf("cannot decrypt session %s: wrong passphrase?", c.ID)
+		}
+		return string(plain), nil
+	}
+	out, err := mapChatText(c, open)
+	if err != nil {
+		return c, err
+	}
+	out.Encryption = ""
+	return out, nil
+}
+
+// mapChatText returns a copy of c with f applied to its private text.
+func mapChatText(c savedChat, f func(string) (string, error)) (savedChat, error) {
+	var err error
+	if c.Title, err = f(c.Title); err != nil {
+		return c, err
+	}
+	if c.System, err = f(c.System); err != nil {
+		return c, err
+	}
+	messages := make([]chatMessage, len(c.Messages))
+	for i, m := range c.Messages {
+		if m.Content, err = f(m.Content); err != nil {
+			return c, err
+		}
+		messages[i] = m
+	}
+	c.Messages = messages
+	bookmarks := make([]bookmark, len(c.Bookmarks))
+	for i, b := range c.Bookmarks {
+		if b.Label, err = f(b.Label); err != nil {
+			return c, err
+		}
+		bookmarks[i] = b
+	}
+	c.Bookmarks = bookmarks
+	return c, nil
+}
+
+// sessionSalt returns the salt for new sessions from sessions.key,
+// checking the passphrase against it. When the file does not exist yet it
+// is created if create is set, asking for the new passphrase twice, and
+// otherwise the salt is nil.
+func sessionSalt(cfg SessionsConfig, create bool) ([]byte, error) {
+	sessionKeys.Lock()
+	salt := sessionKeys.salt
+	sessionKeys.Unlock()
+	if salt != nil {
+		return salt, nil
+	}
+
+	cfgPath, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(filepath.Dir(cfgPath), sessionKeyFileName)
+	var kf sessionKeyFile
+	b, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &kf); err != nil || len(kf.Salt) == 0 {
+			return nil, fmt.Errorf("cannot parse %s", path)
+		}
+		aead, err := sessionCipherFor(cfg, kf.Salt)
+		if err != nil {
+			return nil, err
+		}
+		nonce := aead.NonceSize()
+		if len(kf.Check) < nonce {
+			return nil, fmt.Errorf("cannot parse %s", path)
+		}
+		if _, err := aead.Open(nil, kf.Check[:nonce], kf.Check[nonce:], nil); err != nil {
+			return nil, forgetPassphrase()
+		}
+	case os.IsNotExist(err) && !create:
+		return nil, nil
+	case os.IsNotExist(err):
+		kf.Salt = make([]byte, 16)
+		if _, err := rand.Read(kf.Salt); err != nil {
+			return nil, err
+		}
+		if _, err := sessionPassphrase(cfg, true); err != nil {
+			return nil, err
+		}
+		aead, err := sessionCipherFor(cfg, kf.Salt)
+		if err != nil {
+			return nil, err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+		kf.Check = aead.Seal(nonce, nonce, []byte(passphraseCheck), nil)
+		b, _ := json.MarshalIndent(kf, "", "  ")
+		if err := os.WriteFile(path, append(b, '\n'), configFilePerm); err != nil {
+			return nil, fmt.Errorf("cannot write %s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("cannot read %s: %w", path, err)
+	}
+
+	sessionKeys.Lock()
+	sessionKeys.salt = kf.Salt
+	sessionKeys.Unlock()
+	return kf.Salt, nil
+}
+
+// sessionCipherFor returns the cipher for sessions encrypted with salt.
+func sessionCipherFor(cfg SessionsConfig, salt []byte) (cipher.AEAD, error) {
+	passphrase, err := sessionPassphrase(cfg, false)
+	if err != nil {
+		return nil, err
+	}
+	sessionKeys.Lock()
+	defer sessionKeys.Unlock()
+	if aead, ok := sessionKeys.bySalt[string(salt)]; ok {
+		return aead, nil
+	}
+	key := argon2.IDKey([]byte(passphrase), salt, 1, 64*1024, 4, 32)
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if sessionKeys.bySalt == nil {
+		sessionKeys.bySalt = map[string]cipher.AEAD{}
+	}
+	sessionKeys.bySalt[string(salt)] = aead
+	return aead, nil
+}
+
+// sessionPassphrase returns the passphrase from sessions.key_command, the
+// ASKGPT_PASSPHRASE environment variable or the terminal, in that order.
+// A new passphrase is typed twice.
+func sessionPassphrase(cfg SessionsConfig, confirm bool) (string, error) {
+	sessionKeys.Lock()
+	defer sessionKeys.Unlock()
+	if sessionKeys.passphrase != "" || sessionKeys.err != nil {
+		return sessionKeys.passphrase, sessionKeys.err
+	}
+	passphrase, err := readSessionPassphrase(cfg, confirm)
+	sessionKeys.passphrase, sessionKeys.err = passphrase, err
+	return passphrase, err
+}
+
+func readSessionPassphrase(cfg SessionsConfig, confirm bool) (string, error) {
+	if strings.TrimSpace(cfg.KeyCommand) != "" {
+		return runKeyCommand(cfg.KeyCommand)
+	}
+	if p := os.Getenv(passphraseEnv); p != "" {
+		return p, nil
+	}
+	if !isTerminal(os.Stdin) {
+		return "", fmt.Errorf("saved sessions are encrypted: set %s or sessions.key_command", passphraseEnv)
+	}
+	read := func(prompt string) (string, error) {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(int(os.Stdin.Fd()))
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("cannot read passphrase: %w", err)
+		}
+		return string(b), nil
+	}
+	if !confirm {
+		p, err := read("Passphrase for saved sessions: ")
+		if err == nil && p == "" {
+			err = errors.New("no passphrase given")
+		}
+		return p, err
+	}
+	p, err := read("New passphrase for saved sessions: ")
+	if err != nil {
+		return "", err
+	}
+	if p == "" {
+		return "", errors.New("no passphrase given")
+	}
+	again, err := read("Repeat the passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if again != p {
+		return "", errors.New("the passphrases do not match")
+	}
+	return p, nil
+}
+
+// forgetPassphrase drops a passphrase that turned out to be wrong and
+// returns the error to report. It is not asked again in this process.
+func forgetPassphrase() error {
+	sessionKeys.Lock()
+	defer sessionKeys.Unlock()
+	sessionKeys.passphrase = ""
+	sessionKeys.err = errors.New("wrong passphrase for the saved sessions")
+	sessionKeys.bySalt = nil
+	return sessionKeys.err
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sessionsDBName = "sessions.db"
+	// sessionsDBVersion is the schema version, kept in PRAGMA user_version.
+	sessionsDBVersion = 4
+	// minTrigram is the shortest text the search index finds.
+	minTrigram = 3
+)
+
+// sessionsSchema is the layout of sessions.db. Times are Unix nanoseconds,
+// or NULL when unknown. Keeping messages in their own table lets them be
+// searched and counted without decoding whole sessions.
+const sessionsSchema = `
+CREATE TABLE sessions (
+	id          TEXT PRIMARY KEY,
+	created_at  INTEGER,
+	saved_at    INTEGER,
+	used_at     INTEGER NOT NULL,
+	title       TEXT NOT NULL DEFAULT '',
+	source      TEXT NOT NULL DEFAULT '',
+	task        TEXT NOT NULL DEFAULT '',
+	model       TEXT NOT NULL DEFAULT '',
+	preset      TEXT NOT NULL DEFAULT '',
+	temperature REAL,
+	top_p       REAL,
+	persona     TEXT NOT NULL DEFAULT '',
+	system      TEXT NOT NULL DEFAULT '',
+	encryption  TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX sessions_used_at ON sessions (used_at);
+CREATE TABLE messages (
+	session_id TEXT NOT NULL,
+	seq        INTEGER NOT NULL,
+	role       TEXT NOT NULL,
+	content    TEXT NOT NULL,
+	time       INTEGER,
+	PRIMARY KEY (session_id, seq)
+);
+` + bookmarksTable + tagsAndSearchTables
+
+// bookmarksTable is part of the schema from version 3 on.
+const bookmarksTable = `
+CREATE TABLE bookmarks (
+	session_id TEXT NOT NULL,
+	seq        INTEGER NOT NULL,
+	label      TEXT NOT NULL,
+	turn       INTEGER NOT NULL,
+	at         INTEGER,
+	PRIMARY KEY (session_id, seq)
+);
+`
+
+// tagsAndSearchTables are part of the schema from version 4 on.
+// messages_search indexes the messages of the sessions that are not
+// encrypted by their trigrams, which finds any text of three characters or
+// more in them, ignoring case, as askgpt search does.
+const tagsAndSearchTables = `
+CREATE TABLE tags (
+	session_id TEXT NOT NULL,
+	tag        TEXT NOT NULL,
+	PRIMARY KEY (session_id, tag)
+);
+CREATE INDEX tags_tag ON tags (tag);
+CREATE VIRTUAL TABLE messages_search USING fts5(session_id UNINDEXED, role UNINDEXED, content, tokenize = 'trigram');
+`
+
+// sqliteStore keeps the sessions in ~/.askgpt/sessions.db.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// openSQLiteStore opens sessions.db, creating it on first use and copying
+// the session files saved until then into it.
+func openSQLiteStore() (*sqliteStore, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(cfgPath)
+	if err := os.MkdirAll(dir, configDirPerm); err != nil {
+		return nil, fmt.Errorf("cannot create dir %s: %w", dir, err)
+	}
+	path := filepath.Join(dir, sessionsDBName)
+	// Create the file private, as the conversations are; SQLite gives its
+	// journal files the same permissions.
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, configFilePerm)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	f.Close()
+	// Another askgpt may be saving its chat at the same moment: wait for
+	// it, and take the write lock when a transaction starts.
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	s := &sqliteStore{db: db}
+	if err := s.init(filepath.Join(dir, sessionsDirName)); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("cannot open %s: %w", path, err)
+	}
+	return s, nil
+}
+
+// init creates the tables in a new database and migrates the session files
+// from filesDir into it, or updates the tables of an older version. The
+// files are left in place as a backup.
+func (s *sqliteStore) init(filesDir string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var version int
+	if err := tx.QueryRow("PRAGMA user_version").Scan(&version); err != nil {
+		return err
+	}
+	switch version {
+	case sessionsDBVersion:
+		return nil
+	case 1, 2, 3:
+		// Version 1 had no encryption column, versions before 3 no
+		// bookmarks and those before 4 no tags or search index.
+		var migration string
+		if version < 2 {
+			migration += "ALTER TABLE sessions ADD COLUMN encryption TEXT NOT NULL DEFAULT '';"
+		}
+		if version < 3 {
+			migration += bookmarksTable
+		}
+		migration += tagsAndSearchTables + `
+INSERT INTO messages_search (session_id, role, content)
+	SELECT session_id, role, content FROM messages JOIN sessions ON id = session_id
+	WHERE encryption = '' ORDER BY session_id, seq;
+`
+		if _, err := tx.Exec(migration + fmt.Sprintf("PRAGMA user_version = %d;", sessionsDBVersion)); err != nil {
+			return err
+		}
+		return tx.Commit()
+	case 0:
+	default:
+		return fmt.Errorf("%s was created by a newer askgpt (version %d)", sessionsDBName, version)
+	}
+	if _, err := tx.Exec(sessionsSchema + fmt.Sprintf("PRAGMA user_version = %d;", sessionsDBVersion)); err != nil {
+		return err
+	}
+
+	files := fileStore{filesDir}
+	ids, err := files.IDs()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	copied := 0
+	for _, id := range ids {
+		c, err := files.Load(id)
+		if err != nil {
+			warnf("%v\n", err)
+			continue
+		}
+		used := c.SavedAt
+		if info, err := os.Stat(files.path(id)); err == nil {
+			used = info.ModTime()
+		}
+		if err := saveSession(tx, c, used); err != nil {
+			return err
+		}
+		copied++
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if copied > 0 {
+		fmt.Fprintf(os.Stderr, "Copied %d session(s) from %s into %s; the files are kept as a backup.\n",
+			copied, filesDir, sessionsDBName)
+	}
+	return nil
+}
+
+func (s *sqliteStore) IDs() ([]string, error) {
+	return s.queryIDs("SELECT id FROM sessions ORDER BY used_at, id")
+}
+
+func (s *sqliteStore) NewID(t time.Time) (string, error) {
+	base := t.Local().Format(sessionIDFormat)
+	var taken []string
+	rows, err := s.db.Query("SELECT id FROM sessions WHERE id = ? OR id LIKE ?", base, base+"-%")
+	if err != nil {
+		return "", fmt.Errorf("cannot list sessions: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return "", fmt.Errorf("cannot list sessions: %w", err)
+		}
+		taken = append(taken, id)
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("cannot list sessions: %w", err)
+	}
+	id := base
+	for n := 2; slices.Contains(taken, id); n++ {
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+	return id, nil
+}
+
+func (s *sqliteStore) Used(id string) (time.Time, error) {
+	var used sql.NullInt64
+	err := s.db.QueryRow("SELECT used_at FROM sessions WHERE id = ?", id).Scan(&used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, fmt.Errorf("no session %q", id)
+	}
+	if err != nil {
+		return time.Time{}, fmt.Errorf("cannot load session %s: %w", id, err)
+	}
+	return fromUnixNano(used), nil
+}
+
+func (s *sqliteStore) Load(id string) (savedChat, error) {
+	c := savedChat{Version: savedChatVersion, ID: id}
+	var created, saved sql.NullInt64
+	var temperature, topP sql.NullFloat64
+	err := s.db.QueryRow(`SELECT created_at, saved_at, title, source, task, model, preset,
+		temperature, top_p, persona, system, encryption FROM sessions WHERE id = ?`, id).Scan(
+		&created, &saved, &c.Title, &c.Source, &c.Task, &c.Model, &c.Preset,
+		&temperature, &topP, &c.Persona, &c.System, &c.Encryption)
+	if errors.Is(err, sql.ErrNoRows) {
+		return c, fmt.Errorf("no session %q", id)
+	}
+	if err != nil {
+		return c, fmt.Errorf("cannot load session %s: %w", id, err)
+	}
+	c.CreatedAt, c.SavedAt = fromUnixNano(created), fromUnixNano(saved)
+	c.Temperature, c.TopP = fromNullFloat(temperature), fromNullFloat(topP)
+
+	rows, err := s.db.Query("SELECT role, content, time FROM messages WHERE session_id = ? ORDER BY seq", id)
+	if err != nil {
+		return c, fmt.Errorf("cannot load session %s: %w", id, err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m chatMessage
+		var t sql.NullInt64
+		if err := rows.Scan(&m.Role, &m.Content, &t); err != nil {
+			return c, fmt.Errorf("cannot load session %s: %w", id, err)
+		}
+		m.Time = fromUnixNano(t)
+		c.Messages = append(c.Messages, m)
+	}
+	if err := rows.Err(); err != nil {
+		return c, fmt.Errorf("cannot load session %s: %w", id, err)
+	}
+
+	marks, err := s.db.Query("SELECT label, turn, at FROM bookmarks WHERE session_id = ? ORDER BY seq", id)
+	if err != nil {
+		return c, fmt.Errorf("cannot load session %s: %w", id, err)
+	}
+	defer marks.Close()
+	for marks.Next() {
+		var b bookmark
+		var at sql.NullInt64
+		if err := marks.Scan(&b.Label, &b.Turn, &at); err != nil {
+			return c, fmt.Errorf("cannot load session %s: %w", id, err)
+		}
+		b.At = fromUnixNano(at)
+		c.Bookmarks = append(c.Bookmarks, b)
+	}
+	if err := marks.Err(); err != nil {
+		return c, fmt.Errorf("cannot load session %s: %w", id, err)
+	}
+
+	tags, err := s.db.Query("SELECT tag FROM tags WHERE session_id = ? ORDER BY tag", id)
+	if err != nil {
+		return c, fmt.Errorf("cannot load session %s: %w", id, err)
+	}
+	defer tags.Close()
+	for tags.Next() {
+		var tag string
+		if err := tags.Scan(&tag); err != nil {
+			return c, fmt.Errorf("cannot load session %s: %w", id, err)
+		}
+		c.Tags = append(c.Tags, tag)
+	}
+	if err := tags.Err(); err != nil {
+		return c, fmt.Errorf("cannot load session %s: %w", id, err)
+	}
+	return c, nil
+}
+
+func (s *sqliteStore) Save(c savedChat, used time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot save conversation: %w", err)
+	}
+	defer tx.Rollback()
+	if used.IsZero() {
+		var prev sql.NullInt64
+		_ = tx.QueryRow("SELECT used_at FROM sessions WHERE id = ?", c.ID).Scan(&prev)
+		if used = fromUnixNano(prev); used.IsZero() {
+			used = time.Now()
+		}
+	}
+	if err := saveSession(tx, c, used); err != nil {
+		return fmt.Errorf("cannot save conversation: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot save conversation: %w", err)
+	}
+	return nil
+}
+
+// saveSession replaces the session c.ID, messages, bookmarks, tags and all.
+func saveSession(tx *sql.Tx, c savedChat, used time.Time) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO sessions (id, created_at, saved_at, used_at, title,
+		source, task, model, preset, temperature, top_p, persona, system, encryption)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		c.ID, unixNano(c.CreatedAt), unixNano(c.SavedAt), used.UnixNano(), c.Title,
+		c.Source, c.Task, c.Model, c.Preset, nullFloat(c.Temperature), nullFloat(c.TopP), c.Persona, c.System, c.Encryption)
+	if err != nil {
+		return err
+	}
+	if err := deleteSessionRows(tx, c.ID); err != nil {
+		return err
+	}
+	for i, m := range c.Messages {
+		_, err := tx.Exec("INSERT INTO messages (session_id, seq, role, content, time) VALUES (?, ?, ?, ?, ?)",
+			c.ID, i, m.Role, m.Content, unixNano(m.Time))
+		if err != nil {
+			return err
+		}
+		// Encrypted text would only be found by the ciphertext.
+		if c.Encryption == "" {
+			_, err := tx.Exec("INSERT INTO messages_search (session_id, role, content) VALUES (?, ?, ?)", c.ID, m.Role, m.Content)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for i, b := range c.Bookmarks {
+		_, err := tx.Exec("INSERT INTO bookmarks (session_id, seq, label, turn, at) VALUES (?, ?, ?, ?, ?)",
+			c.ID, i, b.Label, b.Turn, unixNano(b.At))
+		if err != nil {
+			return err
+		}
+	}
+	for _, tag := range c.Tags {
+		if _, err := tx.Exec("INSERT OR IGNORE INTO tags (session_id, tag) VALUES (?, ?)", c.ID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteSessionRows deletes what the session id has in every table but
+// sessions.
+func deleteSessionRows(tx *sql.Tx, id string) error {
+	for _, table := range []string{"messages", "messages_search", "bookmarks", "tags"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE session_id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) Delete(id string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("cannot delete session: %w", err)
+	}
+	defer tx.Rollback()
+	if err := deleteSessionRows(tx, id); err != nil {
+		return fmt.Errorf("cannot delete session: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE id = ?", id); err != nil {
+		return fmt.Errorf("cannot delete session: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("cannot delete session: %w", err)
+	}
+	return nil
+}
+
+// searchIDs returns the ids of the sessions, most recently used last, that
+// may have a message with text in it, from role unless that is "": those
+// the search index finds it in, and every encrypted one, which it cannot
+// look into. Text too short for the index finds every session.
+func (s *sqliteStore) searchIDs(text, role string) ([]string, error) {
+	if utf8.RuneCountInString(text) < minTrigram {
+		return s.IDs()
+	}
+	// A quoted phrase is matched as it is, whatever characters it has.
+	phrase := `"` + strings.ReplaceAll(text, `"`, `""`) + `"`
+	return s.queryIDs(`SELECT id FROM sessions WHERE encryption != '' OR id IN (
+		SELECT session_id FROM messages_search WHERE messages_search MATCH ? AND (? = '' OR role = ?))
+		ORDER BY used_at, id`, phrase, role, role)
+}
+
+// taggedIDs returns the ids of the sessions tagged tag, most recently used
+// last.
+func (s *sqliteStore) taggedIDs(tag string) ([]string, error) {
+	return s.queryIDs(`SELECT id FROM sessions JOIN tags ON session_id = id WHERE tag = ? ORDER BY used_at, id`, tag)
+}
+
+// modelStats counts what the sessions of each model hold, without loading
+// them.
+func (s *sqliteStore) modelStats() ([]modelStats, error) {
+	rows, err := s.db.Query(`SELECT model, COUNT(*), SUM((SELECT COUNT(*) FROM messages WHERE session_id = id)),
+		MAX(used_at) FROM sessions GROUP BY model ORDER BY model`)
+	if err != nil {
+		return nil, fmt.Errorf("cannot count sessions: %w", err)
+	}
+	defer rows.Close()
+	var stats []modelStats
+	for rows.Next() {
+		var m modelStats
+		var used sql.NullInt64
+		if err := rows.Scan(&m.Model, &m.Sessions, &m.Messages, &used); err != nil {
+			return nil, fmt.Errorf("cannot count sessions: %w", err)
+		}
+		m.LastUsed = fromUnixNano(used)
+		stats = append(stats, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot count sessions: %w", err)
+	}
+	return stats, nil
+}
+
+func (s *sqliteStore) queryIDs(query string, args ...any) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list sessions: %w", err)
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("cannot list sessions: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("cannot list sessions: %w", err)
+	}
+	return ids, nil
+}
+
+func unixNano(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	return t.UnixNano()
+}
+
+func fromUnixNano(n sql.NullInt64) time.Time {
+	if !n.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, n.Int64)
+}
+
+func nullFloat(f *float32) any {
+	if f == nil {
+		return nil
+	}
+	return float64(*f)
+}
+
+func fromNullFloat(n sql.NullFloat64) *float32 {
+	if !n.Valid {
+		return nil
+	}
+	f := float32(n.Float64)
+	return &f
+}
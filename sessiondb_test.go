@@ -0,0 +1,83 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStoreSearchAndTags(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	db, err := openSQLiteStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.db.Close()
+
+	now := time.Now()
+	sessions := []savedChat{
+		{ID: "plain", Messages: testChat("How do I tune the connection pool?", "Set max_open_conns."), Tags: []string{"db", "work"}},
+		{ID: "other", Messages: testChat("Write a haiku", "Autumn moonlight"), Tags: []string{"fun"}},
+		// Encrypted text is not indexed, so the session is always looked in.
+		{ID: "sealed", Encryption: "v1", Messages: testChat("c2VhbGVk", "c2VhbGVk")},
+	}
+	for i, c := range sessions {
+		c.Version = savedChatVersion
+		if err := db.Save(c, now.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		text, role string
+		want       []string
+	}{
+		{"connection POOL", "", []string{"plain", "sealed"}},
+		{"max_open", "", []string{"plain", "sealed"}},
+		{"max_open", "user", []string{"sealed"}},
+		{"moonlight", "assistant", []string{"other", "sealed"}},
+		{`say "hi"`, "", []string{"sealed"}},
+		// Shorter than a trigram: every session.
+		{"po", "", []string{"plain", "other", "sealed"}},
+	}
+	for _, tt := range tests {
+		got, err := db.searchIDs(tt.text, tt.role)
+		if err != nil {
+			t.Fatalf("searchIDs(%q, %q): %v", tt.text, tt.role, err)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("searchIDs(%q, %q) = %q, want %q", tt.text, tt.role, got, tt.want)
+		}
+	}
+
+	if got, err := db.taggedIDs("work"); err != nil || !slices.Equal(got, []string{"plain"}) {
+		t.Errorf("taggedIDs(work) = %q, %v; want [plain]", got, err)
+	}
+	c, err := db.Load("plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(c.Tags, []string{"db", "work"}) {
+		t.Errorf("loaded tags %q, want [db work]", c.Tags)
+	}
+
+	// Saving again replaces what the index has of the session.
+	c.Messages = testChat("Something else entirely", "ok")
+	if err := db.Save(c, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.searchIDs("connection", ""); !slices.Equal(got, []string{"sealed"}) {
+		t.Errorf("after saving, searchIDs(connection) = %q, want [sealed]", got)
+	}
+	if err := db.Delete("other"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := db.searchIDs("moonlight", ""); !slices.Equal(got, []string{"sealed"}) {
+		t.Errorf("after deleting, searchIDs(moonlight) = %q, want [sealed]", got)
+	}
+}
+
+// testChat returns a turn of question and answer.
+func testChat(question, answer string) []chatMessage {
+	return []chatMessage{newChatMessage("user", question), newChatMessage("assistant", answer)}
+}
@@ -0,0 +1,647 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sessionsDirName = "sessions"
+	sessionIDFormat = "20060102-150405"
+)
+
+// Every interactive chat is saved as a session, by default in
+// ~/.askgpt/sessions/<id>.json, where id is the time it started, so it can
+// be continued with "askgpt resume".
+
+// SessionsConfig is the sessions: section of config.yaml:
+//
+//	sessions:
+//	  store: sqlite  # keep sessions in ~/.askgpt/sessions.db; default "files"
+//	  encrypt: true  # encrypt the conversations with a passphrase
+//	  key_command: security find-generic-password -s askgpt -w
+type SessionsConfig struct {
+	Store   string `yaml:"store,omitempty"`
+	Encrypt bool   `yaml:"encrypt,omitempty"`
+	// KeyCommand, when set, prints the passphrase, e.g. from a keychain.
+	KeyCommand string `yaml:"key_command,omitempty"`
+}
+
+// sessionStore keeps the saved sessions.
+type sessionStore interface {
+	// IDs returns the ids of the saved sessions, most recently used last.
+	IDs() ([]string, error)
+	// Used returns the time the session was last used.
+	Used(id string) (time.Time, error)
+	// NewID returns an unused id for a session started at t.
+	NewID(t time.Time) (string, error)
+	Load(id string) (savedChat, error)
+	// Save writes the session c.ID and marks it used at the given time. A
+	// zero time keeps its place in the order, as when it is renamed.
+	Save(c savedChat, used time.Time) error
+	Delete(id string) error
+}
+
+// openSessionStore opens the store chosen in config.yaml.
+func openSessionStore(cfg SessionsConfig) (sessionStore, error) {
+	var store sessionStore
+	switch cfg.Store {
+	case "", "files":
+		dir, err := sessionsDir()
+		if err != nil {
+			return nil, err
+		}
+		store = fileStore{dir}
+	case "sqlite":
+		db, err := openSQLiteStore()
+		if err != nil {
+			return nil, err
+		}
+		store = db
+	default:
+		return nil, fmt.Errorf("unknown sessions.store %q in config.yaml (use files or sqlite)", cfg.Store)
+	}
+	return archiveStore{cryptStore{store, cfg}}, nil
+}
+
+// storeBackend returns the store under the wrappers openSessionStore puts
+// around it, for what only one kind of store does.
+func storeBackend(store sessionStore) sessionStore {
+	for {
+		switch s := store.(type) {
+		case archiveStore:
+			store = s.sessionStore
+		case cryptStore:
+			store = s.sessionStore
+		default:
+			return store
+		}
+	}
+}
+
+// openConfiguredStore opens the session store for the commands that do not
+// otherwise need the config, which may not even exist yet.
+func openConfiguredStore() (sessionStore, error) {
+	cfg, err := readConfigIfExists()
+	if err != nil {
+		return nil, err
+	}
+	return openSessionStore(cfg.Sessions)
+}
+
+// readConfigIfExists reads config.yaml, or returns the defaults when there
+// is none yet. Unlike loadConfigIfExists it reports a broken config.
+func readConfigIfExists() (ConfigFile, error) {
+	path, err := configPath()
+	if err != nil {
+		return ConfigFile{}, err
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return ConfigFile{}, nil
+	}
+	return loadConfigFile(path)
+}
+
+// sessionsDir returns ~/.askgpt/sessions, creating it if needed.
+func sessionsDir() (string, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	dir := filepath.Join(filepath.Dir(cfgPath), sessionsDirName)
+	if err := os.MkdirAll(dir, configDirPerm); err != nil {
+		return "", fmt.Errorf("cannot create sessions directory: %w", err)
+	}
+	return dir, nil
+}
+
+// fileStore keeps each session in its own JSON file. The file's
+// modification time is the time the session was last used.
+type fileStore struct {
+	dir string
+}
+
+func (f fileStore) path(id string) string {
+	return filepath.Join(f.dir, id+".json")
+}
+
+func (f fileStore) NewID(t time.Time) (string, error) {
+	base := t.Local().Format(sessionIDFormat)
+	id := base
+	for n := 2; ; n++ {
+		if _, err := os.Stat(f.path(id)); os.IsNotExist(err) {
+			return id, nil
+		}
+		id = fmt.Sprintf("%s-%d", base, n)
+	}
+}
+
+func (f fileStore) IDs() ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot list sessions: %w", err)
+	}
+	type session struct {
+		id    string
+		mtime time.Time
+	}
+	var found []session
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !e.Type().IsRegular() {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		found = append(found, session{id, info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool {
+		if !found[i].mtime.Equal(found[j].mtime) {
+			return found[i].mtime.Before(found[j].mtime)
+		}
+		return found[i].id < found[j].id
+	})
+	ids := make([]string, len(found))
+	for i, s := range found {
+		ids[i] = s.id
+	}
+	return ids, nil
+}
+
+func (f fileStore) Used(id string) (time.Time, error) {
+	info, err := os.Stat(f.path(id))
+	if err != nil {
+		return time.Time{}, fmt.Errorf("no session %q", id)
+	}
+	return info.ModTime(), nil
+}
+
+func (f fileStore) Load(id string) (savedChat, error) {
+	c, err := readSavedChat(f.path(id))
+	if c.ID == "" {
+		c.ID = id
+	}
+	return c, err
+}
+
+func (f fileStore) Save(c savedChat, used time.Time) error {
+	path := f.path(c.ID)
+	if used.IsZero() {
+		if info, err := os.Stat(path); err == nil {
+			used = info.ModTime()
+		}
+	}
+	if err := writeSavedChat(path, c); err != nil {
+		return err
+	}
+	if !used.IsZero() {
+		_ = os.Chtimes(path, used, used)
+	}
+	return nil
+}
+
+func (f fileStore) Delete(id string) error {
+	if err := os.Remove(f.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("cannot delete session: %w", err)
+	}
+	return nil
+}
+
+// findSession resolves "last", an id or a unique prefix of one to the id of
+// a saved session.
+func findSession(store sessionStore, ref string) (string, error) {
+	ids, err := store.IDs()
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "", errors.New("no saved sessions yet")
+	}
+	if ref == "" || ref == "last" {
+		return ids[len(ids)-1], nil
+	}
+	var matches []string
+	for _, id := range ids {
+		if id == ref {
+			return id, nil
+		}
+		if strings.HasPrefix(id, ref) {
+			matches = append(matches, id)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no session %q", ref)
+	case 1:
+		return matches[0], nil
+	}
+	return "", fmt.Errorf("session %q is ambiguous: %s", ref, strings.Join(matches, ", "))
+}
+
+func runResume(args []string) int {
+	fs := flag.NewFlagSet("resume", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	force := fs.Bool("force", false, "")
+	at := fs.String("at", "", "")
+
+	// Allow flags after the session id.
+	var words []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(words) > 1 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt resume [id|last] [--at <bookmark>] [--force]")
+		return 2
+	}
+	ref := ""
+	if len(words) == 1 {
+		ref = words[0]
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	store, err := openSessionStore(cfgFile.Sessions)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	var c savedChat
+	if *at != "" {
+		// A bookmark is branched from, in a new session, leaving the one it
+		// is in as it was.
+		from, b, err := findBookmark(store, ref, *at)
+		if err == nil {
+			c, err = branchAt(store, from, b)
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Branched session %s at bookmark %q into %s.\n", from.ID, b.Label, c.ID)
+	} else {
+		id, err := findSession(store, ref)
+		if err == nil {
+			c, err = store.Load(id)
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+	personas, err := loadPersonas(cfgFile)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	memory, err := loadMemory()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	taskDef, _ := lookupTask(cfgFile, c.Task)
+	trackSpending(cfgFile, c.Task, *force)
+
+	s := &chatSession{
+		cfgFile:  cfgFile,
+		task:     c.Task,
+		taskDef:  taskDef,
+		client:   apiClient(cfgFile),
+		in:       newChatInput(cfgFile),
+		memory:   memory,
+		personas: personas,
+		store:    store,
+		redactor: outgoingRedactor(),
+	}
+	if s.redactor != nil && cfgFile.Redact.Restore {
+		s.opts.restore = s.redactor
+	}
+	s.restore(c)
+	s.id, s.created = c.ID, c.CreatedAt
+
+	fmt.Fprintf(os.Stderr, "Resuming session %s: %d message(s), model %s.\n", s.id, len(s.messages), s.cfgFile.AskGPT.Model)
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].Role == "user" {
+			fmt.Fprintf(os.Stderr, "Last question: %s\n", firstLine(s.messages[i].Content, 70))
+			break
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Type /help for the commands.")
+	s.run("")
+	return 0
+}
+
+// sessionTitle names a new session after the first message typed in it,
+// not a summary standing in for it.
+func sessionTitle(input string, messages []chatMessage) string {
+	if strings.TrimSpace(input) == "" {
+		for _, m := range messages {
+			if m.Role == "user" && !isSummary(m.Message) {
+				input = m.Content
+				break
+			}
+		}
+	}
+	return firstLine(input, 60)
+}
+
+// forkTitle returns the title of a fork: the one given, or the original's
+// marked as a fork.
+func forkTitle(original string, messages []chatMessage, title string) string {
+	if title = strings.TrimSpace(title); title != "" {
+		return title
+	}
+	return sessionTitle(original, messages) + " (fork)"
+}
+
+// firstTurns returns the messages of the first n questions and their
+// answers.
+func firstTurns(messages []chatMessage, n int) []chatMessage {
+	for i, m := range messages {
+		if m.Role == "user" {
+			if n == 0 {
+				return messages[:i]
+			}
+			n--
+		}
+	}
+	return messages
+}
+
+// countTurns returns the number of questions asked in a conversation.
+func countTurns(messages []chatMessage) int {
+	n := 0
+	for _, m := range messages {
+		if m.Role == "user" {
+			n++
+		}
+	}
+	return n
+}
+
+func runSessions(args []string) int {
+	usage := func() int {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt sessions list [--tag <tag>]")
+		fmt.Fprintln(os.Stderr, "       askgpt sessions show <id|last>")
+		fmt.Fprintln(os.Stderr, "       askgpt sessions rename <id|last> <title>")
+		fmt.Fprintln(os.Stderr, "       askgpt sessions tag|untag <id|last> <tag>...")
+		fmt.Fprintln(os.Stderr, "       askgpt sessions stats")
+		fmt.Fprintln(os.Stderr, "       askgpt sessions delete <id|last>...")
+		fmt.Fprintln(os.Stderr, "       askgpt sessions fork <id|last> [--at <turn>] [title]")
+		fmt.Fprintln(os.Stderr, "       askgpt sessions prune [--older-than 30d] [--keep n] [--dry-run]")
+		fmt.Fprintln(os.Stderr, "       askgpt sessions compact [id...] [--older-than 30d] [--keep-turns n] [--dry-run]")
+		return 2
+	}
+	if len(args) == 0 {
+		return usage()
+	}
+
+	cfg, err := readConfigIfExists()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	store, err := openSessionStore(cfg.Sessions)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	switch args[0] {
+	case "list":
+		var tag string
+		switch {
+		case len(args) == 3 && args[1] == "--tag":
+			tag = args[2]
+		case len(args) == 2 && strings.HasPrefix(args[1], "--tag="):
+			tag = strings.TrimPrefix(args[1], "--tag=")
+		case len(args) != 1:
+			return usage()
+		}
+		err = listSessions(store, tag)
+	case "show":
+		if len(args) != 2 {
+			return usage()
+		}
+		err = showSession(store, args[1])
+	case "rename":
+		if len(args) < 3 {
+			return usage()
+		}
+		err = renameSession(store, args[1], strings.Join(args[2:], " "))
+	case "delete":
+		if len(args) < 2 {
+			return usage()
+		}
+		err = deleteSessions(store, args[1:])
+	case "tag", "untag":
+		if len(args) < 3 {
+			return usage()
+		}
+		err = tagSession(store, args[1], args[2:], args[0] == "untag")
+	case "stats":
+		if len(args) != 1 {
+			return usage()
+		}
+		err = printSessionStats(store)
+	case "fork":
+		if len(args) < 2 {
+			return usage()
+		}
+		err = forkSession(store, args[1:])
+	case "prune":
+		err = runPrune(store, args[1:])
+	case "compact":
+		return runCompact(store, cfg.Sessions, args[1:])
+	default:
+		return usage()
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// listSessions lists the sessions, or those tagged tag.
+func listSessions(store sessionStore, tag string) error {
+	ids, err := store.IDs()
+	if tag != "" {
+		ids, err = taggedIDs(store, tag)
+	}
+	if err != nil {
+		return err
+	}
+	if len(ids) == 0 && tag != "" {
+		fmt.Fprintf(os.Stderr, "No sessions are tagged %s.\n", tag)
+		return nil
+	}
+	if len(ids) == 0 {
+		fmt.Fprintln(os.Stderr, "No saved sessions yet.")
+		return nil
+	}
+	fmt.Printf("%-20s %-16s %-16s %5s  %s\n", "ID", "CREATED", "MODEL", "TURNS", "TITLE")
+	// Most recently used first.
+	for i := len(ids) - 1; i >= 0; i-- {
+		c, err := store.Load(ids[i])
+		if err != nil {
+			warnf("%v\n", err)
+			continue
+		}
+		title := sessionTitle(c.Title, c.Messages)
+		if len(c.Tags) > 0 {
+			title += "  #" + strings.Join(c.Tags, " #")
+		}
+		created := c.CreatedAt
+		if created.IsZero() {
+			created = c.SavedAt
+		}
+		fmt.Printf("%-20s %-16s %-16s %5d  %s\n", ids[i], created.Local().Format("2006-01-02 15:04"),
+			firstLine(c.Model, 16), countTurns(c.Messages), title)
+	}
+	return nil
+}
+
+func showSession(store sessionStore, ref string) error {
+	id, err := findSession(store, ref)
+	if err != nil {
+		return err
+	}
+	c, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Session:  %s\n", id)
+	fmt.Printf("Title:    %s\n", sessionTitle(c.Title, c.Messages))
+	if !c.CreatedAt.IsZero() {
+		fmt.Printf("Created:  %s\n", c.CreatedAt.Local().Format("2006-01-02 15:04:05"))
+	}
+	fmt.Printf("Updated:  %s\n", c.SavedAt.Local().Format("2006-01-02 15:04:05"))
+	fmt.Printf("Model:    %s\n", c.Model)
+	if len(c.Tags) > 0 {
+		fmt.Printf("Tags:     %s\n", strings.Join(c.Tags, ", "))
+	}
+	if c.Task != "" {
+		fmt.Printf("Task:     %s\n", c.Task)
+	}
+	if c.Persona != "" {
+		fmt.Printf("Persona:  %s\n", c.Persona)
+	}
+	if c.System != "" {
+		fmt.Printf("System:   %s\n", c.System)
+	}
+	fmt.Printf("Turns:    %d\n", countTurns(c.Messages))
+	for _, m := range c.Messages {
+		who := "You"
+		if m.Role == "assistant" {
+			who = "Assistant"
+		}
+		fmt.Printf("\n%s:\n%s\n", who, strings.TrimRight(m.Content, "\n"))
+	}
+	return nil
+}
+
+func renameSession(store sessionStore, ref, title string) error {
+	id, err := findSession(store, ref)
+	if err != nil {
+		return err
+	}
+	c, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	c.Title = strings.TrimSpace(title)
+	// Renaming is not using the session; keep its place in the "last" order.
+	if err := store.Save(c, time.Time{}); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Renamed session %s to %q.\n", id, c.Title)
+	return nil
+}
+
+// forkSession copies a session, or its first turns, into a new one to
+// branch off from there.
+func forkSession(store sessionStore, args []string) error {
+	fs := flag.NewFlagSet("fork", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	at := fs.Int("at", 0, "")
+	// Allow flags after the session id and title.
+	var words []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(words) == 0 {
+		return errors.New("usage: askgpt sessions fork <id|last> [--at <turn>] [title]")
+	}
+
+	id, err := findSession(store, words[0])
+	if err != nil {
+		return err
+	}
+	c, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	turns := countTurns(c.Messages)
+	if *at < 0 || *at > turns {
+		return fmt.Errorf("session %s has %d turn(s); --at must be between 1 and %d", id, turns, turns)
+	}
+	if *at > 0 {
+		c.Messages = firstTurns(c.Messages, *at)
+	}
+	now := time.Now()
+	c.Title = forkTitle(c.Title, c.Messages, strings.Join(words[1:], " "))
+	c.CreatedAt, c.SavedAt, c.Source, c.Bookmarks = now, now, "", nil
+	if c.ID, err = store.NewID(now); err != nil {
+		return err
+	}
+	if err := store.Save(c, now); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Forked session %s after %d turn(s) into %s %q.\n", id, countTurns(c.Messages), c.ID, c.Title)
+	fmt.Fprintf(os.Stderr, "Continue it with: askgpt resume %s\n", c.ID)
+	return nil
+}
+
+func deleteSessions(store sessionStore, refs []string) error {
+	// Resolve every reference first, so a typo deletes nothing.
+	var ids []string
+	for _, ref := range refs {
+		id, err := findSession(store, ref)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if err := store.Delete(id); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Deleted session %s.\n", id)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// modelStats is how much the sessions of one model hold.
+type modelStats struct {
+	Model    string
+	Sessions int
+	Messages int
+	LastUsed time.Time
+}
+
+// printSessionStats handles "askgpt sessions stats": the sessions and
+// messages of each model, most used first.
+func printSessionStats(store sessionStore) error {
+	var stats []modelStats
+	var err error
+	if db, ok := storeBackend(store).(*sqliteStore); ok {
+		stats, err = db.modelStats()
+	} else {
+		stats, err = loadModelStats(store)
+	}
+	if err != nil {
+		return err
+	}
+	if len(stats) == 0 {
+		fmt.Fprintln(os.Stderr, "No saved sessions yet.")
+		return nil
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Sessions > stats[j].Sessions })
+	total := modelStats{Model: "total"}
+	fmt.Printf("%-24s %8s %9s  %s\n", "MODEL", "SESSIONS", "MESSAGES", "LAST USED")
+	for _, s := range stats {
+		fmt.Printf("%-24s %8d %9d  %s\n", firstLine(s.Model, 24), s.Sessions, s.Messages, formatTime(s.LastUsed))
+		total.Sessions += s.Sessions
+		total.Messages += s.Messages
+		if s.LastUsed.After(total.LastUsed) {
+			total.LastUsed = s.LastUsed
+		}
+	}
+	if len(stats) > 1 {
+		fmt.Printf("%-24s %8d %9d  %s\n", total.Model, total.Sessions, total.Messages, formatTime(total.LastUsed))
+	}
+	return nil
+}
+
+// loadModelStats counts what the sessions hold by reading every one.
+func loadModelStats(store sessionStore) ([]modelStats, error) {
+	ids, err := store.IDs()
+	if err != nil {
+		return nil, err
+	}
+	byModel := map[string]*modelStats{}
+	var stats []modelStats
+	for _, id := range ids {
+		c, err := store.Load(id)
+		if err != nil {
+			warnf("%v\n", err)
+			continue
+		}
+		used, err := store.Used(id)
+		if err != nil {
+			return nil, err
+		}
+		s := byModel[c.Model]
+		if s == nil {
+			s = &modelStats{Model: c.Model}
+			byModel[c.Model] = s
+		}
+		s.Sessions++
+		s.Messages += len(c.Messages)
+		if used.After(s.LastUsed) {
+			s.LastUsed = used
+		}
+	}
+	for _, s := range byModel {
+		stats = append(stats, *s)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Model < stats[j].Model })
+	return stats, nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// tagSession handles "askgpt sessions tag" and "untag": tags are added to
+// the session, or removed from it.
+func tagSession(store sessionStore, ref string, tags []string, remove bool) error {
+	for i, tag := range tags {
+		tags[i] = strings.TrimPrefix(strings.TrimSpace(tag), "#")
+		if tags[i] == "" || strings.ContainsAny(tags[i], " \t\n,") {
+			return fmt.Errorf("invalid tag %q (use a single word)", tag)
+		}
+	}
+	id, err := findSession(store, ref)
+	if err != nil {
+		return err
+	}
+	c, err := store.Load(id)
+	if err != nil {
+		return err
+	}
+	if remove {
+		c.Tags = slices.DeleteFunc(c.Tags, func(t string) bool { return slices.Contains(tags, t) })
+	} else {
+		c.Tags = append(c.Tags, tags...)
+	}
+	slices.Sort(c.Tags)
+	c.Tags = slices.Compact(c.Tags)
+	// Tagging is not using the session; keep its place in the "last" order.
+	if err := store.Save(c, time.Time{}); err != nil {
+		return err
+	}
+	if len(c.Tags) == 0 {
+		fmt.Fprintf(os.Stderr, "Session %s has no tags.\n", id)
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "Session %s is tagged #%s.\n", id, strings.Join(c.Tags, " #"))
+	return nil
+}
+
+// taggedIDs returns the ids of the sessions tagged tag, most recently used
+// last. The SQLite store looks them up; the files are read one by one.
+func taggedIDs(store sessionStore, tag string) ([]string, error) {
+	tag = strings.TrimPrefix(tag, "#")
+	if db, ok := storeBackend(store).(*sqliteStore); ok {
+		return db.taggedIDs(tag)
+	}
+	ids, err := store.IDs()
+	if err != nil {
+		return nil, err
+	}
+	return slices.DeleteFunc(ids, func(id string) bool {
+		c, err := store.Load(id)
+		if err != nil {
+			warnf("%v\n", err)
+			return true
+		}
+		return !slices.Contains(c.Tags, tag)
+	}), nil
+}
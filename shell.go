@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// shellTimeout is how long a command run for the model or by /run may take.
+const shellTimeout = 2 * time.Minute
+
+// shellLangs are the languages of the code blocks /run takes for commands.
+var shellLangs = map[string]bool{
+	"": true, "sh": true, "bash": true, "zsh": true, "shell": true,
+	"cmd": true, "bat": true, "powershell": true, "ps1": true,
+}
+
+// errDeclined is returned when the user does not let a tool go ahead.
+var errDeclined = errors.New("the user declined")
+
+// askYesNo asks the user to agree to what a tool is about to do, and
+// returns errDeclined unless they do. Without a terminal to ask on the
+// answer is always no.
+func askYesNo(question string) error {
+	if !isTerminal(os.Stdin) {
+		return errors.New("this needs the user's agreement, and there is no terminal to ask on")
+	}
+	answer, err := readSingleLine(question + " [y/N] ")
+	if err != nil {
+		return err
+	}
+	if a := strings.ToLower(answer); a != "y" && a != "yes" {
+		return errDeclined
+	}
+	return nil
+}
+
+// confirmShell shows a command and asks whether to run it.
+func confirmShell(command string) error {
+	if !isTerminal(os.Stdin) {
+		return errors.New("commands are only run after asking, which needs a terminal")
+	}
+	for _, line := range strings.Split(command, "\n") {
+		fmt.Fprintf(os.Stderr, "  $ %s\n", line)
+	}
+	return askYesNo("Run this command?")
+}
+
+// runShell runs a command with sh (cmd on Windows) in the current
+// directory, showing its output as it goes, and returns the output and the
+// exit status. The command gets no input and is stopped after
+// shellTimeout or when ctx is cancelled.
+func runShell(ctx context.Context, command string) (string, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, shellTimeout)
+	defer cancel()
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+	var out bytes.Buffer
+	w := io.MultiWriter(&out, os.Stderr)
+	cmd.Stdout, cmd.Stderr = w, w
+	// Children left running in the background must not keep the command
+	// from finishing.
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	var exit *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return out.String(), -1, fmt.Errorf("the command was stopped after %v", shellTimeout)
+	case ctx.Err() != nil:
+		return out.String(), -1, ctx.Err()
+	case errors.As(err, &exit):
+		return out.String(), exit.ExitCode(), nil
+	case err != nil:
+		return out.String(), -1, err
+	}
+	return out.String(), 0, nil
+}
+
+// shellReport describes a command that ran and what it printed, for the
+// model.
+func shellReport(command, output string, status int) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Command:\n```sh\n%s\n```\nExit status: %d\n", command, status)
+	if strings.TrimSpace(output) == "" {
+		b.WriteString("It printed nothing.")
+	} else {
+		fmt.Fprintf(&b, "Output:\n```\n%s\n```", strings.TrimRight(output, "\n"))
+	}
+	return b.String()
+}
+
+// runShellTool is the run_shell tool: it runs the command the model gives
+// once the user agrees to it.
+func runShellTool(ctx context.Context, args string) (string, error) {
+	var in struct {
+		Command string `json:"command"`
+	}
+	if err := decodeToolArgs(args, &in); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(in.Command) == "" {
+		return "", errors.New("no command given")
+	}
+	if err := confirmShell(in.Command); err != nil {
+		return "", err
+	}
+	output, status, err := runShell(ctx, in.Command)
+	if err != nil {
+		return "", err
+	}
+	return shellReport(in.Command, output, status), nil
+}
+
+// lastShellCommand returns the last shell code block of an answer.
+func lastShellCommand(answer string) (string, bool) {
+	blocks := splitFences(answer)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		b := blocks[i]
+		if b.code && shellLangs[strings.ToLower(b.lang)] && strings.TrimSpace(b.text) != "" {
+			return strings.TrimSpace(b.text), true
+		}
+	}
+	return "", false
+}
+
+// runCommandLine handles "/run [command]": it runs the command given, or
+// the last one the model suggested, after asking, and returns a message
+// telling the model what it printed.
+func (s *chatSession) runCommandLine(command string) (string, error) {
+	if command == "" {
+		var ok bool
+		if s.hasAnswer() {
+			command, ok = lastShellCommand(s.messages[len(s.messages)-1].Content)
+		}
+		if !ok {
+			return "", errors.New("the last answer suggests no command; give one with /run <command>")
+		}
+	}
+	if err := confirmShell(command); err != nil {
+		return "", err
+	}
+	ctx, stop := s.requestContext()
+	defer stop()
+	output, status, err := runShell(ctx, command)
+	if err != nil {
+		return "", err
+	}
+	if status != 0 {
+		fmt.Fprintf(os.Stderr, "(exit status %d)\n", status)
+	}
+	return "I ran this:\n\n" + shellReport(command, output, status), nil
+}
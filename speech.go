@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const (
+	defaultSpeechModel = "tts-1"
+	defaultVoice       = "alloy"
+	// maxSpeechInput is the most characters the speech endpoint reads in
+	// one request; longer texts are sent in parts.
+	maxSpeechInput = 4096
+)
+
+type speechRequest struct {
+	Model          string `json:"model"`
+	Input          string `json:"input"`
+	Voice          string `json:"voice"`
+	ResponseFormat string `json:"response_format,omitempty"`
+}
+
+// audioPlayer is a command that plays an audio file. An argument "{}" is
+// replaced by the file; without one the file is added at the end.
+type audioPlayer struct {
+	Command []string
+	Format  string // the format to ask the speech endpoint for
+}
+
+// audioPlayers lists the players for the current platform, in order of
+// preference. audio.player in config.yaml comes first.
+func audioPlayers(cfg AudioConfig) []audioPlayer {
+	var players []audioPlayer
+	if f := strings.Fields(cfg.Player); len(f) > 0 {
+		players = append(players, audioPlayer{Command: f, Format: "mp3"})
+	}
+	switch runtime.GOOS {
+	case "darwin":
+		players = append(players, audioPlayer{[]string{"afplay"}, "mp3"})
+	case "windows":
+		players = append(players, audioPlayer{[]string{"powershell", "-NoProfile", "-Command",
+			"(New-Object Media.SoundPlayer '{}').PlaySync()"}, "wav"})
+	default:
+		players = append(players,
+			audioPlayer{[]string{"mpv", "--no-video", "--really-quiet"}, "mp3"},
+			audioPlayer{[]string{"ffplay", "-nodisp", "-autoexit", "-loglevel", "quiet"}, "mp3"},
+			audioPlayer{[]string{"mpg123", "-q"}, "mp3"},
+			audioPlayer{[]string{"paplay"}, "wav"},
+			audioPlayer{[]string{"aplay", "-q"}, "wav"},
+		)
+	}
+	return players
+}
+
+// findPlayer returns the first installed audio player.
+func findPlayer(cfg AudioConfig) (audioPlayer, error) {
+	var tried []string
+	for _, p := range audioPlayers(cfg) {
+		if _, err := exec.LookPath(p.Command[0]); err == nil {
+			return p, nil
+		}
+		tried = append(tried, p.Command[0])
+	}
+	return audioPlayer{}, fmt.Errorf("cannot play audio: none of %s is installed (set audio.player in config.yaml, or save it with -o)",
+		strings.Join(tried, ", "))
+}
+
+// play plays an audio file until it ends or ctx is cancelled.
+func (p audioPlayer) play(ctx context.Context, path string) error {
+	args := append([]string(nil), p.Command[1:]...)
+	replaced := false
+	for i, a := range args {
+		if strings.Contains(a, "{}") {
+			args[i], replaced = strings.ReplaceAll(a, "{}", path), true
+		}
+	}
+	if !replaced {
+		args = append(args, path)
+	}
+	cmd := exec.CommandContext(ctx, p.Command[0], args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil && ctx.Err() == nil {
+		return fmt.Errorf("%s failed: %w", p.Command[0], err)
+	}
+	return nil
+}
+
+// speechParts splits text into parts the speech endpoint takes, at
+// paragraph, line or sentence ends where it can.
+func speechParts(text string) []string {
+	var parts []string
+	for text != "" {
+		if len(text) <= maxSpeechInput {
+			parts = append(parts, text)
+			break
+		}
+		cut := -1
+		for _, sep := range []string{"\n\n", "\n", ". ", " "} {
+			if i := strings.LastIndex(text[:maxSpeechInput], sep); i > 0 {
+				cut = i + len(sep)
+				break
+			}
+		}
+		if cut < 0 {
+			// No break at all: cut at a rune boundary.
+			cut = maxSpeechInput
+			for cut > 0 && !isRuneStart(text[cut]) {
+				cut--
+			}
+		}
+		parts = append(parts, text[:cut])
+		text = strings.TrimLeft(text[cut:], " \n")
+	}
+	return parts
+}
+
+func isRuneStart(b byte) bool { return b&0xC0 != 0x80 }
+
+// speechText turns a Markdown answer into text worth reading out: code
+// blocks are left out and formatting marks dropped.
+func speechText(answer string) string {
+	var b strings.Builder
+	for _, block := range splitFences(answer) {
+		if block.code {
+			b.WriteString("\n(Code left out.)\n")
+			continue
+		}
+		b.WriteString(strings.NewReplacer("**", "", "__", "", "`", "", "#", "").Replace(block.text))
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// synthesize returns the audio of a part of text, in format.
+func synthesize(ctx context.Context, client *http.Client, cfg ConfigFile, text, format string) ([]byte, error) {
+	if err := checkBudget(); err != nil {
+		return nil, err
+	}
+	req := speechRequest{Model: cfg.Audio.SpeechModel, Input: redactOutgoing(text), Voice: cfg.Audio.Voice, ResponseFormat: format}
+	if req.Model == "" {
+		req.Model = defaultSpeechModel
+	}
+	if req.Voice == "" {
+		req.Voice = defaultVoice
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := doAPIRequest(ctx, client, cfg.AskGPT, apiEndpoint(cfg.AskGPT, "audio/speech"), "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	// Speech is priced by the input; the log counts it.
+	recordUsage(req.Model, nil, []Message{{Role: "user", Content: text}}, "")
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read audio: %w", err)
+	}
+	return b, nil
+}
+
+// speak reads text out, part by part, with the first audio player found.
+func speak(ctx context.Context, client *http.Client, cfg ConfigFile, text string) error {
+	player, err := findPlayer(cfg.Audio)
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "askgpt-speech")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	for i, part := range speechParts(text) {
+		audio, err := synthesize(ctx, client, cfg, part, player.Format)
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, fmt.Sprintf("part%d.%s", i+1, player.Format))
+		if err := os.WriteFile(path, audio, 0o600); err != nil {
+			return err
+		}
+		if err := player.play(ctx, path); err != nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveSpeech writes the audio of text to path, in the format its extension
+// names. Long texts are joined from parts, which only works for formats
+// made of frames, such as MP3.
+func saveSpeech(ctx context.Context, client *http.Client, cfg ConfigFile, text, path string) error {
+	format := strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+	switch format {
+	case "":
+		format = "mp3"
+	case "mp3", "aac", "pcm", "opus", "flac", "wav":
+	default:
+		return fmt.Errorf("cannot save speech as %q (use .mp3, .aac, .opus, .flac, .wav or .pcm)", format)
+	}
+	parts := speechParts(text)
+	if len(parts) > 1 && format != "mp3" && format != "aac" && format != "pcm" {
+		return fmt.Errorf("texts over %d characters can only be saved as .mp3, .aac or .pcm", maxSpeechInput)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for _, part := range parts {
+		audio, err := synthesize(ctx, client, cfg, part, format)
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(audio); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// speakAnswer reads an answer out for --speak.
+func (s *chatSession) speakAnswer(answer string) {
+	text := speechText(answer)
+	if text == "" {
+		return
+	}
+	ctx, stop := context.Background(), func() {}
+	if !s.opts.oneShot {
+		ctx, stop = s.requestContext()
+	}
+	defer stop()
+	if err := speak(ctx, s.client, s.cfgFile, text); err != nil {
+		errorf("%v\n", err)
+	}
+}
+
+// runTTS handles "askgpt tts [text]": it reads text, or stdin, out loud or
+// saves it with -o.
+func runTTS(args []string) int {
+	fs := flag.NewFlagSet("tts", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	out := fs.String("o", "", "")
+	fs.StringVar(out, "out", "", "")
+	voice := fs.String("voice", "", "")
+	model := fs.String("model", "", "")
+	force := fs.Bool("force", false, "")
+
+	// Allow flags after the text.
+	var words []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		words = append(words, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	text := strings.Join(words, " ")
+	if text == "" || text == "-" {
+		if isTerminal(os.Stdin) {
+			fmt.Fprintln(os.Stderr, "Usage: askgpt tts <text|-> [-o file.mp3] [--voice name] [--model name]")
+			return 2
+		}
+		b, err := io.ReadAll(os.Stdin)
+		if err == nil {
+			text, err = decodeTextInput("stdin", b, false)
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+	}
+	if text = strings.TrimSpace(text); text == "" {
+		fmt.Fprintln(os.Stderr, "No input received.")
+		return 1
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "tts", *force)
+	if *voice != "" {
+		cfgFile.Audio.Voice = *voice
+	}
+	if *model != "" {
+		cfgFile.Audio.SpeechModel = *model
+	}
+	client := apiClient(cfgFile)
+	var err error
+	if *out != "" {
+		if err = saveSpeech(context.Background(), client, cfgFile, text, *out); err == nil {
+			fmt.Fprintf(os.Stderr, "Saved %s\n", *out)
+		}
+	} else {
+		err = speak(context.Background(), client, cfgFile, text)
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
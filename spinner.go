@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	spinnerDelay    = 500 * time.Millisecond // quick answers show no spinner
+	spinnerInterval = 100 * time.Millisecond
+)
+
+var spinnerFrames = []rune("⠋⠙⠹⠸⠼⠴⠦⠧⠇⠏")
+
+// startSpinner shows a spinner with the seconds spent waiting for the
+// answer on stderr, if it is a terminal, until the func it returns is
+// called: that clears it, and may be called more than once. --raw and
+// tracing, which has its own lines to print, leave it out.
+func startSpinner(opts taskOptions) func() {
+	if opts.raw || traceLevel > 0 || !isTerminal(os.Stderr) {
+		return func() {}
+	}
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		start := time.Now()
+		tick := time.NewTicker(spinnerInterval)
+		defer tick.Stop()
+		shown := false
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				if shown {
+					fmt.Fprint(os.Stderr, "\r\x1b[K")
+				}
+				return
+			case <-tick.C:
+			}
+			elapsed := time.Since(start)
+			if elapsed < spinnerDelay {
+				continue
+			}
+			frame := fmt.Sprintf("%c %ds", spinnerFrames[i%len(spinnerFrames)], int(elapsed.Seconds()))
+			fmt.Fprint(os.Stderr, "\r"+paint(os.Stderr, colors.usage, frame))
+			shown = true
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+}
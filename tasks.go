@@ -0,0 +1,272 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// inputPlaceholder marks where the user's input goes in a task prompt. It is
+// the short form of {{.Input}}; see templateData for the other variables.
+const inputPlaceholder = "{{input}}"
+
+// TaskConfig is a task defined in the tasks: section of config.yaml. It can
+// be written as just the prompt string, or as a mapping:
+//
+//	tasks:
+//	  jira-ticket:
+//	    description: Turn notes into a Jira ticket
+//	    prompt: "Write a Jira ticket (title, description, acceptance criteria) for: {{input}}"
+//	    model: gpt-4o
+//	    temperature: 0.2
+//
+// Params declares extra flags for the task with their defaults; the values
+// are available to the prompt as {{.Params.<name>}}. ShowDiff prints a word
+// diff between the input and the first answer, for editing tasks. Chunked
+// lets an input too long for the context window be condensed in parts
+// first, see chunkedInput; Chunking, which implies it, says how to split
+// the input.
+type TaskConfig struct {
+	Description string            `yaml:"description,omitempty"`
+	Prompt      string            `yaml:"prompt"`
+	Model       string            `yaml:"model,omitempty"`
+	Temperature *float32          `yaml:"temperature,omitempty"`
+	Preset      string            `yaml:"preset,omitempty"`
+	Params      map[string]string `yaml:"params,omitempty"`
+	ShowDiff    bool              `yaml:"show_diff,omitempty"`
+	Chunked     bool              `yaml:"chunked,omitempty"`
+	Chunking    *ChunkingConfig   `yaml:"chunking,omitempty"`
+}
+
+func (t *TaskConfig) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		t.Prompt = value.Value
+		return nil
+	}
+	type plain TaskConfig
+	return value.Decode((*plain)(t))
+}
+
+type namedTask struct {
+	Name string
+	Task TaskConfig
+}
+
+var builtinTasks = []namedTask{
+	{"chat", TaskConfig{Description: "Start a chat session without prompt template"}},
+	{"ask", TaskConfig{Description: "Ask a question without prompt template (same as chat)"}},
+	{"agent", TaskConfig{Description: "Carry out a task in steps with tools (--steps 20)", Prompt: agentPrompt}},
+	{"translate-en", TaskConfig{Description: "Translate text to English", Prompt: "Translate the following text into English:\n\n" + inputPlaceholder}},
+	{"translate-zh", TaskConfig{Description: "Translate text to Chinese", Prompt: "将下列内容翻译为中文：\n\n" + inputPlaceholder}},
+	{"summarize", TaskConfig{Description: "Summarize content", Prompt: "总结下面的内容：\n\n" + inputPlaceholder, Chunked: true}},
+	{"explain", TaskConfig{Description: "Explain content", Prompt: "解释下面的内容：\n\n" + inputPlaceholder, Chunked: true}},
+	{"proofread", TaskConfig{
+		Description: "Fix spelling and grammar, then show the changes",
+		Prompt: "Proofread the following text. Fix spelling, grammar and punctuation mistakes only; keep the wording, " +
+			"tone, language and formatting otherwise unchanged. Output only the corrected text.\n\n" + inputPlaceholder,
+		ShowDiff: true,
+	}},
+	{"rewrite", TaskConfig{
+		Description: "Rewrite text in another tone (--tone formal)",
+		Prompt: "Rewrite the following text in a {{.Params.tone}} tone. Keep its meaning, language and formatting. " +
+			"Output only the rewritten text.\n\n" + inputPlaceholder,
+		Params: map[string]string{"tone": "neutral"},
+	}},
+	{"shorten", TaskConfig{
+		Description: "Make text shorter, keeping the key points",
+		Prompt: "Shorten the following text to about half its length. Keep the key points, its tone, language and " +
+			"formatting. Output only the shortened text.\n\n" + inputPlaceholder,
+	}},
+}
+
+// lookupTask finds a task by name. Tasks from config take precedence, so a
+// built-in can be redefined.
+func lookupTask(cfg ConfigFile, name string) (TaskConfig, bool) {
+	if t, ok := cfg.Tasks[name]; ok {
+		return t, true
+	}
+	for _, b := range builtinTasks {
+		if b.Name == name {
+			return b.Task, true
+		}
+	}
+	return TaskConfig{}, false
+}
+
+// taskList returns the built-in tasks followed by the user's tasks, sorted
+// by name, for help output and shell completion.
+func taskList(cfg ConfigFile) []namedTask {
+	list := append(builtinTasks[:0:0], builtinTasks...)
+	var custom []string
+	for name := range cfg.Tasks {
+		if _, builtin := lookupTask(ConfigFile{}, name); !builtin {
+			custom = append(custom, name)
+		}
+	}
+	sort.Strings(custom)
+	for _, name := range custom {
+		t := cfg.Tasks[name]
+		if t.Description == "" {
+			t.Description = firstLine(t.Prompt, 50)
+		}
+		list = append(list, namedTask{name, t})
+	}
+	return list
+}
+
+const (
+	tasksDirName    = "tasks"
+	taskFileExt     = ".tmpl"
+	frontMatterLine = "---"
+)
+
+// withTaskFiles adds the tasks defined as ~/.askgpt/tasks/<name>.tmpl files to
+// cfg.Tasks. The file body is the prompt; optional YAML front matter between
+// "---" lines sets the other fields:
+//
+//	---
+//	description: Review a diff for bugs
+//	model: gpt-4o
+//	temperature: 0.2
+//	---
+//	Review this diff and list likely bugs:
+//
+//	{{input}}
+//
+// A file wins over a config entry of the same name, like persona files.
+func withTaskFiles(cfg ConfigFile) (ConfigFile, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return cfg, err
+	}
+	files, err := filepath.Glob(filepath.Join(filepath.Dir(cfgPath), tasksDirName, "*"+taskFileExt))
+	if err != nil || len(files) == 0 {
+		return cfg, err
+	}
+
+	tasks := make(map[string]TaskConfig, len(cfg.Tasks)+len(files))
+	for name, t := range cfg.Tasks {
+		tasks[name] = t
+	}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return cfg, fmt.Errorf("cannot read task %s: %w", f, err)
+		}
+		t, err := parseTaskFile(string(b))
+		if err != nil {
+			return cfg, fmt.Errorf("cannot parse task %s: %w", f, err)
+		}
+		tasks[strings.TrimSuffix(filepath.Base(f), taskFileExt)] = t
+	}
+	cfg.Tasks = tasks
+	return cfg, nil
+}
+
+func parseTaskFile(content string) (TaskConfig, error) {
+	content = strings.TrimPrefix(content, "\uFEFF")
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	var t TaskConfig
+	if rest, ok := strings.CutPrefix(content, frontMatterLine+"\n"); ok {
+		// The leading and trailing newlines let the closing line be the
+		// first or the last line of the file.
+		meta, body, found := strings.Cut("\n"+rest+"\n", "\n"+frontMatterLine+"\n")
+		if !found {
+			return t, fmt.Errorf("front matter is not closed with %q", frontMatterLine)
+		}
+		if err := yaml.Unmarshal([]byte(meta), &t); err != nil {
+			return t, err
+		}
+		content = body
+	}
+	t.Prompt = strings.TrimSpace(content)
+	return t, nil
+}
+
+// templateData is what task prompts can reference as Go template actions:
+//
+//	{{.Input}}          the user's message ({{input}} also works)
+//	{{.Clipboard}}      the text on the system clipboard
+//	{{.File "path"}}    the contents of a text file
+//	{{.Env "VAR"}}      an environment variable
+//	{{.Date}}           today's date, e.g. 2024-05-31
+//	{{.Params.name}}    a task parameter, see TaskConfig.Params
+//
+// Everything but the input is only read when the prompt uses it.
+type templateData struct {
+	Params    map[string]string
+	input     string
+	usedInput bool
+}
+
+func (d *templateData) Input() string {
+	d.usedInput = true
+	return d.input
+}
+
+func (d *templateData) Clipboard() (string, error) { return readClipboard() }
+
+func (d *templateData) File(path string) (string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read %s: %w", path, err)
+	}
+	return decodeTextInput(path, b, false)
+}
+
+func (d *templateData) Env(name string) string { return os.Getenv(name) }
+
+func (d *templateData) Date() string { return time.Now().Format("2006-01-02") }
+
+// renderTaskPrompt evaluates the task prompt as a Go template. A prompt that
+// does not use the input gets it appended after a blank line.
+func renderTaskPrompt(prompt, input string, params map[string]string) (string, error) {
+	if prompt == "" {
+		return input, nil
+	}
+	if !strings.Contains(prompt, "{{") {
+		return prompt + "\n\n" + input, nil
+	}
+
+	data := &templateData{Params: params, input: input}
+	tmpl, err := template.New("prompt").Funcs(template.FuncMap{"input": data.Input}).Option("missingkey=error").Parse(prompt)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse task prompt: %w", err)
+	}
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("cannot render task prompt: %w", err)
+	}
+	if !data.usedInput {
+		return b.String() + "\n\n" + input, nil
+	}
+	return b.String(), nil
+}
+
+// loadConfigIfExists reads the config for help and completion output, which
+// should work (with built-ins only) before askgpt has been configured.
+func loadConfigIfExists() ConfigFile {
+	path, err := configPath()
+	if err != nil {
+		return ConfigFile{}
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return ConfigFile{}
+	}
+	cfg, err := loadConfigFile(path)
+	if err != nil {
+		return ConfigFile{}
+	}
+	if withFiles, err := withTaskFiles(cfg); err == nil {
+		cfg = withFiles
+	}
+	return cfg
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// decodeTextInput turns raw input bytes into text that can be sent to the
+// model. Documents such as PDFs have their text extracted, see
+// documentText. UTF-8 passes through (minus a BOM); UTF-16 with a BOM and
+// Latin-1 are transcoded with a notice. Anything else is treated as binary
+// and refused, unless forceBase64 is set, in which case it is sent base64
+// encoded. Providers reject invalid UTF-8 with unhelpful 400 errors, so it is
+// better to catch it here.
+func decodeTextInput(name string, b []byte, forceBase64 bool) (string, error) {
+	if text, ok, err := documentText(name, b); ok {
+		return text, err
+	}
+	switch {
+	case bytes.HasPrefix(b, []byte{0xEF, 0xBB, 0xBF}):
+		b = b[3:]
+	case bytes.HasPrefix(b, []byte{0xFF, 0xFE}), bytes.HasPrefix(b, []byte{0xFE, 0xFF}):
+		if s, ok := decodeUTF16(b); ok {
+			fmt.Fprintf(os.Stderr, "Note: %s is UTF-16, transcoded to UTF-8.\n", name)
+			return s, nil
+		}
+	}
+
+	if !bytes.ContainsRune(b, 0) && utf8.Valid(b) {
+		return string(b), nil
+	}
+	if looksLikeLatin1(b) {
+		fmt.Fprintf(os.Stderr, "Note: %s is not valid UTF-8, decoded it as Latin-1.\n", name)
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+		}
+		return string(runes), nil
+	}
+
+	if forceBase64 {
+		fmt.Fprintf(os.Stderr, "Note: %s looks binary, sending it base64 encoded (%d bytes).\n", name, len(b))
+		return fmt.Sprintf("The following is the base64 encoding of the binary file %s (%d bytes):\n\n%s",
+			name, len(b), base64.StdEncoding.EncodeToString(b)), nil
+	}
+	return "", fmt.Errorf("%s looks like binary data (not valid UTF-8 text); convert it to text first or pass --force-binary-as-base64", name)
+}
+
+func decodeUTF16(b []byte) (string, bool) {
+	if len(b)%2 != 0 {
+		return "", false
+	}
+	bigEndian := b[0] == 0xFE
+	units := make([]uint16, 0, len(b)/2-1)
+	for i := 2; i+1 < len(b); i += 2 {
+		if bigEndian {
+			units = append(units, uint16(b[i])<<8|uint16(b[i+1]))
+		} else {
+			units = append(units, uint16(b[i+1])<<8|uint16(b[i]))
+		}
+	}
+	s := string(utf16.Decode(units))
+	return s, !strings.ContainsRune(s, 0)
+}
+
+// looksLikeLatin1 accepts data without NULs or other control characters
+// (apart from common whitespace), as binary formats nearly always have them.
+func looksLikeLatin1(b []byte) bool {
+	for _, c := range b {
+		switch {
+		case c == '\t', c == '\n', c == '\r', c == '\f':
+		case c < 0x20, c >= 0x7F && c <= 0x9F:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+)
+
+// o200kModels are the model name prefixes that use the o200k_base encoding.
+// Every other model is counted with cl100k_base, which is close enough for
+// models from other vendors too.
+var o200kModels = []string{"gpt-4o", "gpt-4.1", "gpt-4.5", "gpt-5", "chatgpt-4o", "o1", "o3", "o4"}
+
+// tokenizers caches the encodings, which take a moment to load, and the
+// token counts of the texts seen so far, so a growing chat only has its
+// new messages counted.
+var tokenizers struct {
+	sync.Mutex
+	byName map[string]*tiktoken.Tiktoken
+	counts map[string]map[string]int // by encoding, then text
+}
+
+func init() {
+	// The BPE ranks are compiled in rather than downloaded on first use.
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// encodingName returns the name of the encoding model uses.
+func encodingName(model string) string {
+	for _, prefix := range o200kModels {
+		if strings.HasPrefix(model, prefix) {
+			return tiktoken.MODEL_O200K_BASE
+		}
+	}
+	return tiktoken.MODEL_CL100K_BASE
+}
+
+// textTokens returns the number of tokens text takes up for model, or the
+// estimate when the encoding cannot be loaded.
+func textTokens(model, text string) int {
+	if text == "" {
+		return 0
+	}
+	name := encodingName(model)
+	tokenizers.Lock()
+	defer tokenizers.Unlock()
+	if n, ok := tokenizers.counts[name][text]; ok {
+		return n
+	}
+	n := countWith(name, text)
+	if tokenizers.counts == nil {
+		tokenizers.counts = map[string]map[string]int{}
+	}
+	if tokenizers.counts[name] == nil {
+		tokenizers.counts[name] = map[string]int{}
+	}
+	tokenizers.counts[name][text] = n
+	return n
+}
+
+// tokenLen is textTokens without remembering the count, for the many
+// pieces of a text that is being split up.
+func tokenLen(model, text string) int {
+	tokenizers.Lock()
+	defer tokenizers.Unlock()
+	return countWith(encodingName(model), text)
+}
+
+// countWith counts the tokens of text in the named encoding, loading it on
+// first use. tokenizers must be locked.
+func countWith(name, text string) int {
+	enc, ok := tokenizers.byName[name]
+	if !ok {
+		var err error
+		if enc, err = tiktoken.GetEncoding(name); err != nil {
+			return estimateTokens(text)
+		}
+		if tokenizers.byName == nil {
+			tokenizers.byName = map[string]*tiktoken.Tiktoken{}
+		}
+		tokenizers.byName[name] = enc
+	}
+	// Special tokens such as <|endoftext|> in the text are sent as plain
+	// text, so they are counted as such.
+	return len(enc.EncodeOrdinary(text))
+}
+
+// runTokens handles "askgpt tokens <file|-> [--model m]": it counts the
+// tokens of files, or of stdin, before they are sent anywhere.
+func runTokens(args []string) int {
+	fs := flag.NewFlagSet("tokens", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	model := fs.String("model", "", "")
+
+	// Allow flags after the files.
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt tokens <file|-> ... [--model <name>]")
+		return 2
+	}
+
+	cfg := loadConfigIfExists()
+	if *model == "" {
+		*model = cfg.AskGPT.Model
+	}
+	total := 0
+	for _, name := range files {
+		var b []byte
+		var err error
+		if name == "-" {
+			b, err = io.ReadAll(os.Stdin)
+			name = "stdin"
+		} else {
+			b, err = os.ReadFile(name)
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		text, err := decodeTextInput(name, b, false)
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		n := textTokens(*model, text)
+		total += n
+		fmt.Printf("%8d  %s\n", n, name)
+	}
+	if len(files) > 1 {
+		fmt.Printf("%8d  total\n", total)
+	}
+	window := contextWindow(cfg, *model)
+	fmt.Fprintf(os.Stderr, "%s (%s): %d%% of the %d-token context window\n",
+		*model, encodingName(*model), total*100/window, window)
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"maps"
+	"strings"
+)
+
+const (
+	// defaultContextWindow is assumed for models that are not known.
+	defaultContextWindow = 8192
+	// contextWarnPercent is how full the context window may get before the
+	// chat warns about it.
+	contextWarnPercent = 80
+	// messageOverhead is about the tokens each message costs for its role
+	// and separators.
+	messageOverhead = 4
+)
+
+// builtinContextWindows maps model name prefixes to their context window in
+// tokens; the longest matching prefix wins. The context_windows section of
+// config.yaml adds to and overrides it:
+//
+//	context_windows:
+//	  llama3:70b: 8192
+var builtinContextWindows = map[string]int{
+	"gpt-3.5-turbo": 16385,
+	"gpt-4":         8192,
+	"gpt-4-turbo":   128000,
+	"gpt-4o":        128000,
+	"gpt-4.1":       1047576,
+	"gpt-5":         400000,
+	"o1":            200000,
+	"o3":            200000,
+	"o4-mini":       200000,
+}
+
+// contextWindow returns the context window of model.
+func contextWindow(cfg ConfigFile, model string) int {
+	windows := maps.Clone(builtinContextWindows)
+	maps.Copy(windows, cfg.ContextWindows)
+	if n, ok := lookupModel(windows, model); ok && n > 0 {
+		return n
+	}
+	return defaultContextWindow
+}
+
+// lookupModel returns the value of the longest name prefix of model in m.
+func lookupModel[V any](m map[string]V, model string) (V, bool) {
+	var v V
+	best, found := "", false
+	for prefix, pv := range m {
+		if strings.HasPrefix(model, prefix) && (!found || len(prefix) > len(best)) {
+			best, v, found = prefix, pv, true
+		}
+	}
+	return v, found
+}
+
+// countTokens returns the tokens a request to model with messages takes up.
+func countTokens(model string, messages []Message) int {
+	n := 0
+	for _, m := range messages {
+		n += textTokens(model, m.Content) + messageOverhead
+		for _, img := range m.Images {
+			n += imageTokens(img)
+		}
+	}
+	return n
+}
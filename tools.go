@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultToolRounds is how many times in a row the model may call tools
+	// before it has to answer, unless tools.max_rounds says otherwise.
+	defaultToolRounds = 10
+	// maxToolOutput is the most of a tool's output sent back to the model.
+	maxToolOutput = 50000
+)
+
+// ToolsConfig is the tools: section of config.yaml: the tools the model
+// may call in every chat, on top of those --tools names, and how many
+// rounds of calls it may make for one answer.
+//
+//	tools:
+//	  enabled: [current_time, fetch_url, run_shell]
+//	  max_rounds: 10
+//	  mcp: [files]
+type ToolsConfig struct {
+	Enabled   []string `yaml:"enabled,omitempty"`
+	MaxRounds int      `yaml:"max_rounds,omitempty"`
+	MCP       []string `yaml:"mcp,omitempty"` // servers of mcp_servers to connect to
+}
+
+// localTool is a tool askgpt runs for the model. Run gets the arguments as
+// the model wrote them, JSON matching Def.Function.Parameters, and returns
+// what to tell it; an error is told to it as well, so it can try again.
+type localTool struct {
+	Def Tool
+	Run func(ctx context.Context, args string) (string, error)
+}
+
+// newTool returns a function tool with parameters given as a JSON Schema.
+func newTool(name, description, parameters string, run func(ctx context.Context, args string) (string, error)) localTool {
+	return localTool{
+		Def: Tool{Type: "function", Function: ToolFunction{Name: name, Description: description, Parameters: json.RawMessage(parameters)}},
+		Run: run,
+	}
+}
+
+// builtinTools are the tools --tools and tools.enabled can name. They are
+// made for a session, as some need its client or its terminal.
+var builtinTools = map[string]func(s *chatSession) localTool{
+	"current_time": func(s *chatSession) localTool {
+		return newTool("current_time", "Returns the current local date, time and time zone.", `{"type":"object","properties":{}}`,
+			func(ctx context.Context, args string) (string, error) {
+				return time.Now().Format("Monday, 2 January 2006 15:04:05 MST (-07:00)"), nil
+			})
+	},
+	"fetch_url": func(s *chatSession) localTool {
+		return newTool("fetch_url", "Downloads a web page and returns its readable text.",
+			`{"type":"object","properties":{"url":{"type":"string","description":"The http or https URL to fetch"}},"required":["url"]}`,
+			func(ctx context.Context, args string) (string, error) {
+				var in struct {
+					URL string `json:"url"`
+				}
+				if err := decodeToolArgs(args, &in); err != nil {
+					return "", err
+				}
+				if !strings.HasPrefix(in.URL, "http://") && !strings.HasPrefix(in.URL, "https://") {
+					return "", fmt.Errorf("%q is not an http or https URL", in.URL)
+				}
+				title, text, err := fetchPage(ctx, s.client, in.URL)
+				if title != "" {
+					text = "Title: " + title + "\n\n" + text
+				}
+				return text, err
+			})
+	},
+	"run_shell": func(s *chatSession) localTool {
+		return newTool("run_shell", "Runs a shell command in the user's current directory and returns its output and exit status. The user is shown the command and asked before it runs; it gets no input and is stopped after two minutes.",
+			`{"type":"object","properties":{"command":{"type":"string","description":"The command, as given to sh -c"}},"required":["command"]}`,
+			runShellTool)
+	},
+}
+
+// toolNames returns the names builtinTools knows, sorted.
+func toolNames() []string {
+	var names []string
+	for name := range builtinTools {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// decodeToolArgs decodes the arguments of a call into v.
+func decodeToolArgs(args string, v any) error {
+	if strings.TrimSpace(args) == "" {
+		args = "{}"
+	}
+	if err := json.Unmarshal([]byte(args), v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+// loadTools makes the tools the config and names enable for s. Names may
+// be given several to a flag, separated by commas.
+func (s *chatSession) loadTools(names []string) error {
+	seen := map[string]bool{}
+	for _, list := range slices.Concat(s.cfgFile.Tools.Enabled, names) {
+		for _, name := range strings.Split(list, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			if slices.Contains(workspaceTools, name) {
+				if s.opts.workspace == "" {
+					return fmt.Errorf("tool %s needs --workspace", name)
+				}
+				continue // added by loadWorkspace
+			}
+			makeTool, ok := builtinTools[name]
+			if !ok {
+				return fmt.Errorf("unknown tool %q (known: %s)", name, strings.Join(toolNames(), ", "))
+			}
+			s.addTool(makeTool(s))
+		}
+	}
+	return nil
+}
+
+// addTool makes a tool available to the model.
+func (s *chatSession) addTool(t localTool) {
+	if s.tools == nil {
+		s.tools = map[string]localTool{}
+	}
+	if _, ok := s.tools[t.Def.Function.Name]; !ok {
+		s.opts.tools = append(s.opts.tools, t.Def)
+	}
+	s.tools[t.Def.Function.Name] = t
+}
+
+// chat sends request, and as long as the model answers with tool calls
+// runs them and sends their results back, up to tools.max_rounds times, or
+// for the agent its number of steps.
+// The calls and results are sent with the rounds of this turn only; the
+// conversation keeps the final answer.
+func (s *chatSession) chat(ctx context.Context, t turn, request []Message) (chatResult, error) {
+	maxRounds := s.cfgFile.Tools.MaxRounds
+	if maxRounds <= 0 {
+		maxRounds = defaultToolRounds
+	}
+	for round := 1; ; round++ {
+		// The agent shows its steps, and past the last one has to sum up.
+		if s.steps > 0 && round > s.steps {
+			fmt.Fprintf(os.Stderr, "[agent] Out of steps after %d; asking for a summary.\n", s.steps)
+			request = append(request, Message{Role: "user", Content: agentLimitPrompt})
+			t.opts.tools = nil
+		} else if s.steps > 0 {
+			fmt.Fprintf(os.Stderr, "[step %d/%d]\n", round, s.steps)
+		}
+		rctx, sp := startSpan(ctx, "chat "+t.cfg.Model, spanClient)
+		sp.set("gen_ai.operation.name", "chat")
+		sp.set("gen_ai.request.model", t.cfg.Model)
+		res, err := doStreamingChat(rctx, s.client, t.cfg, request, t.opts)
+		if res.Usage != nil {
+			sp.set("gen_ai.usage.input_tokens", res.Usage.PromptTokens)
+			sp.set("gen_ai.usage.output_tokens", res.Usage.CompletionTokens)
+		}
+		if res.FinishReason != "" {
+			sp.set("gen_ai.response.finish_reasons", res.FinishReason)
+		}
+		sp.end(err)
+		if err != nil || len(res.ToolCalls) == 0 {
+			return res, err
+		}
+		s.addCost(t.cfg.Model, res.Usage, false)
+		if round > maxRounds && s.steps == 0 {
+			return res, fmt.Errorf("the model still called tools after %d rounds (tools.max_rounds)", maxRounds)
+		}
+		request = append(request, Message{Role: "assistant", Content: res.Content, ToolCalls: res.ToolCalls})
+		for _, call := range res.ToolCalls {
+			tctx, sp := startSpan(ctx, "execute_tool "+call.Function.Name, spanInternal)
+			sp.set("gen_ai.tool.name", call.Function.Name)
+			out := s.runTool(tctx, call)
+			sp.end(tctx.Err())
+			if ctx.Err() != nil {
+				return chatResult{}, ctx.Err()
+			}
+			request = append(request, Message{Role: "tool", ToolCallID: call.ID, Content: out})
+		}
+	}
+}
+
+// runTool runs one call and returns what to tell the model.
+func (s *chatSession) runTool(ctx context.Context, call ToolCall) string {
+	name, args := call.Function.Name, strings.TrimSpace(call.Function.Arguments)
+	fmt.Fprintf(os.Stderr, "[tool] %s %s\n", name, args)
+	tool, ok := s.tools[name]
+	var out string
+	var err error
+	if ok {
+		out, err = tool.Run(ctx, args)
+	} else {
+		err = errors.New("there is no tool named " + name)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "[tool] %s failed: %v\n", name, err)
+		return "Error: " + err.Error()
+	}
+	out = s.redactText(out)
+	if len(out) > maxToolOutput {
+		cut := maxToolOutput
+		for cut > 0 && !isRuneStart(out[cut]) {
+			cut--
+		}
+		out = out[:cut] + fmt.Sprintf("\n[... %s more left out]", formatBytes(len(out)-cut))
+	}
+	fmt.Fprintf(os.Stderr, "[tool] %s returned %s\n", name, formatBytes(len(out)))
+	return out
+}
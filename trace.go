@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Trace levels, set by -v/--verbose and --debug.
+const (
+	traceVerbose = 1 // requests, status, timing, rate limits and retries
+	traceDebug   = 2 // all headers and every line of streamed responses
+)
+
+// traceLevel is how much is traced to stderr; 0 traces nothing.
+var traceLevel int
+
+// tracef writes a trace line to stderr if the trace level is at least level.
+func tracef(level int, format string, args ...any) {
+	if traceLevel >= level {
+		fmt.Fprintf(os.Stderr, "[trace] "+format+"\n", args...)
+	}
+}
+
+// traceTransport traces the requests made through it and their responses,
+// with secrets masked, logs them, see logging.go, and records them as spans,
+// see otel.go.
+type traceTransport struct {
+	base http.RoundTripper
+}
+
+func (t traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	base := t.base
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	tracef(traceVerbose, "%s %s (%d bytes)", req.Method, maskURL(req.URL), req.ContentLength)
+	if traceLevel >= traceDebug {
+		traceHeaders("> ", req.Header)
+	}
+	if logEnabled(slog.LevelDebug) {
+		logger.Debug("request headers", "url", maskURL(req.URL), "headers", maskHeaders(req.Header))
+	}
+
+	_, sp := startSpan(req.Context(), req.Method, spanClient)
+	sp.set("http.request.method", req.Method)
+	sp.set("url.full", maskURL(req.URL))
+	sp.set("server.address", req.URL.Hostname())
+	start := time.Now()
+	resp, err := base.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		sp.end(err)
+		tracef(traceVerbose, "%s %s failed after %v: %v", req.Method, maskURL(req.URL), elapsed, err)
+		logger.Warn("request failed", "method", req.Method, "url", maskURL(req.URL), "duration_ms", elapsed.Milliseconds(), "error", err.Error())
+		return resp, err
+	}
+
+	id := firstHeader(resp.Header, "X-Request-Id", "Request-Id")
+	limits := rateLimits(resp.Header)
+	line := fmt.Sprintf("%s in %v", resp.Status, elapsed)
+	if id != "" {
+		line += ", request id " + id
+	}
+	if limits != "" {
+		line += ", " + limits
+	}
+	tracef(traceVerbose, "%s", line)
+	sp.set("http.response.status_code", resp.StatusCode)
+	if resp.StatusCode >= 400 {
+		sp.end(errors.New(resp.Status))
+	} else {
+		sp.end(nil)
+	}
+	level := slog.LevelInfo
+	if resp.StatusCode >= 400 {
+		level = slog.LevelWarn
+	}
+	logger.Log(req.Context(), level, "response", "method", req.Method, "url", maskURL(req.URL),
+		"status", resp.StatusCode, "duration_ms", elapsed.Milliseconds(), "request_id", id, "rate_limit", limits)
+	if traceLevel >= traceDebug {
+		traceHeaders("< ", resp.Header)
+	}
+	if logEnabled(slog.LevelDebug) {
+		logger.Debug("response headers", "url", maskURL(req.URL), "headers", maskHeaders(resp.Header))
+	}
+	if traceLevel >= traceDebug || logEnabled(slog.LevelDebug) {
+		if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(resp.Body, &streamTracer{}), resp.Body}
+		}
+	}
+	return resp, nil
+}
+
+// traceHeaders traces headers in order of name, prefixed with > for a
+// request and < for a response.
+func traceHeaders(prefix string, h http.Header) {
+	var names []string
+	for name := range h {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		for _, v := range h[name] {
+			tracef(traceDebug, "%s%s: %s", prefix, name, maskHeader(name, v))
+		}
+	}
+}
+
+// maskHeaders returns h with the secrets masked, for the log.
+func maskHeaders(h http.Header) map[string]string {
+	m := make(map[string]string, len(h))
+	for name, values := range h {
+		masked := make([]string, len(values))
+		for i, v := range values {
+			masked[i] = maskHeader(name, v)
+		}
+		m[name] = strings.Join(masked, ", ")
+	}
+	return m
+}
+
+// rateLimits sums up the rate limit headers of a response, such as
+// x-ratelimit-remaining-requests and retry-after.
+func rateLimits(h http.Header) string {
+	var parts []string
+	for name, values := range h {
+		lower := strings.ToLower(name)
+		if strings.Contains(lower, "ratelimit") || lower == "retry-after" {
+			parts = append(parts, lower+"="+strings.Join(values, ","))
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	slices.Sort(parts)
+	return "rate limit: " + strings.Join(parts, " ")
+}
+
+func firstHeader(h http.Header, names ...string) string {
+	for _, name := range names {
+		if v := h.Get(name); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// maskURL masks keys passed in the query string, as some providers take
+// them.
+func maskURL(u *url.URL) string {
+	q := u.Query()
+	masked := false
+	for name, values := range q {
+		switch strings.ToLower(name) {
+		case "key", "api_key", "api-key", "apikey", "access_token":
+			for i, v := range values {
+				values[i] = maskHeader("api-key", v)
+			}
+			masked = true
+		}
+	}
+	if !masked {
+		return u.String()
+	}
+	c := *u
+	c.RawQuery = q.Encode()
+	return c.String()
+}
+
+// maxTracedLine is how much of a line of a streamed response is traced.
+const maxTracedLine = 300
+
+// streamTracer traces the lines of a streamed response as they are read.
+type streamTracer struct {
+	partial []byte
+}
+
+func (st *streamTracer) Write(p []byte) (int, error) {
+	st.partial = append(st.partial, p...)
+	for {
+		i := bytes.IndexByte(st.partial, '\n')
+		if i < 0 {
+			break
+		}
+		line := strings.TrimRight(string(st.partial[:i]), "\r")
+		st.partial = st.partial[i+1:]
+		if line == "" {
+			continue
+		}
+		if len(line) > maxTracedLine {
+			line = line[:maxTracedLine] + "..."
+		}
+		tracef(traceDebug, "stream: %s", line)
+		logger.Debug("stream", "line", line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	defaultTranscribeModel = "whisper-1"
+	// maxAudioUpload is the largest file the transcriptions endpoint takes.
+	maxAudioUpload = 25 << 20
+)
+
+// AudioConfig is the audio: section of config.yaml: the models askgpt
+// transcribe and askgpt tts (or --speak) use, the voice, and the command
+// that plays speech, which is otherwise looked for (see audioPlayers):
+//
+//	audio:
+//	  transcribe_model: gpt-4o-transcribe
+//	  speech_model: gpt-4o-mini-tts
+//	  voice: nova
+//	  player: mpv --really-quiet
+type AudioConfig struct {
+	TranscribeModel string `yaml:"transcribe_model,omitempty"`
+	SpeechModel     string `yaml:"speech_model,omitempty"`
+	Voice           string `yaml:"voice,omitempty"`
+	Player          string `yaml:"player,omitempty"`
+}
+
+// runTranscribe handles "askgpt transcribe <audio>": it uploads the audio to
+// the transcriptions endpoint and prints the transcript, or hands it to a
+// task with --then.
+func runTranscribe(args []string) int {
+	fs := flag.NewFlagSet("transcribe", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	model := fs.String("model", "", "")
+	language := fs.String("language", "", "")
+	format := fs.String("format", "text", "")
+	then := fs.String("then", "", "")
+	force := fs.Bool("force", false, "")
+
+	// Allow flags after the file name.
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	if len(files) != 1 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt transcribe <audio file> [--model name] [--language code] [--format text|srt|vtt|json] [--then task]")
+		return 2
+	}
+	switch *format {
+	case "text", "srt", "vtt", "json", "verbose_json":
+	default:
+		errorf("unknown format %q (use text, srt, vtt or json)\n", *format)
+		return 2
+	}
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "transcribe", *force)
+	if *model == "" {
+		*model = cfgFile.Audio.TranscribeModel
+	}
+	if *model == "" {
+		*model = defaultTranscribeModel
+	}
+
+	fmt.Fprintf(os.Stderr, "[transcribe] Uploading %s to %s...\n", files[0], *model)
+	client := apiClient(cfgFile)
+	transcript, err := transcribeAudio(context.Background(), client, cfgFile.AskGPT, files[0],
+		map[string]string{"model": *model, "language": *language, "response_format": *format})
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	if *then == "" {
+		fmt.Println(strings.TrimRight(transcript, "\n"))
+		return 0
+	}
+	return runThen(*then, transcript, *force)
+}
+
+// transcribeAudio uploads an audio file with the given form fields, empty
+// ones left out, and returns the transcript as the API formats it.
+func transcribeAudio(ctx context.Context, client *http.Client, cfg AskGPTConfig, path string, fields map[string]string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("cannot read audio %s: %w", path, err)
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil && fi.Size() > maxAudioUpload {
+		return "", fmt.Errorf("%s is %s, over the %s the API takes; split or compress it first",
+			path, formatBytes(int(fi.Size())), formatBytes(maxAudioUpload))
+	}
+	if err := checkBudget(); err != nil {
+		return "", err
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if value != "" {
+			w.WriteField(name, value)
+		}
+	}
+	part, err := w.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(part, f); err != nil {
+		return "", fmt.Errorf("cannot read audio %s: %w", path, err)
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	resp, err := doAPIRequest(ctx, client, cfg, apiEndpoint(cfg, "audio/transcriptions"), w.FormDataContentType(), body.Bytes())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot read response: %w", err)
+	}
+	// Audio is priced by the minute; the log counts the transcript.
+	recordUsage(fields["model"], nil, nil, string(b))
+	return string(b), nil
+}
+
+// runThen runs askgpt again with a task on the transcript, piped to it as
+// a file would be.
+func runThen(task, transcript string, force bool) int {
+	exe, err := os.Executable()
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	args := []string{task, "--yes"}
+	if force {
+		args = append(args, "--force")
+	}
+	cmd := exec.Command(exe, args...)
+	cmd.Stdin = strings.NewReader(transcript)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return exitErr.ExitCode()
+		}
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// appendTranscript adds a question and its answer to the day's journal in
+// transcript_dir, YYYY-MM-DD.md, for people who keep daily notes. It is
+// written alongside the session store, not instead of it. note marks a
+// retried, continued or cut-off answer.
+func appendTranscript(dir string, cfg AskGPTConfig, question, answer, note string) error {
+	dir, err := expandHome(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, configDirPerm); err != nil {
+		return fmt.Errorf("cannot create transcript dir: %w", err)
+	}
+	now := time.Now()
+	path := filepath.Join(dir, now.Format("2006-01-02")+".md")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, configFilePerm)
+	if err != nil {
+		return fmt.Errorf("cannot write transcript: %w", err)
+	}
+	defer f.Close()
+
+	var b strings.Builder
+	if info, err := f.Stat(); err == nil && info.Size() == 0 {
+		fmt.Fprintf(&b, "# askgpt · %s\n", now.Format("Monday, 2 January 2006"))
+	}
+	fmt.Fprintf(&b, "\n## %s · %s", now.Format("15:04"), cfg.Model)
+	if note != "" {
+		fmt.Fprintf(&b, " (%s)", note)
+	}
+	b.WriteString("\n\n")
+	if question != "" {
+		fmt.Fprintf(&b, "**You:**\n\n%s\n\n", strings.TrimRight(question, "\n"))
+	}
+	fmt.Fprintf(&b, "**Assistant:**\n\n%s\n", strings.TrimRight(answer, "\n"))
+	if _, err := f.WriteString(b.String()); err != nil {
+		return fmt.Errorf("cannot write transcript: %w", err)
+	}
+	return nil
+}
+
+// expandHome replaces a leading ~ with the home directory.
+func expandHome(path string) (string, error) {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("cannot resolve home dir: %w", err)
+	}
+	return filepath.Join(home, path[1:]), nil
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	defaultTranslateParallel = 4
+	glossaryFileName         = "glossary.json"
+)
+
+var languageNames = map[string]string{
+	"ar": "Arabic", "de": "German", "en": "English", "es": "Spanish",
+	"fr": "French", "hi": "Hindi", "it": "Italian", "ja": "Japanese",
+	"ko": "Korean", "nl": "Dutch", "pl": "Polish", "pt": "Portuguese",
+	"ru": "Russian", "sv": "Swedish", "tr": "Turkish", "uk": "Ukrainian",
+	"vi": "Vietnamese", "zh": "Simplified Chinese", "zh-tw": "Traditional Chinese",
+}
+
+func languageName(code string) string {
+	if name, ok := languageNames[strings.ToLower(code)]; ok {
+		return name
+	}
+	return code
+}
+
+// glossary maps a source term to its translation per language code.
+type glossary map[string]map[string]string
+
+func runTranslate(args []string) int {
+	fs := flag.NewFlagSet("translate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	to := fs.String("to", "", "")
+	outDir := fs.String("out-dir", "", "")
+	glossaryPath := fs.String("glossary", "", "")
+	parallel := fs.Int("parallel", defaultTranslateParallel, "")
+	force := fs.Bool("force", false, "")
+	noRedact := fs.Bool("no-redact", false, "")
+
+	// Allow flags after the file names, like task mode does.
+	var files []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			errorf("%v\n", err)
+			return 2
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		files = append(files, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+
+	var langs []string
+	for _, l := range strings.Split(*to, ",") {
+		if l = strings.TrimSpace(l); l != "" && !slices.Contains(langs, l) {
+			langs = append(langs, l)
+		}
+	}
+	if len(langs) == 0 || len(files) == 0 || *outDir == "" {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt translate --to en,ja,de <files...> --out-dir <dir> [--glossary <file>] [--parallel n]")
+		return 2
+	}
+	if *parallel < 1 {
+		*parallel = 1
+	}
+	// A file given twice, say by overlapping globs, is translated once.
+	seen := map[string]bool{}
+	files = slices.DeleteFunc(files, func(f string) bool {
+		dup := seen[filepath.Clean(f)]
+		seen[filepath.Clean(f)] = true
+		return dup
+	})
+
+	cfgFile, ok := loadRuntimeConfig()
+	if !ok {
+		return 1
+	}
+	trackSpending(cfgFile, "translate", *force)
+	if _, err := useRedaction(cfgFile, *noRedact); err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	sampling, err := resolveSampling(cfgFile, "translate", "", cfgFile.AskGPT.Model)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	opts := taskOptions{noStream: true, sampling: sampling}
+	client := apiClient(cfgFile)
+
+	sources := make(map[string]string, len(files))
+	// Documents are translated to plain text, saved as .txt.
+	extracted := map[string]bool{}
+	for _, f := range files {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			errorf("cannot read %s: %v\n", f, err)
+			return 1
+		}
+		text, doc, err := documentText(f, b)
+		if !doc {
+			text, err = decodeTextInput(f, b, false)
+		}
+		if err != nil {
+			errorf("%v\n", err)
+			return 1
+		}
+		sources[f], extracted[f] = text, doc
+	}
+	// Translations are named after the file alone, so files of the same
+	// name in different directories would overwrite each other's.
+	byName := map[string]string{}
+	for _, f := range files {
+		name := translationName(f, langs[0], extracted[f])
+		if other, ok := byName[name]; ok {
+			errorf("%s and %s would both be translated to %s; translate them with different --out-dir\n", other, f, filepath.Join(*outDir, name))
+			return 2
+		}
+		byName[name] = f
+	}
+	if err := os.MkdirAll(*outDir, 0o755); err != nil {
+		errorf("cannot create dir %s: %v\n", *outDir, err)
+		return 1
+	}
+
+	// Every language is translated with the same glossary so terminology
+	// stays consistent across the outputs.
+	var terms glossary
+	if *glossaryPath != "" {
+		terms, err = loadGlossary(*glossaryPath)
+	} else {
+		fmt.Fprintln(os.Stderr, "Building shared glossary...")
+		terms, err = buildGlossary(client, cfgFile.AskGPT, opts, sources, langs)
+		if err != nil {
+			// Translating without a glossary is still useful.
+			warnf("%v; translating without one.\n", err)
+			terms, err = nil, nil
+		} else {
+			path := filepath.Join(*outDir, glossaryFileName)
+			if err = writeGlossary(path, terms); err == nil {
+				fmt.Fprintf(os.Stderr, "Glossary with %d terms written to %s (edit it and pass --glossary to reuse)\n", len(terms), path)
+			}
+		}
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+
+	type job struct{ file, lang string }
+	jobs := make(chan job)
+	var mu sync.Mutex
+	failed := 0
+
+	var wg sync.WaitGroup
+	for i := 0; i < *parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				out, err := translateDocument(client, cfgFile.AskGPT, opts, sources[j.file], j.lang, terms)
+				if err == nil {
+					path := filepath.Join(*outDir, translationName(j.file, j.lang, extracted[j.file]))
+					if err = os.WriteFile(path, []byte(out), 0o644); err == nil {
+						mu.Lock()
+						fmt.Fprintf(os.Stderr, "[%s] %s -> %s\n", j.lang, j.file, path)
+						mu.Unlock()
+						continue
+					}
+				}
+				mu.Lock()
+				failed++
+				fmt.Fprintf(os.Stderr, "[%s] %s failed: %v\n", j.lang, j.file, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, f := range files {
+		for _, l := range langs {
+			jobs <- job{f, l}
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if failed > 0 {
+		fmt.Fprintf(os.Stderr, "%d of %d translations failed.\n", failed, len(files)*len(langs))
+		return 1
+	}
+	return 0
+}
+
+// translationName returns the name of the translation of file into lang:
+// README.md becomes README.ja.md, and a document its text was extracted
+// from, such as report.pdf, report.ja.txt.
+func translationName(file, lang string, extracted bool) string {
+	base := filepath.Base(file)
+	ext := filepath.Ext(base)
+	if extracted {
+		return strings.TrimSuffix(base, ext) + "." + lang + ".txt"
+	}
+	return strings.TrimSuffix(base, ext) + "." + lang + ext
+}
+
+func translateDocument(client *http.Client, cfg AskGPTConfig, opts taskOptions, text, lang string, terms glossary) (string, error) {
+	var prompt strings.Builder
+	fmt.Fprintf(&prompt, "Translate the following document into %s. Preserve the formatting exactly "+
+		"(Markdown, code blocks, links, placeholders) and do not translate code. "+
+		"Output only the translation, without any commentary.\n", languageName(lang))
+	if lines := glossaryLines(terms, lang); len(lines) > 0 {
+		prompt.WriteString("\nUse exactly these translations for the following terms:\n")
+		prompt.WriteString(strings.Join(lines, "\n"))
+		prompt.WriteString("\n")
+	}
+	prompt.WriteString("\n---\n\n")
+	prompt.WriteString(text)
+
+	req := newChatRequest(cfg, []Message{{Role: "user", Content: prompt.String()}}, opts)
+	req.MaxTokens = 0 // documents can be long; let the provider use its limit
+	res, err := sendChat(context.Background(), client, cfg, req, nil)
+	if err != nil {
+		return "", err
+	}
+	if res.FinishReason == "length" {
+		return "", fmt.Errorf("translation was truncated by the model's output limit")
+	}
+	// The translation is written to a file here, so the redacted values go
+	// back in.
+	out := strings.TrimSpace(restoreOutgoing(res.Content))
+	if !strings.HasSuffix(out, "\n") {
+		out += "\n"
+	}
+	return out, nil
+}
+
+// buildGlossary asks the model for the key terms of the sources and their
+// translations into every target language.
+func buildGlossary(client *http.Client, cfg AskGPTConfig, opts taskOptions, sources map[string]string, langs []string) (glossary, error) {
+	var doc strings.Builder
+	names := make([]string, 0, len(sources))
+	for name := range sources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		doc.WriteString(sources[name])
+		doc.WriteString("\n\n")
+	}
+
+	prompt := fmt.Sprintf("Extract up to 30 important domain terms, product names and recurring phrases from the text below "+
+		"whose translation must stay consistent. Answer with a JSON object mapping each term (as it appears in the text) "+
+		"to an object with its translation for each of these language codes: %s. "+
+		"Keep names that should not be translated unchanged.\n\n---\n\n%s", strings.Join(langs, ", "), doc.String())
+
+	o := opts
+	o.jsonMode = true
+	req := newChatRequest(cfg, []Message{{Role: "user", Content: prompt}}, o)
+	req.MaxTokens = 0
+	res, err := sendChat(context.Background(), client, cfg, req, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot build glossary: %w", err)
+	}
+	pretty, err := formatJSONResponse(res.Content)
+	if err != nil {
+		return nil, fmt.Errorf("cannot build glossary: %w", err)
+	}
+	var terms glossary
+	if err := json.Unmarshal([]byte(pretty), &terms); err != nil {
+		return nil, fmt.Errorf("cannot build glossary: unexpected shape: %w", err)
+	}
+	return terms, nil
+}
+
+// loadGlossary reads a glossary in JSON or YAML (a YAML parser reads both).
+func loadGlossary(path string) (glossary, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read glossary %s: %w", path, err)
+	}
+	var terms glossary
+	if err := yaml.Unmarshal(b, &terms); err != nil {
+		return nil, fmt.Errorf("cannot parse glossary %s: %w", path, err)
+	}
+	return terms, nil
+}
+
+func writeGlossary(path string, terms glossary) error {
+	b, err := json.MarshalIndent(terms, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+		return fmt.Errorf("cannot write glossary %s: %w", path, err)
+	}
+	return nil
+}
+
+func glossaryLines(terms glossary, lang string) []string {
+	var lines []string
+	for term, tr := range terms {
+		if t, ok := tr[lang]; ok && t != "" {
+			lines = append(lines, fmt.Sprintf("- %s => %s", term, t))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	defaultKeepTurns      = 10
+	defaultSummarizeTurns = 4
+	// summaryPrefix starts the message that stands in for summarized turns.
+	summaryPrefix   = "[Summary of the earlier conversation]\n\n"
+	summarizePrompt = "Summarize the conversation below so it can continue without it. " +
+		"Keep the facts, decisions, names, numbers and code the rest of the conversation may refer to, " +
+		"and any summary it starts with. Be concise; write only the summary."
+)
+
+// ContextConfig is the context: section of config.yaml. It says what to do
+// when a chat grows close to filling the model's context window, instead of
+// letting the API reject it:
+//
+//	context:
+//	  strategy: sliding    # leave out the oldest turns, as few as needed
+//	  strategy: last_n     # keep only the last keep_turns turns
+//	  keep_turns: 10
+//	  strategy: summarize  # replace the oldest summarize_turns turns with a summary
+//	  summarize_turns: 4
+//	  threshold: 80        # percent of the window to start at
+//
+// The system prompts are always sent. sliding and last_n only leave turns
+// out of the request, and the session keeps the whole conversation; a
+// summary replaces the turns it covers in the session too.
+type ContextConfig struct {
+	Strategy       string `yaml:"strategy,omitempty"`
+	KeepTurns      int    `yaml:"keep_turns,omitempty"`
+	SummarizeTurns int    `yaml:"summarize_turns,omitempty"`
+	Threshold      int    `yaml:"threshold,omitempty"`
+}
+
+// trims reports whether turns are left out to fit the context window.
+func (c ContextConfig) trims() bool {
+	return c.validate() == nil && c.Strategy != "" && c.Strategy != "off"
+}
+
+// limit returns how many tokens of window a request may take before the
+// strategy applies.
+func (c ContextConfig) limit(window int) int {
+	percent := c.Threshold
+	if percent <= 0 {
+		percent = contextWarnPercent
+	}
+	return window * percent / 100
+}
+
+func (c ContextConfig) validate() error {
+	switch c.Strategy {
+	case "", "off", "sliding", "last_n", "summarize":
+	default:
+		return fmt.Errorf("unknown context.strategy %q in config.yaml (use off, sliding, last_n or summarize)", c.Strategy)
+	}
+	if c.KeepTurns < 0 || c.SummarizeTurns < 0 {
+		return errors.New("context.keep_turns and context.summarize_turns in config.yaml must not be negative")
+	}
+	if c.Threshold < 0 || c.Threshold > 100 {
+		return errors.New("context.threshold in config.yaml must be a percentage")
+	}
+	return nil
+}
+
+// summarizable returns how many of the first messages the next summary
+// covers: a summary written before, if any, and the summarize_turns turns
+// after it. The last turn is never summarized; 0 means there is nothing to
+// summarize.
+func (c ContextConfig) summarizable(messages []chatMessage) int {
+	turns := c.SummarizeTurns
+	if turns <= 0 {
+		turns = defaultSummarizeTurns
+	}
+	starts := turnStarts(apiMessages(messages))
+	skip := 0
+	if len(messages) > 0 && isSummary(messages[0].Message) {
+		skip = 1
+	}
+	end := min(skip+turns, len(starts)-1)
+	if end <= skip {
+		return 0
+	}
+	return starts[end]
+}
+
+func isSummary(m Message) bool {
+	return m.Role == "user" && strings.HasPrefix(m.Content, summaryPrefix)
+}
+
+// summaryRequest returns the messages asking the model to summarize the
+// given part of a conversation.
+func summaryRequest(messages []chatMessage) []Message {
+	return []Message{
+		{Role: "system", Content: summarizePrompt},
+		{Role: "user", Content: conversationText(messages)},
+	}
+}
+
+// conversationText writes messages out as text, each after the name of its
+// role.
+func conversationText(messages []chatMessage) string {
+	var b strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&b, "%s: %s\n\n", roleName(m.Role), strings.TrimSpace(m.Content))
+	}
+	return b.String()
+}
+
+// trimContext returns the conversation to send in a request to model, with
+// the given context window, and the number of turns left out. system is
+// the size of the system prompts in tokens. Nothing is left out until
+// the request passes the threshold, and the last turn is always sent. With
+// the summarize strategy this is the fallback when summarizing fails.
+func trimContext(cfg ContextConfig, model string, messages []Message, system, window int) ([]Message, int) {
+	limit := cfg.limit(window)
+	if !cfg.trims() || system+countTokens(model, messages) <= limit {
+		return messages, 0
+	}
+	starts := turnStarts(messages)
+	first := 0 // index into starts of the first turn sent
+	if cfg.Strategy == "last_n" {
+		keep := cfg.KeepTurns
+		if keep <= 0 {
+			keep = defaultKeepTurns
+		}
+		first = max(len(starts)-keep, 0)
+	}
+	for ; first < len(starts)-1; first++ {
+		if system+countTokens(model, messages[starts[first]:]) <= limit {
+			break
+		}
+	}
+	if first == 0 {
+		return messages, 0
+	}
+	return messages[starts[first]:], first
+}
+
+// turnStarts returns the index of every user message that starts a turn.
+// Anything before the first one counts as part of it.
+func turnStarts(messages []Message) []int {
+	starts := []int{0}
+	for i, m := range messages {
+		if m.Role == "user" && i > 0 {
+			starts = append(starts, i)
+		}
+	}
+	return starts
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	usageLogName = "usage.jsonl"
+	// budgetWarnPercent is how much of the monthly budget may be spent
+	// before askgpt warns about it.
+	budgetWarnPercent = 80
+)
+
+// BudgetConfig is the budget: section of config.yaml, in US dollars:
+//
+//	budget:
+//	  monthly: 10.00
+//
+// Spending is estimated from the usage log, see usageRecord, so it only
+// covers requests made by askgpt on this machine.
+type BudgetConfig struct {
+	Monthly float64 `yaml:"monthly,omitempty"`
+}
+
+// usageRecord is a line of ~/.askgpt/usage.jsonl, written for every request.
+// Cost is left out when the price of the model is not known; Estimated is
+// set when the API did not report usage and the tokens were counted
+// locally.
+type usageRecord struct {
+	Time             time.Time `json:"time"`
+	Model            string    `json:"model"`
+	Task             string    `json:"task,omitempty"`
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Cost             *float64  `json:"cost,omitempty"`
+	Estimated        bool      `json:"estimated,omitempty"`
+}
+
+// spending holds what the requests of this process are logged and budgeted
+// against; trackSpending sets it up.
+var spending struct {
+	sync.Mutex
+	cfg    ConfigFile
+	task   string
+	force  bool // send even when the budget is spent
+	warned bool
+}
+
+// trackSpending sets the config and task the requests of this process are
+// logged with. force lets them through when the monthly budget is spent.
+func trackSpending(cfg ConfigFile, task string, force bool) {
+	spending.Lock()
+	defer spending.Unlock()
+	spending.cfg, spending.task, spending.force = cfg, task, force
+}
+
+func usageLogPath() (string, error) {
+	cfgPath, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(cfgPath), usageLogName), nil
+}
+
+// recordUsage appends a request to model to the usage log. When the API
+// did not report usage, the tokens of req and answer are counted instead.
+func recordUsage(model string, u *Usage, req []Message, answer string) {
+	spending.Lock()
+	cfg, task := spending.cfg, spending.task
+	spending.Unlock()
+
+	rec := usageRecord{Time: time.Now(), Model: model, Task: task}
+	if u != nil {
+		rec.PromptTokens, rec.CompletionTokens = u.PromptTokens, u.CompletionTokens
+	} else {
+		rec.PromptTokens, rec.CompletionTokens = countTokens(model, req), textTokens(model, answer)
+		rec.Estimated = true
+	}
+	usage := Usage{PromptTokens: rec.PromptTokens, CompletionTokens: rec.CompletionTokens}
+	if cost, ok := usageCost(cfg, model, &usage); ok {
+		rec.Cost = &cost
+	}
+	if err := appendUsage(rec); err != nil {
+		warnf("%v\n", err)
+	}
+}
+
+func appendUsage(rec usageRecord) error {
+	path, err := usageLogPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), configDirPerm); err != nil {
+		return fmt.Errorf("cannot create dir %s: %w", filepath.Dir(path), err)
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, configFilePerm)
+	if err != nil {
+		return fmt.Errorf("cannot write usage log: %w", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("cannot write usage log: %w", err)
+	}
+	return nil
+}
+
+// readUsage returns the usage records since the given time, oldest first.
+// Lines that cannot be parsed are skipped.
+func readUsage(since time.Time) ([]usageRecord, error) {
+	path, err := usageLogPath()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot read usage log: %w", err)
+	}
+	defer f.Close()
+	var records []usageRecord
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var rec usageRecord
+		if json.Unmarshal(sc.Bytes(), &rec) != nil || rec.Time.Before(since) {
+			continue
+		}
+		records = append(records, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("cannot read usage log: %w", err)
+	}
+	return records, nil
+}
+
+// monthSpend returns the estimated dollars spent since the start of the
+// month.
+func monthSpend() (float64, error) {
+	now := time.Now()
+	records, err := readUsage(time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local))
+	if err != nil {
+		return 0, err
+	}
+	spent := 0.0
+	for _, rec := range records {
+		if rec.Cost != nil {
+			spent += *rec.Cost
+		}
+	}
+	return spent, nil
+}
+
+// checkBudget is run before every request. It refuses to send once the
+// monthly budget is spent, unless --force was given, and warns once when
+// most of it is.
+func checkBudget() error {
+	spending.Lock()
+	defer spending.Unlock()
+	budget := spending.cfg.Budget.Monthly
+	if budget <= 0 {
+		return nil
+	}
+	spent, err := monthSpend()
+	if err != nil {
+		return err
+	}
+	switch {
+	case spent >= budget && !spending.force:
+		return fmt.Errorf("the monthly budget of %s is spent (~%s so far); pass --force to send anyway, or raise budget.monthly in config.yaml",
+			formatCost(budget), formatCost(spent))
+	case spent*100 >= budget*budgetWarnPercent && !spending.warned:
+		fmt.Fprintf(os.Stderr, "[budget] ~%s of the %s monthly budget is spent.\n", formatCost(spent), formatCost(budget))
+		spending.warned = true
+	}
+	return nil
+}
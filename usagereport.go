@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultUsageDays = 30
+
+// usageRow is a line of the usage report: the requests of one day, model
+// or task, whichever the report is grouped by.
+type usageRow struct {
+	Day              string   `json:"day,omitempty"`
+	Model            string   `json:"model,omitempty"`
+	Task             string   `json:"task,omitempty"`
+	Requests         int      `json:"requests"`
+	PromptTokens     int      `json:"prompt_tokens"`
+	CompletionTokens int      `json:"completion_tokens"`
+	Cost             *float64 `json:"cost,omitempty"` // nil when no model in it has a price
+}
+
+func (r *usageRow) key(by string) *string {
+	switch by {
+	case "model":
+		return &r.Model
+	case "task":
+		return &r.Task
+	}
+	return &r.Day
+}
+
+// add adds the requests of o to r.
+func (r *usageRow) add(o usageRow) {
+	r.Requests += o.Requests
+	r.PromptTokens += o.PromptTokens
+	r.CompletionTokens += o.CompletionTokens
+	if o.Cost != nil {
+		if r.Cost == nil {
+			r.Cost = new(float64)
+		}
+		*r.Cost += *o.Cost
+	}
+}
+
+// runUsage handles "askgpt usage": it adds up the usage log of the last
+// days by day, model or task.
+func runUsage(args []string) int {
+	fs := flag.NewFlagSet("usage", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	days := fs.Int("days", defaultUsageDays, "")
+	by := fs.String("by", "day", "")
+	format := fs.String("format", "table", "")
+	if err := fs.Parse(args); err != nil || fs.NArg() > 0 || *days < 1 {
+		fmt.Fprintln(os.Stderr, "Usage: askgpt usage [--days n] [--by day|model|task] [--format table|json|csv]")
+		return 2
+	}
+	switch *by {
+	case "day", "model", "task":
+	default:
+		errorf("unknown grouping %q (use day, model or task)\n", *by)
+		return 2
+	}
+
+	now := time.Now()
+	since := time.Date(now.Year(), now.Month(), now.Day()-*days+1, 0, 0, 0, 0, time.Local)
+	records, err := readUsage(since)
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	rows := usageRows(records, *by)
+
+	switch *format {
+	case "table":
+		if len(rows) == 0 {
+			fmt.Fprintf(os.Stderr, "No requests in the last %d day(s).\n", *days)
+			return 0
+		}
+		printUsageTable(rows, *by)
+	case "json":
+		if rows == nil {
+			rows = []usageRow{}
+		}
+		b, _ := json.MarshalIndent(rows, "", "  ")
+		fmt.Println(string(b))
+	case "csv":
+		err = writeUsageCSV(os.Stdout, rows, *by)
+	default:
+		errorf("unknown format %q (use table, json or csv)\n", *format)
+		return 2
+	}
+	if err != nil {
+		errorf("%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// usageRows groups records by day, model or task, in that order of key.
+func usageRows(records []usageRecord, by string) []usageRow {
+	byKey := map[string]*usageRow{}
+	for _, rec := range records {
+		var k string
+		switch by {
+		case "model":
+			k = rec.Model
+		case "task":
+			k = rec.Task
+		default:
+			k = rec.Time.Local().Format("2006-01-02")
+		}
+		row, ok := byKey[k]
+		if !ok {
+			row = &usageRow{}
+			*row.key(by) = k
+			byKey[k] = row
+		}
+		row.add(usageRow{Requests: 1, PromptTokens: rec.PromptTokens, CompletionTokens: rec.CompletionTokens, Cost: rec.Cost})
+	}
+	keys := make([]string, 0, len(byKey))
+	for k := range byKey {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var rows []usageRow
+	for _, k := range keys {
+		rows = append(rows, *byKey[k])
+	}
+	return rows
+}
+
+func printUsageTable(rows []usageRow, by string) {
+	const line = "%-24s %8s %12s %12s %10s\n"
+	fmt.Printf(line, strings.ToUpper(by), "REQUESTS", "PROMPT", "COMPLETION", "COST")
+	var total usageRow
+	for _, r := range rows {
+		fmt.Printf(line, firstLine(orNone(*r.key(by)), 24), strconv.Itoa(r.Requests),
+			strconv.Itoa(r.PromptTokens), strconv.Itoa(r.CompletionTokens), rowCost(r.Cost))
+		total.add(r)
+	}
+	fmt.Printf(line, "total", strconv.Itoa(total.Requests),
+		strconv.Itoa(total.PromptTokens), strconv.Itoa(total.CompletionTokens), rowCost(total.Cost))
+}
+
+func writeUsageCSV(w io.Writer, rows []usageRow, by string) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{by, "requests", "prompt_tokens", "completion_tokens", "cost"})
+	for _, r := range rows {
+		cost := ""
+		if r.Cost != nil {
+			cost = strconv.FormatFloat(*r.Cost, 'f', 6, 64)
+		}
+		cw.Write([]string{*r.key(by), strconv.Itoa(r.Requests), strconv.Itoa(r.PromptTokens),
+			strconv.Itoa(r.CompletionTokens), cost})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func rowCost(c *float64) string {
+	if c == nil {
+		return "-"
+	}
+	return formatCost(*c)
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// maxPageSize is the most of a web page --fetch-urls downloads.
+const maxPageSize = 10 << 20
+
+// urlRe finds the web addresses in a message for --fetch-urls.
+var urlRe = regexp.MustCompile(`https?://[^\s<>"'` + "`" + `]+`)
+
+// boilerplateRe matches the class or id of elements around the content of a
+// page rather than in it: menus, banners, share buttons and the like.
+var boilerplateRe = regexp.MustCompile(`(?i)\b(nav|navbar|menu|sidebar|footer|header|banner|cookie|consent|share|social|advert|ads|promo|newsletter|subscribe|related|comments?|breadcrumbs?)\b`)
+
+var (
+	// pageSkip are left out of a page with everything inside.
+	pageSkip = map[atom.Atom]bool{
+		atom.Head: true, atom.Script: true, atom.Style: true, atom.Noscript: true, atom.Template: true,
+		atom.Svg: true, atom.Iframe: true, atom.Nav: true, atom.Header: true, atom.Footer: true,
+		atom.Aside: true, atom.Form: true, atom.Button: true, atom.Select: true, atom.Dialog: true,
+	}
+	// pageBlocks end a paragraph.
+	pageBlocks = map[atom.Atom]bool{
+		atom.P: true, atom.Div: true, atom.Section: true, atom.Article: true, atom.Main: true,
+		atom.Tr: true, atom.Blockquote: true, atom.Pre: true, atom.Figcaption: true,
+		atom.Dt: true, atom.Dd: true, atom.Table: true, atom.Ul: true, atom.Ol: true,
+		atom.H1: true, atom.H2: true, atom.H3: true, atom.H4: true, atom.H5: true, atom.H6: true,
+	}
+	headingLevels = map[atom.Atom]int{atom.H1: 1, atom.H2: 2, atom.H3: 3, atom.H4: 4, atom.H5: 5, atom.H6: 6}
+)
+
+// fetchURLs returns message with the readable text of the web pages it
+// names added to it, for --fetch-urls.
+func fetchURLs(ctx context.Context, client *http.Client, message string) (string, error) {
+	seen := map[string]bool{}
+	var blocks []string
+	for _, u := range urlRe.FindAllString(message, -1) {
+		u = strings.TrimRight(u, ".,;:!?)]}'\"")
+		if seen[u] {
+			continue
+		}
+		seen[u] = true
+		title, text, err := fetchPage(ctx, client, u)
+		if err != nil {
+			return "", err
+		}
+		label := u
+		if title != "" {
+			label += " (" + title + ")"
+		}
+		fmt.Fprintf(os.Stderr, "Fetched %s, %s (~%d tokens)\n", label, formatBytes(len(text)), estimateTokens(text))
+		blocks = append(blocks, fencePage(label, text))
+	}
+	if len(blocks) == 0 {
+		return message, nil
+	}
+	return message + "\n\n" + strings.Join(blocks, "\n\n"), nil
+}
+
+// fencePage labels the text of a page with its address, fenced like an
+// attached file, see fenceFile.
+func fencePage(label, text string) string {
+	return "Page: " + strings.TrimPrefix(fenceFile(label, text), "File: ")
+}
+
+// fetchPage downloads a web page and returns its title and readable text.
+// Pages that are not HTML are read like files: text as it is, and documents
+// such as PDFs have their text extracted.
+func fetchPage(ctx context.Context, client *http.Client, url string) (title, text string, err error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot fetch %s: %w", url, err)
+	}
+	req.Header.Set("User-Agent", "askgpt (+https://github.com/abnerhexu/askgpt)")
+	req.Header.Set("Accept", "text/html,text/plain;q=0.9,*/*;q=0.8")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot fetch %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("cannot fetch %s: %s", url, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, maxPageSize))
+	if err != nil {
+		return "", "", fmt.Errorf("cannot fetch %s: %w", url, err)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" &&
+		(mediaType != "" || !bytes.Contains(bytes.ToLower(b[:min(len(b), 512)]), []byte("<html"))) {
+		text, err := decodeTextInput(url, b, false)
+		return "", text, err
+	}
+	title, text, err = pageText(b)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot read %s: %w", url, err)
+	}
+	if strings.TrimSpace(text) == "" {
+		return "", "", fmt.Errorf("%s has no text to read; it may need JavaScript to show its content", url)
+	}
+	return title, text, nil
+}
+
+// pageText returns the title and the readable text of an HTML page: the
+// article or main part of it when it marks one, without the menus, banners
+// and scripts around it. Headings and list items keep a Markdown mark.
+func pageText(b []byte) (title, text string, err error) {
+	doc, err := html.Parse(bytes.NewReader(b))
+	if err != nil {
+		return "", "", err
+	}
+	if t := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Title }); t != nil {
+		title = strings.Join(strings.Fields(nodeText(t)), " ")
+	}
+	root := findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Article })
+	if root == nil {
+		root = findElement(doc, func(n *html.Node) bool { return n.DataAtom == atom.Main || attr(n, "role") == "main" })
+	}
+	if root == nil {
+		root = doc
+	}
+	var out strings.Builder
+	writePageText(&out, root, true)
+	return title, tidyLines(out.String()), nil
+}
+
+func writePageText(out *strings.Builder, n *html.Node, top bool) {
+	switch n.Type {
+	case html.TextNode:
+		s := strings.Join(strings.Fields(n.Data), " ")
+		if n.Data != "" && unicode.IsSpace(rune(n.Data[0])) && !strings.HasSuffix(out.String(), " ") {
+			out.WriteString(" ")
+		}
+		out.WriteString(s)
+		if s != "" && unicode.IsSpace(rune(n.Data[len(n.Data)-1])) {
+			out.WriteString(" ")
+		}
+		return
+	case html.ElementNode:
+		// The element picked as the content is kept whatever it is called.
+		if !top && (pageSkip[n.DataAtom] || isBoilerplate(n)) {
+			return
+		}
+		switch n.DataAtom {
+		case atom.Br:
+			out.WriteString("\n")
+		case atom.Td, atom.Th:
+			out.WriteString("\t")
+		case atom.Li:
+			out.WriteString("\n- ")
+		}
+		if level := headingLevels[n.DataAtom]; level > 0 {
+			out.WriteString("\n\n" + strings.Repeat("#", level) + " ")
+		}
+	case html.CommentNode:
+		return
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		writePageText(out, c, false)
+	}
+	if n.Type == html.ElementNode && pageBlocks[n.DataAtom] {
+		out.WriteString("\n\n")
+	}
+}
+
+// isBoilerplate reports whether an element is hidden, or by its class, id
+// or role around the content rather than in it.
+func isBoilerplate(n *html.Node) bool {
+	if n.DataAtom == atom.Body || n.DataAtom == atom.Html {
+		return false
+	}
+	for _, a := range n.Attr {
+		switch a.Key {
+		case "hidden":
+			return true
+		case "aria-hidden":
+			if a.Val == "true" {
+				return true
+			}
+		case "role":
+			if a.Val == "navigation" || a.Val == "banner" || a.Val == "contentinfo" || a.Val == "complementary" {
+				return true
+			}
+		case "class", "id":
+			if boilerplateRe.MatchString(strings.NewReplacer("-", " ", "_", " ").Replace(a.Val)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func findElement(n *html.Node, match func(*html.Node) bool) *html.Node {
+	if n.Type == html.ElementNode && match(n) {
+		return n
+	}
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if found := findElement(c, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+func nodeText(n *html.Node) string {
+	if n.Type == html.TextNode {
+		return n.Data
+	}
+	var b strings.Builder
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		b.WriteString(nodeText(c))
+	}
+	return b.String()
+}
+
+func attr(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// fetchPages adds the pages a message names to it for --fetch-urls.
+func (s *chatSession) fetchPages(message string) (string, error) {
+	ctx, stop := context.Background(), func() {}
+	if !s.opts.oneShot {
+		ctx, stop = s.requestContext()
+	}
+	defer stop()
+	return fetchURLs(ctx, s.client, message)
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+)
+
+// maxListEntries is the most entries list_dir returns.
+const maxListEntries = 1000
+
+// workspaceTools are the tools --workspace gives the model.
+var workspaceTools = []string{"read_file", "list_dir", "apply_patch"}
+
+// workspace is the directory --workspace lets the model read and, with the
+// user's agreement, edit. Paths the model gives are relative to it and may
+// not lead out of it, through ".." or a symbolic link.
+type workspace struct {
+	root string // absolute, with symbolic links resolved
+}
+
+func openWorkspace(dir string) (*workspace, error) {
+	root, err := filepath.Abs(dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot open workspace %s: %w", dir, err)
+	}
+	if fi, err := os.Stat(root); err != nil {
+		return nil, fmt.Errorf("cannot open workspace %s: %w", dir, err)
+	} else if !fi.IsDir() {
+		return nil, fmt.Errorf("workspace %s is not a directory", dir)
+	}
+	return &workspace{root: root}, nil
+}
+
+// resolve returns the absolute path of a path in the workspace, and the
+// path relative to it, slash-separated. The path need not exist yet.
+func (w *workspace) resolve(name string) (abs, rel string, err error) {
+	p := filepath.FromSlash(name)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(w.root, p)
+	}
+	p = filepath.Clean(p)
+	// Resolve the links in the part of the path that exists.
+	real, rest := p, ""
+	for {
+		r, err := filepath.EvalSymlinks(real)
+		if err == nil {
+			real = filepath.Join(r, rest)
+			break
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", "", err
+		}
+		// A link to a file that does not exist would be followed when the
+		// file is written, wherever it leads.
+		if _, lerr := os.Lstat(real); lerr == nil {
+			return "", "", fmt.Errorf("%s leads through a symbolic link to a file that does not exist", name)
+		}
+		parent := filepath.Dir(real)
+		if parent == real {
+			break
+		}
+		rest = filepath.Join(filepath.Base(real), rest)
+		real = parent
+	}
+	rel, err = filepath.Rel(w.root, real)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("%s is outside the workspace", name)
+	}
+	return real, filepath.ToSlash(rel), nil
+}
+
+// readText reads a text file of the workspace.
+func (w *workspace) readText(name string) (abs, rel, text string, err error) {
+	abs, rel, err = w.resolve(name)
+	if err != nil {
+		return "", "", "", err
+	}
+	b, err := os.ReadFile(abs)
+	if err != nil {
+		return "", "", "", fmt.Errorf("cannot read %s: %w", rel, unwrapPathError(err))
+	}
+	if bytes.ContainsRune(b, 0) || !utf8.Valid(b) {
+		return "", "", "", fmt.Errorf("%s is not a text file", rel)
+	}
+	return abs, rel, string(b), nil
+}
+
+// unwrapPathError drops the absolute path from an *fs.PathError, so the
+// model is told about paths as it knows them.
+func unwrapPathError(err error) error {
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		return pe.Err
+	}
+	return err
+}
+
+// readFile is the read_file tool: the text of a file, or of some of its
+// lines.
+func (w *workspace) readFile(ctx context.Context, args string) (string, error) {
+	var in struct {
+		Path      string `json:"path"`
+		StartLine int    `json:"start_line"`
+		EndLine   int    `json:"end_line"`
+	}
+	if err := decodeToolArgs(args, &in); err != nil {
+		return "", err
+	}
+	_, _, text, err := w.readText(in.Path)
+	if err != nil || in.StartLine <= 0 && in.EndLine <= 0 {
+		return text, err
+	}
+	lines := strings.SplitAfter(text, "\n")
+	start, end := max(in.StartLine, 1), len(lines)
+	if in.EndLine > 0 {
+		end = min(in.EndLine, end)
+	}
+	if start > end {
+		return "", fmt.Errorf("%s has %d lines", in.Path, len(lines))
+	}
+	return strings.Join(lines[start-1:end], ""), nil
+}
+
+// listDir is the list_dir tool: the files and directories in a directory,
+// or under it with recursive, leaving out those .gitignore files ignore.
+func (w *workspace) listDir(ctx context.Context, args string) (string, error) {
+	var in struct {
+		Path      string `json:"path"`
+		Recursive bool   `json:"recursive"`
+	}
+	if err := decodeToolArgs(args, &in); err != nil {
+		return "", err
+	}
+	abs, rel, err := w.resolve(in.Path)
+	if err != nil {
+		return "", err
+	}
+	if fi, err := os.Stat(abs); err != nil {
+		return "", fmt.Errorf("cannot list %s: %w", rel, unwrapPathError(err))
+	} else if !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", rel)
+	}
+
+	// The walk starts at the root, so the .gitignore files above the
+	// directory apply too, but only goes down the way to it.
+	var b strings.Builder
+	n := 0
+	ignores := ignoreList{}
+	err = filepath.WalkDir(w.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil // skip unreadable entries
+		}
+		r, _ := filepath.Rel(w.root, p)
+		r = filepath.ToSlash(r)
+		inside := rel == "." || r == rel || strings.HasPrefix(r, rel+"/")
+		if r != "." {
+			if d.Name() == ".git" || ignores.ignored(r, d.IsDir()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !inside && !strings.HasPrefix(rel, r+"/") {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+		if inside && r != rel {
+			if n == maxListEntries {
+				fmt.Fprintf(&b, "[... more left out]\n")
+				return filepath.SkipAll
+			}
+			n++
+			if d.IsDir() {
+				fmt.Fprintf(&b, "%s/\n", r)
+			} else if fi, err := d.Info(); err == nil {
+				fmt.Fprintf(&b, "%s (%s)\n", r, formatBytes(int(fi.Size())))
+			}
+		}
+		if d.IsDir() {
+			if inside && r != rel && !in.Recursive {
+				return filepath.SkipDir
+			}
+			ignores = ignores.loadGitignore(p, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("cannot list %s: %w", rel, err)
+	}
+	if n == 0 {
+		return rel + " is empty.", nil
+	}
+	return b.String(), nil
+}
+
+// fileEdit replaces text in a file.
+type fileEdit struct {
+	OldText string `json:"old_text"`
+	NewText string `json:"new_text"`
+}
+
+// applyPatch is the apply_patch tool: it shows the change the model wants
+// to make to a file and makes it if the user agrees. The change is either
+// edits, each replacing text found once in the file, or content, the whole
+// new file.
+func (w *workspace) applyPatch(ctx context.Context, args string) (string, error) {
+	var in struct {
+		Path    string     `json:"path"`
+		Edits   []fileEdit `json:"edits"`
+		Content *string    `json:"content"`
+	}
+	if err := decodeToolArgs(args, &in); err != nil {
+		return "", err
+	}
+	if (in.Content == nil) == (len(in.Edits) == 0) {
+		return "", errors.New("give either edits or content")
+	}
+	abs, rel, err := w.resolve(in.Path)
+	if err != nil {
+		return "", err
+	}
+	var old string
+	perm := fs.FileMode(0o644)
+	fi, err := os.Stat(abs)
+	switch {
+	case err == nil && fi.IsDir():
+		return "", fmt.Errorf("%s is a directory", rel)
+	case err == nil:
+		if _, _, old, err = w.readText(in.Path); err != nil {
+			return "", err
+		}
+		perm = fi.Mode().Perm()
+	case !errors.Is(err, fs.ErrNotExist):
+		return "", fmt.Errorf("cannot read %s: %w", rel, unwrapPathError(err))
+	case in.Content == nil:
+		return "", fmt.Errorf("%s does not exist; give its content to create it", rel)
+	}
+
+	updated := old
+	if in.Content != nil {
+		updated = *in.Content
+	}
+	for i, e := range in.Edits {
+		if e.OldText == "" {
+			return "", fmt.Errorf("edit %d has no old_text", i+1)
+		}
+		switch strings.Count(updated, e.OldText) {
+		case 0:
+			return "", fmt.Errorf("edit %d: old_text is not in %s; read the file again and copy the text exactly", i+1, rel)
+		case 1:
+			updated = strings.Replace(updated, e.OldText, e.NewText, 1)
+		default:
+			return "", fmt.Errorf("edit %d: old_text is in %s more than once; include more of the text around it", i+1, rel)
+		}
+	}
+	if updated == old && fi != nil {
+		return rel + " already has that content; nothing to change.", nil
+	}
+
+	if fi == nil {
+		fmt.Fprintf(os.Stderr, "New file %s:\n", rel)
+	} else {
+		fmt.Fprintf(os.Stderr, "Change to %s:\n", rel)
+	}
+	printLineChange(old, updated)
+	if err := askYesNo("Apply it?"); err != nil {
+		return "", err
+	}
+	if fi == nil {
+		if err := os.MkdirAll(filepath.Dir(abs), 0o755); err != nil {
+			return "", fmt.Errorf("cannot create %s: %w", rel, unwrapPathError(err))
+		}
+	}
+	if fi == nil {
+		err = createFile(abs, []byte(updated), perm)
+	} else {
+		err = os.WriteFile(abs, []byte(updated), perm)
+	}
+	if err != nil {
+		return "", fmt.Errorf("cannot write %s: %w", rel, unwrapPathError(err))
+	}
+	if fi == nil {
+		return fmt.Sprintf("Created %s.", rel), nil
+	}
+	return fmt.Sprintf("Changed %s.", rel), nil
+}
+
+// createFile writes a new file. Unlike os.WriteFile it fails if the file
+// exists, and with O_EXCL a symbolic link put in its place since it was
+// resolved is not followed.
+func createFile(name string, data []byte, perm fs.FileMode) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// printLineChange shows the lines that differ between two versions of a
+// file, with a few unchanged lines around them, diff style.
+func printLineChange(old, updated string) {
+	const contextLines = 2
+	a, b := splitLines(old), splitLines(updated)
+	pre := 0
+	for pre < len(a) && pre < len(b) && a[pre] == b[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(a)-pre && suf < len(b)-pre && a[len(a)-1-suf] == b[len(b)-1-suf] {
+		suf++
+	}
+	start := max(pre-contextLines, 0)
+	fmt.Fprintf(os.Stderr, "@@ line %d @@\n", start+1)
+	for _, l := range a[start:pre] {
+		fmt.Fprintf(os.Stderr, "  %s\n", l)
+	}
+	for _, l := range a[pre : len(a)-suf] {
+		fmt.Fprintf(os.Stderr, "- %s\n", l)
+	}
+	for _, l := range b[pre : len(b)-suf] {
+		fmt.Fprintf(os.Stderr, "+ %s\n", l)
+	}
+	for _, l := range a[len(a)-suf : min(len(a)-suf+contextLines, len(a))] {
+		fmt.Fprintf(os.Stderr, "  %s\n", l)
+	}
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// loadWorkspace gives the model the tools to read and edit the --workspace
+// directory.
+func (s *chatSession) loadWorkspace(dir string) error {
+	w, err := openWorkspace(dir)
+	if err != nil {
+		return err
+	}
+	s.addTool(newTool("read_file", "Returns the text of a file in the workspace, or of lines start_line to end_line of it.",
+		`{"type":"object","properties":{"path":{"type":"string","description":"Path relative to the workspace"},"start_line":{"type":"integer"},"end_line":{"type":"integer"}},"required":["path"]}`,
+		w.readFile))
+	s.addTool(newTool("list_dir", "Lists the files, with their sizes, and the directories in a directory of the workspace, or everything under it with recursive. Files ignored by .gitignore are left out.",
+		`{"type":"object","properties":{"path":{"type":"string","description":"Path relative to the workspace; . for its top"},"recursive":{"type":"boolean"}},"required":["path"]}`,
+		w.listDir))
+	s.addTool(newTool("apply_patch", "Changes or creates a file in the workspace once the user agrees to the change. Give either edits, each replacing old_text, which must be found exactly once in the file, with new_text; or content, the whole new file.",
+		`{"type":"object","properties":{"path":{"type":"string","description":"Path relative to the workspace"},"edits":{"type":"array","items":{"type":"object","properties":{"old_text":{"type":"string"},"new_text":{"type":"string"}},"required":["old_text","new_text"]}},"content":{"type":"string"}},"required":["path"]}`,
+		w.applyPatch))
+	fmt.Fprintf(os.Stderr, "[workspace] %s: the model may read it and, after asking, change it.\n", w.root)
+	return nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWorkspaceResolve(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(root, "src"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for link, target := range map[string]string{
+		"inside":   filepath.Join(root, "src"),
+		"escape":   filepath.Join(outside, "secret"),
+		"dangling": filepath.Join(outside, "missing"),
+		"dir":      filepath.Join(outside, "missing-dir"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Skipf("cannot create symbolic links: %v", err)
+		}
+	}
+	w, err := openWorkspace(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, path, want string
+		wantErr          bool
+	}{
+		{"existing directory", "src", "src", false},
+		{"new file", "src/new.go", "src/new.go", false},
+		{"new file in a new directory", "pkg/new.go", "pkg/new.go", false},
+		{"link inside", "inside/new.go", "src/new.go", false},
+		{"dot dot", "../secret", "", true},
+		{"link outside", "escape", "", true},
+		{"dangling link", "dangling", "", true},
+		{"through a dangling link", "dir/new.go", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, rel, err := w.resolve(tt.path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resolve(%q) error = %v, want error %v", tt.path, err, tt.wantErr)
+			}
+			if rel != tt.want {
+				t.Errorf("resolve(%q) = %q, want %q", tt.path, rel, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateFileDoesNotFollowLinks(t *testing.T) {
+	root, outside := t.TempDir(), t.TempDir()
+	target := filepath.Join(outside, "x")
+	if err := os.Symlink(target, filepath.Join(root, "evil")); err != nil {
+		t.Skipf("cannot create symbolic links: %v", err)
+	}
+	if err := createFile(filepath.Join(root, "evil"), []byte("x"), 0o644); err == nil {
+		t.Error("createFile wrote through a symbolic link")
+	}
+	if _, err := os.Lstat(target); !os.IsNotExist(err) {
+		t.Errorf("the link target was created: %v", err)
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/term"
+)
+
+// wrapOutput reports whether answers are wrapped at word boundaries: on a
+// terminal, unless --no-wrap or --raw says otherwise.
+func wrapOutput(opts taskOptions) bool {
+	return !opts.noWrap && !opts.raw && isTerminal(os.Stdout)
+}
+
+var (
+	widthOnce sync.Once
+	widthNow  atomic.Int64
+)
+
+// terminalWidth returns the width of the terminal on stdout, or 80 without
+// one. It is asked again whenever the terminal is resized.
+func terminalWidth() int {
+	widthOnce.Do(func() {
+		update := func() {
+			if w, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && w > 0 {
+				widthNow.Store(int64(w))
+			}
+		}
+		widthNow.Store(80)
+		update()
+		resized := make(chan os.Signal, 1)
+		notifyResize(resized)
+		go func() {
+			for range resized {
+				update()
+			}
+		}()
+	})
+	return int(widthNow.Load())
+}
+
+// wrapWriter wraps streamed text at spaces to the width of the terminal.
+// The word being streamed is held back until it ends, so that it can be
+// moved to the next row whole; a word wider than a row is left to the
+// terminal.
+type wrapWriter struct {
+	w      io.Writer
+	col    int // the column the cursor is at
+	spaces int // spaces before the next word
+	word   strings.Builder
+}
+
+func (ww *wrapWriter) Write(p []byte) (int, error) {
+	ww.write(string(p))
+	return len(p), nil
+}
+
+func (ww *wrapWriter) write(s string) {
+	for _, r := range s {
+		switch r {
+		case ' ':
+			ww.flushWord()
+			ww.spaces++
+		case '\n':
+			ww.flushWord()
+			io.WriteString(ww.w, "\n")
+			ww.col, ww.spaces = 0, 0
+		default:
+			ww.word.WriteRune(r)
+		}
+	}
+}
+
+// flushWord writes the word held back, on the next row if it does not fit
+// on this one.
+func (ww *wrapWriter) flushWord() {
+	if ww.word.Len() == 0 {
+		return
+	}
+	word := ww.word.String()
+	ww.word.Reset()
+	width := displayWidth(word)
+	if ww.col > 0 && ww.col+ww.spaces+width > terminalWidth() {
+		io.WriteString(ww.w, "\n")
+		ww.col = 0
+	} else {
+		io.WriteString(ww.w, strings.Repeat(" ", ww.spaces))
+		ww.col += ww.spaces
+	}
+	io.WriteString(ww.w, word)
+	ww.col += width
+	ww.spaces = 0
+}
+
+// flush writes what is held back at the end of an answer.
+func (ww *wrapWriter) flush() {
+	ww.flushWord()
+	ww.spaces = 0
+}
+
+// wrapLine breaks a rendered line, which may hold ANSI styles, at spaces so
+// that it fits rows of width columns. Its first row starts at column col,
+// the others with indent.
+func wrapLine(s string, width, col int, indent string) string {
+	if width <= 0 {
+		return s
+	}
+	indentWidth := displayWidth(stripANSI(indent))
+	var b strings.Builder
+	for i, word := range strings.Split(s, " ") {
+		w := displayWidth(stripANSI(word))
+		if i > 0 {
+			if col > indentWidth && col+1+w > width {
+				b.WriteString("\n" + indent)
+				col = indentWidth
+			} else {
+				b.WriteString(" ")
+				col++
+			}
+		}
+		b.WriteString(word)
+		col += w
+	}
+	return b.String()
+}